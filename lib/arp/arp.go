@@ -21,15 +21,53 @@ var iDebug = 0
 // -----------------------------------------------------------------------------
 // Lets compare the mac address supplied with the one in the ARP packet for both
 // the SRC MAC and TARGET MAC in the ARP Payload
-func ReplaceArpPayloadMacAddresses(packet gopacket.Packet, i802dot1QOffset int, userSuppliedMacAddress, userSuppliedMacAddressNew []byte) {
+func ReplaceArpPayloadMacAddresses(packet gopacket.Packet, i802dot1QOffset int, userSuppliedMacAddress, userSuppliedMacAddressNew []byte) error {
+	arpHeader, err := getArpHeader(packet, i802dot1QOffset)
+	if err != nil {
+		return err
+	}
+	return ReplaceArpHeaderMacAddresses(arpHeader, userSuppliedMacAddress, userSuppliedMacAddressNew)
+} // ReplaceArpPayloadMacAddresses()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceArpPayloadIPv4Addresses()
+// -----------------------------------------------------------------------------
+// Lets compare the IPv4 address supplied with the one in the ARP packet for both
+// the SRC IP and TARGET IP in the ARP Payload
+func ReplaceArpPayloadIPv4Addresses(packet gopacket.Packet, i802dot1QOffset int, userSuppliedIPv4Address, userSuppliedIPv4AddressNew []byte) error {
+	arpHeader, err := getArpHeader(packet, i802dot1QOffset)
+	if err != nil {
+		return err
+	}
+	return ReplaceArpHeaderIPv4Addresses(arpHeader, userSuppliedIPv4Address, userSuppliedIPv4AddressNew)
+} // ReplaceArpPayloadIPv4Addresses()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceArpHeaderMacAddresses()
+// -----------------------------------------------------------------------------
+// This does the same thing as ReplaceArpPayloadMacAddresses but works directly
+// on the bytes of the ARP header
+func ReplaceArpHeaderMacAddresses(arpHeader []byte, userSuppliedMacAddress, userSuppliedMacAddressNew []byte) error {
 	// Define the byte offsets for the data we are looking for
-	iArpSenderMacStart := 8 + i802dot1QOffset
+	iArpSenderMacStart := 8
 	iArpSenderMacEnd := iArpSenderMacStart + 6
-	iArpTargetMacStart := 18 + i802dot1QOffset
+	iArpTargetMacStart := 18
 	iArpTargetMacEnd := iArpTargetMacStart + 6
 
-	senderMacAddressFromArpPacket := packet.LinkLayer().LayerPayload()[iArpSenderMacStart:iArpSenderMacEnd]
-	targetMacAddressFromArpPacket := packet.LinkLayer().LayerPayload()[iArpTargetMacStart:iArpTargetMacEnd]
+	bIPv4, err := checkArpHeader(arpHeader)
+	if err != nil {
+		return err
+	}
+
+	// The offsets above are only right for ethernet ARP packets for IPv4
+	if !bIPv4 {
+		return nil
+	}
+
+	senderMacAddressFromArpPacket := arpHeader[iArpSenderMacStart:iArpSenderMacEnd]
+	targetMacAddressFromArpPacket := arpHeader[iArpTargetMacStart:iArpTargetMacEnd]
 
 	// Sender MAC in payload
 	bSenderMacAddressMatch := common.AreByteSlicesEqual(senderMacAddressFromArpPacket, userSuppliedMacAddress)
@@ -40,7 +78,7 @@ func ReplaceArpPayloadMacAddresses(packet gopacket.Packet, i802dot1QOffset int,
 
 		j := 0
 		for i := iArpSenderMacStart; i < iArpSenderMacEnd; i++ {
-			packet.LinkLayer().LayerPayload()[i] = userSuppliedMacAddressNew[j]
+			arpHeader[i] = userSuppliedMacAddressNew[j]
 			j++
 		}
 	}
@@ -54,32 +92,39 @@ func ReplaceArpPayloadMacAddresses(packet gopacket.Packet, i802dot1QOffset int,
 
 		j := 0
 		for i := iArpTargetMacStart; i < iArpTargetMacEnd; i++ {
-			packet.LinkLayer().LayerPayload()[i] = userSuppliedMacAddressNew[j]
+			arpHeader[i] = userSuppliedMacAddressNew[j]
 			j++
 		}
 	}
-} // ReplaceArpPayloadMacAddresses()
+	return nil
+} // ReplaceArpHeaderMacAddresses()
 
 //
 // -----------------------------------------------------------------------------
-// ReplaceArpPayloadIPv4Addresses()
+// ReplaceArpHeaderIPv4Addresses()
 // -----------------------------------------------------------------------------
-// Lets compare the IPv4 address supplied with the one in the ARP packet for both
-// the SRC IP and TARGET IP in the ARP Payload
-func ReplaceArpPayloadIPv4Addresses(packet gopacket.Packet, i802dot1QOffset int, userSuppliedIPv4Address, userSuppliedIPv4AddressNew []byte) {
-	// Make sure the apr.proto.type is 0800
-	if packet.LinkLayer().LayerPayload()[2] == 8 && packet.LinkLayer().LayerPayload()[3] == 0 {
+// This does the same thing as ReplaceArpPayloadIPv4Addresses but works directly
+// on the bytes of the ARP header
+func ReplaceArpHeaderIPv4Addresses(arpHeader []byte, userSuppliedIPv4Address, userSuppliedIPv4AddressNew []byte) error {
+	// Define the byte offsets for the data we are looking for
+	iArpSenderIPStart := 14
+	iArpSenderIPEnd := iArpSenderIPStart + 4
+	iArpTargetIPStart := 24
+	iArpTargetIPEnd := iArpTargetIPStart + 4
+
+	bIPv4, err := checkArpHeader(arpHeader)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the arp.proto.type is 0800
+	if bIPv4 {
 		if iDebug == 1 {
 			fmt.Println("DEBUG: Found an ARP packet with proto type IP")
 		}
-		// Define the byte offsets for the data we are looking for
-		iArpSenderIPStart := 14 + i802dot1QOffset
-		iArpSenderIPEnd := iArpSenderIPStart + 4
-		iArpTargetIPStart := 24 + i802dot1QOffset
-		iArpTargetIPEnd := iArpTargetIPStart + 4
 
-		senderIPv4AddressFromArpPacket := packet.LinkLayer().LayerPayload()[iArpSenderIPStart:iArpSenderIPEnd]
-		targetIPv4AddressFromArpPacket := packet.LinkLayer().LayerPayload()[iArpTargetIPStart:iArpTargetIPEnd]
+		senderIPv4AddressFromArpPacket := arpHeader[iArpSenderIPStart:iArpSenderIPEnd]
+		targetIPv4AddressFromArpPacket := arpHeader[iArpTargetIPStart:iArpTargetIPEnd]
 
 		bSenderIPv4AddressMatch := common.AreByteSlicesEqual(senderIPv4AddressFromArpPacket, userSuppliedIPv4Address)
 		if bSenderIPv4AddressMatch {
@@ -88,7 +133,7 @@ func ReplaceArpPayloadIPv4Addresses(packet gopacket.Packet, i802dot1QOffset int,
 			}
 			j := 0
 			for i := iArpSenderIPStart; i < iArpSenderIPEnd; i++ {
-				packet.LinkLayer().LayerPayload()[i] = userSuppliedIPv4AddressNew[j]
+				arpHeader[i] = userSuppliedIPv4AddressNew[j]
 				j++
 			}
 		}
@@ -100,9 +145,48 @@ func ReplaceArpPayloadIPv4Addresses(packet gopacket.Packet, i802dot1QOffset int,
 			}
 			j := 0
 			for i := iArpTargetIPStart; i < iArpTargetIPEnd; i++ {
-				packet.LinkLayer().LayerPayload()[i] = userSuppliedIPv4AddressNew[j]
+				arpHeader[i] = userSuppliedIPv4AddressNew[j]
 				j++
 			}
 		}
 	}
-} // ReplaceArpPayloadIPv4Addresses()
+	return nil
+} // ReplaceArpHeaderIPv4Addresses()
+
+//
+// -----------------------------------------------------------------------------
+// getArpHeader()
+// -----------------------------------------------------------------------------
+// The ARP header starts after any 802.1Q tags in the ethernet payload
+func getArpHeader(packet gopacket.Packet, i802dot1QOffset int) ([]byte, error) {
+	if packet.LinkLayer() == nil || len(packet.LinkLayer().LayerPayload()) < i802dot1QOffset {
+		return nil, fmt.Errorf("%w: no ARP header", common.ErrMalformedPacket)
+	}
+	return packet.LinkLayer().LayerPayload()[i802dot1QOffset:], nil
+} // getArpHeader()
+
+//
+// -----------------------------------------------------------------------------
+// checkArpHeader()
+// -----------------------------------------------------------------------------
+// Make sure the ARP header is long enough to hold all of the fields we are going
+// to look at.  It returns true if it is an ethernet ARP packet for IPv4, with 6
+// byte MAC addresses and 4 byte IP addresses, as those are the only ones we update.
+func checkArpHeader(arpHeader []byte) (bool, error) {
+	// Hardware type, protocol type, hardware and protocol address sizes
+	if len(arpHeader) < 8 {
+		return false, fmt.Errorf("%w: ARP header is too short", common.ErrMalformedPacket)
+	}
+
+	// The payload has to be long enough for both sets of addresses
+	iArpLength := 8 + 2*int(arpHeader[4]) + 2*int(arpHeader[5])
+	if len(arpHeader) < iArpLength {
+		return false, fmt.Errorf("%w: ARP payload is too short", common.ErrMalformedPacket)
+	}
+
+	// Make sure the arp.hw.type is 0001 with a size of 6 and the arp.proto.type
+	// is 0800 with a size of 4
+	bIPv4 := arpHeader[0] == 0 && arpHeader[1] == 1 && arpHeader[4] == 6 &&
+		arpHeader[2] == 8 && arpHeader[3] == 0 && arpHeader[5] == 4
+	return bIPv4, nil
+} // checkArpHeader()
@@ -0,0 +1,115 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package arp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"net"
+	"testing"
+)
+
+var macAddressNew = net.HardwareAddr{0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+var ipv4AddressNew = net.IP{2, 2, 2, 2}
+
+func TestReplaceArpPayloadAddresses(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            []byte
+		i802dot1QOffset int
+		bError          bool
+	}{
+		{"untagged", pcaptest.ARPRequest(0), 0, false},
+		{"802.1Q", pcaptest.ARPRequest(1), 4, false},
+		{"Q-in-Q", pcaptest.ARPRequest(2), 8, false},
+		{"truncated", pcaptest.ARPRequest(0)[:20], 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := gopacket.NewPacket(tt.data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+			errMac := ReplaceArpPayloadMacAddresses(packet, tt.i802dot1QOffset, pcaptest.MacAddressA, macAddressNew)
+			errIP := ReplaceArpPayloadIPv4Addresses(packet, tt.i802dot1QOffset, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+			if tt.bError {
+				if !errors.Is(errMac, common.ErrMalformedPacket) || !errors.Is(errIP, common.ErrMalformedPacket) {
+					t.Fatal("Expected malformed packet errors, got ", errMac, errIP)
+				}
+				return
+			}
+			if errMac != nil || errIP != nil {
+				t.Fatal("Unexpected errors ", errMac, errIP)
+			}
+
+			arpHeader := tt.data[14+tt.i802dot1QOffset:]
+			if !bytes.Equal(arpHeader[8:14], macAddressNew) {
+				t.Errorf("Expected sender MAC %v, got %v", macAddressNew, arpHeader[8:14])
+			}
+			if !bytes.Equal(arpHeader[14:18], ipv4AddressNew) {
+				t.Errorf("Expected sender IP %v, got %v", ipv4AddressNew, arpHeader[14:18])
+			}
+			if !bytes.Equal(arpHeader[24:28], pcaptest.IPv4AddressB.To4()) {
+				t.Errorf("Expected target IP to be unchanged, got %v", arpHeader[24:28])
+			}
+		})
+	}
+}
+
+func TestReplaceArpHeaderNotIPv4(t *testing.T) {
+	arpHeader := pcaptest.ARPRequest(0)[14:]
+	arpHeader[3] = 0x01 // Not IPv4
+
+	original := append([]byte(nil), arpHeader...)
+	if err := ReplaceArpHeaderMacAddresses(arpHeader, pcaptest.MacAddressA, macAddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if err := ReplaceArpHeaderIPv4Addresses(arpHeader, pcaptest.IPv4AddressA.To4(), ipv4AddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if !bytes.Equal(arpHeader, original) {
+		t.Error("Expected a non IPv4 ARP packet to be left alone")
+	}
+}
+
+func FuzzReplaceArpHeaderMacAddresses(f *testing.F) {
+	for _, p := range pcaptest.Corpus() {
+		if len(p.Data) > 14 {
+			f.Add(p.Data[14:])
+		}
+	}
+	f.Fuzz(func(t *testing.T, arpHeader []byte) {
+		ReplaceArpHeaderMacAddresses(arpHeader, pcaptest.MacAddressA, macAddressNew)
+	})
+}
+
+func FuzzReplaceArpHeaderIPv4Addresses(f *testing.F) {
+	for _, p := range pcaptest.Corpus() {
+		if len(p.Data) > 14 {
+			f.Add(p.Data[14:])
+		}
+	}
+	f.Fuzz(func(t *testing.T, arpHeader []byte) {
+		ReplaceArpHeaderIPv4Addresses(arpHeader, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+	})
+}
+
+func FuzzReplaceArpPayloadAddresses(f *testing.F) {
+	for _, p := range pcaptest.Corpus() {
+		f.Add(p.Data, 0)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, i802dot1QOffset int) {
+		if i802dot1QOffset < 0 || i802dot1QOffset > 8 {
+			return
+		}
+		packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+		ReplaceArpPayloadMacAddresses(packet, i802dot1QOffset, pcaptest.MacAddressA, macAddressNew)
+		ReplaceArpPayloadIPv4Addresses(packet, i802dot1QOffset, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+	})
+}
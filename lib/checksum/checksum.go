@@ -0,0 +1,137 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package checksum computes and updates the internet checksums (RFC 1071) in
+// IPv4, TCP, UDP and ICMP headers.
+package checksum
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+//
+// -----------------------------------------------------------------------------
+// Sum()
+// -----------------------------------------------------------------------------
+// Add up the data as 16 bit big endian words.  iOffset is where the data starts
+// in the block that is being checksummed, if it is odd every byte moves to the
+// other half of its word.  The carries are folded back in but the result is
+// not complemented.
+func Sum(data []byte, iOffset int) uint32 {
+	// A 64K packet can come close to overflowing 32 bits so add up in 64
+	var sum uint64
+	for i, b := range data {
+		if (iOffset+i)%2 == 0 {
+			sum += uint64(b) << 8
+		} else {
+			sum += uint64(b)
+		}
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint32(sum)
+} // Sum()
+
+//
+// -----------------------------------------------------------------------------
+// Fold()
+// -----------------------------------------------------------------------------
+// Add the carries back in until the sum fits in 16 bits
+func Fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+} // Fold()
+
+//
+// -----------------------------------------------------------------------------
+// Update()
+// -----------------------------------------------------------------------------
+// This function will work out the new checksum after the old bytes were replaced
+// with the new bytes (RFC 1624), without looking at the rest of the data.  This
+// works on packets that were cut short by the snap length and keeps a checksum
+// that was already wrong (for example from checksum offload) just as wrong.
+// iOffset is where the bytes are in the block that is being checksummed.
+func Update(checksum uint16, iOffset int, old, new []byte) uint16 {
+	sum := uint32(^checksum) + uint32(^Fold(Sum(old, iOffset))) + uint32(Fold(Sum(new, iOffset)))
+	return ^Fold(sum)
+} // Update()
+
+//
+// -----------------------------------------------------------------------------
+// IPv4Header()
+// -----------------------------------------------------------------------------
+// Compute the checksum of an IPv4 header, the checksum field itself is skipped.
+// The header has to be complete.
+func IPv4Header(ipHeader []byte) uint16 {
+	iHeaderLength := int(ipHeader[0]&0x0f) * 4
+	sum := Sum(ipHeader[:10], 0) + Sum(ipHeader[12:iHeaderLength], 12)
+	return ^Fold(sum)
+} // IPv4Header()
+
+//
+// -----------------------------------------------------------------------------
+// PseudoHeader()
+// -----------------------------------------------------------------------------
+// Add up the IPv4 or IPv6 pseudo header that TCP and UDP checksums cover
+func PseudoHeader(src, dst []byte, ipProtocol layers.IPProtocol, iLength int) uint32 {
+	sum := Sum(src, 0) + Sum(dst, 0)
+	sum += uint32(ipProtocol)
+	sum += uint32(iLength>>16) + uint32(iLength&0xffff)
+	return sum
+} // PseudoHeader()
+
+//
+// -----------------------------------------------------------------------------
+// Transport()
+// -----------------------------------------------------------------------------
+// Compute the TCP or UDP checksum of a whole segment.  The checksum field needs
+// to be set to zero first, or left in place to check it, in which case a valid
+// segment gives 0.
+func Transport(src, dst []byte, ipProtocol layers.IPProtocol, segment []byte) uint16 {
+	sum := PseudoHeader(src, dst, ipProtocol, len(segment)) + Sum(segment, 0)
+	return ^Fold(sum)
+} // Transport()
+
+//
+// -----------------------------------------------------------------------------
+// UpdateTransport()
+// -----------------------------------------------------------------------------
+// This function will fix the checksum in a TCP, UDP or ICMPv6 header after the
+// old bytes were replaced with the new ones.  iOffset is where the bytes are from
+// the start of the header, addresses in the pseudo header are at an even offset
+// so 0 can be used for them.  A UDP checksum of 0 means there is no checksum so
+// it is left alone.  Nothing is done if the checksum field was cut off.
+func UpdateTransport(segment []byte, ipProtocol layers.IPProtocol, iOffset int, old, new []byte) {
+	iChecksumOffset := 0
+	switch ipProtocol {
+	case layers.IPProtocolTCP:
+		iChecksumOffset = 16
+	case layers.IPProtocolUDP:
+		iChecksumOffset = 6
+	case layers.IPProtocolICMPv6:
+		iChecksumOffset = 2
+	default:
+		return
+	}
+	if len(segment) < iChecksumOffset+2 {
+		return
+	}
+
+	iChecksum := uint16(segment[iChecksumOffset])<<8 | uint16(segment[iChecksumOffset+1])
+	if ipProtocol == layers.IPProtocolUDP && iChecksum == 0 {
+		return
+	}
+
+	iChecksum = Update(iChecksum, iOffset, old, new)
+	if ipProtocol == layers.IPProtocolUDP && iChecksum == 0 {
+		iChecksum = 0xffff
+	}
+	segment[iChecksumOffset] = byte(iChecksum >> 8)
+	segment[iChecksumOffset+1] = byte(iChecksum)
+} // UpdateTransport()
@@ -0,0 +1,126 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package checksum_test
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+func TestIPv4Header(t *testing.T) {
+	ipHeader := pcaptest.IPv4UDP(0, nil)[14:34]
+	expected := uint16(ipHeader[10])<<8 | uint16(ipHeader[11])
+	if sum := checksum.IPv4Header(ipHeader); sum != expected {
+		t.Errorf("Expected 0x%04x, got 0x%04x", expected, sum)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		iIPOffset  int
+		iIPLength  int
+		iAddress   int
+		ipProtocol layers.IPProtocol
+	}{
+		{"udp", pcaptest.IPv4UDP(0, []byte("hello")), 14, 20, 4, layers.IPProtocolUDP},
+		{"tcp", pcaptest.IPv4TCP(1, []byte("odd length")), 18, 20, 4, layers.IPProtocolTCP},
+		{"ipv6", pcaptest.IPv6UDP(0, []byte("hello")), 14, 40, 16, layers.IPProtocolUDP},
+	}
+
+	for _, tt := range tests {
+		ip := tt.data[tt.iIPOffset:]
+		iSrc := 12
+		if tt.iAddress == 16 {
+			iSrc = 8
+		}
+		src := ip[iSrc : iSrc+tt.iAddress]
+		dst := ip[iSrc+tt.iAddress : iSrc+2*tt.iAddress]
+
+		// Leave out the ethernet padding
+		iTotalLength := int(ip[2])<<8 | int(ip[3])
+		if tt.iAddress == 16 {
+			iTotalLength = 40 + (int(ip[4])<<8 | int(ip[5]))
+		}
+		segment := ip[tt.iIPLength:iTotalLength]
+
+		// A valid segment with the checksum left in place adds up to zero
+		if sum := checksum.Transport(src, dst, tt.ipProtocol, segment); sum != 0 {
+			t.Errorf("%s: expected a valid checksum, got 0x%04x", tt.name, sum)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	data := pcaptest.IPv4UDP(0, []byte("hello world"))
+	ipHeader := data[14:34]
+	segment := data[34 : 34+8+len("hello world")]
+	src := append([]byte(nil), ipHeader[12:16]...)
+	dst := ipHeader[16:20]
+
+	// Change the source address and update both checksums
+	iIPChecksum := uint16(ipHeader[10])<<8 | uint16(ipHeader[11])
+	iUDPChecksum := uint16(segment[6])<<8 | uint16(segment[7])
+	newSrc := []byte{192, 168, 1, 1}
+	copy(ipHeader[12:16], newSrc)
+
+	iIPChecksum = checksum.Update(iIPChecksum, 12, src, newSrc)
+	if expected := checksum.IPv4Header(ipHeader); iIPChecksum != expected {
+		t.Errorf("Expected IPv4 checksum 0x%04x, got 0x%04x", expected, iIPChecksum)
+	}
+
+	iUDPChecksum = checksum.Update(iUDPChecksum, 0, src, newSrc)
+	segment[6], segment[7] = byte(iUDPChecksum>>8), byte(iUDPChecksum)
+	if sum := checksum.Transport(newSrc, dst, layers.IPProtocolUDP, segment); sum != 0 {
+		t.Errorf("Expected a valid UDP checksum, got 0x%04x", sum)
+	}
+
+	// Bytes at an odd offset, "hello world" starts at offset 8 of the segment
+	// so the "e" is at offset 9
+	iUDPChecksum = checksum.Update(iUDPChecksum, 9, []byte("ello"), []byte("ELLO"))
+	copy(segment[9:], "ELLO")
+	segment[6], segment[7] = byte(iUDPChecksum>>8), byte(iUDPChecksum)
+	if sum := checksum.Transport(newSrc, dst, layers.IPProtocolUDP, segment); sum != 0 {
+		t.Errorf("Expected a valid UDP checksum after an odd update, got 0x%04x", sum)
+	}
+}
+
+func TestSumLarge(t *testing.T) {
+	data := make([]byte, 65534)
+	for i := range data {
+		data[i] = 0xff
+	}
+	if sum := checksum.Fold(checksum.Sum(data, 0)); sum != 0xffff {
+		t.Errorf("Expected 0xffff, got 0x%04x", sum)
+	}
+}
+
+func TestUpdateTransport(t *testing.T) {
+	data := pcaptest.IPv4TCP(0, []byte("hello world"))
+	ipHeader := data[14:34]
+	segment := data[34:]
+	src := append([]byte(nil), ipHeader[12:20]...)
+	copy(ipHeader[12:16], []byte{192, 168, 1, 1})
+
+	checksum.UpdateTransport(segment, layers.IPProtocolTCP, 0, src, ipHeader[12:20])
+	if sum := checksum.Transport(ipHeader[12:16], ipHeader[16:20], layers.IPProtocolTCP, segment); sum != 0 {
+		t.Errorf("Expected a valid TCP checksum, got 0x%04x", sum)
+	}
+
+	// A UDP checksum of zero is not set and has to stay that way
+	udp := []byte{0, 1, 0, 2, 0, 8, 0, 0}
+	checksum.UpdateTransport(udp, layers.IPProtocolUDP, 0, []byte{1, 2}, []byte{3, 4})
+	if udp[6] != 0 || udp[7] != 0 {
+		t.Error("Expected the UDP checksum to stay zero")
+	}
+
+	// Too short to hold the checksum
+	checksum.UpdateTransport(udp[:5], layers.IPProtocolUDP, 0, []byte{1, 2}, []byte{3, 4})
+}
@@ -6,6 +6,14 @@
 
 package common
 
+import (
+	"errors"
+)
+
+// ErrMalformedPacket is returned (usually wrapped) by the rewrite functions
+// when a packet is too short or otherwise cannot be parsed safely.
+var ErrMalformedPacket = errors.New("malformed packet")
+
 //
 // -----------------------------------------------------------------------------
 // AreByteSlicesEqual
@@ -0,0 +1,206 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package dedup removes the copies of a packet that show up more than once in a
+// capture taken from several SPAN ports.  Two packets are the same when they only
+// differ in the fields that change on the way from one SPAN port to the next:
+// the 802.1Q tags, the IPv4 TTL or IPv6 hop limit, and the IPv4, TCP, UDP and
+// ICMP checksums.
+package dedup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"hash/fnv"
+	"time"
+)
+
+var iDebug = 0
+
+// Filter remembers the packets that were seen within the time window, the
+// counter says how many duplicates were found
+type Filter struct {
+	Duplicates int
+
+	linkType layers.LinkType
+	window   time.Duration
+	seen     map[uint64][]*seenPacket
+	order    []*seenPacket
+}
+
+// seenPacket is a packet in the order it was seen, so it can be forgotten once
+// it is out of the window.  The bytes that were hashed are kept as well so that
+// two packets that only share a hash are not taken for the same packet.
+type seenPacket struct {
+	iHash uint64
+	key   []byte
+	ts    time.Time
+}
+
+//
+// -----------------------------------------------------------------------------
+// New()
+// -----------------------------------------------------------------------------
+// This function will make a filter for packets of the link type.  A packet is a
+// duplicate when the same packet was seen no more than the window before it, by
+// the capture timestamps.
+func New(linkType layers.LinkType, window time.Duration) *Filter {
+	return &Filter{
+		linkType: linkType,
+		window:   window,
+		seen:     make(map[uint64][]*seenPacket),
+	}
+} // New()
+
+//
+// -----------------------------------------------------------------------------
+// Reader()
+// -----------------------------------------------------------------------------
+// This function will wrap a packet reader so that the duplicates are skipped.
+// Only a copy of the bytes that are compared is held on to, so the reader can
+// reuse its buffer.  The reader has to be called from one goroutine.
+func (d *Filter) Reader(read func() ([]byte, gopacket.CaptureInfo, error)) func() ([]byte, gopacket.CaptureInfo, error) {
+	return func() ([]byte, gopacket.CaptureInfo, error) {
+		for {
+			data, ci, err := read()
+			if err != nil || !d.Duplicate(data, ci.Timestamp) {
+				return data, ci, err
+			}
+		}
+	}
+} // Reader()
+
+//
+// -----------------------------------------------------------------------------
+// Duplicate()
+// -----------------------------------------------------------------------------
+// This function will check if the packet was already seen within the window.  A
+// packet that is not a duplicate is remembered, a duplicate is counted.  The
+// window is measured from the first copy, and captures that were merged slightly
+// out of order are allowed for by looking both ways.  The hash only finds the
+// packets to compare with, a packet is a duplicate when the bytes are the same.
+func (d *Filter) Duplicate(data []byte, ts time.Time) bool {
+	d.expire(ts)
+
+	key := key(data, d.linkType)
+	iHash := hash(key)
+	for _, seen := range d.seen[iHash] {
+		diff := ts.Sub(seen.ts)
+		if diff <= d.window && diff >= -d.window && bytes.Equal(seen.key, key) {
+			d.Duplicates++
+			if iDebug == 1 {
+				fmt.Println("DEBUG: Found a duplicate packet", diff, "after the first copy")
+			}
+			return true
+		}
+	}
+
+	seen := &seenPacket{iHash: iHash, key: key, ts: ts}
+	d.seen[iHash] = append(d.seen[iHash], seen)
+	d.order = append(d.order, seen)
+	return false
+} // Duplicate()
+
+// expire forgets the packets that are too old to have a duplicate at ts
+func (d *Filter) expire(ts time.Time) {
+	for len(d.order) > 0 && ts.Sub(d.order[0].ts) > d.window {
+		old := d.order[0]
+		d.order = d.order[1:]
+
+		same := d.seen[old.iHash]
+		for i := range same {
+			if same[i] == old {
+				same = append(same[:i], same[i+1:]...)
+				break
+			}
+		}
+		if len(same) == 0 {
+			delete(d.seen, old.iHash)
+		} else {
+			d.seen[old.iHash] = same
+		}
+	}
+}
+
+//
+// -----------------------------------------------------------------------------
+// key()
+// -----------------------------------------------------------------------------
+// Copy the bytes of the packet that two copies of it have in common, leaving out
+// the 802.1Q tags, the IPv4 TTL and header checksum or the IPv6 hop limit, and
+// the TCP, UDP and ICMP checksums.  The copy stops at the end of the IP datagram
+// so that the Ethernet padding, which differs between a tagged and an untagged
+// copy, is left out as well.  An IP length of 0, which offloaded packets and
+// jumbograms have, or one that is shorter than the IP header does not say where
+// the datagram ends, so the whole packet is used.  A packet of a link type the
+// fast parser does not understand is used as it is.
+func key(data []byte, linkType layers.LinkType) []byte {
+	f, err := frame.Parse(data, linkType)
+	if err != nil {
+		return append([]byte(nil), data...)
+	}
+
+	// The parts to leave out, in the order they come in the packet
+	var skip [][2]int
+	if f.LinkType == layers.LinkTypeEthernet && f.VLANOffset > 0 {
+		skip = append(skip, [2]int{12, 12 + f.VLANOffset})
+	}
+	if f.NetworkOffset >= 0 {
+		if f.IPVersion == 4 && len(data) >= f.NetworkOffset+20 {
+			skip = append(skip, [2]int{f.NetworkOffset + 8, f.NetworkOffset + 9}, [2]int{f.NetworkOffset + 10, f.NetworkOffset + 12})
+		} else if f.IPVersion == 6 && len(data) >= f.NetworkOffset+40 {
+			skip = append(skip, [2]int{f.NetworkOffset + 7, f.NetworkOffset + 8})
+		}
+	}
+	if f.TransportOffset >= 0 {
+		if f.IPProtocol == layers.IPProtocolTCP && len(data) >= f.TransportOffset+18 {
+			skip = append(skip, [2]int{f.TransportOffset + 16, f.TransportOffset + 18})
+		} else if f.IPProtocol == layers.IPProtocolUDP && len(data) >= f.TransportOffset+8 {
+			skip = append(skip, [2]int{f.TransportOffset + 6, f.TransportOffset + 8})
+		}
+	} else if f.ICMPOffset >= 0 && len(data) >= f.ICMPOffset+4 {
+		skip = append(skip, [2]int{f.ICMPOffset + 2, f.ICMPOffset + 4})
+	}
+
+	iEnd := len(data)
+	if f.NetworkOffset >= 0 {
+		if f.IPVersion == 4 && len(data) >= f.NetworkOffset+20 {
+			iLength := int(binary.BigEndian.Uint16(data[f.NetworkOffset+2:]))
+			if iLength >= int(data[f.NetworkOffset]&0x0f)*4 {
+				iEnd = f.NetworkOffset + iLength
+			}
+		} else if f.IPVersion == 6 && len(data) >= f.NetworkOffset+40 {
+			if iPayloadLength := int(binary.BigEndian.Uint16(data[f.NetworkOffset+4:])); iPayloadLength > 0 {
+				iEnd = f.NetworkOffset + 40 + iPayloadLength
+			}
+		}
+		if iEnd > len(data) {
+			iEnd = len(data)
+		}
+	}
+
+	key := make([]byte, 0, iEnd)
+	iStart := 0
+	for _, part := range skip {
+		if part[1] > iEnd {
+			break
+		}
+		key = append(key, data[iStart:part[0]]...)
+		iStart = part[1]
+	}
+	return append(key, data[iStart:iEnd]...)
+} // key()
+
+// hash is the FNV-1a hash of the bytes that are compared
+func hash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
@@ -0,0 +1,136 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package dedup
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDuplicate(t *testing.T) {
+	start := pcaptest.StartTime
+	d := New(layers.LinkTypeEthernet, 50*time.Millisecond)
+
+	// A copy from another SPAN port has an 802.1Q tag, a lower TTL and a
+	// different IPv4 header checksum
+	packet := pcaptest.IPv4UDP(0, []byte("hello world"))
+	copied := pcaptest.IPv4UDP(1, []byte("hello world"))
+	copied[18+8]--
+	copied[18+10]++
+	if d.Duplicate(packet, start) {
+		t.Error("Did not expect the first packet to be a duplicate")
+	}
+	if !d.Duplicate(copied, start.Add(time.Millisecond)) {
+		t.Error("Expected the copy from another SPAN port to be a duplicate")
+	}
+
+	// A different payload is a different packet
+	if d.Duplicate(pcaptest.IPv4UDP(0, []byte("hello earth")), start.Add(2*time.Millisecond)) {
+		t.Error("Did not expect a packet with another payload to be a duplicate")
+	}
+
+	// The same IPv6 packet with a lower hop limit, and out of order
+	packet6 := pcaptest.IPv6UDP(0, []byte("hello world"))
+	copied6 := pcaptest.IPv6UDP(2, []byte("hello world"))
+	copied6[22+7]--
+	if d.Duplicate(packet6, start.Add(10*time.Millisecond)) || !d.Duplicate(copied6, start.Add(9*time.Millisecond)) {
+		t.Error("Expected the IPv6 copy to be a duplicate")
+	}
+
+	// Once out of the window the packet is seen again
+	if d.Duplicate(packet, start.Add(100*time.Millisecond)) {
+		t.Error("Did not expect a packet outside of the window to be a duplicate")
+	}
+	if d.Duplicates != 2 {
+		t.Errorf("Expected 2 duplicates, got %d", d.Duplicates)
+	}
+}
+
+func TestOffloaded(t *testing.T) {
+	start := pcaptest.StartTime
+	d := New(layers.LinkTypeEthernet, 50*time.Millisecond)
+
+	// An offloaded packet has an IP length of 0, so all of it is compared
+	packet := pcaptest.IPv4UDP(0, []byte("hello world"))
+	other := pcaptest.IPv4UDP(0, []byte("hello earth"))
+	packet[14+2], packet[14+3] = 0, 0
+	other[14+2], other[14+3] = 0, 0
+	if d.Duplicate(packet, start) || d.Duplicate(other, start.Add(time.Millisecond)) {
+		t.Error("Did not expect offloaded IPv4 packets with other payloads to be duplicates")
+	}
+	if !d.Duplicate(packet, start.Add(2*time.Millisecond)) {
+		t.Error("Expected the same offloaded IPv4 packet to be a duplicate")
+	}
+
+	packet6 := pcaptest.IPv6UDP(0, []byte("hello world"))
+	other6 := pcaptest.IPv6UDP(0, []byte("hello earth"))
+	packet6[14+4], packet6[14+5] = 0, 0
+	other6[14+4], other6[14+5] = 0, 0
+	if d.Duplicate(packet6, start) || d.Duplicate(other6, start.Add(time.Millisecond)) {
+		t.Error("Did not expect IPv6 packets with a payload length of 0 and other payloads to be duplicates")
+	}
+}
+
+func TestCollision(t *testing.T) {
+	start := pcaptest.StartTime
+	d := New(layers.LinkTypeEthernet, 50*time.Millisecond)
+
+	// Make the first packet look like it has the same hash as the second, the
+	// second is still not a duplicate because the bytes are not the same
+	packet := key(pcaptest.IPv4UDP(0, []byte("hello world")), layers.LinkTypeEthernet)
+	other := pcaptest.IPv4UDP(0, []byte("hello earth"))
+	iHash := hash(key(other, layers.LinkTypeEthernet))
+	seen := &seenPacket{iHash: iHash, key: packet, ts: start}
+	d.seen[iHash] = []*seenPacket{seen}
+	d.order = []*seenPacket{seen}
+	if d.Duplicate(other, start.Add(time.Millisecond)) {
+		t.Error("Did not expect a packet that only shares the hash to be a duplicate")
+	}
+	if len(d.seen[iHash]) != 2 {
+		t.Errorf("Expected both packets to be kept under the hash, got %d", len(d.seen[iHash]))
+	}
+
+	// Both are forgotten once they are out of the window
+	d.Duplicate(other, start.Add(time.Second))
+	if len(d.seen[iHash]) != 1 || len(d.order) != 1 {
+		t.Errorf("Expected only the last packet to be kept, got %d and %d", len(d.seen[iHash]), len(d.order))
+	}
+}
+
+func TestReader(t *testing.T) {
+	packets := [][]byte{
+		pcaptest.IPv4TCP(0, []byte("one")),
+		pcaptest.IPv4TCP(1, []byte("one")),
+		pcaptest.IPv4TCP(0, []byte("two")),
+		pcaptest.IPv4TCP(2, []byte("two")),
+		pcaptest.ARPRequest(0),
+	}
+	i := 0
+	d := New(layers.LinkTypeEthernet, 50*time.Millisecond)
+	read := d.Reader(func() ([]byte, gopacket.CaptureInfo, error) {
+		if i == len(packets) {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		i++
+		return packets[i-1], gopacket.CaptureInfo{Timestamp: pcaptest.StartTime.Add(time.Duration(i) * time.Millisecond)}, nil
+	})
+
+	iPackets := 0
+	for {
+		if _, _, err := read(); err != nil {
+			break
+		}
+		iPackets++
+	}
+	if iPackets != 3 || d.Duplicates != 2 {
+		t.Errorf("Expected 3 packets and 2 duplicates, got %d and %d", iPackets, d.Duplicates)
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package dhcp rewrites the MAC and IP addresses that are carried inside DHCP
+// and DHCPv6 messages, the same way the arp package does for ARP payloads.
+package dhcp
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/layer2"
+	"net"
+)
+
+var iDebug = 0
+
+// The well known ports for DHCP and DHCPv6
+const (
+	iServerPort   = 67
+	iClientPort   = 68
+	iV6ClientPort = 546
+	iV6ServerPort = 547
+)
+
+// The length of the fixed part of a DHCP message before the magic cookie
+const iDhcpHeaderLength = 236
+
+// The DHCP options that hold one or more IPv4 addresses
+var dhcpIPv4Options = map[byte]string{
+	3:  "router",
+	6:  "DNS server",
+	42: "NTP server",
+	44: "NetBIOS name server",
+	50: "requested IP",
+	54: "server identifier",
+}
+
+// The DHCPv6 options that hold a list of IPv6 addresses
+var dhcpv6IPv6Options = map[uint16]string{
+	12: "server unicast",
+	22: "SIP server",
+	23: "DNS server",
+	31: "SNTP server",
+}
+
+// The DHCPv6 options that are looked at
+const (
+	iV6OptionClientID         = 1
+	iV6OptionServerID         = 2
+	iV6OptionIANA             = 3
+	iV6OptionIATA             = 4
+	iV6OptionIAAddress        = 5
+	iV6OptionRelayMessage     = 9
+	iV6OptionNTPServer        = 56
+	iV6OptionLinkLayerAddress = 79
+)
+
+//
+// -----------------------------------------------------------------------------
+// Locate()
+// -----------------------------------------------------------------------------
+// This function will find a DHCP or DHCPv6 message in a UDP datagram.  The start
+// and end offsets in the frame data are returned along with the DHCP version, 4
+// or 6.  A start of -1 means the frame is not DHCP or the message was cut short.
+func Locate(f *frame.Frame) (int, int, int) {
+	if f.IPProtocol != layers.IPProtocolUDP {
+		return -1, -1, 0
+	}
+
+	iVersion := 0
+	iSrcPort, iDstPort := f.Ports()
+	switch {
+	case f.IPVersion == 4 && (iSrcPort == iServerPort || iSrcPort == iClientPort) && (iDstPort == iServerPort || iDstPort == iClientPort):
+		iVersion = 4
+	case f.IPVersion == 6 && (iSrcPort == iV6ServerPort || iSrcPort == iV6ClientPort) && (iDstPort == iV6ServerPort || iDstPort == iV6ClientPort):
+		iVersion = 6
+	default:
+		return -1, -1, 0
+	}
+
+	iStart, iEnd := f.Payload()
+	if iStart < 0 {
+		return -1, -1, 0
+	}
+	return iStart, iEnd, iVersion
+} // Locate()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceDhcpHeaderMacAddresses()
+// -----------------------------------------------------------------------------
+// Lets compare the mac address supplied with the client hardware address in the
+// DHCP message and with the one in the client identifier option
+func ReplaceDhcpHeaderMacAddresses(dhcpHeader []byte, userSuppliedMacAddress, userSuppliedMacAddressNew []byte) error {
+	// Define the byte offsets for the data we are looking for
+	iChaddrStart := 28
+	iChaddrEnd := iChaddrStart + 6
+
+	bDhcp, err := checkDhcpHeader(dhcpHeader)
+	if err != nil || !bDhcp {
+		return err
+	}
+
+	// The client hardware address is only a MAC address for ethernet
+	if dhcpHeader[1] == 1 && dhcpHeader[2] == 6 {
+		replace(dhcpHeader[iChaddrStart:iChaddrEnd], userSuppliedMacAddress, userSuppliedMacAddressNew, "DHCP client hardware address")
+	}
+
+	return walkOptions(dhcpHeader, func(iCode byte, value []byte) {
+		// A client identifier of hardware type 1 is a MAC address
+		if iCode == 61 && len(value) == 7 && value[0] == 1 {
+			replace(value[1:], userSuppliedMacAddress, userSuppliedMacAddressNew, "DHCP client identifier")
+		}
+	})
+} // ReplaceDhcpHeaderMacAddresses()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceDhcpHeaderIPv4Addresses()
+// -----------------------------------------------------------------------------
+// Lets compare the IPv4 address supplied with the client, your, server and relay
+// addresses in the DHCP message and with the addresses in the options
+func ReplaceDhcpHeaderIPv4Addresses(dhcpHeader []byte, userSuppliedIPv4Address, userSuppliedIPv4AddressNew []byte) error {
+	bDhcp, err := checkDhcpHeader(dhcpHeader)
+	if err != nil || !bDhcp {
+		return err
+	}
+
+	// ciaddr, yiaddr, siaddr and giaddr follow each other
+	for i, sName := range []string{"ciaddr", "yiaddr", "siaddr", "giaddr"} {
+		iStart := 12 + 4*i
+		replace(dhcpHeader[iStart:iStart+4], userSuppliedIPv4Address, userSuppliedIPv4AddressNew, "DHCP "+sName)
+	}
+
+	return walkOptions(dhcpHeader, func(iCode byte, value []byte) {
+		sName, ok := dhcpIPv4Options[iCode]
+		if !ok || len(value)%4 != 0 {
+			return
+		}
+		for i := 0; i < len(value); i += 4 {
+			replace(value[i:i+4], userSuppliedIPv4Address, userSuppliedIPv4AddressNew, "DHCP "+sName)
+		}
+	})
+} // ReplaceDhcpHeaderIPv4Addresses()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceDhcpv6HeaderMacAddresses()
+// -----------------------------------------------------------------------------
+// Lets compare the mac address supplied with the link layer addresses in the
+// DUIDs of the client and server identifier options and with the client link
+// layer address option a relay adds.  Relayed messages are looked at as well.
+func ReplaceDhcpv6HeaderMacAddresses(dhcpv6Header []byte, userSuppliedMacAddress, userSuppliedMacAddressNew []byte) error {
+	return walkDhcpv6Message(dhcpv6Header, func(iCode uint16, value []byte) error {
+		switch iCode {
+		case iV6OptionClientID, iV6OptionServerID:
+			if mac := duidMacAddress(value); mac != nil {
+				replace(mac, userSuppliedMacAddress, userSuppliedMacAddressNew, "DHCPv6 DUID")
+			}
+		case iV6OptionLinkLayerAddress:
+			if len(value) == 8 && value[0] == 0 && value[1] == 1 {
+				replace(value[2:], userSuppliedMacAddress, userSuppliedMacAddressNew, "DHCPv6 client link layer address")
+			}
+		}
+		return nil
+	}, nil)
+} // ReplaceDhcpv6HeaderMacAddresses()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceDhcpv6HeaderIPv6Addresses()
+// -----------------------------------------------------------------------------
+// Lets compare the IPv6 address supplied with the link and peer addresses of
+// relayed messages, the addresses that are handed out and the server addresses
+// in the options
+func ReplaceDhcpv6HeaderIPv6Addresses(dhcpv6Header []byte, userSuppliedIPv6Address, userSuppliedIPv6AddressNew []byte) error {
+	relay := func(relayHeader []byte) {
+		replace(relayHeader[2:18], userSuppliedIPv6Address, userSuppliedIPv6AddressNew, "DHCPv6 relay link address")
+		replace(relayHeader[18:34], userSuppliedIPv6Address, userSuppliedIPv6AddressNew, "DHCPv6 relay peer address")
+	}
+
+	var visit func(iCode uint16, value []byte) error
+	visit = func(iCode uint16, value []byte) error {
+		if sName, ok := dhcpv6IPv6Options[iCode]; ok && len(value)%16 == 0 {
+			for i := 0; i < len(value); i += 16 {
+				replace(value[i:i+16], userSuppliedIPv6Address, userSuppliedIPv6AddressNew, "DHCPv6 "+sName)
+			}
+			return nil
+		}
+
+		switch iCode {
+		case iV6OptionIANA:
+			if len(value) < 12 {
+				return fmt.Errorf("%w: DHCPv6 IA_NA option is too short", common.ErrMalformedPacket)
+			}
+			return walkDhcpv6Options(value[12:], visit)
+		case iV6OptionIATA:
+			if len(value) < 4 {
+				return fmt.Errorf("%w: DHCPv6 IA_TA option is too short", common.ErrMalformedPacket)
+			}
+			return walkDhcpv6Options(value[4:], visit)
+		case iV6OptionIAAddress:
+			if len(value) < 24 {
+				return fmt.Errorf("%w: DHCPv6 IA address option is too short", common.ErrMalformedPacket)
+			}
+			replace(value[:16], userSuppliedIPv6Address, userSuppliedIPv6AddressNew, "DHCPv6 IA address")
+		case iV6OptionNTPServer:
+			// The NTP server option holds sub-options of its own, 1 is an address
+			return walkDhcpv6Options(value, func(iSubCode uint16, subValue []byte) error {
+				if iSubCode == 1 && len(subValue) == 16 {
+					replace(subValue, userSuppliedIPv6Address, userSuppliedIPv6AddressNew, "DHCPv6 NTP server")
+				}
+				return nil
+			})
+		}
+		return nil
+	}
+
+	return walkDhcpv6Message(dhcpv6Header, visit, relay)
+} // ReplaceDhcpv6HeaderIPv6Addresses()
+
+//
+// -----------------------------------------------------------------------------
+// checkDhcpHeader()
+// -----------------------------------------------------------------------------
+// Make sure the DHCP message is long enough to hold the fixed header.  It returns
+// true if it looks like a DHCP request or reply, other traffic on the DHCP ports
+// is left alone.
+func checkDhcpHeader(dhcpHeader []byte) (bool, error) {
+	if len(dhcpHeader) < iDhcpHeaderLength {
+		return false, fmt.Errorf("%w: DHCP header is too short", common.ErrMalformedPacket)
+	}
+	return dhcpHeader[0] == 1 || dhcpHeader[0] == 2, nil
+} // checkDhcpHeader()
+
+//
+// -----------------------------------------------------------------------------
+// walkOptions()
+// -----------------------------------------------------------------------------
+// Call visit for each option after the magic cookie.  A message without the
+// magic cookie is BOOTP and has no options.
+func walkOptions(dhcpHeader []byte, visit func(iCode byte, value []byte)) error {
+	options := dhcpHeader[iDhcpHeaderLength:]
+	if len(options) < 4 || options[0] != 99 || options[1] != 130 || options[2] != 83 || options[3] != 99 {
+		return nil
+	}
+
+	i := 4
+	for i < len(options) {
+		iCode := options[i]
+		if iCode == 0 {
+			i++
+			continue
+		}
+		if iCode == 255 {
+			return nil
+		}
+		if i+2 > len(options) || i+2+int(options[i+1]) > len(options) {
+			return fmt.Errorf("%w: DHCP option %d is cut short", common.ErrMalformedPacket, iCode)
+		}
+		visit(iCode, options[i+2:i+2+int(options[i+1])])
+		i += 2 + int(options[i+1])
+	}
+	return nil
+} // walkOptions()
+
+//
+// -----------------------------------------------------------------------------
+// walkDhcpv6Message()
+// -----------------------------------------------------------------------------
+// Call visit for each option of a DHCPv6 message.  A relay message has the link
+// and peer addresses in front of its options, relay is called with that header
+// if it is not nil, and the message it carries is walked as well.
+func walkDhcpv6Message(dhcpv6Header []byte, visit func(iCode uint16, value []byte) error, relay func(relayHeader []byte)) error {
+	if len(dhcpv6Header) < 4 {
+		return fmt.Errorf("%w: DHCPv6 header is too short", common.ErrMalformedPacket)
+	}
+
+	// Relay forward and relay reply messages
+	if dhcpv6Header[0] == 12 || dhcpv6Header[0] == 13 {
+		if len(dhcpv6Header) < 34 {
+			return fmt.Errorf("%w: DHCPv6 relay header is too short", common.ErrMalformedPacket)
+		}
+		if relay != nil {
+			relay(dhcpv6Header)
+		}
+		return walkDhcpv6Options(dhcpv6Header[34:], func(iCode uint16, value []byte) error {
+			if iCode == iV6OptionRelayMessage {
+				return walkDhcpv6Message(value, visit, relay)
+			}
+			return visit(iCode, value)
+		})
+	}
+	return walkDhcpv6Options(dhcpv6Header[4:], visit)
+} // walkDhcpv6Message()
+
+//
+// -----------------------------------------------------------------------------
+// walkDhcpv6Options()
+// -----------------------------------------------------------------------------
+// Call visit for each DHCPv6 option, these have a two byte code and length
+func walkDhcpv6Options(options []byte, visit func(iCode uint16, value []byte) error) error {
+	for len(options) > 0 {
+		if len(options) < 4 {
+			return fmt.Errorf("%w: DHCPv6 option is cut short", common.ErrMalformedPacket)
+		}
+		iCode := uint16(options[0])<<8 | uint16(options[1])
+		iLength := int(options[2])<<8 | int(options[3])
+		if len(options) < 4+iLength {
+			return fmt.Errorf("%w: DHCPv6 option %d is cut short", common.ErrMalformedPacket, iCode)
+		}
+		if err := visit(iCode, options[4:4+iLength]); err != nil {
+			return err
+		}
+		options = options[4+iLength:]
+	}
+	return nil
+} // walkDhcpv6Options()
+
+//
+// -----------------------------------------------------------------------------
+// duidMacAddress()
+// -----------------------------------------------------------------------------
+// Find the MAC address in a DUID that is based on an ethernet link layer address,
+// with a time (DUID-LLT) or without one (DUID-LL).  Nil is returned for any other
+// kind of DUID.
+func duidMacAddress(duid []byte) []byte {
+	if len(duid) < 4 || duid[2] != 0 || duid[3] != 1 {
+		return nil
+	}
+	switch {
+	case duid[0] == 0 && duid[1] == 1 && len(duid) == 14:
+		return duid[8:14]
+	case duid[0] == 0 && duid[1] == 3 && len(duid) == 10:
+		return duid[4:10]
+	}
+	return nil
+} // duidMacAddress()
+
+//
+// -----------------------------------------------------------------------------
+// replace()
+// -----------------------------------------------------------------------------
+// Replace an address in the message if it is the one the user supplied
+func replace(address, userSuppliedAddress, userSuppliedAddressNew []byte, sName string) {
+	if !common.AreByteSlicesEqual(address, userSuppliedAddress) {
+		return
+	}
+	if iDebug == 1 {
+		if len(address) == 6 {
+			fmt.Println("DEBUG: There is a match on the", sName, "updating", layer2.MakePrettyMacAddress(userSuppliedAddress), "to", layer2.MakePrettyMacAddress(userSuppliedAddressNew))
+		} else {
+			fmt.Println("DEBUG: There is a match on the", sName, "updating", net.IP(userSuppliedAddress), "to", net.IP(userSuppliedAddressNew))
+		}
+	}
+	copy(address, userSuppliedAddressNew)
+} // replace()
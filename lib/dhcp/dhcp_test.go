@@ -0,0 +1,187 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package dhcp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"net"
+	"testing"
+)
+
+var macAddressNew = net.HardwareAddr{0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+var ipv4AddressNew = net.IP{2, 2, 2, 2}
+var ipv6AddressNew = net.ParseIP("2001:db8::99")
+
+// locate finds the DHCP message in one of the test packets
+func locate(t *testing.T, data []byte) ([]byte, int) {
+	f := pcaptest.Parse(t, data)
+	iStart, iEnd, iVersion := Locate(f)
+	if iStart < 0 {
+		t.Fatal("Expected a DHCP message")
+	}
+	return data[iStart:iEnd], iVersion
+}
+
+func TestLocate(t *testing.T) {
+	for _, p := range pcaptest.Corpus() {
+		f, err := frame.Parse(p.Data, layers.LinkTypeEthernet)
+		if err != nil {
+			continue
+		}
+
+		iStart, _, iVersion := Locate(f)
+		switch p.Name {
+		case "dhcp-ack":
+			if iStart < 0 || iVersion != 4 {
+				t.Errorf("%s: expected a DHCP message, got version %d", p.Name, iVersion)
+			}
+		case "dhcpv6-reply":
+			if iStart < 0 || iVersion != 6 {
+				t.Errorf("%s: expected a DHCPv6 message, got version %d", p.Name, iVersion)
+			}
+		default:
+			if iStart >= 0 {
+				t.Errorf("%s: did not expect a DHCP message", p.Name)
+			}
+		}
+	}
+}
+
+func TestReplaceDhcpHeaderAddresses(t *testing.T) {
+	dhcpHeader, _ := locate(t, pcaptest.DHCPAck())
+	if err := ReplaceDhcpHeaderMacAddresses(dhcpHeader, pcaptest.MacAddressA, macAddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if err := ReplaceDhcpHeaderIPv4Addresses(dhcpHeader, pcaptest.IPv4AddressA.To4(), ipv4AddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+
+	tests := []struct {
+		name     string
+		iOffset  int
+		expected []byte
+	}{
+		{"chaddr", 28, macAddressNew},
+		{"yiaddr", 16, ipv4AddressNew},
+		{"siaddr", 20, pcaptest.IPv4AddressB.To4()},
+		{"server identifier", 245, pcaptest.IPv4AddressB.To4()},
+		{"first DNS server", 251, pcaptest.IPv4AddressB.To4()},
+		{"second DNS server", 255, ipv4AddressNew},
+		{"client identifier", 262, macAddressNew},
+	}
+
+	for _, tt := range tests {
+		if value := dhcpHeader[tt.iOffset : tt.iOffset+len(tt.expected)]; !bytes.Equal(value, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, value)
+		}
+	}
+}
+
+func TestReplaceDhcpHeaderErrors(t *testing.T) {
+	dhcpHeader, _ := locate(t, pcaptest.DHCPAck())
+
+	// Too short for the fixed header
+	err := ReplaceDhcpHeaderMacAddresses(dhcpHeader[:200], pcaptest.MacAddressA, macAddressNew)
+	if !errors.Is(err, common.ErrMalformedPacket) {
+		t.Error("Expected a malformed packet error, got ", err)
+	}
+
+	// An option that runs past the end of the message
+	err = ReplaceDhcpHeaderIPv4Addresses(dhcpHeader[:250], pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+	if !errors.Is(err, common.ErrMalformedPacket) {
+		t.Error("Expected a malformed packet error, got ", err)
+	}
+
+	// Something else on the DHCP ports is left alone
+	other := append([]byte(nil), dhcpHeader...)
+	other[0] = 9
+	original := append([]byte(nil), other...)
+	if err := ReplaceDhcpHeaderMacAddresses(other, pcaptest.MacAddressA, macAddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if !bytes.Equal(other, original) {
+		t.Error("Expected a message that is not DHCP to be left alone")
+	}
+}
+
+func TestReplaceDhcpv6HeaderAddresses(t *testing.T) {
+	dhcpv6Header, _ := locate(t, pcaptest.DHCPv6Reply())
+	if err := ReplaceDhcpv6HeaderMacAddresses(dhcpv6Header, pcaptest.MacAddressA, macAddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if err := ReplaceDhcpv6HeaderIPv6Addresses(dhcpv6Header, pcaptest.IPv6AddressA, ipv6AddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+
+	tests := []struct {
+		name     string
+		iOffset  int
+		expected []byte
+	}{
+		{"client DUID", 12, macAddressNew},
+		{"server DUID", 30, pcaptest.MacAddressB},
+		{"IA address", 56, ipv6AddressNew},
+		{"first DNS server", 84, pcaptest.IPv6AddressB},
+		{"second DNS server", 100, ipv6AddressNew},
+	}
+
+	for _, tt := range tests {
+		if value := dhcpv6Header[tt.iOffset : tt.iOffset+len(tt.expected)]; !bytes.Equal(value, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, value)
+		}
+	}
+}
+
+func TestReplaceDhcpv6Relay(t *testing.T) {
+	inner, _ := locate(t, pcaptest.DHCPv6Reply())
+
+	// A relay reply from the relay on A that carries the reply
+	relay := append([]byte{13, 0}, pcaptest.IPv6AddressA...)
+	relay = append(relay, pcaptest.IPv6AddressB...)
+	relay = append(relay, 0, 9, byte(len(inner)>>8), byte(len(inner)))
+	relay = append(relay, inner...)
+
+	if err := ReplaceDhcpv6HeaderMacAddresses(relay, pcaptest.MacAddressA, macAddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if err := ReplaceDhcpv6HeaderIPv6Addresses(relay, pcaptest.IPv6AddressA, ipv6AddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if !bytes.Equal(relay[2:18], ipv6AddressNew) || !bytes.Equal(relay[18:34], pcaptest.IPv6AddressB) {
+		t.Errorf("Expected the link address to change, got %v and %v", net.IP(relay[2:18]), net.IP(relay[18:34]))
+	}
+	if !bytes.Equal(relay[38+12:38+18], macAddressNew) || !bytes.Equal(relay[38+56:38+72], ipv6AddressNew) {
+		t.Error("Expected the relayed message to be rewritten")
+	}
+
+	// An option that runs past the end of the message
+	err := ReplaceDhcpv6HeaderIPv6Addresses(relay[:len(relay)-2], pcaptest.IPv6AddressA, ipv6AddressNew)
+	if !errors.Is(err, common.ErrMalformedPacket) {
+		t.Error("Expected a malformed packet error, got ", err)
+	}
+}
+
+func FuzzReplaceDhcpHeaderAddresses(f *testing.F) {
+	f.Add(pcaptest.DHCPAck()[42:])
+	f.Fuzz(func(t *testing.T, dhcpHeader []byte) {
+		ReplaceDhcpHeaderMacAddresses(dhcpHeader, pcaptest.MacAddressA, macAddressNew)
+		ReplaceDhcpHeaderIPv4Addresses(dhcpHeader, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+	})
+}
+
+func FuzzReplaceDhcpv6HeaderAddresses(f *testing.F) {
+	f.Add(pcaptest.DHCPv6Reply()[62:])
+	f.Fuzz(func(t *testing.T, dhcpv6Header []byte) {
+		ReplaceDhcpv6HeaderMacAddresses(dhcpv6Header, pcaptest.MacAddressA, macAddressNew)
+		ReplaceDhcpv6HeaderIPv6Addresses(dhcpv6Header, pcaptest.IPv6AddressA, ipv6AddressNew)
+	})
+}
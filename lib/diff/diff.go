@@ -0,0 +1,230 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package diff compares a packet before and after it was rewritten and reports
+// the header fields that changed.  It is used by the dry run mode.
+package diff
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/layer2"
+	"net"
+	"time"
+)
+
+// Change is a single field that is different after the rewrite
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// String formats the change for the dry run output
+func (c Change) String() string {
+	return fmt.Sprintf("%-12s %s -> %s", c.Field, c.Old, c.New)
+}
+
+// field is a named header field found in the raw bytes of a frame
+type field struct {
+	sName  string
+	value  []byte
+	format func([]byte) string
+}
+
+//
+// -----------------------------------------------------------------------------
+// CompareCaptureInfo()
+// -----------------------------------------------------------------------------
+// This function will report a change to the timestamp in the PCAP header
+func CompareCaptureInfo(old, new gopacket.CaptureInfo) []Change {
+	if old.Timestamp.Equal(new.Timestamp) {
+		return nil
+	}
+	return []Change{{
+		Field: "timestamp",
+		Old:   old.Timestamp.UTC().Format(time.RFC3339Nano),
+		New:   new.Timestamp.UTC().Format(time.RFC3339Nano),
+	}}
+} // CompareCaptureInfo()
+
+//
+// -----------------------------------------------------------------------------
+// CompareFrames()
+// -----------------------------------------------------------------------------
+// This function will report every MAC address, VLAN ID, MPLS label, PPPoE
+// session, IP address, IP header field, ARP address and TCP sequence number that
+// is different between the two frames, and how much of the TCP or UDP payload
+// changed.  Fields that share a byte are only reported when what is shown for
+// them changed.  The frames need to have been parsed from the same packet before
+// and after it was rewritten.
+func CompareFrames(old, new *frame.Frame) []Change {
+	newFields := make(map[string][]byte)
+	for _, f := range fields(new) {
+		newFields[f.sName] = f.value
+	}
+
+	var changes []Change
+	for _, f := range fields(old) {
+		value, ok := newFields[f.sName]
+		if !ok || string(value) == string(f.value) {
+			continue
+		}
+		sOld, sNew := f.format(f.value), f.format(value)
+		if sOld == sNew {
+			continue
+		}
+		changes = append(changes, Change{Field: f.sName, Old: sOld, New: sNew})
+	}
+
+	if change, ok := comparePayloads(old, new); ok {
+		changes = append(changes, change)
+	}
+	return changes
+} // CompareFrames()
+
+//
+// -----------------------------------------------------------------------------
+// comparePayloads()
+// -----------------------------------------------------------------------------
+// Report the length of the TCP or UDP payload and how many of its bytes are
+// different, the payloads are too big to show
+func comparePayloads(old, new *frame.Frame) (Change, bool) {
+	iOldStart, iOldEnd := old.Payload()
+	iNewStart, iNewEnd := new.Payload()
+	if iOldStart < 0 || iNewStart < 0 {
+		return Change{}, false
+	}
+
+	oldPayload := old.Data[iOldStart:iOldEnd]
+	newPayload := new.Data[iNewStart:iNewEnd]
+	iChanged := len(newPayload) - len(oldPayload)
+	if iChanged < 0 {
+		iChanged = -iChanged
+	}
+	for i := 0; i < len(oldPayload) && i < len(newPayload); i++ {
+		if oldPayload[i] != newPayload[i] {
+			iChanged++
+		}
+	}
+	if iChanged == 0 {
+		return Change{}, false
+	}
+	return Change{
+		Field: "payload",
+		Old:   fmt.Sprintf("%d bytes", len(oldPayload)),
+		New:   fmt.Sprintf("%d bytes, %d changed", len(newPayload), iChanged),
+	}, true
+} // comparePayloads()
+
+//
+// -----------------------------------------------------------------------------
+// fields()
+// -----------------------------------------------------------------------------
+// Find the fields that the rewrites can change, anything that is cut short is
+// left out
+func fields(f *frame.Frame) []field {
+	var l []field
+	add := func(sName string, iStart, iLength int, format func([]byte) string) {
+		if iStart >= 0 && len(f.Data) >= iStart+iLength {
+			l = append(l, field{sName: sName, value: f.Data[iStart : iStart+iLength], format: format})
+		}
+	}
+
+	if f.LinkType == layers.LinkTypeEthernet {
+		add("eth.dst", 0, 6, layer2.MakePrettyMacAddress)
+		add("eth.src", 6, 6, layer2.MakePrettyMacAddress)
+		if f.VLANOffset >= 4 {
+			add("vlan", 14, 2, formatVLAN)
+		}
+		if f.VLANOffset == 8 {
+			add("vlan.inner", 18, 2, formatVLAN)
+		}
+		for i := 0; i < f.MPLSLabels; i++ {
+			sName := "mpls.label"
+			if i > 0 {
+				sName = fmt.Sprintf("mpls.label.%d", i+1)
+			}
+			add(sName, 14+f.VLANOffset+4*i, 3, formatMPLSLabel)
+		}
+		if f.EthernetType == layers.EthernetTypePPPoEDiscovery || f.EthernetType == layers.EthernetTypePPPoESession {
+			add("pppoe.session", 14+f.VLANOffset+2, 2, formatHex)
+		}
+	}
+
+	if f.NetworkOffset < 0 {
+		return l
+	}
+
+	switch {
+	case f.IPVersion == 4:
+		add("ip.src", f.NetworkOffset+12, 4, formatIP)
+		add("ip.dst", f.NetworkOffset+16, 4, formatIP)
+		add("ip.tos", f.NetworkOffset+1, 1, formatByte)
+		add("ip.id", f.NetworkOffset+4, 2, formatHex)
+		add("ip.ttl", f.NetworkOffset+8, 1, formatByte)
+	case f.IPVersion == 6:
+		add("ip6.src", f.NetworkOffset+8, 16, formatIP)
+		add("ip6.dst", f.NetworkOffset+24, 16, formatIP)
+		add("ip6.tclass", f.NetworkOffset, 2, formatTrafficClass)
+		add("ip6.flow", f.NetworkOffset+1, 3, formatFlowLabel)
+		add("ip6.hlim", f.NetworkOffset+7, 1, formatByte)
+	case f.EthernetType == layers.EthernetTypeARP:
+		add("arp.src.mac", f.NetworkOffset+8, 6, layer2.MakePrettyMacAddress)
+		add("arp.src.ip", f.NetworkOffset+14, 4, formatIP)
+		add("arp.dst.mac", f.NetworkOffset+18, 6, layer2.MakePrettyMacAddress)
+		add("arp.dst.ip", f.NetworkOffset+24, 4, formatIP)
+	}
+
+	if f.TransportOffset >= 0 && f.IPProtocol == layers.IPProtocolTCP {
+		add("tcp.seq", f.TransportOffset+4, 4, formatNumber)
+		add("tcp.ack", f.TransportOffset+8, 4, formatNumber)
+	}
+	return l
+} // fields()
+
+// formatVLAN shows the 12 bit VLAN ID from the tag control information
+func formatVLAN(tci []byte) string {
+	return fmt.Sprintf("%d", (uint16(tci[0])<<8|uint16(tci[1]))&0x0fff)
+}
+
+// formatMPLSLabel shows the 20 bit label of an MPLS label stack entry
+func formatMPLSLabel(entry []byte) string {
+	return fmt.Sprintf("%d", uint32(entry[0])<<12|uint32(entry[1])<<4|uint32(entry[2])>>4)
+}
+
+// formatHex shows a 16 bit big endian number in hex
+func formatHex(b []byte) string {
+	return fmt.Sprintf("0x%04x", uint16(b[0])<<8|uint16(b[1]))
+}
+
+// formatByte shows a single byte as a number
+func formatByte(b []byte) string {
+	return fmt.Sprintf("%d", b[0])
+}
+
+// formatTrafficClass shows the 8 bit IPv6 traffic class that sits across the
+// first two bytes of the header
+func formatTrafficClass(b []byte) string {
+	return fmt.Sprintf("%d", (b[0]&0x0f)<<4|b[1]>>4)
+}
+
+// formatFlowLabel shows the 20 bit IPv6 flow label
+func formatFlowLabel(b []byte) string {
+	return fmt.Sprintf("%d", uint32(b[0]&0x0f)<<16|uint32(b[1])<<8|uint32(b[2]))
+}
+
+// formatNumber shows a 32 bit big endian number
+func formatNumber(b []byte) string {
+	return fmt.Sprintf("%d", uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8|uint32(b[3]))
+}
+
+// formatIP shows an IPv4 or IPv6 address
+func formatIP(ip []byte) string {
+	return net.IP(ip).String()
+}
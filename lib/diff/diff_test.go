@@ -0,0 +1,81 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package diff
+
+import (
+	"github.com/google/gopacket"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+	"time"
+)
+
+func TestCompareFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		iOffset  int
+		value    []byte
+		expected []Change
+	}{
+		{"unchanged", pcaptest.IPv4UDP(0, nil), 0, nil, nil},
+		{"eth.src", pcaptest.IPv4UDP(0, nil), 6, []byte{0x22, 0x33, 0x44, 0x55, 0x66, 0x77},
+			[]Change{{"eth.src", "68:A8:6D:18:36:92", "22:33:44:55:66:77"}}},
+		{"vlan", pcaptest.IPv4TCP(2, nil), 18, []byte{0x00, 0x65},
+			[]Change{{"vlan.inner", "100", "101"}}},
+		{"mpls", pcaptest.MPLS(4, 100, 200), 19, []byte{0x12, 0xc1},
+			[]Change{{"mpls.label.2", "200", "300"}}},
+		{"pppoe", pcaptest.PPPoE(4, 0x1234), 16, []byte{0x43, 0x21},
+			[]Change{{"pppoe.session", "0x1234", "0x4321"}}},
+		{"ip.dst", pcaptest.IPv4TCP(1, nil), 34, []byte{2, 2, 2, 2},
+			[]Change{{"ip.dst", "10.0.2.32", "2.2.2.2"}}},
+		{"ip.ttl", pcaptest.IPv4UDP(0, nil), 22, []byte{128},
+			[]Change{{"ip.ttl", "64", "128"}}},
+		{"ip6.flow", pcaptest.IPv6UDP(0, nil), 16, []byte{0x30, 0x39},
+			[]Change{{"ip6.flow", "0", "12345"}}},
+		{"ip6.src", pcaptest.IPv6UDP(0, nil), 37, []byte{0x33},
+			[]Change{{"ip6.src", "2001:db8::32", "2001:db8::33"}}},
+		{"arp", pcaptest.ARPRequest(1), 32, []byte{2, 2, 2, 2},
+			[]Change{{"arp.src.ip", "10.0.2.32", "2.2.2.2"}}},
+		{"tcp.seq", pcaptest.ServerTCP(4002, 80, false, 5000, 9000, nil), 38, []byte{0, 0, 0x13, 0x8a},
+			[]Change{{"tcp.seq", "5000", "5002"}}},
+		{"payload", pcaptest.IPv4UDP(0, []byte("hello world")), 43, []byte("HE"),
+			[]Change{{"payload", "11 bytes", "11 bytes, 2 changed"}}},
+	}
+
+	for _, tt := range tests {
+		original := append([]byte(nil), tt.data...)
+		copy(tt.data[tt.iOffset:], tt.value)
+
+		oldFrame := pcaptest.Parse(t, original)
+		newFrame := pcaptest.Parse(t, tt.data)
+
+		changes := CompareFrames(oldFrame, newFrame)
+		if len(changes) != len(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, changes)
+			continue
+		}
+		for i := range changes {
+			if changes[i] != tt.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tt.name, tt.expected[i], changes[i])
+			}
+		}
+	}
+}
+
+func TestCompareCaptureInfo(t *testing.T) {
+	old := gopacket.CaptureInfo{Timestamp: pcaptest.StartTime}
+	if changes := CompareCaptureInfo(old, old); len(changes) != 0 {
+		t.Error("Expected no changes, got ", changes)
+	}
+
+	new := gopacket.CaptureInfo{Timestamp: pcaptest.StartTime.Add(90 * time.Minute)}
+	changes := CompareCaptureInfo(old, new)
+	expected := Change{"timestamp", "2015-06-01T12:00:00Z", "2015-06-01T13:30:00Z"}
+	if len(changes) != 1 || changes[0] != expected {
+		t.Errorf("Expected %v, got %v", expected, changes)
+	}
+}
@@ -0,0 +1,798 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package dns rewrites the addresses found inside DNS messages, the A and AAAA
+// records in the answers and the in-addr.arpa and ip6.arpa names that are used
+// for reverse lookups, and the host and domain names in the questions and
+// records.
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/domain"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"strconv"
+	"strings"
+)
+
+var iDebug = 0
+
+// ErrBadMessage is returned when the payload can not be parsed as a DNS message.
+// Traffic on port 53 is not always DNS so this is not treated as a malformed
+// packet.
+var ErrBadMessage = errors.New("not a valid DNS message")
+
+// Port is the well known port for DNS over UDP and TCP
+const Port = 53
+
+// The record types that carry an address or a name that may be compressed
+const (
+	iTypeA     = 1
+	iTypeNS    = 2
+	iTypeCNAME = 5
+	iTypeSOA   = 6
+	iTypePTR   = 12
+	iTypeMX    = 15
+	iTypeAAAA  = 28
+	iTypeSRV   = 33
+)
+
+// The most compression pointers that are followed in a single name
+const iMaxPointers = 32
+
+// Mapping is an address to replace and what to replace it with, both addresses
+// are either 4 or 16 bytes long
+type Mapping struct {
+	Old []byte
+	New []byte
+}
+
+// Rules are the changes to make to each DNS message, Domains is nil if no host
+// or domain names are changed
+type Rules struct {
+	Addresses []Mapping
+	Domains   *domain.Rules
+}
+
+// name is a domain name from the message.  The wire form has every label with
+// the compression pointers followed.  The offsets of the labels are kept so a
+// name can be changed in place when the new one has the same label lengths.
+type name struct {
+	wire         []byte
+	labelOffsets []int
+}
+
+// record is a question or a resource record.  A question only has the name and
+// the type and class in fixed.
+type record struct {
+	name         name
+	iType        uint16
+	fixed        []byte
+	iRDataOffset int
+	rdata        []byte
+	rdataNames   []name
+}
+
+// message is a parsed DNS message
+type message struct {
+	header    []byte
+	questions []record
+	records   []record
+	trailer   []byte
+}
+
+//
+// -----------------------------------------------------------------------------
+// RewriteMessage()
+// -----------------------------------------------------------------------------
+// This function will apply the rules to a DNS message.  A and AAAA records,
+// reverse lookup names and the names the domain rules cover are changed in place
+// when possible.  If a name changes length, or a compressed name is shared in a
+// way that can not be patched, the whole message is rebuilt without compression,
+// but only when bAllowResize is true, otherwise the names are left as they are.
+// The message that is returned is either msg itself or a new slice, along with
+// the number of addresses and names that were changed.
+func RewriteMessage(msg []byte, rules *Rules, bAllowResize bool) ([]byte, int, error) {
+	m, err := parse(msg)
+	if err != nil {
+		return msg, 0, err
+	}
+
+	iChanges := 0
+	bRebuild := false
+	newNames := make(map[*name][]byte)
+
+	// ---------------------------------------------------------------------
+	// Find the reverse lookup names and domain names that need to change
+	// ---------------------------------------------------------------------
+	for _, n := range m.names() {
+		newWire := rules.mapName(n.wire)
+		if newWire == nil {
+			continue
+		}
+		if sameLabels(n.wire, newWire) {
+			newNames[n] = newWire
+			iChanges++
+		} else if bAllowResize {
+			newNames[n] = newWire
+			bRebuild = true
+			iChanges++
+		} else if iDebug == 1 {
+			fmt.Println("DEBUG: DNS name can not change length, leaving it as it is")
+		}
+	}
+
+	// ---------------------------------------------------------------------
+	// Find the A and AAAA records that need to change
+	// ---------------------------------------------------------------------
+	newRData := make(map[int][]byte)
+	for i, r := range m.records {
+		if r.iType != iTypeA && r.iType != iTypeAAAA {
+			continue
+		}
+		if newAddress := rules.mapAddress(r.rdata); newAddress != nil {
+			newRData[i] = newAddress
+			iChanges++
+		}
+	}
+
+	if iChanges == 0 {
+		return msg, 0, nil
+	}
+
+	// A label that is patched in place changes every name that points at it,
+	// so make sure each name still comes out the way it should
+	if !bRebuild && len(newNames) > 0 && !m.canPatch(msg, newNames) {
+		if bAllowResize {
+			bRebuild = true
+		} else {
+			if iDebug == 1 {
+				fmt.Println("DEBUG: DNS names share labels that can not be patched, leaving them as they are")
+			}
+			iChanges -= len(newNames)
+			newNames = nil
+		}
+	}
+	if bRebuild {
+		return m.build(newNames, newRData), iChanges, nil
+	}
+
+	// ---------------------------------------------------------------------
+	// Everything fits where it is
+	// ---------------------------------------------------------------------
+	for n, newWire := range newNames {
+		n.patch(msg, newWire)
+	}
+	for i, newAddress := range newRData {
+		copy(msg[m.records[i].iRDataOffset:], newAddress)
+	}
+	return msg, iChanges, nil
+} // RewriteMessage()
+
+//
+// -----------------------------------------------------------------------------
+// RewriteTCPPayload()
+// -----------------------------------------------------------------------------
+// This function will apply the rules to the DNS messages in a TCP segment, each
+// one has a two byte length in front of it.  A segment does not have to start
+// or end on a message boundary, so only the complete messages from the start
+// of the segment are changed.  Messages that keep their length are changed in
+// place, if one changes length a new payload is built with the new lengths in
+// front of the messages.  The payload that is returned is either the one passed
+// in or a new slice, along with the number of addresses and names that were
+// changed.
+func RewriteTCPPayload(payload []byte, rules *Rules) ([]byte, int, error) {
+	var rebuilt []byte
+	iChanges := 0
+	iOffset := 0
+
+	// Everything after the messages that were looked at is kept as it is
+	finish := func() []byte {
+		if rebuilt == nil {
+			return payload
+		}
+		return append(rebuilt, payload[iOffset:]...)
+	}
+
+	for len(payload)-iOffset >= 2 {
+		iLength := int(payload[iOffset])<<8 | int(payload[iOffset+1])
+		if len(payload) < iOffset+2+iLength {
+			break
+		}
+		msg, iMessageChanges, err := RewriteMessage(payload[iOffset+2:iOffset+2+iLength], rules, true)
+		if err != nil {
+			return finish(), iChanges, err
+		}
+
+		// A rebuilt message is a new slice so the old one is still there to
+		// fall back to if the new one is too long
+		if len(msg) > 0xffff {
+			msg = payload[iOffset+2 : iOffset+2+iLength]
+			iMessageChanges = 0
+		}
+		iChanges += iMessageChanges
+
+		if rebuilt == nil && len(msg) != iLength {
+			rebuilt = make([]byte, 0, len(payload)+len(msg)-iLength)
+			rebuilt = append(rebuilt, payload[:iOffset]...)
+		}
+		if rebuilt != nil {
+			rebuilt = append(rebuilt, byte(len(msg)>>8), byte(len(msg)))
+			rebuilt = append(rebuilt, msg...)
+		}
+		iOffset += 2 + iLength
+	}
+	return finish(), iChanges, nil
+} // RewriteTCPPayload()
+
+//
+// -----------------------------------------------------------------------------
+// Locate()
+// -----------------------------------------------------------------------------
+// This function will find the DNS payload of a UDP or TCP segment to or from
+// port 53.  The start and end offsets in the frame data are returned along with
+// true if it is TCP.  A start of -1 means the frame is not DNS or the payload
+// was cut short.
+func Locate(f *frame.Frame) (int, int, bool) {
+	iSrcPort, iDstPort := f.Ports()
+	if iSrcPort != Port && iDstPort != Port {
+		return -1, -1, false
+	}
+	iStart, iEnd := f.Payload()
+	return iStart, iEnd, f.IPProtocol == layers.IPProtocolTCP
+} // Locate()
+
+//
+// -----------------------------------------------------------------------------
+// CompareMessages()
+// -----------------------------------------------------------------------------
+// This function will check that a rewritten DNS message only differs from the
+// original in the ways the rules allow.  Compression is ignored, the names are
+// compared after following the pointers.  A description of each difference that
+// the rules do not explain is returned.
+func CompareMessages(original, rewritten []byte, rules *Rules) ([]string, error) {
+	a, err := parse(original)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parse(rewritten)
+	if err != nil {
+		return []string{"the rewritten DNS message could not be parsed: " + err.Error()}, nil
+	}
+
+	var differences []string
+	if !bytes.Equal(a.header, b.header) {
+		differences = append(differences, "DNS header changed")
+	}
+	if len(a.questions) != len(b.questions) || len(a.records) != len(b.records) {
+		return append(differences, "DNS record counts changed"), nil
+	}
+
+	compareName := func(sWhere string, old, new []byte) {
+		if bytes.Equal(old, new) {
+			return
+		}
+		if mapped := rules.mapName(old); mapped == nil || !bytes.Equal(mapped, new) {
+			differences = append(differences, fmt.Sprintf("DNS %s name changed from %s to %s", sWhere, formatName(old), formatName(new)))
+		}
+	}
+
+	for i := range a.questions {
+		compareName("question", a.questions[i].name.wire, b.questions[i].name.wire)
+		if !bytes.Equal(a.questions[i].fixed, b.questions[i].fixed) {
+			differences = append(differences, fmt.Sprintf("DNS question %d type or class changed", i+1))
+		}
+	}
+
+	for i := range a.records {
+		old, new := a.records[i], b.records[i]
+		compareName("record", old.name.wire, new.name.wire)
+		if !bytes.Equal(old.fixed, new.fixed) {
+			differences = append(differences, fmt.Sprintf("DNS record %d type, class or TTL changed", i+1))
+			continue
+		}
+
+		// The names in the record data can change the same way the owner
+		// names do, everything else in the data has to stay the same
+		if len(old.rdataNames) > 0 && len(old.rdataNames) == len(new.rdataNames) {
+			for j := range old.rdataNames {
+				compareName("record data", old.rdataNames[j].wire, new.rdataNames[j].wire)
+			}
+			if !bytes.Equal(old.rdataFixed(), new.rdataFixed()) {
+				differences = append(differences, fmt.Sprintf("DNS record %d data changed", i+1))
+			}
+			continue
+		}
+
+		oldRData, newRData := old.expandedRData(), new.expandedRData()
+		if bytes.Equal(oldRData, newRData) {
+			continue
+		}
+		if old.iType == iTypeA || old.iType == iTypeAAAA {
+			if mapped := rules.mapAddress(oldRData); mapped != nil && bytes.Equal(mapped, newRData) {
+				continue
+			}
+		}
+		differences = append(differences, fmt.Sprintf("DNS record %d data changed", i+1))
+	}
+
+	if !bytes.Equal(a.trailer, b.trailer) {
+		differences = append(differences, "bytes after the DNS message changed")
+	}
+	return differences, nil
+} // CompareMessages()
+
+//
+// -----------------------------------------------------------------------------
+// CompareTCPPayloads()
+// -----------------------------------------------------------------------------
+// This function will compare the DNS messages in two TCP segments the same way
+// CompareMessages does, a message may have changed length.  Whatever is left
+// after the complete messages has to be the same.
+func CompareTCPPayloads(original, rewritten []byte, rules *Rules) ([]string, error) {
+	var differences []string
+	for len(original) >= 2 {
+		iLength := int(original[0])<<8 | int(original[1])
+		if len(original) < 2+iLength {
+			break
+		}
+		if len(rewritten) < 2 {
+			return append(differences, "DNS messages are missing"), nil
+		}
+		iNewLength := int(rewritten[0])<<8 | int(rewritten[1])
+		if len(rewritten) < 2+iNewLength {
+			return append(differences, "DNS message length is wrong"), nil
+		}
+
+		l, err := CompareMessages(original[2:2+iLength], rewritten[2:2+iNewLength], rules)
+		if err != nil {
+			return nil, err
+		}
+		differences = append(differences, l...)
+		original = original[2+iLength:]
+		rewritten = rewritten[2+iNewLength:]
+	}
+
+	if !bytes.Equal(original, rewritten) {
+		differences = append(differences, "bytes after the DNS messages changed")
+	}
+	return differences, nil
+} // CompareTCPPayloads()
+
+//
+// -----------------------------------------------------------------------------
+// ReverseName()
+// -----------------------------------------------------------------------------
+// Build the in-addr.arpa or ip6.arpa name for an address in wire form
+func ReverseName(ip []byte) []byte {
+	var labels []string
+	if len(ip) == 4 {
+		for i := 3; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip[i])))
+		}
+		labels = append(labels, "in-addr", "arpa")
+	} else {
+		const sHex = "0123456789abcdef"
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, string(sHex[ip[i]&0x0f]), string(sHex[ip[i]>>4]))
+		}
+		labels = append(labels, "ip6", "arpa")
+	}
+
+	var wire []byte
+	for _, sLabel := range labels {
+		wire = append(wire, byte(len(sLabel)))
+		wire = append(wire, sLabel...)
+	}
+	return append(wire, 0)
+} // ReverseName()
+
+//
+// -----------------------------------------------------------------------------
+// mapName()
+// -----------------------------------------------------------------------------
+// Find the new name for a reverse lookup name of one of the old addresses, or
+// for a name the domain rules cover.  Nil is returned if the name does not need
+// to change or the new name would not fit in a DNS message.
+func (rules *Rules) mapName(wire []byte) []byte {
+	for _, mapping := range rules.Addresses {
+		if bytes.EqualFold(wire, ReverseName(mapping.Old)) {
+			return ReverseName(mapping.New)
+		}
+	}
+	if rules.Domains == nil {
+		return nil
+	}
+
+	// A dot inside a label can not be told apart from the dots between them
+	for i := 0; i < len(wire) && wire[i] != 0; i += int(wire[i]) + 1 {
+		if bytes.IndexByte(wire[i+1:i+1+int(wire[i])], '.') >= 0 {
+			return nil
+		}
+	}
+	sNew, ok := rules.Domains.Replace(formatName(wire))
+	if !ok {
+		return nil
+	}
+	return encodeName(sNew)
+} // mapName()
+
+//
+// -----------------------------------------------------------------------------
+// mapAddress()
+// -----------------------------------------------------------------------------
+// Find the new address for one of the old addresses, nil is returned if the
+// address does not need to change
+func (rules *Rules) mapAddress(address []byte) []byte {
+	for _, mapping := range rules.Addresses {
+		if bytes.Equal(address, mapping.Old) {
+			return mapping.New
+		}
+	}
+	return nil
+} // mapAddress()
+
+//
+// -----------------------------------------------------------------------------
+// parse()
+// -----------------------------------------------------------------------------
+// Split a DNS message in to its questions and resource records
+func parse(msg []byte) (*message, error) {
+	if len(msg) < 12 {
+		return nil, fmt.Errorf("%w: message is too short", ErrBadMessage)
+	}
+
+	m := &message{header: msg[:12]}
+	iQuestions := int(msg[4])<<8 | int(msg[5])
+	iRecords := int(msg[6])<<8 | int(msg[7]) + int(msg[8])<<8 | int(msg[9]) + int(msg[10])<<8 | int(msg[11])
+
+	iOffset := 12
+	for i := 0; i < iQuestions; i++ {
+		n, iNext, err := readName(msg, iOffset)
+		if err != nil {
+			return nil, err
+		}
+		if len(msg) < iNext+4 {
+			return nil, fmt.Errorf("%w: question is cut short", ErrBadMessage)
+		}
+		m.questions = append(m.questions, record{name: n, fixed: msg[iNext : iNext+4]})
+		iOffset = iNext + 4
+	}
+
+	for i := 0; i < iRecords; i++ {
+		n, iNext, err := readName(msg, iOffset)
+		if err != nil {
+			return nil, err
+		}
+		if len(msg) < iNext+10 {
+			return nil, fmt.Errorf("%w: resource record is cut short", ErrBadMessage)
+		}
+		iRDataLength := int(msg[iNext+8])<<8 | int(msg[iNext+9])
+		iRDataOffset := iNext + 10
+		if len(msg) < iRDataOffset+iRDataLength {
+			return nil, fmt.Errorf("%w: resource record data is cut short", ErrBadMessage)
+		}
+
+		r := record{
+			name:         n,
+			iType:        uint16(msg[iNext])<<8 | uint16(msg[iNext+1]),
+			fixed:        msg[iNext : iNext+8],
+			iRDataOffset: iRDataOffset,
+			rdata:        msg[iRDataOffset : iRDataOffset+iRDataLength],
+		}
+		if err := r.readRDataNames(msg); err != nil {
+			return nil, err
+		}
+		m.records = append(m.records, r)
+		iOffset = iRDataOffset + iRDataLength
+	}
+
+	m.trailer = msg[iOffset:]
+	return m, nil
+} // parse()
+
+//
+// -----------------------------------------------------------------------------
+// readName()
+// -----------------------------------------------------------------------------
+// Read a name that starts at iOffset, following any compression pointers.  The
+// offset just past the name in the message is returned with it.
+func readName(msg []byte, iOffset int) (name, int, error) {
+	var n name
+	iNext := -1
+	iPointers := 0
+
+	for {
+		if iOffset >= len(msg) {
+			return n, 0, fmt.Errorf("%w: name is cut short", ErrBadMessage)
+		}
+		iLength := int(msg[iOffset])
+
+		switch {
+		case iLength == 0:
+			n.wire = append(n.wire, 0)
+			if iNext < 0 {
+				iNext = iOffset + 1
+			}
+			return n, iNext, nil
+
+		case iLength&0xc0 == 0xc0:
+			if iOffset+1 >= len(msg) {
+				return n, 0, fmt.Errorf("%w: compression pointer is cut short", ErrBadMessage)
+			}
+			iPointer := (iLength&0x3f)<<8 | int(msg[iOffset+1])
+
+			// Pointers have to go back in the message, this also stops loops
+			if iPointer >= iOffset || iPointers == iMaxPointers {
+				return n, 0, fmt.Errorf("%w: bad compression pointer", ErrBadMessage)
+			}
+			if iNext < 0 {
+				iNext = iOffset + 2
+			}
+			iPointers++
+			iOffset = iPointer
+
+		case iLength&0xc0 != 0:
+			return n, 0, fmt.Errorf("%w: unsupported label type", ErrBadMessage)
+
+		default:
+			if iOffset+1+iLength > len(msg) || len(n.wire)+1+iLength > 255 {
+				return n, 0, fmt.Errorf("%w: label is cut short or name is too long", ErrBadMessage)
+			}
+			n.labelOffsets = append(n.labelOffsets, iOffset)
+			n.wire = append(n.wire, msg[iOffset:iOffset+1+iLength]...)
+			iOffset += 1 + iLength
+		}
+	}
+} // readName()
+
+//
+// -----------------------------------------------------------------------------
+// readRDataNames()
+// -----------------------------------------------------------------------------
+// Read the names inside the data of the record types that are allowed to use
+// compression there (RFC 3597), plus SRV as some servers compress it anyway
+func (r *record) readRDataNames(msg []byte) error {
+	var nameOffsets []int
+	switch r.iType {
+	case iTypeNS, iTypeCNAME, iTypePTR:
+		nameOffsets = []int{0}
+	case iTypeMX:
+		nameOffsets = []int{2}
+	case iTypeSRV:
+		nameOffsets = []int{6}
+	case iTypeSOA:
+		nameOffsets = []int{0, -1}
+	default:
+		return nil
+	}
+
+	iOffset := r.iRDataOffset
+	iEnd := r.iRDataOffset + len(r.rdata)
+	if r.iType == iTypeSOA {
+		iEnd -= 20
+	}
+	for _, iNameOffset := range nameOffsets {
+		if iNameOffset >= 0 {
+			iOffset = r.iRDataOffset + iNameOffset
+		}
+		if iOffset >= iEnd {
+			return fmt.Errorf("%w: record data is too short", ErrBadMessage)
+		}
+		n, iNext, err := readName(msg[:iEnd], iOffset)
+		if err != nil {
+			return err
+		}
+		r.rdataNames = append(r.rdataNames, n)
+		iOffset = iNext
+	}
+	return nil
+} // readRDataNames()
+
+//
+// -----------------------------------------------------------------------------
+// expandedRData()
+// -----------------------------------------------------------------------------
+// Build the record data with any compressed names written out in full
+func (r *record) expandedRData() []byte {
+	return r.buildRData(func(n *name) []byte { return n.wire })
+} // expandedRData()
+
+//
+// -----------------------------------------------------------------------------
+// buildRData()
+// -----------------------------------------------------------------------------
+// Build the record data with the names in it written out in full, nameWire gives
+// the wire form to use for each of them
+func (r *record) buildRData(nameWire func(*name) []byte) []byte {
+	if len(r.rdataNames) == 0 {
+		return r.rdata
+	}
+
+	var rdata []byte
+	switch r.iType {
+	case iTypeMX:
+		rdata = append(rdata, r.rdata[:2]...)
+	case iTypeSRV:
+		rdata = append(rdata, r.rdata[:6]...)
+	}
+	for i := range r.rdataNames {
+		rdata = append(rdata, nameWire(&r.rdataNames[i])...)
+	}
+	if r.iType == iTypeSOA {
+		rdata = append(rdata, r.rdata[len(r.rdata)-20:]...)
+	}
+	return rdata
+} // buildRData()
+
+//
+// -----------------------------------------------------------------------------
+// rdataFixed()
+// -----------------------------------------------------------------------------
+// The parts of the record data that are not names, the preference of an MX
+// record, the priority, weight and port of an SRV record and the serial and
+// timers of an SOA record
+func (r *record) rdataFixed() []byte {
+	switch r.iType {
+	case iTypeMX:
+		return r.rdata[:2]
+	case iTypeSRV:
+		return r.rdata[:6]
+	case iTypeSOA:
+		return r.rdata[len(r.rdata)-20:]
+	}
+	return nil
+} // rdataFixed()
+
+//
+// -----------------------------------------------------------------------------
+// names()
+// -----------------------------------------------------------------------------
+// Every question and record owner name in the message, and the names inside
+// the record data
+func (m *message) names() []*name {
+	var l []*name
+	for i := range m.questions {
+		l = append(l, &m.questions[i].name)
+	}
+	for i := range m.records {
+		l = append(l, &m.records[i].name)
+		for j := range m.records[i].rdataNames {
+			l = append(l, &m.records[i].rdataNames[j])
+		}
+	}
+	return l
+} // names()
+
+//
+// -----------------------------------------------------------------------------
+// canPatch()
+// -----------------------------------------------------------------------------
+// Patch the new names in to a copy of the message and make sure every name in
+// it reads back the way it should.  This fails when a name that changes shares
+// a compressed label with a name that does not, or with one that changes in a
+// different way.
+func (m *message) canPatch(msg []byte, newNames map[*name][]byte) bool {
+	patched := append([]byte(nil), msg...)
+	for n, newWire := range newNames {
+		n.patch(patched, newWire)
+	}
+
+	p, err := parse(patched)
+	if err != nil {
+		return false
+	}
+	oldNames, patchedNames := m.names(), p.names()
+	if len(oldNames) != len(patchedNames) {
+		return false
+	}
+	for i, n := range oldNames {
+		expected := n.wire
+		if newWire, ok := newNames[n]; ok {
+			expected = newWire
+		}
+		if !bytes.Equal(patchedNames[i].wire, expected) {
+			return false
+		}
+	}
+	return true
+} // canPatch()
+
+//
+// -----------------------------------------------------------------------------
+// build()
+// -----------------------------------------------------------------------------
+// Write the message out again without compression, using the new names and
+// record data
+func (m *message) build(newNames map[*name][]byte, newRData map[int][]byte) []byte {
+	msg := append([]byte(nil), m.header...)
+
+	nameWire := func(n *name) []byte {
+		if newWire, ok := newNames[n]; ok {
+			return newWire
+		}
+		return n.wire
+	}
+
+	for i := range m.questions {
+		msg = append(msg, nameWire(&m.questions[i].name)...)
+		msg = append(msg, m.questions[i].fixed...)
+	}
+
+	for i := range m.records {
+		r := &m.records[i]
+		rdata := r.buildRData(nameWire)
+		if newAddress, ok := newRData[i]; ok {
+			rdata = newAddress
+		}
+
+		msg = append(msg, nameWire(&r.name)...)
+		msg = append(msg, r.fixed...)
+		msg = append(msg, byte(len(rdata)>>8), byte(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return append(msg, m.trailer...)
+} // build()
+
+//
+// -----------------------------------------------------------------------------
+// patch()
+// -----------------------------------------------------------------------------
+// Write a new name with the same label lengths over the labels of the old one
+func (n *name) patch(msg []byte, newWire []byte) {
+	iWire := 0
+	for _, iOffset := range n.labelOffsets {
+		iLength := int(newWire[iWire]) + 1
+		copy(msg[iOffset:iOffset+iLength], newWire[iWire:iWire+iLength])
+		iWire += iLength
+	}
+} // patch()
+
+//
+// -----------------------------------------------------------------------------
+// sameLabels()
+// -----------------------------------------------------------------------------
+// Report if two names in wire form have labels of the same lengths
+func sameLabels(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i += int(a[i]) + 1 {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+} // sameLabels()
+
+// encodeName turns a name with dots between the labels in to wire form, nil is
+// returned if a label or the name is too long
+func encodeName(sName string) []byte {
+	var wire []byte
+	for _, sLabel := range strings.Split(strings.TrimSuffix(sName, "."), ".") {
+		if sLabel == "" || len(sLabel) > 63 {
+			return nil
+		}
+		wire = append(wire, byte(len(sLabel)))
+		wire = append(wire, sLabel...)
+	}
+	if len(wire)+1 > 255 {
+		return nil
+	}
+	return append(wire, 0)
+}
+
+// formatName shows a name in wire form with dots between the labels
+func formatName(wire []byte) string {
+	var labels []string
+	for i := 0; i < len(wire) && wire[i] != 0; i += int(wire[i]) + 1 {
+		labels = append(labels, string(wire[i+1:i+1+int(wire[i])]))
+	}
+	return strings.Join(labels, ".") + "."
+}
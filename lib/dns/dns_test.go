@@ -0,0 +1,246 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/domain"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"net"
+	"testing"
+)
+
+var ipv4AddressNew = net.IP{2, 2, 2, 2}
+var ipv6AddressNew = net.ParseIP("2001:db8::99")
+
+var rules = &Rules{Addresses: []Mapping{
+	{Old: pcaptest.IPv4AddressA.To4(), New: ipv4AddressNew},
+	{Old: pcaptest.IPv6AddressA, New: ipv6AddressNew},
+}}
+
+var domainRules = &Rules{Domains: &domain.Rules{Mappings: []domain.Mapping{
+	{Old: "example.com", New: "customer.test"},
+	{Old: "example.org", New: "example.net"},
+	{Old: "www.example.org", New: "www.example.biz"},
+}}}
+
+// rebuiltResponse builds a response with one answer the way a rebuilt message
+// looks, without compression
+func rebuiltResponse(sName string, iType uint16, rdata []byte) []byte {
+	msg := pcaptest.DNSQuery(sName, iType)
+	msg[2], msg[3], msg[7] = 0x81, 0x80, 1
+	msg = append(msg, pcaptest.DNSName(sName)...)
+	msg = append(msg, byte(iType>>8), byte(iType), 0, 1, 0, 0, 0x0e, 0x10, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(msg, rdata...)
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip    []byte
+		sName string
+	}{
+		{pcaptest.IPv4AddressA.To4(), "32.2.0.10.in-addr.arpa"},
+		{pcaptest.IPv6AddressA, "2.3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for _, tt := range tests {
+		if name := ReverseName(tt.ip); !bytes.Equal(name, pcaptest.DNSName(tt.sName)) {
+			t.Errorf("Expected %s, got %s", tt.sName, formatName(name))
+		}
+	}
+}
+
+func TestRewriteMessage(t *testing.T) {
+	ptrResponse := pcaptest.DNSResponse("32.2.0.10.in-addr.arpa", 12, pcaptest.DNSName("host.example.com"))
+	ptrNewResponse := rebuiltResponse("2.2.2.2.in-addr.arpa", 12, pcaptest.DNSName("host.example.com"))
+
+	// The same length names keep their compression
+	ptrSameLength := pcaptest.DNSResponse("32.2.0.10.in-addr.arpa", 12, pcaptest.DNSName("host.example.com"))
+	sameLengthRules := &Rules{Addresses: []Mapping{{Old: pcaptest.IPv4AddressA.To4(), New: []byte{10, 0, 2, 99}}}}
+
+	// A CNAME whose data points in to the question name, the two names change
+	// in different ways so the shared labels can not be patched
+	cname := pcaptest.DNSResponse("www.example.org", 5, []byte{3, 'c', 'd', 'n', 0xc0, 16})
+	cnameRebuilt := rebuiltResponse("www.example.biz", 5, pcaptest.DNSName("cdn.example.net"))
+
+	tests := []struct {
+		name         string
+		msg          []byte
+		rules        *Rules
+		bAllowResize bool
+		expected     []byte
+		iChanges     int
+		bError       bool
+	}{
+		{"A", pcaptest.DNSResponse("www.example.com", 1, pcaptest.IPv4AddressA.To4()), rules, true, pcaptest.DNSResponse("www.example.com", 1, ipv4AddressNew), 1, false},
+		{"AAAA", pcaptest.DNSResponse("www.example.com", 28, pcaptest.IPv6AddressA), rules, false, pcaptest.DNSResponse("www.example.com", 28, ipv6AddressNew), 1, false},
+		{"other address", pcaptest.DNSResponse("www.example.com", 1, pcaptest.IPv4AddressB.To4()), rules, true, pcaptest.DNSResponse("www.example.com", 1, pcaptest.IPv4AddressB.To4()), 0, false},
+		{"PTR query", pcaptest.DNSQuery("32.2.0.10.in-addr.arpa", 12), rules, true, pcaptest.DNSQuery("2.2.2.2.in-addr.arpa", 12), 1, false},
+		{"PTR response", ptrResponse, rules, true, ptrNewResponse, 2, false},
+		{"PTR no resize", pcaptest.DNSQuery("32.2.0.10.in-addr.arpa", 12), rules, false, pcaptest.DNSQuery("32.2.0.10.in-addr.arpa", 12), 0, false},
+		{"PTR same length", ptrSameLength, sameLengthRules, false, pcaptest.DNSResponse("99.2.0.10.in-addr.arpa", 12, pcaptest.DNSName("host.example.com")), 2, false},
+		{"IPv6 PTR", pcaptest.DNSQuery(formatName(ReverseName(pcaptest.IPv6AddressA)), 12), rules, false, pcaptest.DNSQuery(formatName(ReverseName(ipv6AddressNew)), 12), 1, false},
+		{"upper case", pcaptest.DNSQuery("32.2.0.10.IN-ADDR.ARPA", 12), rules, true, pcaptest.DNSQuery("2.2.2.2.in-addr.arpa", 12), 1, false},
+		{"domain", pcaptest.DNSResponse("www.example.com", 1, pcaptest.IPv4AddressA.To4()), domainRules, true, rebuiltResponse("www.customer.test", 1, pcaptest.IPv4AddressA.To4()), 2, false},
+		{"domain no resize", pcaptest.DNSQuery("www.example.com", 1), domainRules, false, pcaptest.DNSQuery("www.example.com", 1), 0, false},
+		{"domain same length", pcaptest.DNSResponse("Mail.Example.Org", 1, pcaptest.IPv4AddressA.To4()), domainRules, false, pcaptest.DNSResponse("Mail.example.net", 1, pcaptest.IPv4AddressA.To4()), 2, false},
+		{"domain in record data", pcaptest.DNSResponse("32.2.0.10.in-addr.arpa", 12, pcaptest.DNSName("host.example.org")), domainRules, false, pcaptest.DNSResponse("32.2.0.10.in-addr.arpa", 12, pcaptest.DNSName("host.example.net")), 1, false},
+		{"shared labels", cname, domainRules, true, cnameRebuilt, 3, false},
+		{"shared labels no resize", cname, domainRules, false, cname, 0, false},
+		{"short", []byte{0x12, 0x34, 0x01}, rules, true, nil, 0, true},
+		{"cut short", pcaptest.DNSResponse("www.example.com", 1, pcaptest.IPv4AddressA.To4())[:40], rules, true, nil, 0, true},
+		{"pointer loop", []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 1, 0, 1}, rules, true, nil, 0, true},
+	}
+
+	for _, tt := range tests {
+		msg, iChanges, err := RewriteMessage(tt.msg, tt.rules, tt.bAllowResize)
+		if tt.bError {
+			if !errors.Is(err, ErrBadMessage) {
+				t.Errorf("%s: expected a bad message error, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if iChanges != tt.iChanges {
+			t.Errorf("%s: expected %d changes, got %d", tt.name, tt.iChanges, iChanges)
+		}
+		if !bytes.Equal(msg, tt.expected) {
+			t.Errorf("%s: expected\n%x\ngot\n%x", tt.name, tt.expected, msg)
+		}
+	}
+}
+
+func TestRewriteTCPPayload(t *testing.T) {
+	msg := pcaptest.DNSResponse("www.example.com", 1, pcaptest.IPv4AddressA.To4())
+	payload := append([]byte{0, byte(len(msg))}, msg...)
+	payload = append(payload, payload...)
+
+	// The second copy is cut short so it is left alone
+	payload = payload[:len(payload)-4]
+	expected := append([]byte(nil), payload...)
+	copy(expected[2:], pcaptest.DNSResponse("www.example.com", 1, ipv4AddressNew))
+
+	newPayload, iChanges, err := RewriteTCPPayload(payload, rules)
+	if err != nil || iChanges != 1 {
+		t.Fatalf("Expected 1 change, got %d (%v)", iChanges, err)
+	}
+	if !bytes.Equal(newPayload, expected) {
+		t.Errorf("Expected\n%x\ngot\n%x", expected, newPayload)
+	}
+
+	// A message that changes length gets a new length in front of it
+	longer := rebuiltResponse("www.customer.test", 1, pcaptest.IPv4AddressA.To4())
+	payload = append([]byte{0, byte(len(msg))}, msg...)
+	expected = append([]byte{0, byte(len(longer))}, longer...)
+	newPayload, iChanges, err = RewriteTCPPayload(payload, domainRules)
+	if err != nil || iChanges != 2 {
+		t.Fatalf("Expected 2 changes, got %d (%v)", iChanges, err)
+	}
+	if !bytes.Equal(newPayload, expected) {
+		t.Errorf("Expected\n%x\ngot\n%x", expected, newPayload)
+	}
+	if differences, err := CompareTCPPayloads(payload, newPayload, domainRules); err != nil || len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v (%v)", differences, err)
+	}
+}
+
+func TestCompareMessages(t *testing.T) {
+	original := pcaptest.DNSResponse("32.2.0.10.in-addr.arpa", 12, pcaptest.DNSName("host.example.com"))
+	rewritten, _, err := RewriteMessage(append([]byte(nil), original...), rules, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rebuilt message has no compression but says the same thing
+	if differences, err := CompareMessages(original, rewritten, rules); err != nil || len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v (%v)", differences, err)
+	}
+
+	// Without the rules the names are different
+	if differences, err := CompareMessages(original, rewritten, &Rules{}); err != nil || len(differences) != 2 {
+		t.Errorf("Expected 2 differences, got %v (%v)", differences, err)
+	}
+
+	// Names in the record data follow the domain rules
+	original = pcaptest.DNSResponse("32.2.0.10.in-addr.arpa", 12, pcaptest.DNSName("host.example.com"))
+	rewritten, _, err = RewriteMessage(append([]byte(nil), original...), domainRules, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if differences, err := CompareMessages(original, rewritten, domainRules); err != nil || len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v (%v)", differences, err)
+	}
+	if differences, err := CompareMessages(original, rewritten, rules); err != nil || len(differences) != 1 {
+		t.Errorf("Expected 1 difference, got %v (%v)", differences, err)
+	}
+
+	// A TTL change is never allowed
+	changed := append([]byte(nil), original...)
+	changed[len(changed)-len(pcaptest.DNSName("host.example.com"))-3]++
+	if differences, err := CompareMessages(original, changed, rules); err != nil || len(differences) != 1 {
+		t.Errorf("Expected 1 difference, got %v (%v)", differences, err)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	for _, p := range pcaptest.Corpus() {
+		f, err := frame.Parse(p.Data, layers.LinkTypeEthernet)
+		if err != nil {
+			continue
+		}
+
+		iStart, iEnd, bTCP := Locate(f)
+		switch p.Name {
+		case "dns-a", "dns-aaaa", "dns-ptr-query", "dns-ptr":
+			if iStart < 0 || bTCP {
+				t.Errorf("%s: expected a UDP DNS message", p.Name)
+				continue
+			}
+			if _, err := parse(p.Data[iStart:iEnd]); err != nil {
+				t.Errorf("%s: unexpected error %v", p.Name, err)
+			}
+		case "dns-tcp":
+			if iStart < 0 || !bTCP || iEnd-iStart != len(pcaptest.DNSResponse("www.example.com", 1, pcaptest.IPv4AddressA.To4()))+2 {
+				t.Errorf("%s: expected a TCP DNS message, got %d to %d", p.Name, iStart, iEnd)
+			}
+		default:
+			if iStart >= 0 {
+				t.Errorf("%s: did not expect a DNS message", p.Name)
+			}
+		}
+	}
+}
+
+func FuzzRewriteMessage(f *testing.F) {
+	f.Add(pcaptest.DNSResponse("www.example.com", 1, pcaptest.IPv4AddressA.To4()))
+	f.Add(pcaptest.DNSResponse("32.2.0.10.in-addr.arpa", 12, pcaptest.DNSName("host.example.com")))
+	f.Add(pcaptest.DNSQuery("32.2.0.10.in-addr.arpa", 12))
+	f.Add(pcaptest.DNSResponse("www.example.org", 5, []byte{3, 'c', 'd', 'n', 0xc0, 16}))
+	allRules := &Rules{Addresses: rules.Addresses, Domains: domainRules.Domains}
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		for _, bAllowResize := range []bool{true, false} {
+			original := append([]byte(nil), msg...)
+			rewritten, _, err := RewriteMessage(append([]byte(nil), msg...), allRules, bAllowResize)
+			if err != nil {
+				return
+			}
+
+			// Whatever was rewritten has to parse again and only differ where
+			// the rules allow
+			differences, err := CompareMessages(original, rewritten, allRules)
+			if err != nil || len(differences) != 0 {
+				t.Errorf("Rewritten message does not match: %v (%v)", differences, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,329 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package domain changes host and domain names to new ones.  A rule for a domain
+// also covers every name below it, so example.com=example.net turns
+// www.example.com in to www.example.net.  The names in HTTP Host headers and in
+// the server name extension of a TLS ClientHello are rewritten here, the DNS
+// package uses the same rules for the names in DNS messages.
+package domain
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+var iDebug = 0
+
+// Mapping is a domain to replace and what to replace it with, both are in lower
+// case without a trailing dot
+type Mapping struct {
+	Old string
+	New string
+}
+
+// Rules are the domains to change
+type Rules struct {
+	Mappings []Mapping
+}
+
+// The request methods that are looked for at the start of a TCP payload
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// The TLS record and handshake values that are looked for
+const (
+	iTLSRecordHandshake      = 22
+	iTLSHandshakeClientHello = 1
+	iTLSExtensionServerName  = 0
+	iTLSServerNameHost       = 0
+)
+
+//
+// -----------------------------------------------------------------------------
+// ParseRules()
+// -----------------------------------------------------------------------------
+// This function will parse the domain mappings from the command line, they are
+// old=new pairs separated by a comma
+func ParseRules(sRules string) (*Rules, error) {
+	rules := &Rules{}
+	for _, sMapping := range strings.Split(sRules, ",") {
+		l := strings.Split(sMapping, "=")
+		if len(l) != 2 {
+			return nil, fmt.Errorf("invalid domain mapping %s, it should be old=new", sMapping)
+		}
+
+		sOld := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(l[0]), "."))
+		sNew := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(l[1]), "."))
+		if !isValidName(sOld) || !isValidName(sNew) {
+			return nil, fmt.Errorf("invalid domain mapping %s", sMapping)
+		}
+		rules.Mappings = append(rules.Mappings, Mapping{Old: sOld, New: sNew})
+
+		if iDebug == 1 {
+			fmt.Println("DEBUG: Domain", sOld, "will be changed to", sNew)
+		}
+	}
+	return rules, nil
+} // ParseRules()
+
+//
+// -----------------------------------------------------------------------------
+// Replace()
+// -----------------------------------------------------------------------------
+// This function will find the new name for a host or domain name.  The longest
+// domain that matches wins, the case of the labels in front of it is kept, and
+// a trailing dot stays where it is.  False is returned if the name does not
+// need to change.
+func (rules *Rules) Replace(sName string) (string, bool) {
+	if rules == nil {
+		return sName, false
+	}
+	sTrimmed := strings.TrimSuffix(sName, ".")
+	sLower := strings.ToLower(sTrimmed)
+
+	iBest := -1
+	for i, m := range rules.Mappings {
+		if sLower != m.Old && !strings.HasSuffix(sLower, "."+m.Old) {
+			continue
+		}
+		if iBest < 0 || len(m.Old) > len(rules.Mappings[iBest].Old) {
+			iBest = i
+		}
+	}
+	if iBest < 0 {
+		return sName, false
+	}
+
+	m := rules.Mappings[iBest]
+	sNew := sTrimmed[:len(sTrimmed)-len(m.Old)] + m.New + sName[len(sTrimmed):]
+	return sNew, !strings.EqualFold(sNew, sName)
+} // Replace()
+
+//
+// -----------------------------------------------------------------------------
+// RewriteTCPPayload()
+// -----------------------------------------------------------------------------
+// This function will change the host name in an HTTP request or a TLS
+// ClientHello at the start of a TCP segment.  The payload passed in is never
+// changed, a new one is returned along with the number of names that were
+// changed.  The new payload can be longer or shorter than the old one.
+func RewriteTCPPayload(payload []byte, rules *Rules) ([]byte, int) {
+	if newPayload, iChanges := rewriteHTTPHost(payload, rules); iChanges > 0 {
+		return newPayload, iChanges
+	}
+	return rewriteTLSServerName(payload, rules)
+} // RewriteTCPPayload()
+
+//
+// -----------------------------------------------------------------------------
+// rewriteHTTPHost()
+// -----------------------------------------------------------------------------
+// Change the Host header of the HTTP request at the start of the payload.  Only
+// the header lines that are complete in this segment are looked at, and only
+// those of the first request.  A port after the name is kept.
+func rewriteHTTPHost(payload []byte, rules *Rules) ([]byte, int) {
+	iLineEnd := bytes.Index(payload, []byte("\r\n"))
+	if iLineEnd < 0 || !isHTTPRequestLine(payload[:iLineEnd]) {
+		return payload, 0
+	}
+
+	iOffset := iLineEnd + 2
+	for {
+		iLineEnd = bytes.Index(payload[iOffset:], []byte("\r\n"))
+		if iLineEnd <= 0 {
+			return payload, 0
+		}
+		line := payload[iOffset : iOffset+iLineEnd]
+		if len(line) > 5 && bytes.EqualFold(line[:5], []byte("host:")) {
+			break
+		}
+		iOffset += iLineEnd + 2
+	}
+
+	// Find the name between the white space and any port
+	iStart := iOffset + 5
+	iEnd := iOffset + iLineEnd
+	for iStart < iEnd && (payload[iStart] == ' ' || payload[iStart] == '\t') {
+		iStart++
+	}
+	for iEnd > iStart && (payload[iEnd-1] == ' ' || payload[iEnd-1] == '\t') {
+		iEnd--
+	}
+	if iStart == iEnd || payload[iStart] == '[' {
+		return payload, 0
+	}
+	if iColon := bytes.IndexByte(payload[iStart:iEnd], ':'); iColon >= 0 {
+		iEnd = iStart + iColon
+	}
+
+	sNew, ok := rules.Replace(string(payload[iStart:iEnd]))
+	if !ok {
+		return payload, 0
+	}
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Changing HTTP Host", string(payload[iStart:iEnd]), "to", sNew)
+	}
+
+	newPayload := make([]byte, 0, len(payload)+len(sNew)-(iEnd-iStart))
+	newPayload = append(newPayload, payload[:iStart]...)
+	newPayload = append(newPayload, sNew...)
+	return append(newPayload, payload[iEnd:]...), 1
+} // rewriteHTTPHost()
+
+//
+// -----------------------------------------------------------------------------
+// rewriteTLSServerName()
+// -----------------------------------------------------------------------------
+// Change the host names in the server name extension (RFC 6066) of a TLS
+// ClientHello at the start of the payload.  The whole ClientHello has to be in
+// the first record of this segment.  The lengths of the name, the name list, the
+// extension, the extensions, the handshake and the record all change with it.
+func rewriteTLSServerName(payload []byte, rules *Rules) ([]byte, int) {
+	if len(payload) < 9 || payload[0] != iTLSRecordHandshake || payload[1] != 3 || payload[5] != iTLSHandshakeClientHello {
+		return payload, 0
+	}
+	iRecordEnd := 5 + readLength(payload[3:5])
+	iHandshakeEnd := 9 + readLength(payload[6:9])
+	if iRecordEnd > len(payload) || iHandshakeEnd > iRecordEnd {
+		return payload, 0
+	}
+
+	// Step over the version, random, session ID, cipher suites and compression
+	// methods to get to the extensions
+	iOffset := 9 + 2 + 32
+	for _, iLengthSize := range []int{1, 2, 1} {
+		if iOffset+iLengthSize > iHandshakeEnd {
+			return payload, 0
+		}
+		iOffset += iLengthSize + readLength(payload[iOffset:iOffset+iLengthSize])
+	}
+	iExtensionsAt := iOffset
+	if iExtensionsAt+2 > iHandshakeEnd || iExtensionsAt+2+readLength(payload[iExtensionsAt:iExtensionsAt+2]) > iHandshakeEnd {
+		return payload, 0
+	}
+
+	// Find the server name extension
+	iOffset = iExtensionsAt + 2
+	iExtensionsEnd := iOffset + readLength(payload[iExtensionsAt:iExtensionsAt+2])
+	iExtensionAt := -1
+	for iOffset+4 <= iExtensionsEnd {
+		iLength := readLength(payload[iOffset+2 : iOffset+4])
+		if iOffset+4+iLength > iExtensionsEnd {
+			return payload, 0
+		}
+		if readLength(payload[iOffset:iOffset+2]) == iTLSExtensionServerName {
+			iExtensionAt = iOffset
+			break
+		}
+		iOffset += 4 + iLength
+	}
+	if iExtensionAt < 0 || readLength(payload[iExtensionAt+2:iExtensionAt+4]) < 2 {
+		return payload, 0
+	}
+
+	// Collect the names in the list, they are changed from the last one to the
+	// first so the offsets of the ones in front stay the same
+	iListAt := iExtensionAt + 4
+	iListEnd := iListAt + 2 + readLength(payload[iListAt:iListAt+2])
+	if iListEnd > iExtensionAt+4+readLength(payload[iExtensionAt+2:iExtensionAt+4]) {
+		return payload, 0
+	}
+	var nameOffsets []int
+	for iOffset = iListAt + 2; iOffset+3 <= iListEnd; {
+		iLength := readLength(payload[iOffset+1 : iOffset+3])
+		if iOffset+3+iLength > iListEnd {
+			return payload, 0
+		}
+		if payload[iOffset] == iTLSServerNameHost {
+			nameOffsets = append(nameOffsets, iOffset)
+		}
+		iOffset += 3 + iLength
+	}
+
+	newPayload := payload
+	iChanges := 0
+	for i := len(nameOffsets) - 1; i >= 0; i-- {
+		iNameAt := nameOffsets[i]
+		iLength := readLength(newPayload[iNameAt+1 : iNameAt+3])
+		sOld := string(newPayload[iNameAt+3 : iNameAt+3+iLength])
+		sNew, ok := rules.Replace(sOld)
+		if !ok {
+			continue
+		}
+		if iDebug == 1 {
+			fmt.Println("DEBUG: Changing TLS server name", sOld, "to", sNew)
+		}
+
+		iDelta := len(sNew) - iLength
+		changed := make([]byte, 0, len(newPayload)+iDelta)
+		changed = append(changed, newPayload[:iNameAt+3]...)
+		changed = append(changed, sNew...)
+		changed = append(changed, newPayload[iNameAt+3+iLength:]...)
+
+		// Every length that covers the name, from the inside out
+		for _, l := range [][2]int{{iNameAt + 1, 2}, {iListAt, 2}, {iExtensionAt + 2, 2}, {iExtensionsAt, 2}, {6, 3}, {3, 2}} {
+			if !addToLength(changed[l[0]:l[0]+l[1]], iDelta) {
+				return payload, 0
+			}
+		}
+		newPayload = changed
+		iChanges++
+	}
+	return newPayload, iChanges
+} // rewriteTLSServerName()
+
+// isHTTPRequestLine checks for a request method, a target and an HTTP version
+func isHTTPRequestLine(line []byte) bool {
+	for _, sMethod := range httpMethods {
+		if bytes.HasPrefix(line, []byte(sMethod+" ")) {
+			return bytes.Contains(line, []byte(" HTTP/1."))
+		}
+	}
+	return false
+}
+
+// isValidName checks that a name from the command line is made of labels of
+// letters, digits, hyphens and underscores
+func isValidName(sName string) bool {
+	if sName == "" || len(sName) > 253 {
+		return false
+	}
+	for _, sLabel := range strings.Split(sName, ".") {
+		if sLabel == "" || len(sLabel) > 63 {
+			return false
+		}
+		for _, c := range sLabel {
+			if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// readLength reads a big endian length of one to three bytes
+func readLength(b []byte) int {
+	iLength := 0
+	for _, c := range b {
+		iLength = iLength<<8 | int(c)
+	}
+	return iLength
+}
+
+// addToLength adds iDelta to a big endian length of one to three bytes, false is
+// returned if the new length does not fit
+func addToLength(b []byte, iDelta int) bool {
+	iLength := readLength(b) + iDelta
+	if iLength < 0 || iLength >= 1<<(8*uint(len(b))) {
+		return false
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(iLength)
+		iLength >>= 8
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package domain
+
+import (
+	"bytes"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+var rules = &Rules{Mappings: []Mapping{
+	{Old: "example.com", New: "customer.test"},
+	{Old: "mail.example.com", New: "mx.test"},
+}}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		sRules   string
+		expected []Mapping
+		bError   bool
+	}{
+		{"example.com=customer.test", []Mapping{{"example.com", "customer.test"}}, false},
+		{"Example.COM.=a.test, b.example=c.test", []Mapping{{"example.com", "a.test"}, {"b.example", "c.test"}}, false},
+		{"example.com", nil, true},
+		{"example.com=", nil, true},
+		{"example..com=a.test", nil, true},
+		{"exa mple.com=a.test", nil, true},
+		{"a=b=c", nil, true},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRules(tt.sRules)
+		if tt.bError {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.sRules)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.sRules, err)
+			continue
+		}
+		if len(r.Mappings) != len(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.sRules, tt.expected, r.Mappings)
+			continue
+		}
+		for i := range tt.expected {
+			if r.Mappings[i] != tt.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tt.sRules, tt.expected, r.Mappings)
+			}
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		sName    string
+		expected string
+		bChanged bool
+	}{
+		{"example.com", "customer.test", true},
+		{"www.example.com", "www.customer.test", true},
+		{"WWW.Example.Com.", "WWW.customer.test.", true},
+		{"mail.example.com", "mx.test", true},
+		{"smtp.mail.example.com", "smtp.mx.test", true},
+		{"badexample.com", "badexample.com", false},
+		{"example.com.au", "example.com.au", false},
+		{"customer.test", "customer.test", false},
+	}
+
+	for _, tt := range tests {
+		sNew, bChanged := rules.Replace(tt.sName)
+		if sNew != tt.expected || bChanged != tt.bChanged {
+			t.Errorf("%s: expected %s %t, got %s %t", tt.sName, tt.expected, tt.bChanged, sNew, bChanged)
+		}
+	}
+}
+
+func TestRewriteHTTPHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		expected string
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "GET / HTTP/1.1\r\nHost: www.customer.test\r\n\r\n"},
+		{"port", "POST /form HTTP/1.1\r\nAccept: */*\r\nhost:example.com:8080 \r\n\r\nbody", "POST /form HTTP/1.1\r\nAccept: */*\r\nhost:customer.test:8080 \r\n\r\nbody"},
+		{"other host", "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n", "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n"},
+		{"after the headers", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\nHost: example.com\r\n", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\nHost: example.com\r\n"},
+		{"cut short", "GET / HTTP/1.1\r\nHost: example.com", "GET / HTTP/1.1\r\nHost: example.com"},
+		{"response", "HTTP/1.1 200 OK\r\nHost: example.com\r\n\r\n", "HTTP/1.1 200 OK\r\nHost: example.com\r\n\r\n"},
+		{"ipv6 literal", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		payload := []byte(tt.payload)
+		newPayload, iChanges := RewriteTCPPayload(payload, rules)
+		if string(newPayload) != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, newPayload)
+		}
+		if (iChanges == 1) != (tt.payload != tt.expected) {
+			t.Errorf("%s: wrong number of changes %d", tt.name, iChanges)
+		}
+		if string(payload) != tt.payload {
+			t.Errorf("%s: the payload passed in was changed", tt.name)
+		}
+	}
+}
+
+func TestRewriteTLSServerName(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		expected []byte
+	}{
+		{"longer", pcaptest.TLSClientHello("www.example.com"), pcaptest.TLSClientHello("www.customer.test")},
+		{"shorter", pcaptest.TLSClientHello("mail.example.com"), pcaptest.TLSClientHello("mx.test")},
+		{"other name", pcaptest.TLSClientHello("www.example.org"), pcaptest.TLSClientHello("www.example.org")},
+		{"cut short", pcaptest.TLSClientHello("www.example.com")[:60], pcaptest.TLSClientHello("www.example.com")[:60]},
+		{"not a handshake", append([]byte{23}, pcaptest.TLSClientHello("www.example.com")[1:]...), append([]byte{23}, pcaptest.TLSClientHello("www.example.com")[1:]...)},
+	}
+
+	for _, tt := range tests {
+		newPayload, iChanges := RewriteTCPPayload(tt.payload, rules)
+		if !bytes.Equal(newPayload, tt.expected) {
+			t.Errorf("%s: expected\n%x\ngot\n%x", tt.name, tt.expected, newPayload)
+		}
+		if (iChanges == 1) != !bytes.Equal(tt.payload, tt.expected) {
+			t.Errorf("%s: wrong number of changes %d", tt.name, iChanges)
+		}
+	}
+}
+
+func FuzzRewriteTCPPayload(f *testing.F) {
+	f.Add(pcaptest.TLSClientHello("www.example.com"))
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		original := append([]byte(nil), payload...)
+		newPayload, iChanges := RewriteTCPPayload(payload, rules)
+		if !bytes.Equal(payload, original) {
+			t.Error("The payload passed in was changed")
+		}
+		if iChanges == 0 && !bytes.Equal(newPayload, original) {
+			t.Error("The payload changed without a change being counted")
+		}
+	})
+}
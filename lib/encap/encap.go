@@ -0,0 +1,285 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package encap wraps packets in a VXLAN, GRE or ERSPAN tunnel, so a capture can
+// be replayed to a tool that only sees traffic that arrives that way.  The new
+// outer ethernet, IP and tunnel headers come from the rules, and the packet that
+// is wrapped is left as it is.
+package encap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/layer2"
+	"net"
+)
+
+var iDebug = 0
+
+// Mode is the kind of tunnel the packets are wrapped in
+type Mode int
+
+// The tunnels a packet can be wrapped in
+const (
+	ModeVXLAN Mode = iota + 1
+	ModeGRE
+	ModeERSPAN
+)
+
+// The default outer MAC addresses are locally administered ones
+const (
+	sDefaultSrcMac = "02:00:00:00:00:01"
+	sDefaultDstMac = "02:00:00:00:00:02"
+)
+
+// The fixed values of the outer headers
+const (
+	iVXLANPort       = 4789
+	iVXLANSourcePort = 49152
+	iGREEthernet     = 0x6558
+	iGREERSPAN       = 0x88be
+	iTTL             = 64
+)
+
+// Rules say what the outer headers look like.  The VNI is the VXLAN network
+// identifier, the GRE key if it is not 0, or the ERSPAN session ID.  The IP
+// identification and the ERSPAN sequence number go up by one for every packet,
+// so the packets have to be wrapped in the order they are written out.
+type Rules struct {
+	Mode      Mode
+	SrcMac    []byte
+	DstMac    []byte
+	SrcIP     []byte
+	DstIP     []byte
+	VNI       uint32
+	iID       uint16
+	iSequence uint32
+}
+
+//
+// -----------------------------------------------------------------------------
+// ParseRules()
+// -----------------------------------------------------------------------------
+// This function will parse the encapsulation options from the command line.  The
+// mode is vxlan, gre or erspan, the IP addresses are both IPv4 or both IPv6 and
+// have to be given, and the MAC addresses default to locally administered ones.
+func ParseRules(sMode, sSrcMac, sDstMac, sSrcIP, sDstIP string, iVNI int) (*Rules, error) {
+	rules := &Rules{}
+	switch sMode {
+	case "vxlan":
+		rules.Mode = ModeVXLAN
+	case "gre":
+		rules.Mode = ModeGRE
+	case "erspan":
+		rules.Mode = ModeERSPAN
+	default:
+		return nil, fmt.Errorf("invalid encapsulation %s, it should be vxlan, gre or erspan", sMode)
+	}
+
+	if iVNI < 0 || iVNI > 0xffffff || (rules.Mode == ModeERSPAN && iVNI > 0x3ff) {
+		return nil, fmt.Errorf("invalid VNI %d, it should be 0 to 16777215, or 0 to 1023 for an ERSPAN session", iVNI)
+	}
+	rules.VNI = uint32(iVNI)
+
+	if sSrcMac == "" {
+		sSrcMac = sDefaultSrcMac
+	}
+	if sDstMac == "" {
+		sDstMac = sDefaultDstMac
+	}
+	var err error
+	if rules.SrcMac, err = layer2.ParseSuppliedLayer2Address(sSrcMac); err != nil {
+		return nil, err
+	}
+	if rules.DstMac, err = layer2.ParseSuppliedLayer2Address(sDstMac); err != nil {
+		return nil, err
+	}
+
+	if rules.SrcIP, err = parseIP(sSrcIP); err != nil {
+		return nil, err
+	}
+	if rules.DstIP, err = parseIP(sDstIP); err != nil {
+		return nil, err
+	}
+	if len(rules.SrcIP) != len(rules.DstIP) {
+		return nil, fmt.Errorf("the outer IP addresses %s and %s are not the same version", sSrcIP, sDstIP)
+	}
+	return rules, nil
+} // ParseRules()
+
+//
+// -----------------------------------------------------------------------------
+// CheckLinkType()
+// -----------------------------------------------------------------------------
+// This function will make sure the packets of a link type can be wrapped.  An
+// ethernet frame can go in any of the tunnels, a packet that starts with its IP
+// header is given an ethernet header with the outer MAC addresses for VXLAN and
+// ERSPAN.
+func (rules *Rules) CheckLinkType(linkType layers.LinkType) error {
+	switch linkType {
+	case layers.LinkTypeEthernet, layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		return nil
+	}
+	return fmt.Errorf("packets with link type %s can not be encapsulated, only ethernet and raw IP are supported", linkType)
+} // CheckLinkType()
+
+//
+// -----------------------------------------------------------------------------
+// Encapsulate()
+// -----------------------------------------------------------------------------
+// This function will return a new ethernet frame with the packet wrapped in the
+// tunnel.  The packet is not changed.  An error wrapping common.ErrMalformedPacket
+// is returned if the packet is too big to fit in the outer IP packet, or if it
+// starts with something other than an IP header when that is what the link type
+// says.
+func (rules *Rules) Encapsulate(data []byte, linkType layers.LinkType) ([]byte, error) {
+	inner := data
+	var iProtocol uint16 = iGREEthernet
+	if linkType != layers.LinkTypeEthernet {
+		ethType, err := ipEthernetType(data)
+		if err != nil {
+			return nil, err
+		}
+		if rules.Mode == ModeGRE {
+			iProtocol = uint16(ethType)
+		} else {
+			header := make([]byte, 14, 14+len(data))
+			copy(header[0:6], rules.DstMac)
+			copy(header[6:12], rules.SrcMac)
+			header[12], header[13] = byte(ethType>>8), byte(ethType)
+			inner = append(header, data...)
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// The tunnel header
+	// ---------------------------------------------------------------------
+	var tunnel []byte
+	ipProtocol := layers.IPProtocolGRE
+	switch rules.Mode {
+	case ModeVXLAN:
+		ipProtocol = layers.IPProtocolUDP
+		tunnel = make([]byte, 16)
+		tunnel[0], tunnel[1] = byte(iVXLANSourcePort>>8), byte(iVXLANSourcePort&0xff)
+		tunnel[2], tunnel[3] = byte(iVXLANPort>>8), byte(iVXLANPort&0xff)
+		tunnel[8] = 0x08
+		tunnel[12], tunnel[13], tunnel[14] = byte(rules.VNI>>16), byte(rules.VNI>>8), byte(rules.VNI)
+	case ModeGRE:
+		tunnel = []byte{0, 0, byte(iProtocol >> 8), byte(iProtocol)}
+		if rules.VNI != 0 {
+			tunnel[0] = 0x20
+			tunnel = append(tunnel, byte(rules.VNI>>24), byte(rules.VNI>>16), byte(rules.VNI>>8), byte(rules.VNI))
+		}
+	case ModeERSPAN:
+		// GRE with a sequence number followed by an ERSPAN type II header
+		tunnel = make([]byte, 16)
+		tunnel[0] = 0x10
+		tunnel[2], tunnel[3] = byte(iGREERSPAN>>8), byte(iGREERSPAN&0xff)
+		tunnel[4], tunnel[5], tunnel[6], tunnel[7] = byte(rules.iSequence>>24), byte(rules.iSequence>>16), byte(rules.iSequence>>8), byte(rules.iSequence)
+		tunnel[8] = 0x10
+		tunnel[10], tunnel[11] = byte(rules.VNI>>8)&0x03, byte(rules.VNI)
+		rules.iSequence++
+	}
+
+	iPayloadLength := len(tunnel) + len(inner)
+	if iPayloadLength > 0xffff-40 {
+		return nil, fmt.Errorf("%w: packet of %d bytes is too big to encapsulate", common.ErrMalformedPacket, len(data))
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// The outer IP header
+	// ---------------------------------------------------------------------
+	var ipHeader []byte
+	if len(rules.SrcIP) == 4 {
+		ipHeader = make([]byte, 20)
+		iTotalLength := 20 + iPayloadLength
+		ipHeader[0] = 0x45
+		ipHeader[2], ipHeader[3] = byte(iTotalLength>>8), byte(iTotalLength)
+		ipHeader[4], ipHeader[5] = byte(rules.iID>>8), byte(rules.iID)
+		ipHeader[8] = iTTL
+		ipHeader[9] = byte(ipProtocol)
+		copy(ipHeader[12:16], rules.SrcIP)
+		copy(ipHeader[16:20], rules.DstIP)
+		iChecksum := checksum.IPv4Header(ipHeader)
+		ipHeader[10], ipHeader[11] = byte(iChecksum>>8), byte(iChecksum)
+		rules.iID++
+	} else {
+		ipHeader = make([]byte, 40)
+		ipHeader[0] = 0x60
+		ipHeader[4], ipHeader[5] = byte(iPayloadLength>>8), byte(iPayloadLength)
+		ipHeader[6] = byte(ipProtocol)
+		ipHeader[7] = iTTL
+		copy(ipHeader[8:24], rules.SrcIP)
+		copy(ipHeader[24:40], rules.DstIP)
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Put it all together, a UDP checksum is only needed over IPv6
+	// ---------------------------------------------------------------------
+	ethType := layers.EthernetTypeIPv4
+	if len(rules.SrcIP) == 16 {
+		ethType = layers.EthernetTypeIPv6
+	}
+	frame := make([]byte, 0, 14+len(ipHeader)+iPayloadLength)
+	frame = append(frame, rules.DstMac...)
+	frame = append(frame, rules.SrcMac...)
+	frame = append(frame, byte(ethType>>8), byte(ethType))
+	frame = append(frame, ipHeader...)
+	iTransport := len(frame)
+	frame = append(frame, tunnel...)
+	frame = append(frame, inner...)
+
+	if rules.Mode == ModeVXLAN {
+		segment := frame[iTransport:]
+		segment[4], segment[5] = byte(len(segment)>>8), byte(len(segment))
+		if ethType == layers.EthernetTypeIPv6 {
+			iChecksum := checksum.Transport(rules.SrcIP, rules.DstIP, layers.IPProtocolUDP, segment)
+			if iChecksum == 0 {
+				iChecksum = 0xffff
+			}
+			segment[6], segment[7] = byte(iChecksum>>8), byte(iChecksum)
+		}
+	}
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Encapsulated a packet of", len(data), "bytes in", len(frame)-len(inner), "bytes of headers")
+	}
+	return frame, nil
+} // Encapsulate()
+
+// parseIP reads one of the outer IP addresses, IPv4 addresses are kept as 4
+// bytes
+func parseIP(sAddress string) ([]byte, error) {
+	if sAddress == "" {
+		return nil, fmt.Errorf("the outer source and destination IP addresses are needed to encapsulate")
+	}
+	ip := net.ParseIP(sAddress)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid outer IP address %s", sAddress)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// ipEthernetType works out the ethernet type of a packet that starts with its IP
+// header
+func ipEthernetType(data []byte) (layers.EthernetType, error) {
+	if len(data) > 0 {
+		switch data[0] >> 4 {
+		case 4:
+			return layers.EthernetTypeIPv4, nil
+		case 6:
+			return layers.EthernetTypeIPv6, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: packet does not start with an IPv4 or IPv6 header", common.ErrMalformedPacket)
+}
@@ -0,0 +1,148 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package encap
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"github.com/jordan2175/rewritecap/lib/tunnel"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("vxlan", "", "", "192.0.2.1", "192.0.2.2", 100)
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if rules.Mode != ModeVXLAN || rules.VNI != 100 || len(rules.SrcIP) != 4 || len(rules.DstIP) != 4 {
+		t.Errorf("Wrong rules %+v", rules)
+	}
+	if !bytes.Equal(rules.SrcMac, []byte{2, 0, 0, 0, 0, 1}) || !bytes.Equal(rules.DstMac, []byte{2, 0, 0, 0, 0, 2}) {
+		t.Errorf("Expected the default MAC addresses, got % x and % x", rules.SrcMac, rules.DstMac)
+	}
+
+	tests := [][]string{
+		{"ipip", "", "", "192.0.2.1", "192.0.2.2"},
+		{"vxlan", "", "", "", "192.0.2.2"},
+		{"vxlan", "", "", "192.0.2.1", "2001:db8::1"},
+		{"gre", "00:11:22", "", "192.0.2.1", "192.0.2.2"},
+		{"gre", "", "", "192.0.2.300", "192.0.2.2"},
+	}
+	for _, test := range tests {
+		if _, err := ParseRules(test[0], test[1], test[2], test[3], test[4], 0); err == nil {
+			t.Errorf("%v: expected an error", test)
+		}
+	}
+	if _, err := ParseRules("vxlan", "", "", "192.0.2.1", "192.0.2.2", 1<<24); err == nil {
+		t.Error("Expected an error for a VNI that is too big")
+	}
+	if _, err := ParseRules("erspan", "", "", "192.0.2.1", "192.0.2.2", 1024); err == nil {
+		t.Error("Expected an error for an ERSPAN session that is too big")
+	}
+}
+
+func TestEncapsulate(t *testing.T) {
+	ethernet := pcaptest.IPv4UDP(0, []byte("hello world"))
+	tests := []struct {
+		sMode    string
+		sSrcIP   string
+		sDstIP   string
+		data     []byte
+		linkType layers.LinkType
+		inner    []byte
+	}{
+		{"vxlan", "192.0.2.1", "192.0.2.2", ethernet, layers.LinkTypeEthernet, ethernet},
+		{"vxlan", "2001:db8::1", "2001:db8::2", ethernet, layers.LinkTypeEthernet, ethernet},
+		{"gre", "192.0.2.1", "192.0.2.2", ethernet, layers.LinkTypeEthernet, ethernet},
+		{"gre", "192.0.2.1", "192.0.2.2", ethernet[14:], layers.LinkTypeRaw, ethernet[14:]},
+		{"erspan", "192.0.2.1", "192.0.2.2", ethernet, layers.LinkTypeEthernet, ethernet},
+		{"erspan", "192.0.2.1", "192.0.2.2", ethernet[14:], layers.LinkTypeRaw, nil},
+	}
+
+	for _, test := range tests {
+		rules, err := ParseRules(test.sMode, "", "", test.sSrcIP, test.sDstIP, 100)
+		if err != nil {
+			t.Fatal("Unexpected error ", err)
+		}
+		data, err := rules.Encapsulate(test.data, test.linkType)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.sMode, err)
+		}
+
+		f := pcaptest.Parse(t, data)
+		if !bytes.Equal(data[0:6], rules.DstMac) || !bytes.Equal(data[6:12], rules.SrcMac) {
+			t.Errorf("%s: wrong outer MAC addresses % x", test.sMode, data[0:12])
+		}
+		if f.IPVersion == 4 {
+			if iChecksum := checksum.IPv4Header(data[14:]); data[24] != byte(iChecksum>>8) || data[25] != byte(iChecksum) {
+				t.Errorf("%s: expected a valid IPv4 header checksum", test.sMode)
+			}
+			if iLength := int(data[16])<<8 | int(data[17]); iLength != len(data)-14 {
+				t.Errorf("%s: expected an IPv4 length of %d, got %d", test.sMode, len(data)-14, iLength)
+			}
+		} else if iLength := int(data[18])<<8 | int(data[19]); iLength != len(data)-54 {
+			t.Errorf("%s: expected an IPv6 payload length of %d, got %d", test.sMode, len(data)-54, iLength)
+		}
+		if f.IPProtocol == layers.IPProtocolUDP && f.IPVersion == 6 {
+			if iChecksum := checksum.Transport(rules.SrcIP, rules.DstIP, layers.IPProtocolUDP, data[f.TransportOffset:]); iChecksum != 0 {
+				t.Errorf("%s: expected a valid UDP checksum, got 0x%04x left over", test.sMode, iChecksum)
+			}
+		}
+
+		// The tunnel has to be one that can be found again
+		_, inner := tunnel.Inner(f)
+		if inner == nil {
+			t.Errorf("%s: expected to find the packet inside the tunnel", test.sMode)
+			continue
+		}
+		if test.inner != nil && !bytes.Equal(inner.Data, test.inner) {
+			t.Errorf("%s: expected the inner packet\n% x\ngot\n% x", test.sMode, test.inner, inner.Data)
+		}
+
+		// ERSPAN gives an IP packet an ethernet header with the outer addresses
+		if test.inner == nil && (!bytes.Equal(inner.Data[14:], test.data) || !bytes.Equal(inner.Data[0:12], data[0:12])) {
+			t.Errorf("%s: expected the IP packet with an ethernet header, got\n% x", test.sMode, inner.Data)
+		}
+	}
+}
+
+func TestEncapsulateSequence(t *testing.T) {
+	rules, err := ParseRules("erspan", "", "", "192.0.2.1", "192.0.2.2", 5)
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	ethernet := pcaptest.IPv4UDP(0, []byte("hello world"))
+	for i := 0; i < 3; i++ {
+		data, err := rules.Encapsulate(ethernet, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal("Unexpected error ", err)
+		}
+		if data[18] != 0 || data[19] != byte(i) || data[41] != byte(i) {
+			t.Errorf("Packet %d: expected IP identification and GRE sequence %d, got %d and %d", i, i, data[19], data[41])
+		}
+		if iSession := int(data[44]&0x03)<<8 | int(data[45]); iSession != 5 {
+			t.Errorf("Packet %d: expected ERSPAN session 5, got %d", i, iSession)
+		}
+	}
+}
+
+func TestEncapsulateNotIP(t *testing.T) {
+	rules, err := ParseRules("gre", "", "", "192.0.2.1", "192.0.2.2", 0)
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, err := rules.Encapsulate([]byte{0x00, 0x01, 0x02}, layers.LinkTypeRaw); !errors.Is(err, common.ErrMalformedPacket) {
+		t.Errorf("Expected a malformed packet error, got %v", err)
+	}
+	if err := rules.CheckLinkType(layers.LinkTypeLinuxSLL); err == nil {
+		t.Error("Expected an error for a Linux cooked capture")
+	}
+}
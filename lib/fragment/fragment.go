@@ -0,0 +1,327 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package fragment puts fragmented IPv4 and IPv6 datagrams back together so the
+// rest of the packet can be rewritten, and splits them up again on the way out,
+// either at the boundaries of the original fragments or to fit an MTU.  IPv4
+// fragments follow RFC 791, IPv6 fragments carry a fragment header (RFC 8200).
+package fragment
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/pppoe"
+)
+
+var iDebug = 0
+
+// The flags and fragment offset of an IPv4 header
+const (
+	iIPv4FlagDF         = 0x4000
+	iIPv4FlagMF         = 0x2000
+	iIPv4FragmentOffset = 0x1fff
+)
+
+// Piece is one fragment of a datagram, where its data goes in the part of the
+// datagram that is fragmented and when it was captured
+type Piece struct {
+	Offset      int
+	Length      int
+	CaptureInfo gopacket.CaptureInfo
+}
+
+//
+// -----------------------------------------------------------------------------
+// Split()
+// -----------------------------------------------------------------------------
+// This function will split an IP packet in to fragments, one for each piece.
+// Whatever comes before the IP header is copied to every fragment.  An IPv4
+// fragment after the first only keeps the options that have the copied flag set,
+// and a packet that already is a fragment keeps its offset and more fragments
+// flag.  An IPv6 fragment gets a fragment header with the identification after
+// the hop-by-hop and routing headers.  When the packet grew after it was put
+// back together the fragment that ends last takes the rest, when it shrank the
+// pieces past the end are left out and are nil in the list that is returned.
+// The offsets of the pieces have to be multiples of 8.
+func Split(f *frame.Frame, pieces []Piece, iID uint32) [][]byte {
+	iIPEnd, _ := IPEnd(f)
+	if iIPEnd < 0 || len(pieces) == 0 {
+		return nil
+	}
+
+	// Find where the fragmented part of the packet starts
+	iStart, iNextHeaderField := 0, 0
+	iBaseOffset, bMoreFragments := 0, false
+	var laterHeader []byte
+	if f.IPVersion == 4 {
+		ipHeader := f.Data[f.NetworkOffset:]
+		iHeaderLength := int(ipHeader[0]&0x0f) * 4
+		if iHeaderLength < 20 || f.NetworkOffset+iHeaderLength > iIPEnd {
+			return nil
+		}
+		iStart = f.NetworkOffset + iHeaderLength
+		iFlags := int(ipHeader[6])<<8 | int(ipHeader[7])
+		iBaseOffset, bMoreFragments = (iFlags&iIPv4FragmentOffset)*8, iFlags&iIPv4FlagMF != 0
+		laterHeader = append(append([]byte(nil), f.Data[:f.NetworkOffset]...), copiedOptions(ipHeader[:iHeaderLength])...)
+	} else if f.IPVersion == 6 {
+		iStart, iNextHeaderField = unfragmentable(f.Data, f.NetworkOffset)
+		if iStart < 0 || iStart > iIPEnd {
+			return nil
+		}
+	} else {
+		return nil
+	}
+
+	data := f.Data[iStart:iIPEnd]
+	if f.IPVersion == 4 && (iBaseOffset+len(data))/8 > iIPv4FragmentOffset {
+		return nil
+	}
+	iLastEnd := 0
+	for _, piece := range pieces {
+		if piece.Offset+piece.Length > iLastEnd {
+			iLastEnd = piece.Offset + piece.Length
+		}
+	}
+
+	packets := make([][]byte, len(pieces))
+	for i, piece := range pieces {
+		if piece.Offset > 0 && piece.Offset >= len(data) {
+			continue
+		}
+		iEnd := piece.Offset + piece.Length
+		if iEnd >= iLastEnd || iEnd > len(data) {
+			iEnd = len(data)
+		}
+		bMore := iEnd < len(data) || bMoreFragments
+
+		var packet []byte
+		if f.IPVersion == 4 {
+			header := f.Data[:iStart]
+			if piece.Offset > 0 {
+				header = laterHeader
+			}
+			packet = make([]byte, 0, len(header)+iEnd-piece.Offset)
+			packet = append(packet, header...)
+			packet = append(packet, data[piece.Offset:iEnd]...)
+
+			ipHeader := packet[f.NetworkOffset:]
+			iFlags := int(ipHeader[6])<<8&iIPv4FlagDF | (iBaseOffset+piece.Offset)/8
+			if bMore {
+				iFlags |= iIPv4FlagMF
+			}
+			ipHeader[6], ipHeader[7] = byte(iFlags>>8), byte(iFlags)
+		} else {
+			iFragmentOffset := piece.Offset
+			if bMore {
+				iFragmentOffset |= 1
+			}
+			packet = make([]byte, 0, iStart+8+iEnd-piece.Offset)
+			packet = append(packet, f.Data[:iStart]...)
+			packet = append(packet, f.Data[iNextHeaderField], 0, byte(iFragmentOffset>>8), byte(iFragmentOffset))
+			packet = append(packet, byte(iID>>24), byte(iID>>16), byte(iID>>8), byte(iID))
+			packet = append(packet, data[piece.Offset:iEnd]...)
+			packet[iNextHeaderField] = byte(layers.IPProtocolIPv6Fragment)
+		}
+		FixLengths(f, packet)
+		packets[i] = packet
+	}
+	return packets
+} // Split()
+
+//
+// -----------------------------------------------------------------------------
+// MTUPieces()
+// -----------------------------------------------------------------------------
+// This function will work out the pieces an IP packet has to be split in to so
+// each fragment fits the MTU.  Every piece but the last is a multiple of 8 bytes.
+// nil is returned when the packet already fits or the MTU is too small for the
+// headers.
+func MTUPieces(f *frame.Frame, iMTU int) []Piece {
+	iIPEnd, _ := IPEnd(f)
+	if iIPEnd < 0 || iIPEnd-f.NetworkOffset <= iMTU {
+		return nil
+	}
+
+	iStart, iHeaderLength := 0, 0
+	if f.IPVersion == 4 {
+		iHeaderLength = int(f.Data[f.NetworkOffset]&0x0f) * 4
+		iStart = f.NetworkOffset + iHeaderLength
+	} else {
+		iStart, _ = unfragmentable(f.Data, f.NetworkOffset)
+		if iStart < 0 {
+			return nil
+		}
+		iHeaderLength = iStart - f.NetworkOffset + 8
+	}
+	iSize := (iMTU - iHeaderLength) &^ 7
+	if iSize < 8 || iStart > iIPEnd {
+		return nil
+	}
+
+	var pieces []Piece
+	for iOffset := 0; iOffset < iIPEnd-iStart; iOffset += iSize {
+		iLength := iSize
+		if iOffset+iLength > iIPEnd-iStart {
+			iLength = iIPEnd - iStart - iOffset
+		}
+		pieces = append(pieces, Piece{Offset: iOffset, Length: iLength})
+	}
+	return pieces
+} // MTUPieces()
+
+//
+// -----------------------------------------------------------------------------
+// IPEnd()
+// -----------------------------------------------------------------------------
+// This function will find where the IP packet ends in the frame data, leaving
+// out any ethernet padding.  Segmentation offload can leave the IPv4 total length
+// or the IPv6 payload length of a TCP packet at zero, the packet then runs to the
+// end of the data and true is returned with it.  It is -1 if the IP header or
+// the packet was cut short.
+func IPEnd(f *frame.Frame) (int, bool) {
+	if f.NetworkOffset < 0 {
+		return -1, false
+	}
+	ipHeader := f.Data[f.NetworkOffset:]
+	iEnd := -1
+	switch f.IPVersion {
+	case 4:
+		if len(ipHeader) < 20 {
+			return -1, false
+		}
+		iEnd = f.NetworkOffset + (int(ipHeader[2])<<8 | int(ipHeader[3]))
+	case 6:
+		if len(ipHeader) < 40 {
+			return -1, false
+		}
+		iEnd = f.NetworkOffset + 40 + (int(ipHeader[4])<<8 | int(ipHeader[5]))
+	default:
+		return -1, false
+	}
+
+	// A TCP header means the length can not really be zero
+	if (f.IPVersion == 4 && iEnd == f.NetworkOffset) || (f.IPVersion == 6 && iEnd == f.NetworkOffset+40 && f.TransportOffset >= 0) {
+		return len(f.Data), true
+	}
+	if iEnd > len(f.Data) {
+		return -1, false
+	}
+	return iEnd, false
+} // IPEnd()
+
+//
+// -----------------------------------------------------------------------------
+// FixLengths()
+// -----------------------------------------------------------------------------
+// This function will set the IP length and the PPPoE length of a packet that was
+// built from the frame, with the same headers in the same place, from the length
+// of its data.  The IPv4 header checksum is fixed as well.
+func FixLengths(f *frame.Frame, packet []byte) {
+	ipHeader := packet[f.NetworkOffset:]
+	if f.IPVersion == 4 {
+		ipHeader[2], ipHeader[3] = byte(len(ipHeader)>>8), byte(len(ipHeader))
+		iChecksum := checksum.IPv4Header(ipHeader)
+		ipHeader[10], ipHeader[11] = byte(iChecksum>>8), byte(iChecksum)
+	} else {
+		ipHeader[4], ipHeader[5] = byte((len(ipHeader)-40)>>8), byte(len(ipHeader)-40)
+	}
+	if iPPPoE := pppoe.Header(f); iPPPoE >= 0 && f.EthernetType == layers.EthernetTypePPPoESession {
+		iLength := len(packet) - iPPPoE - 6
+		packet[iPPPoE+4], packet[iPPPoE+5] = byte(iLength>>8), byte(iLength)
+	}
+} // FixLengths()
+
+//
+// -----------------------------------------------------------------------------
+// copiedOptions()
+// -----------------------------------------------------------------------------
+// Build the IPv4 header for the fragments after the first one, with only the
+// options that have the copied flag set.  It is padded with end of option list
+// bytes to a multiple of 4.
+func copiedOptions(header []byte) []byte {
+	later := append([]byte(nil), header[:20]...)
+	options := header[20:]
+	for i := 0; i < len(options); {
+		iType := options[i]
+		if iType == 0 {
+			break
+		}
+		if iType == 1 {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			break
+		}
+		iLength := int(options[i+1])
+		if iType&0x80 != 0 {
+			later = append(later, options[i:i+iLength]...)
+		}
+		i += iLength
+	}
+	for len(later)%4 != 0 {
+		later = append(later, 0)
+	}
+	later[0] = 0x40 | byte(len(later)/4)
+	return later
+} // copiedOptions()
+
+//
+// -----------------------------------------------------------------------------
+// unfragmentable()
+// -----------------------------------------------------------------------------
+// Find where the part of an IPv6 packet that is fragmented starts, after the
+// hop-by-hop and routing headers and any destination options that come before
+// a routing header.  The offset of the next header field that points at it is
+// returned as well.  The offset is -1 if the headers were cut short.
+func unfragmentable(data []byte, iNetworkOffset int) (int, int) {
+	iNextHeaderField := iNetworkOffset + 6
+	iOffset := iNetworkOffset + 40
+	for {
+		if len(data) < iOffset {
+			return -1, -1
+		}
+		nextHeader := layers.IPProtocol(data[iNextHeaderField])
+		bUnfragmentable := nextHeader == layers.IPProtocolIPv6HopByHop || nextHeader == layers.IPProtocolIPv6Routing
+		if nextHeader == layers.IPProtocolIPv6Destination && len(data) >= iOffset+2 {
+			bUnfragmentable = layers.IPProtocol(data[iOffset]) == layers.IPProtocolIPv6Routing
+		}
+		if !bUnfragmentable {
+			return iOffset, iNextHeaderField
+		}
+		if len(data) < iOffset+2 {
+			return -1, -1
+		}
+		iNextHeaderField = iOffset
+		iOffset += (int(data[iOffset+1]) + 1) * 8
+	}
+} // unfragmentable()
+
+//
+// -----------------------------------------------------------------------------
+// fragmentHeader()
+// -----------------------------------------------------------------------------
+// Find the fragment header of an IPv6 packet, stepping over the other extension
+// headers that can come before it.  The offset of the next header field that
+// points at it is returned as well.  The offset is -1 if there is none.
+func fragmentHeader(data []byte, iNetworkOffset int) (int, int) {
+	iNextHeaderField := iNetworkOffset + 6
+	iOffset := iNetworkOffset + 40
+	for len(data) >= iOffset+8 {
+		switch layers.IPProtocol(data[iNextHeaderField]) {
+		case layers.IPProtocolIPv6Fragment:
+			return iOffset, iNextHeaderField
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			iNextHeaderField = iOffset
+			iOffset += (int(data[iOffset+1]) + 1) * 8
+		default:
+			return -1, -1
+		}
+	}
+	return -1, -1
+} // fragmentHeader()
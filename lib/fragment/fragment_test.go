@@ -0,0 +1,89 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package fragment
+
+import (
+	"bytes"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+// payload builds a UDP payload that is different all the way through
+func payload(iLength int) []byte {
+	data := make([]byte, iLength)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestSplit(t *testing.T) {
+	for _, iVersion := range []int{4, 6} {
+		data := pcaptest.IPv4UDP(0, payload(3000))
+		iSize := 1480
+		if iVersion == 6 {
+			data = pcaptest.IPv6UDP(0, payload(3000))
+			iSize = 1448
+		}
+		f := pcaptest.Parse(t, data)
+
+		// The fragments are the ones the sender would have made
+		pieces := MTUPieces(f, 1500)
+		if len(pieces) != 3 || pieces[1].Offset != iSize || pieces[1].Length != iSize {
+			t.Fatalf("IPv%d: expected 3 pieces of %d bytes, got %v", iVersion, iSize, pieces)
+		}
+		expected := pcaptest.Fragments(iVersion, payload(3000), iSize)
+		packets := Split(f, pieces, 7)
+		if len(packets) != len(expected) {
+			t.Fatalf("IPv%d: expected %d fragments, got %d", iVersion, len(expected), len(packets))
+		}
+		for i := range packets {
+			if !bytes.Equal(packets[i], expected[i]) {
+				t.Errorf("IPv%d fragment %d: expected\n%v\ngot\n%v", iVersion, i, expected[i], packets[i])
+			}
+		}
+
+		// A packet that fits is not split
+		if pieces := MTUPieces(f, 9000); pieces != nil {
+			t.Errorf("IPv%d: did not expect pieces for a packet that fits, got %v", iVersion, pieces)
+		}
+	}
+}
+
+func TestSplitChangedLength(t *testing.T) {
+	pieces := MTUPieces(pcaptest.Parse(t, pcaptest.IPv4UDP(0, payload(3000))), 1500)
+
+	// A datagram that shrank leaves out the pieces past the end
+	packets := Split(pcaptest.Parse(t, pcaptest.IPv4UDP(0, payload(1000))), pieces, 0)
+	if len(packets) != 3 || packets[0] == nil || packets[1] != nil || packets[2] != nil {
+		t.Fatalf("Expected only the first of 3 fragments, got %v", packets)
+	}
+	if iFlags := int(packets[0][20])<<8 | int(packets[0][21]); iFlags != 0 || len(packets[0]) != 14+20+8+1000 {
+		t.Errorf("Expected the first fragment to hold the whole datagram, got flags 0x%04x and %d bytes", iFlags, len(packets[0]))
+	}
+
+	// A datagram that grew puts the rest in the last fragment
+	packets = Split(pcaptest.Parse(t, pcaptest.IPv4UDP(0, payload(3100))), pieces, 0)
+	if len(packets) != 3 || len(packets[2]) != 14+20+3108-2960 {
+		t.Fatalf("Expected the last fragment to carry the rest of the datagram, got %d fragments", len(packets))
+	}
+	if iFlags := int(packets[2][20])<<8 | int(packets[2][21]); iFlags != 2960/8 {
+		t.Errorf("Expected the last fragment at offset %d without more fragments, got 0x%04x", 2960, iFlags)
+	}
+}
+
+func TestCopiedOptions(t *testing.T) {
+	// A record route option that is not copied and a security option that is
+	header := make([]byte, 20)
+	header = append(header, 0x07, 0x07, 0x04, 0, 0, 0, 0, 0x82, 0x04, 0xab, 0xcd, 0x00)
+	header[0] = 0x40 | byte(len(header)/4)
+
+	later := copiedOptions(header)
+	if len(later) != 24 || later[0] != 0x46 || later[20] != 0x82 || later[23] != 0xcd {
+		t.Errorf("Expected only the security option to be copied, got %v", later[20:])
+	}
+}
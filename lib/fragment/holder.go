@@ -0,0 +1,76 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package fragment
+
+import (
+	"github.com/google/gopacket"
+	"time"
+)
+
+// Holder keeps the fragments of a datagram that was split again at its original
+// boundaries until the packets that were read between them are written, so the
+// new file stays in timestamp order.  The zero value is ready to use.
+type Holder struct {
+	packets []heldPacket
+}
+
+// heldPacket is a fragment that is waiting to be written
+type heldPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+//
+// -----------------------------------------------------------------------------
+// Hold()
+// -----------------------------------------------------------------------------
+// This function will keep a fragment until a packet with the same or a later
+// timestamp is written.  The fragments are kept in timestamp order, the ones
+// with the same timestamp in the order they were held.
+func (h *Holder) Hold(ci gopacket.CaptureInfo, data []byte) {
+	i := len(h.packets)
+	for i > 0 && h.packets[i-1].ci.Timestamp.After(ci.Timestamp) {
+		i--
+	}
+	h.packets = append(h.packets, heldPacket{})
+	copy(h.packets[i+1:], h.packets[i:])
+	h.packets[i] = heldPacket{ci: ci, data: data}
+} // Hold()
+
+//
+// -----------------------------------------------------------------------------
+// Release()
+// -----------------------------------------------------------------------------
+// This function will write the fragments that are due before a packet with the
+// timestamp ts, the ones with a timestamp that is not after it
+func (h *Holder) Release(ts time.Time, write func(gopacket.CaptureInfo, []byte) error) error {
+	for len(h.packets) > 0 && !h.packets[0].ci.Timestamp.After(ts) {
+		packet := h.packets[0]
+		h.packets = h.packets[1:]
+		if err := write(packet.ci, packet.data); err != nil {
+			return err
+		}
+	}
+	return nil
+} // Release()
+
+//
+// -----------------------------------------------------------------------------
+// Flush()
+// -----------------------------------------------------------------------------
+// This function will write all of the fragments that are still held, at the end
+// of the file
+func (h *Holder) Flush(write func(gopacket.CaptureInfo, []byte) error) error {
+	for len(h.packets) > 0 {
+		packet := h.packets[0]
+		h.packets = h.packets[1:]
+		if err := write(packet.ci, packet.data); err != nil {
+			return err
+		}
+	}
+	return nil
+} // Flush()
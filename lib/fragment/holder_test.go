@@ -0,0 +1,45 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package fragment
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+	"time"
+)
+
+func TestHolder(t *testing.T) {
+	var h Holder
+	var written []string
+	write := func(ci gopacket.CaptureInfo, data []byte) error {
+		written = append(written, string(data))
+		return nil
+	}
+	at := func(iSeconds int) gopacket.CaptureInfo {
+		return gopacket.CaptureInfo{Timestamp: pcaptest.StartTime.Add(time.Duration(iSeconds) * time.Second)}
+	}
+
+	// The fragments of two datagrams that were read in between each other
+	h.Hold(at(4), []byte("a2"))
+	h.Hold(at(2), []byte("b1"))
+	h.Hold(at(4), []byte("b2"))
+	if err := h.Release(at(1).Timestamp, write); err != nil || len(written) != 0 {
+		t.Fatalf("Did not expect anything to be written before the first fragment, got %v", written)
+	}
+	if err := h.Release(at(4).Timestamp, write); err != nil || len(written) != 3 {
+		t.Fatalf("Expected 3 fragments to be written, got %v", written)
+	}
+	h.Hold(at(6), []byte("c1"))
+	if err := h.Flush(write); err != nil {
+		t.Fatal(err)
+	}
+	if sWritten := fmt.Sprint(written); sWritten != "[b1 a2 b2 c1]" {
+		t.Errorf("Expected the fragments in timestamp order, got %s", sWritten)
+	}
+}
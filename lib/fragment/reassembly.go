@@ -0,0 +1,348 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package fragment
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"io"
+	"sync"
+	"time"
+)
+
+// The biggest IP packet an IPv4 total length or IPv6 payload length can describe
+const iMaxDatagram = 65535
+
+// Datagram is what is known about a datagram that was put back together, the
+// fragments it came from and the IPv6 identification
+type Datagram struct {
+	Pieces []Piece
+	ID     uint32
+}
+
+// Reassembler puts fragmented datagrams back together as the packets are read.
+// The counters say how many datagrams were put back together, how many had
+// fragments that overlap with different data, how many had last fragments that
+// do not agree on the length of the datagram and how many were not complete
+// before the timeout or the end of the file.  The fragments of the last three
+// are passed through as they are.
+type Reassembler struct {
+	Reassembled int
+	Overlaps    int
+	BadLengths  int
+	Incomplete  int
+
+	linkType  layers.LinkType
+	timeout   time.Duration
+	pending   map[string]*datagram
+	order     []*datagram
+	queue     []*queuedPacket
+	iIndex    int
+	datagrams map[int]*Datagram
+	lock      sync.Mutex
+}
+
+// datagram holds the fragments of a datagram until they are all there
+type datagram struct {
+	sKey     string
+	first    time.Time
+	packets  []*queuedPacket
+	pieces   []Piece
+	header   []byte
+	data     []byte
+	filled   []bool
+	iTotal   int
+	id       uint32
+	iVersion int
+	bDone    bool
+}
+
+// queuedPacket is a packet in the order it was read.  A fragment is held until
+// its datagram is put back together, when the first fragment is replaced by the
+// datagram and the others are left out, or until the datagram is given up on,
+// when all of them are handed on as they are.
+type queuedPacket struct {
+	data     []byte
+	ci       gopacket.CaptureInfo
+	datagram *Datagram
+	held     *datagram
+	bMerged  bool
+}
+
+//
+// -----------------------------------------------------------------------------
+// New()
+// -----------------------------------------------------------------------------
+// This function will make a reassembler for packets of the link type.  The
+// fragments of a datagram that is not complete within the timeout, measured by
+// the capture timestamps from its first fragment, are passed through as they
+// are.  Only ethernet and raw IP packets are reassembled.
+func New(linkType layers.LinkType, timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		linkType:  linkType,
+		timeout:   timeout,
+		pending:   make(map[string]*datagram),
+		datagrams: make(map[int]*Datagram),
+	}
+} // New()
+
+//
+// -----------------------------------------------------------------------------
+// Reader()
+// -----------------------------------------------------------------------------
+// This function will wrap a packet reader so that the fragments of a datagram
+// are held back and the datagram is returned in place of its first fragment once
+// the last of them was read.  The packets read after the first fragment wait
+// behind it, so everything comes out in the order it was read.  The packets are
+// counted from 0 as they are returned, which is the index Datagram needs.  The
+// reader has to be called from one goroutine.
+func (r *Reassembler) Reader(read func() ([]byte, gopacket.CaptureInfo, error)) func() ([]byte, gopacket.CaptureInfo, error) {
+	return func() ([]byte, gopacket.CaptureInfo, error) {
+		for {
+			for len(r.queue) > 0 && r.queue[0].held == nil {
+				packet := r.queue[0]
+				r.queue = r.queue[1:]
+				if packet.bMerged {
+					continue
+				}
+				if packet.datagram != nil {
+					r.lock.Lock()
+					r.datagrams[r.iIndex] = packet.datagram
+					r.lock.Unlock()
+				}
+				r.iIndex++
+				return packet.data, packet.ci, nil
+			}
+
+			data, ci, err := read()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if len(r.order) == 0 {
+					return nil, ci, err
+				}
+				r.expire(time.Time{}, true)
+				continue
+			}
+			if err != nil {
+				return nil, ci, err
+			}
+			r.expire(ci.Timestamp, false)
+			r.add(data, ci)
+		}
+	}
+} // Reader()
+
+//
+// -----------------------------------------------------------------------------
+// Datagram()
+// -----------------------------------------------------------------------------
+// This function will return the fragments a packet was put back together from,
+// by the index of the packet counted from 0 as it was returned by the reader.  It
+// is nil if the packet was not put back together.  It is safe to call from
+// another goroutine and only returns a datagram once.
+func (r *Reassembler) Datagram(iIndex int) *Datagram {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d := r.datagrams[iIndex]
+	delete(r.datagrams, iIndex)
+	return d
+} // Datagram()
+
+//
+// -----------------------------------------------------------------------------
+// add()
+// -----------------------------------------------------------------------------
+// Queue a packet that is not a fragment, or add a fragment to its datagram and
+// put the datagram together if it is now complete
+func (r *Reassembler) add(data []byte, ci gopacket.CaptureInfo) {
+	f, err := frame.Parse(data, r.linkType)
+	if err != nil || f.NetworkOffset < 0 || ci.CaptureLength < ci.Length {
+		r.pass(data, ci)
+		return
+	}
+
+	// Find the fragment, where its data starts and ends, and the header that
+	// goes in front of the datagram
+	var sKey string
+	var id uint32
+	iOffset, iStart, bMore, iHeaderEnd, iNextHeaderField := 0, -1, false, 0, -1
+	iIPEnd, _ := IPEnd(f)
+	switch f.IPVersion {
+	case 4:
+		ipHeader := data[f.NetworkOffset:]
+		iFlags := int(ipHeader[6])<<8 | int(ipHeader[7])
+		iHeaderLength := int(ipHeader[0]&0x0f) * 4
+		if iFlags&(iIPv4FlagMF|iIPv4FragmentOffset) != 0 && iHeaderLength >= 20 {
+			iOffset, bMore = (iFlags&iIPv4FragmentOffset)*8, iFlags&iIPv4FlagMF != 0
+			iStart, iHeaderEnd = f.NetworkOffset+iHeaderLength, f.NetworkOffset+iHeaderLength
+			id = uint32(ipHeader[4])<<8 | uint32(ipHeader[5])
+			sKey = fmt.Sprintf("4 %x %x %d %d", ipHeader[12:16], ipHeader[16:20], ipHeader[9], id)
+		}
+	case 6:
+		if iFragment, iField := fragmentHeader(data, f.NetworkOffset); iFragment >= 0 {
+			iFragmentOffset := int(data[iFragment+2])<<8 | int(data[iFragment+3])
+			iOffset, bMore = iFragmentOffset&^7, iFragmentOffset&1 != 0
+			iStart, iHeaderEnd, iNextHeaderField = iFragment+8, iFragment, iField
+			id = uint32(data[iFragment+4])<<24 | uint32(data[iFragment+5])<<16 | uint32(data[iFragment+6])<<8 | uint32(data[iFragment+7])
+			sKey = fmt.Sprintf("6 %x %x %d", data[f.NetworkOffset+8:f.NetworkOffset+24], data[f.NetworkOffset+24:f.NetworkOffset+40], id)
+		}
+	}
+
+	// An IPv6 atomic fragment is a whole datagram on its own
+	if iStart < 0 || iIPEnd < iStart || (iOffset == 0 && !bMore) {
+		r.pass(data, ci)
+		return
+	}
+
+	d := r.pending[sKey]
+	if d == nil {
+		d = &datagram{sKey: sKey, first: ci.Timestamp, iTotal: -1, id: id, iVersion: f.IPVersion}
+		r.pending[sKey] = d
+		r.order = append(r.order, d)
+	}
+	data = append([]byte(nil), data...)
+	packet := &queuedPacket{data: data, ci: ci, held: d}
+	d.packets = append(d.packets, packet)
+	r.queue = append(r.queue, packet)
+
+	payload := data[iStart:iIPEnd]
+	iEnd := iOffset + len(payload)
+	d.pieces = append(d.pieces, Piece{Offset: iOffset, Length: len(payload), CaptureInfo: ci})
+	if iOffset == 0 {
+		d.header = append([]byte(nil), data[:iHeaderEnd]...)
+		if f.IPVersion == 6 {
+			d.header[iNextHeaderField] = data[iHeaderEnd]
+		}
+	}
+	if !bMore {
+		if d.iTotal >= 0 && d.iTotal != iEnd {
+			r.fail(d, &r.BadLengths)
+			return
+		}
+		d.iTotal = iEnd
+	}
+	if iEnd+iHeaderEnd-f.NetworkOffset > iMaxDatagram || (d.iTotal >= 0 && len(d.data) > d.iTotal) || (d.iTotal >= 0 && iEnd > d.iTotal) {
+		r.fail(d, nil)
+		return
+	}
+
+	// Fragments may overlap as long as they agree on the data
+	if iEnd > len(d.data) {
+		d.data = append(d.data, make([]byte, iEnd-len(d.data))...)
+		d.filled = append(d.filled, make([]bool, iEnd-len(d.filled))...)
+	}
+	for i, b := range payload {
+		if d.filled[iOffset+i] && d.data[iOffset+i] != b {
+			r.fail(d, &r.Overlaps)
+			return
+		}
+		d.data[iOffset+i] = b
+		d.filled[iOffset+i] = true
+	}
+
+	if d.header == nil || d.iTotal < 0 {
+		return
+	}
+	for _, bFilled := range d.filled[:d.iTotal] {
+		if !bFilled {
+			return
+		}
+	}
+	r.complete(d)
+} // add()
+
+//
+// -----------------------------------------------------------------------------
+// complete()
+// -----------------------------------------------------------------------------
+// Put the datagram together from the header of the first fragment and the data
+// of all of them.  It takes the place and the capture info of the fragment that
+// was read first.
+func (r *Reassembler) complete(d *datagram) {
+	packet := make([]byte, 0, len(d.header)+d.iTotal)
+	packet = append(packet, d.header...)
+	packet = append(packet, d.data[:d.iTotal]...)
+
+	f, err := frame.Parse(packet, r.linkType)
+	if err != nil || f.NetworkOffset < 0 {
+		r.fail(d, nil)
+		return
+	}
+	if d.iVersion == 4 {
+		ipHeader := packet[f.NetworkOffset:]
+		ipHeader[6] &= iIPv4FlagDF >> 8
+		ipHeader[7] = 0
+	}
+	FixLengths(f, packet)
+
+	r.remove(d)
+	first := d.packets[0]
+	first.data, first.datagram = packet, &Datagram{Pieces: d.pieces, ID: d.id}
+	first.ci.CaptureLength, first.ci.Length = len(packet), len(packet)
+	for _, fragment := range d.packets[1:] {
+		fragment.bMerged = true
+	}
+	r.Reassembled++
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Put a datagram of", d.iTotal, "bytes back together from", len(d.pieces), "fragments")
+	}
+} // complete()
+
+//
+// -----------------------------------------------------------------------------
+// fail()
+// -----------------------------------------------------------------------------
+// Give up on a datagram and pass its fragments through as they are, in the
+// places they were read.  The counter for the reason is added to if there is one.
+func (r *Reassembler) fail(d *datagram, iReason *int) {
+	if iReason != nil {
+		*iReason++
+	}
+	r.remove(d)
+} // fail()
+
+//
+// -----------------------------------------------------------------------------
+// expire()
+// -----------------------------------------------------------------------------
+// Pass through the fragments of the datagrams that are older than the timeout,
+// or all of them at the end of the file
+func (r *Reassembler) expire(now time.Time, bAll bool) {
+	for len(r.order) > 0 {
+		d := r.order[0]
+		if !d.bDone && !bAll && now.Sub(d.first) <= r.timeout {
+			return
+		}
+		r.order = r.order[1:]
+		if d.bDone {
+			continue
+		}
+		r.fail(d, &r.Incomplete)
+	}
+} // expire()
+
+// remove forgets a datagram and lets its fragments go, it is taken out of the
+// order list when it comes to the front
+func (r *Reassembler) remove(d *datagram) {
+	d.bDone = true
+	if r.pending[d.sKey] == d {
+		delete(r.pending, d.sKey)
+	}
+	for _, packet := range d.packets {
+		packet.held = nil
+	}
+}
+
+// pass queues a packet that is not a fragment.  It has to be copied when it
+// waits behind a datagram, as the reader may reuse its buffer.
+func (r *Reassembler) pass(data []byte, ci gopacket.CaptureInfo) {
+	if len(r.queue) > 0 {
+		data = append([]byte(nil), data...)
+	}
+	r.queue = append(r.queue, &queuedPacket{data: data, ci: ci})
+}
@@ -0,0 +1,142 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package fragment
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"io"
+	"testing"
+	"time"
+)
+
+// readAll runs the packets through a reassembler, the seconds are the capture
+// timestamps of the packets
+func readAll(t *testing.T, r *Reassembler, packets [][]byte, seconds []int) ([][]byte, []gopacket.CaptureInfo) {
+	i := 0
+	read := r.Reader(func() ([]byte, gopacket.CaptureInfo, error) {
+		if i == len(packets) {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     pcaptest.StartTime.Add(time.Duration(seconds[i]) * time.Second),
+			CaptureLength: len(packets[i]),
+			Length:        len(packets[i]),
+		}
+		i++
+		return packets[i-1], ci, nil
+	})
+
+	var output [][]byte
+	var captureInfos []gopacket.CaptureInfo
+	for {
+		data, ci, err := read()
+		if err == io.EOF {
+			return output, captureInfos
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ci.CaptureLength != len(data) {
+			t.Errorf("Packet %d: expected a capture length of %d, got %d", len(output), len(data), ci.CaptureLength)
+		}
+		output = append(output, data)
+		captureInfos = append(captureInfos, ci)
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	fragments4 := pcaptest.Fragments(4, payload(3000), 1480)
+	fragments6 := pcaptest.Fragments(6, payload(3000), 1448)
+	other := pcaptest.IPv4TCP(0, []byte("hello"))
+
+	// Out of order and mixed with other packets, each datagram takes the place
+	// of the fragment that was read first
+	r := New(layers.LinkTypeEthernet, 30*time.Second)
+	output, captureInfos := readAll(t, r, [][]byte{fragments4[2], other, fragments6[0], fragments4[0], fragments6[1], fragments4[1], fragments6[2]}, []int{0, 1, 2, 3, 4, 5, 6})
+	if len(output) != 3 || r.Reassembled != 2 || r.Overlaps != 0 || r.BadLengths != 0 || r.Incomplete != 0 {
+		t.Fatalf("Expected 3 packets with 2 put back together, got %d packets and counters %d/%d/%d/%d", len(output), r.Reassembled, r.Overlaps, r.BadLengths, r.Incomplete)
+	}
+	if !bytes.Equal(output[0], pcaptest.IPv4UDP(0, payload(3000))) {
+		t.Error("Expected the IPv4 fragments to be put back together in to the original packet")
+	}
+	if !bytes.Equal(output[1], other) {
+		t.Error("Expected the packet that is not a fragment to come through as it is")
+	}
+	if !bytes.Equal(output[2], pcaptest.IPv6UDP(0, payload(3000))) {
+		t.Error("Expected the IPv6 fragments to be put back together in to the original packet")
+	}
+	for i, iSeconds := range []int{0, 1, 2} {
+		if ts := pcaptest.StartTime.Add(time.Duration(iSeconds) * time.Second); !captureInfos[i].Timestamp.Equal(ts) {
+			t.Errorf("Expected packet %d at %v, got %v", i, ts, captureInfos[i].Timestamp)
+		}
+	}
+
+	// The fragments are remembered once for each datagram
+	if d := r.Datagram(1); d != nil {
+		t.Errorf("Did not expect fragments for packet 1, got %v", d)
+	}
+	if d := r.Datagram(0); d == nil || len(d.Pieces) != 3 || d.Pieces[0].Offset != 2960 || d.ID != 1 {
+		t.Errorf("Expected the 3 IPv4 fragments in the order they were read, got %v", d)
+	}
+	if d := r.Datagram(2); d == nil || len(d.Pieces) != 3 || d.Pieces[2].Length != 3008-2*1448 || d.ID != 7 {
+		t.Errorf("Expected the 3 IPv6 fragments with identification 7, got %v", d)
+	}
+	if d := r.Datagram(0); d != nil {
+		t.Errorf("Did not expect the fragments to be returned twice, got %v", d)
+	}
+}
+
+func TestReassembleOverlap(t *testing.T) {
+	fragments := pcaptest.Fragments(4, payload(3000), 1480)
+
+	// A repeated fragment is fine
+	r := New(layers.LinkTypeEthernet, 30*time.Second)
+	output, _ := readAll(t, r, [][]byte{fragments[0], fragments[0], fragments[1], fragments[2]}, []int{0, 0, 0, 0})
+	if len(output) != 1 || r.Reassembled != 1 || r.Overlaps != 0 {
+		t.Errorf("Expected a repeated fragment to be put back together, got %d packets and %d overlaps", len(output), r.Overlaps)
+	}
+
+	// A fragment that overlaps with different data passes all of them through,
+	// in the places they were read
+	changed := append([]byte(nil), fragments[0]...)
+	changed[100]++
+	other := pcaptest.IPv4TCP(0, []byte("hello"))
+	r = New(layers.LinkTypeEthernet, 30*time.Second)
+	output, _ = readAll(t, r, [][]byte{fragments[0], other, changed}, []int{0, 0, 0})
+	if len(output) != 3 || r.Reassembled != 0 || r.Overlaps != 1 || r.BadLengths != 0 || r.Incomplete != 0 {
+		t.Fatalf("Expected 2 fragments passed through with 1 overlap, got %d packets and counters %d/%d/%d/%d", len(output), r.Reassembled, r.Overlaps, r.BadLengths, r.Incomplete)
+	}
+	if !bytes.Equal(output[0], fragments[0]) || !bytes.Equal(output[1], other) || !bytes.Equal(output[2], changed) {
+		t.Error("Expected the fragments to be passed through as they are")
+	}
+
+	// Two last fragments that end in different places are not an overlap
+	longer := pcaptest.Fragments(4, payload(3100), 1480)
+	r = New(layers.LinkTypeEthernet, 30*time.Second)
+	output, _ = readAll(t, r, [][]byte{fragments[2], longer[2]}, []int{0, 0})
+	if len(output) != 2 || r.Reassembled != 0 || r.Overlaps != 0 || r.BadLengths != 1 || r.Incomplete != 0 {
+		t.Fatalf("Expected 2 fragments passed through with 1 bad length, got %d packets and counters %d/%d/%d/%d", len(output), r.Reassembled, r.Overlaps, r.BadLengths, r.Incomplete)
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	fragments := pcaptest.Fragments(6, payload(3000), 1448)
+	other := pcaptest.IPv4TCP(0, []byte("hello"))
+
+	// The fragments are passed through in front of the packet that expired them
+	r := New(layers.LinkTypeEthernet, 30*time.Second)
+	output, _ := readAll(t, r, [][]byte{fragments[0], fragments[1], other, fragments[2]}, []int{0, 1, 60, 61})
+	if len(output) != 4 || r.Reassembled != 0 || r.Incomplete != 2 {
+		t.Fatalf("Expected 4 packets passed through and 2 incomplete datagrams, got %d packets and counters %d/%d/%d", len(output), r.Reassembled, r.Overlaps, r.Incomplete)
+	}
+	if !bytes.Equal(output[0], fragments[0]) || !bytes.Equal(output[2], other) || !bytes.Equal(output[3], fragments[2]) {
+		t.Error("Expected the packets in the order they were read")
+	}
+}
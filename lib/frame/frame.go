@@ -0,0 +1,559 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package frame
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/common"
+)
+
+// ErrNotSupported is returned by Parse for link types the lightweight parser
+// does not understand, these packets need to be decoded by gopacket instead
+var ErrNotSupported = errors.New("link type is not supported by the fast parser")
+
+// Frame holds the raw bytes of a packet along with the offsets of the headers
+// that we know how to rewrite.  An offset of -1 means that header was not found
+// and an IPProtocol of 0 means the IP header was cut short.  The transport offset
+// is only for TCP and UDP, ICMP and ICMPv6 have their own.  The IP payload offset
+// is where whatever the IP packet carries starts, after any IPv6 extension
+// headers, and is only found for the first fragment.  An MPLS label stack starts
+// right after the ethernet type, the network offset is where the packet under
+// the bottom label starts.  The network offset of a PPPoE session frame is the IP
+// packet after the PPPoE and PPP headers, or the PPPoE header if PPP does not
+// carry IP.
+type Frame struct {
+	Data            []byte
+	LinkType        layers.LinkType
+	EthernetType    layers.EthernetType
+	VLANOffset      int
+	MPLSLabels      int
+	NetworkOffset   int
+	IPVersion       int
+	IPProtocol      layers.IPProtocol
+	TransportOffset int
+	ICMPOffset      int
+	IPPayloadOffset int
+}
+
+//
+// -----------------------------------------------------------------------------
+// Parse()
+// -----------------------------------------------------------------------------
+// This function will find the offsets of the ethernet, 802.1Q, IPv4 / IPv6 and
+// TCP / UDP headers by looking at the raw bytes of the packet.  It does not copy
+// the data or allocate layers like gopacket does.  Only a frame that is too short
+// to hold an ethernet header is an error, anything past that which can not be
+// parsed is simply left out and will be caught by the rewrite functions if they
+// need it.  Packets that start with the IP header, like the ones carried in a
+// tunnel, use one of the raw IP link types.
+func Parse(data []byte, linkType layers.LinkType) (*Frame, error) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		return parseRaw(data, linkType), nil
+	default:
+		return nil, ErrNotSupported
+	}
+
+	ethType, i802dot1QOffset, err := ParseEthernetType(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Frame{
+		Data:            data,
+		LinkType:        linkType,
+		EthernetType:    ethType,
+		VLANOffset:      i802dot1QOffset,
+		NetworkOffset:   14 + i802dot1QOffset,
+		TransportOffset: -1,
+		ICMPOffset:      -1,
+		IPPayloadOffset: -1,
+	}
+
+	switch ethType {
+	case layers.EthernetTypeIPv4:
+		f.IPVersion = 4
+		f.parseIPv4()
+	case layers.EthernetTypeIPv6:
+		f.IPVersion = 6
+		f.parseIPv6()
+	case layers.EthernetTypeMPLSUnicast, layers.EthernetTypeMPLSMulticast:
+		f.parseMPLS()
+	case layers.EthernetTypePPPoESession:
+		f.parsePPPoE()
+	}
+	return f, nil
+} // Parse()
+
+//
+// -----------------------------------------------------------------------------
+// FromPacket()
+// -----------------------------------------------------------------------------
+// This function will build a Frame from a packet that has already been decoded
+// by gopacket, this is used for link types that Parse does not support
+func FromPacket(packet gopacket.Packet, linkType layers.LinkType) (*Frame, error) {
+	data := packet.Data()
+	f := &Frame{
+		Data:            data,
+		LinkType:        linkType,
+		NetworkOffset:   -1,
+		TransportOffset: -1,
+		ICMPOffset:      -1,
+		IPPayloadOffset: -1,
+	}
+
+	iPPPoEVersion := 0
+	if packet.LinkLayer() != nil && packet.LinkLayer().LayerType() == layers.LayerTypeEthernet {
+		ethType, i802dot1QOffset, err := ParseEthernetType(data)
+		if err != nil {
+			return nil, err
+		}
+		f.LinkType = layers.LinkTypeEthernet
+		f.EthernetType = ethType
+		f.VLANOffset = i802dot1QOffset
+		f.NetworkOffset = 14 + i802dot1QOffset
+		switch ethType {
+		case layers.EthernetTypeMPLSUnicast, layers.EthernetTypeMPLSMulticast:
+			iLabels, iEnd := MPLSStack(data, f.NetworkOffset)
+			f.MPLSLabels = iLabels
+			if iEnd >= 0 {
+				f.NetworkOffset = iEnd
+			}
+		case layers.EthernetTypePPPoESession:
+			if iVersion, iStart := PPPoEPacket(data, f.NetworkOffset); iStart >= 0 {
+				f.NetworkOffset = iStart
+				iPPPoEVersion = iVersion
+			}
+		}
+	} else if linkType == layers.LinkTypeEthernet {
+		return nil, fmt.Errorf("%w: frame is too short to hold an ethernet header", common.ErrMalformedPacket)
+	}
+
+	if packet.NetworkLayer() != nil {
+		f.NetworkOffset = offsetOf(data, packet.NetworkLayer().LayerContents())
+		switch ip := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			f.IPVersion = 4
+			f.IPProtocol = ip.Protocol
+		case *layers.IPv6:
+			f.IPVersion = 6
+			f.IPProtocol = ip.NextHeader
+		}
+	} else if f.EthernetType == layers.EthernetTypeIPv4 {
+		f.IPVersion = 4
+	} else if f.EthernetType == layers.EthernetTypeIPv6 {
+		f.IPVersion = 6
+	} else if iPPPoEVersion != 0 {
+		f.IPVersion = iPPPoEVersion
+	} else if f.MPLSLabels > 0 && f.NetworkOffset == 14+f.VLANOffset+4*f.MPLSLabels && f.NetworkOffset < len(data) {
+		// The packet under a whole MPLS label stack was cut short
+		if iVersion := int(data[f.NetworkOffset] >> 4); iVersion == 4 || iVersion == 6 {
+			f.IPVersion = iVersion
+		}
+	}
+
+	// The start of the IP payload is found the same way Parse finds it
+	ip := &Frame{Data: data, NetworkOffset: f.NetworkOffset, TransportOffset: -1, ICMPOffset: -1, IPPayloadOffset: -1}
+	if f.NetworkOffset >= 0 && f.IPVersion != 0 {
+		if f.IPVersion == 4 {
+			ip.parseIPv4()
+		} else {
+			ip.parseIPv6()
+		}
+		f.IPPayloadOffset = ip.IPPayloadOffset
+	}
+
+	// gopacket keeps a transport layer that failed to decode, so make sure the
+	// whole header is there the same way Parse does.  It also decodes the packet
+	// inside a tunnel, only a layer right after the outer IP header belongs to
+	// this frame.
+	if packet.TransportLayer() != nil && f.IPVersion != 0 {
+		if iOffset := offsetOf(data, packet.TransportLayer().LayerContents()); iOffset >= 0 && iOffset == f.IPPayloadOffset {
+			switch packet.TransportLayer().LayerType() {
+			case layers.LayerTypeTCP:
+				f.IPProtocol = layers.IPProtocolTCP
+			case layers.LayerTypeUDP:
+				f.IPProtocol = layers.IPProtocolUDP
+			}
+			f.parseTransport(iOffset)
+		}
+	} else if ip.IPProtocol == layers.IPProtocolTCP && ip.TransportOffset >= 0 && hasZeroLength(data, f.NetworkOffset, f.IPVersion) {
+		// gopacket can give up on an IP length of zero, which is what
+		// segmentation offload leaves behind
+		f.IPProtocol = layers.IPProtocolTCP
+		f.parseTransport(ip.IPPayloadOffset)
+	}
+
+	// ICMP is not a transport layer to gopacket
+	if f.IPVersion != 0 {
+		for _, icmpType := range []gopacket.LayerType{layers.LayerTypeICMPv4, layers.LayerTypeICMPv6} {
+			if l := packet.Layer(icmpType); l != nil {
+				if iOffset := offsetOf(data, l.LayerContents()); iOffset >= 0 && iOffset == f.IPPayloadOffset {
+					f.IPProtocol = layers.IPProtocolICMPv4
+					if icmpType == layers.LayerTypeICMPv6 {
+						f.IPProtocol = layers.IPProtocolICMPv6
+					}
+					f.parseTransport(iOffset)
+				}
+			}
+		}
+	}
+	return f, nil
+} // FromPacket()
+
+//
+// -----------------------------------------------------------------------------
+// ParseEthernetType()
+// -----------------------------------------------------------------------------
+// This function will find the ethernet type of the frame, stepping over any
+// 802.1Q or 802.1ad (Q-in-Q) tags.  It also returns the number of bytes the tags
+// take up so the offsets of the layer 3 and ARP data can be adjusted.
+func ParseEthernetType(data []byte) (layers.EthernetType, int, error) {
+	i802dot1QOffset := 0
+	for {
+		iEthType1 := 12 + i802dot1QOffset
+		if len(data) < iEthType1+2 {
+			return 0, 0, fmt.Errorf("%w: frame is too short to hold an ethernet type", common.ErrMalformedPacket)
+		}
+
+		ethType := layers.EthernetType(uint16(data[iEthType1])<<8 | uint16(data[iEthType1+1]))
+		if ethType != layers.EthernetTypeDot1Q && ethType != layers.EthernetTypeQinQ && ethType != 0x9100 {
+			return ethType, i802dot1QOffset, nil
+		}
+
+		// We only support single tagged and double tagged (Q-in-Q) frames
+		if i802dot1QOffset == 8 {
+			return 0, 0, fmt.Errorf("%w: frame has more than two 802.1Q tags", common.ErrMalformedPacket)
+		}
+		i802dot1QOffset += 4
+	}
+} // ParseEthernetType()
+
+//
+// -----------------------------------------------------------------------------
+// parseRaw()
+// -----------------------------------------------------------------------------
+// Find the headers of a packet that starts with its IPv4 or IPv6 header, the
+// version is taken from the header itself
+func parseRaw(data []byte, linkType layers.LinkType) *Frame {
+	f := &Frame{
+		Data:            data,
+		LinkType:        linkType,
+		NetworkOffset:   -1,
+		TransportOffset: -1,
+		ICMPOffset:      -1,
+		IPPayloadOffset: -1,
+	}
+	if len(data) == 0 {
+		return f
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		f.NetworkOffset, f.IPVersion = 0, 4
+		f.parseIPv4()
+	case 6:
+		f.NetworkOffset, f.IPVersion = 0, 6
+		f.parseIPv6()
+	}
+	return f
+} // parseRaw()
+
+//
+// -----------------------------------------------------------------------------
+// MPLSStack()
+// -----------------------------------------------------------------------------
+// This function will count the labels of the MPLS label stack that starts at
+// iOffset and find where the packet under it starts.  The end is -1 if the stack
+// was cut short before the label with the bottom of stack bit, the labels that
+// were found are still counted.
+func MPLSStack(data []byte, iOffset int) (int, int) {
+	iLabels := 0
+	for len(data) >= iOffset+4 {
+		iLabels++
+		iOffset += 4
+		if data[iOffset-2]&0x01 != 0 {
+			return iLabels, iOffset
+		}
+	}
+	return iLabels, -1
+} // MPLSStack()
+
+//
+// -----------------------------------------------------------------------------
+// PPPoEPacket()
+// -----------------------------------------------------------------------------
+// This function will look at the PPPoE session header (RFC 2516) that starts at
+// iOffset and the PPP protocol after it, which may have been compressed to one
+// byte.  If PPP carries IPv4 or IPv6 the IP version and the offset of the IP
+// packet are returned, otherwise the offset is -1.
+func PPPoEPacket(data []byte, iOffset int) (int, int) {
+	iOffset += 6
+	if len(data) < iOffset+1 {
+		return 0, -1
+	}
+
+	// A protocol with the low bit of its first byte set is only one byte long
+	iProtocol := int(data[iOffset])
+	if iProtocol&0x01 != 0 {
+		iOffset++
+	} else {
+		if len(data) < iOffset+2 {
+			return 0, -1
+		}
+		iProtocol = iProtocol<<8 | int(data[iOffset+1])
+		iOffset += 2
+	}
+
+	switch layers.PPPType(iProtocol) {
+	case layers.PPPTypeIPv4:
+		return 4, iOffset
+	case layers.PPPTypeIPv6:
+		return 6, iOffset
+	}
+	return 0, -1
+} // PPPoEPacket()
+
+//
+// -----------------------------------------------------------------------------
+// parsePPPoE()
+// -----------------------------------------------------------------------------
+// Step over the PPPoE and PPP headers to the IP packet they carry.  Anything else,
+// like LCP or IPCP, is left with the network offset on the PPPoE header.
+func (f *Frame) parsePPPoE() {
+	iVersion, iStart := PPPoEPacket(f.Data, f.NetworkOffset)
+	if iStart < 0 {
+		return
+	}
+	f.NetworkOffset = iStart
+	f.IPVersion = iVersion
+	if iVersion == 4 {
+		f.parseIPv4()
+	} else {
+		f.parseIPv6()
+	}
+} // parsePPPoE()
+
+//
+// -----------------------------------------------------------------------------
+// parseMPLS()
+// -----------------------------------------------------------------------------
+// Step over an MPLS label stack.  MPLS does not say what it carries, so like
+// everyone else the IP version is taken from the first nibble under the stack.
+// Anything else, like an ethernet pseudowire, has no IP version.
+func (f *Frame) parseMPLS() {
+	iLabels, iEnd := MPLSStack(f.Data, f.NetworkOffset)
+	f.MPLSLabels = iLabels
+	if iEnd < 0 {
+		return
+	}
+	f.NetworkOffset = iEnd
+	if len(f.Data) <= iEnd {
+		return
+	}
+
+	switch f.Data[iEnd] >> 4 {
+	case 4:
+		f.IPVersion = 4
+		f.parseIPv4()
+	case 6:
+		f.IPVersion = 6
+		f.parseIPv6()
+	}
+} // parseMPLS()
+
+//
+// -----------------------------------------------------------------------------
+// parseIPv4()
+// -----------------------------------------------------------------------------
+// Find the transport header after an IPv4 header.  Only the first fragment of a
+// packet has a transport header.
+func (f *Frame) parseIPv4() {
+	ipHeader := f.Data[f.NetworkOffset:]
+	if len(ipHeader) < 20 || ipHeader[0]>>4 != 4 {
+		return
+	}
+
+	iHeaderLength := int(ipHeader[0]&0x0f) * 4
+	if iHeaderLength < 20 || len(ipHeader) < iHeaderLength {
+		return
+	}
+
+	f.IPProtocol = layers.IPProtocol(ipHeader[9])
+	iFragmentOffset := (uint16(ipHeader[6])<<8 | uint16(ipHeader[7])) & 0x1fff
+	if iFragmentOffset != 0 {
+		return
+	}
+	f.parseTransport(f.NetworkOffset + iHeaderLength)
+} // parseIPv4()
+
+//
+// -----------------------------------------------------------------------------
+// parseIPv6()
+// -----------------------------------------------------------------------------
+// Find the transport header after an IPv6 header, stepping over any of the
+// common extension headers
+func (f *Frame) parseIPv6() {
+	if len(f.Data) < f.NetworkOffset+40 || f.Data[f.NetworkOffset]>>4 != 6 {
+		return
+	}
+
+	nextHeader := layers.IPProtocol(f.Data[f.NetworkOffset+6])
+	iOffset := f.NetworkOffset + 40
+	for {
+		switch nextHeader {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if len(f.Data) < iOffset+2 {
+				return
+			}
+			nextHeader = layers.IPProtocol(f.Data[iOffset])
+			iOffset += (int(f.Data[iOffset+1]) + 1) * 8
+		case layers.IPProtocolAH:
+			if len(f.Data) < iOffset+2 {
+				return
+			}
+			nextHeader = layers.IPProtocol(f.Data[iOffset])
+			iOffset += (int(f.Data[iOffset+1]) + 2) * 4
+		case layers.IPProtocolIPv6Fragment:
+			if len(f.Data) < iOffset+8 {
+				return
+			}
+			f.IPProtocol = layers.IPProtocol(f.Data[iOffset])
+			iFragmentOffset := (uint16(f.Data[iOffset+2])<<8 | uint16(f.Data[iOffset+3])) >> 3
+			if iFragmentOffset != 0 {
+				return
+			}
+			nextHeader = f.IPProtocol
+			iOffset += 8
+		default:
+			f.IPProtocol = nextHeader
+			f.parseTransport(iOffset)
+			return
+		}
+	}
+} // parseIPv6()
+
+//
+// -----------------------------------------------------------------------------
+// parseTransport()
+// -----------------------------------------------------------------------------
+// Record where the IP payload starts and make sure the TCP, UDP, ICMP or ICMPv6
+// header is all there before recording its offset
+func (f *Frame) parseTransport(iOffset int) {
+	if iOffset > len(f.Data) {
+		return
+	}
+	f.IPPayloadOffset = iOffset
+
+	switch f.IPProtocol {
+	case layers.IPProtocolTCP:
+		if len(f.Data) < iOffset+20 {
+			return
+		}
+		iHeaderLength := int(f.Data[iOffset+12]>>4) * 4
+		if iHeaderLength < 20 || len(f.Data) < iOffset+iHeaderLength {
+			return
+		}
+		f.TransportOffset = iOffset
+	case layers.IPProtocolUDP:
+		if len(f.Data) < iOffset+8 {
+			return
+		}
+		f.TransportOffset = iOffset
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		if len(f.Data) < iOffset+8 {
+			return
+		}
+		f.ICMPOffset = iOffset
+	}
+} // parseTransport()
+
+//
+// -----------------------------------------------------------------------------
+// Ports()
+// -----------------------------------------------------------------------------
+// Get the source and destination ports of the TCP or UDP header, these are 0 if
+// the transport header was not found
+func (f *Frame) Ports() (uint16, uint16) {
+	if f.TransportOffset < 0 {
+		return 0, 0
+	}
+	segment := f.Data[f.TransportOffset:]
+	return uint16(segment[0])<<8 | uint16(segment[1]), uint16(segment[2])<<8 | uint16(segment[3])
+} // Ports()
+
+//
+// -----------------------------------------------------------------------------
+// Payload()
+// -----------------------------------------------------------------------------
+// Find the start and end offsets of the TCP or UDP payload in the frame data.
+// Any ethernet padding after the IP packet is left out.  A start of -1 means
+// there is no transport header or the payload was cut short.
+func (f *Frame) Payload() (int, int) {
+	if f.TransportOffset < 0 || f.NetworkOffset < 0 {
+		return -1, -1
+	}
+
+	// Find where the IP packet ends
+	ipHeader := f.Data[f.NetworkOffset:]
+	iEnd := len(f.Data)
+	switch f.IPVersion {
+	case 4:
+		iEnd = f.NetworkOffset + (int(ipHeader[2])<<8 | int(ipHeader[3]))
+	case 6:
+		if iPayloadLength := int(ipHeader[4])<<8 | int(ipHeader[5]); iPayloadLength != 0 {
+			iEnd = f.NetworkOffset + 40 + iPayloadLength
+		}
+	}
+	if iEnd > len(f.Data) {
+		return -1, -1
+	}
+
+	segment := f.Data[f.TransportOffset:]
+	switch f.IPProtocol {
+	case layers.IPProtocolUDP:
+		iUDPLength := int(segment[4])<<8 | int(segment[5])
+		if iUDPLength < 8 || f.TransportOffset+iUDPLength > iEnd {
+			return -1, -1
+		}
+		return f.TransportOffset + 8, f.TransportOffset + iUDPLength
+	case layers.IPProtocolTCP:
+		iStart := f.TransportOffset + int(segment[12]>>4)*4
+		if iStart > iEnd {
+			return -1, -1
+		}
+		return iStart, iEnd
+	}
+	return -1, -1
+} // Payload()
+
+// hasZeroLength checks for an IPv4 total length or IPv6 payload length of zero
+func hasZeroLength(data []byte, iNetworkOffset, iVersion int) bool {
+	iLengthOffset := iNetworkOffset + 2
+	if iVersion == 6 {
+		iLengthOffset = iNetworkOffset + 4
+	}
+	return len(data) >= iLengthOffset+2 && data[iLengthOffset] == 0 && data[iLengthOffset+1] == 0
+}
+
+//
+// -----------------------------------------------------------------------------
+// offsetOf()
+// -----------------------------------------------------------------------------
+// gopacket layers are slices of the packet data, so the offset of a layer is
+// the difference in their capacities
+func offsetOf(data, contents []byte) int {
+	iOffset := cap(data) - cap(contents)
+	if iOffset < 0 || iOffset > len(data) {
+		return -1
+	}
+	return iOffset
+} // offsetOf()
@@ -0,0 +1,259 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package frame_test
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"net"
+	"testing"
+)
+
+// makeTCPFrame builds an 802.1Q tagged ethernet frame carrying IPv4 and TCP
+func makeTCPFrame(t testing.TB) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x68, 0xa8, 0x6d, 0x18, 0x36, 0x92},
+		DstMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	vlan := &layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 2, 32}, DstIP: net.IP{8, 8, 8, 8}}
+	tcp := &layers.TCP{SrcPort: 4000, DstPort: 80, Seq: 1000, ACK: true, Window: 1000}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, vlan, ip, tcp, gopacket.Payload([]byte("GET / HTTP/1.1\r\n\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseMatchesFromPacket(t *testing.T) {
+	data := makeTCPFrame(t)
+
+	f, err := frame.Parse(data, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal("Parse returned an error: ", err)
+	}
+
+	packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+	g, err := frame.FromPacket(packet, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal("FromPacket returned an error: ", err)
+	}
+
+	if f.VLANOffset != 4 || f.NetworkOffset != 18 || f.TransportOffset != 38 || f.IPVersion != 4 || f.IPProtocol != layers.IPProtocolTCP {
+		t.Errorf("Parse found the wrong offsets: %+v", *f)
+	}
+	if f.LinkType != g.LinkType || f.EthernetType != g.EthernetType || f.VLANOffset != g.VLANOffset ||
+		f.NetworkOffset != g.NetworkOffset || f.IPVersion != g.IPVersion ||
+		f.IPProtocol != g.IPProtocol || f.TransportOffset != g.TransportOffset || f.IPPayloadOffset != g.IPPayloadOffset {
+		t.Errorf("Parse and FromPacket do not agree: %+v != %+v", *f, *g)
+	}
+}
+
+func TestParseICMP(t *testing.T) {
+	for _, iVersion := range []int{4, 6} {
+		data := pcaptest.ICMPUnreachable(iVersion)
+		f, err := frame.Parse(data, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal("Parse returned an error: ", err)
+		}
+		packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+		g, err := frame.FromPacket(packet, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal("FromPacket returned an error: ", err)
+		}
+
+		iICMPOffset := 34
+		if iVersion == 6 {
+			iICMPOffset = 54
+		}
+		if f.ICMPOffset != iICMPOffset || f.TransportOffset != -1 {
+			t.Errorf("IPv%d: Parse found the wrong offsets: %+v", iVersion, *f)
+		}
+		if f.ICMPOffset != g.ICMPOffset || f.IPProtocol != g.IPProtocol || g.TransportOffset != -1 {
+			t.Errorf("IPv%d: Parse and FromPacket do not agree: %+v != %+v", iVersion, *f, *g)
+		}
+	}
+}
+
+func TestParseShortFrame(t *testing.T) {
+	if _, err := frame.Parse([]byte{1, 2, 3, 4, 5, 6, 7, 8}, layers.LinkTypeEthernet); err == nil {
+		t.Error("Expected an error for a runt frame")
+	}
+
+	// A truncated IPv4 header is not an error for the parser, it is just not
+	// marked as having a transport header
+	data := makeTCPFrame(t)[:30]
+	f, err := frame.Parse(data, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal("Parse returned an error: ", err)
+	}
+	if f.TransportOffset != -1 {
+		t.Error("Expected no transport header, got offset ", f.TransportOffset)
+	}
+}
+
+func TestParseNotSupported(t *testing.T) {
+	if _, err := frame.Parse(makeTCPFrame(t), layers.LinkTypeLinuxSLL); err != frame.ErrNotSupported {
+		t.Error("Expected ErrNotSupported, got ", err)
+	}
+}
+
+func TestParseRaw(t *testing.T) {
+	data := makeTCPFrame(t)[18:]
+	f, err := frame.Parse(data, layers.LinkTypeRaw)
+	if err != nil {
+		t.Fatal("Parse returned an error: ", err)
+	}
+	if f.NetworkOffset != 0 || f.IPVersion != 4 || f.IPProtocol != layers.IPProtocolTCP || f.IPPayloadOffset != 20 || f.TransportOffset != 20 {
+		t.Errorf("Parse found the wrong offsets: %+v", *f)
+	}
+
+	// Something that is not an IP header has no headers at all
+	f, err = frame.Parse([]byte{0x00, 0x01, 0x02}, layers.LinkTypeRaw)
+	if err != nil || f.NetworkOffset != -1 || f.IPVersion != 0 {
+		t.Errorf("Expected no IP header, got %+v (%v)", f, err)
+	}
+}
+
+func TestParseMPLS(t *testing.T) {
+	for _, iVersion := range []int{4, 6} {
+		data := pcaptest.MPLS(iVersion, 100, 200)
+		f, err := frame.Parse(data, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal("Parse returned an error: ", err)
+		}
+		packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+		g, err := frame.FromPacket(packet, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal("FromPacket returned an error: ", err)
+		}
+
+		if f.MPLSLabels != 2 || f.NetworkOffset != 22 || f.IPVersion != iVersion || f.IPProtocol != layers.IPProtocolUDP {
+			t.Errorf("IPv%d: Parse found the wrong offsets: %+v", iVersion, *f)
+		}
+		if f.MPLSLabels != g.MPLSLabels || f.NetworkOffset != g.NetworkOffset || f.IPVersion != g.IPVersion ||
+			f.TransportOffset != g.TransportOffset || f.IPPayloadOffset != g.IPPayloadOffset {
+			t.Errorf("IPv%d: Parse and FromPacket do not agree: %+v != %+v", iVersion, *f, *g)
+		}
+	}
+
+	// A stack that is cut short before the bottom of stack bit has no IP header
+	f, err := frame.Parse(pcaptest.MPLS(4, 100, 200)[:20], layers.LinkTypeEthernet)
+	if err != nil || f.MPLSLabels != 1 || f.IPVersion != 0 {
+		t.Errorf("Expected one label and no IP header, got %+v (%v)", f, err)
+	}
+}
+
+func TestParsePPPoE(t *testing.T) {
+	ipv4 := pcaptest.PPPoE(4, 0x1234)
+
+	// The PPP protocol can be compressed to one byte
+	compressed := append(append(append([]byte(nil), ipv4[:20]...), 0x21), ipv4[22:]...)
+	compressed[19]--
+
+	tests := []struct {
+		name           string
+		data           []byte
+		iNetworkOffset int
+		iIPVersion     int
+	}{
+		{"ipv4", ipv4, 22, 4},
+		{"ipv6", pcaptest.PPPoE(6, 0x1234), 22, 6},
+		{"compressed", compressed, 21, 4},
+	}
+	for _, tt := range tests {
+		f, err := frame.Parse(tt.data, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal("Parse returned an error: ", err)
+		}
+		packet := gopacket.NewPacket(tt.data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+		g, err := frame.FromPacket(packet, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal("FromPacket returned an error: ", err)
+		}
+
+		if f.NetworkOffset != tt.iNetworkOffset || f.IPVersion != tt.iIPVersion || f.IPProtocol != layers.IPProtocolUDP || f.TransportOffset < 0 {
+			t.Errorf("%s: Parse found the wrong offsets: %+v", tt.name, *f)
+		}
+		if f.NetworkOffset != g.NetworkOffset || f.IPVersion != g.IPVersion || f.TransportOffset != g.TransportOffset || f.IPPayloadOffset != g.IPPayloadOffset {
+			t.Errorf("%s: Parse and FromPacket do not agree: %+v != %+v", tt.name, *f, *g)
+		}
+	}
+
+	// LCP is not IP, the network offset stays on the PPPoE header
+	lcp := append([]byte(nil), ipv4...)
+	lcp[20], lcp[21] = 0xc0, 0x21
+	f, err := frame.Parse(lcp, layers.LinkTypeEthernet)
+	if err != nil || f.NetworkOffset != 14 || f.IPVersion != 0 {
+		t.Errorf("Expected no IP header, got %+v (%v)", f, err)
+	}
+}
+
+// BenchmarkParse is the fast path, run it next to BenchmarkGopacketDecode to
+// compare the packets per second of the two
+func BenchmarkParse(b *testing.B) {
+	data := makeTCPFrame(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := frame.Parse(data, layers.LinkTypeEthernet); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+// BenchmarkGopacketDecode is the original path where every layer is decoded
+func BenchmarkGopacketDecode(b *testing.B) {
+	data := makeTCPFrame(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+		if _, err := frame.FromPacket(packet, layers.LinkTypeEthernet); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(makeTCPFrame(f))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fr, err := frame.Parse(data, layers.LinkTypeEthernet)
+		if err != nil {
+			return
+		}
+		if fr.NetworkOffset > len(data) || fr.TransportOffset > len(data) {
+			t.Errorf("Offsets are past the end of the frame: %+v", *fr)
+		}
+	})
+}
+
+func TestFromPacketOffloaded(t *testing.T) {
+	// Packets from segmentation offload have an IP length of zero
+	for _, iVersion := range []int{4, 6} {
+		data := pcaptest.Offloaded(iVersion, 3000)
+		f, err := frame.Parse(data, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := frame.FromPacket(gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true}), layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.TransportOffset < 0 || f.IPProtocol != layers.IPProtocolTCP || f.TransportOffset != g.TransportOffset || f.IPProtocol != g.IPProtocol {
+			t.Errorf("IPv%d: Parse and FromPacket do not agree: %+v != %+v", iVersion, *f, *g)
+		}
+	}
+}
@@ -10,7 +10,7 @@ import (
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
-	"os"
+	"io"
 	"time"
 )
 
@@ -24,7 +24,17 @@ var iDebug = 0
 // This change will be made regardless of packet type as it is done on the
 // pcap header not the packet itself
 func ChangeTimestampDate(packet gopacket.Packet, iDiffYear, iDiffMonth, iDiffDay int) {
-	ts := packet.Metadata().CaptureInfo.Timestamp
+	ChangeCaptureInfoDate(&packet.Metadata().CaptureInfo, iDiffYear, iDiffMonth, iDiffDay)
+} //ChangeTimestampDate()
+
+//
+// -----------------------------------------------------------------------------
+// ChangeCaptureInfoDate()
+// -----------------------------------------------------------------------------
+// This does the same thing as ChangeTimestampDate but works directly on the
+// capture info for packets that were not decoded by gopacket
+func ChangeCaptureInfoDate(ci *gopacket.CaptureInfo, iDiffYear, iDiffMonth, iDiffDay int) {
+	ts := ci.Timestamp
 	if iDebug == 1 {
 		fmt.Println("DEBUG: Current timestamp", ts)
 	}
@@ -33,9 +43,8 @@ func ChangeTimestampDate(packet gopacket.Packet, iDiffYear, iDiffMonth, iDiffDay
 	if iDebug == 1 {
 		fmt.Println("DEBUG: Updated timestamp", tsNew)
 	}
-	packet.Metadata().CaptureInfo.Timestamp = tsNew
-
-} //ChangeTimestampDate()
+	ci.Timestamp = tsNew
+} // ChangeCaptureInfoDate()
 
 //
 // -----------------------------------------------------------------------------
@@ -65,6 +74,24 @@ func ComputeNeededPacketDateChange(year, month, day int, pcapStartTimestamp time
 	return
 } // ComputeNeededPacketDateChange()
 
+//
+// -----------------------------------------------------------------------------
+// ParseTimeShift()
+// -----------------------------------------------------------------------------
+// This function will parse a time shift in +/-00h00m00s format so that bad
+// values can be caught before any packets are processed
+func ParseTimeShift(sTime string) (time.Duration, error) {
+	amountOfTimeChange, err := time.ParseDuration(sTime)
+	if err != nil {
+		return 0, err
+	}
+
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Time delta", amountOfTimeChange.String())
+	}
+	return amountOfTimeChange, nil
+} // ParseTimeShift()
+
 //
 // -----------------------------------------------------------------------------
 // ChangeTimestampTimeOfDay()
@@ -72,26 +99,28 @@ func ComputeNeededPacketDateChange(year, month, day int, pcapStartTimestamp time
 // This function will adjust the time of day of the timestamp
 // This change will be made regardless of packet type as it is done on the
 // pcap header not the packet itself
-func ChangeTimestampTimeOfDay(packet gopacket.Packet, sTime string) {
-	var amountOfTimeChange time.Duration
-	var err error
-
-	if sTime != "" {
-		amountOfTimeChange, err = time.ParseDuration(sTime)
-	} else {
-		return
+func ChangeTimestampTimeOfDay(packet gopacket.Packet, sTime string) error {
+	if sTime == "" {
+		return nil
 	}
 
+	amountOfTimeChange, err := ParseTimeShift(sTime)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(0)
+		return err
 	}
 
-	if iDebug == 1 {
-		fmt.Println("DEBUG: Time delta", amountOfTimeChange.String())
-	}
+	ChangeCaptureInfoTimeOfDay(&packet.Metadata().CaptureInfo, amountOfTimeChange)
+	return nil
+} // ChangeTimestampTimeOfDay()
 
-	ts := packet.Metadata().CaptureInfo.Timestamp
+//
+// -----------------------------------------------------------------------------
+// ChangeCaptureInfoTimeOfDay()
+// -----------------------------------------------------------------------------
+// This does the same thing as ChangeTimestampTimeOfDay but works directly on the
+// capture info with a time shift that has already been parsed
+func ChangeCaptureInfoTimeOfDay(ci *gopacket.CaptureInfo, amountOfTimeChange time.Duration) {
+	ts := ci.Timestamp
 	if iDebug == 1 {
 		fmt.Println("DEBUG: Current timestamp", ts)
 	}
@@ -100,8 +129,8 @@ func ChangeTimestampTimeOfDay(packet gopacket.Packet, sTime string) {
 	if iDebug == 1 {
 		fmt.Println("DEBUG: Updated timestamp", tsNew)
 	}
-	packet.Metadata().CaptureInfo.Timestamp = tsNew
-} // ChangeTimestampTimeOfDay()
+	ci.Timestamp = tsNew
+} // ChangeCaptureInfoTimeOfDay()
 
 //
 // -----------------------------------------------------------------------------
@@ -110,19 +139,57 @@ func ChangeTimestampTimeOfDay(packet gopacket.Packet, sTime string) {
 // We need to open the pcap file and read the timestamp from the first packet so
 // that we can figure out an offset for all future packets.  This will address the
 // problem of the pcap spanning multiple days, months, years  as we will always
-// add the same amount of offset to each packet.
-func GetFirstPacketTimestamp(sFilename string) time.Time {
+// add the same amount of offset to each packet.  A file with no packets in it
+// will return the zero time.
+func GetFirstPacketTimestamp(sFilename string) (time.Time, error) {
 	handle, err := pcap.OpenOffline(sFilename)
+	if err != nil {
+		return time.Time{}, err
+	}
 	defer handle.Close()
 
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(0)
+	_, packetHeaderInfo, err := handle.ReadPacketData()
+	if err != nil && err != io.EOF {
+		return time.Time{}, err
 	}
-	_, packetHeaderInfo, _ := handle.ReadPacketData()
 	ts := packetHeaderInfo.Timestamp
 	if iDebug == 1 {
 		fmt.Println("DEBUG: Timestamp of first packet", ts)
 	}
-	return ts
+	return ts, nil
 } // GetFirstPacketTimestamp()
+
+//
+// -----------------------------------------------------------------------------
+// GetEarliestPacketTimestamp
+// -----------------------------------------------------------------------------
+// Captures that were merged by other tools or taken on a NIC with more than one
+// queue do not always have the earliest packet first.  This reads every packet
+// in the pcap file and returns the earliest timestamp, so the date of every
+// packet can be changed from where the capture really starts.  A file with no
+// packets in it will return the zero time.
+func GetEarliestPacketTimestamp(sFilename string) (time.Time, error) {
+	handle, err := pcap.OpenOffline(sFilename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer handle.Close()
+
+	var earliest time.Time
+	for {
+		_, packetHeaderInfo, err := handle.ZeroCopyReadPacketData()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		if earliest.IsZero() || packetHeaderInfo.Timestamp.Before(earliest) {
+			earliest = packetHeaderInfo.Timestamp
+		}
+	}
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Earliest timestamp", earliest)
+	}
+	return earliest, nil
+} // GetEarliestPacketTimestamp()
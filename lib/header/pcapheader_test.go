@@ -0,0 +1,121 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package header
+
+import (
+	"github.com/google/gopacket"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestComputeNeededPacketDateChange(t *testing.T) {
+	start := time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		year, month, day                int
+		iDiffYear, iDiffMonth, iDiffDay int
+	}{
+		{0, 0, 0, 0, 0, 0},
+		{2016, 3, 10, 1, -3, 9},
+		{2015, 0, 0, 0, 0, 0},
+		{0, 12, 31, 0, 6, 30},
+	}
+
+	for _, tt := range tests {
+		y, m, d := ComputeNeededPacketDateChange(tt.year, tt.month, tt.day, start)
+		if y != tt.iDiffYear || m != tt.iDiffMonth || d != tt.iDiffDay {
+			t.Errorf("%d/%d/%d: expected %d/%d/%d, got %d/%d/%d", tt.year, tt.month, tt.day, tt.iDiffYear, tt.iDiffMonth, tt.iDiffDay, y, m, d)
+		}
+	}
+}
+
+func TestParseTimeShift(t *testing.T) {
+	tests := []struct {
+		sTime  string
+		result time.Duration
+		bError bool
+	}{
+		{"2h1m3s", 2*time.Hour + time.Minute + 3*time.Second, false},
+		{"-3m", -3 * time.Minute, false},
+		{"+1h", time.Hour, false},
+		{"2 hours", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		result, err := ParseTimeShift(tt.sTime)
+		if (err != nil) != tt.bError {
+			t.Errorf("%q: expected error %t, got %v", tt.sTime, tt.bError, err)
+			continue
+		}
+		if result != tt.result {
+			t.Errorf("%q: expected %s, got %s", tt.sTime, tt.result, result)
+		}
+	}
+}
+
+func TestChangeCaptureInfo(t *testing.T) {
+	ci := gopacket.CaptureInfo{Timestamp: time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)}
+
+	ChangeCaptureInfoDate(&ci, 1, -3, 9)
+	ChangeCaptureInfoTimeOfDay(&ci, 2*time.Hour)
+	ChangeCaptureInfoTimeOfDay(&ci, -3*time.Minute)
+
+	expected := time.Date(2016, time.March, 10, 13, 57, 0, 0, time.UTC)
+	if !ci.Timestamp.Equal(expected) {
+		t.Error("Expected ", expected, " got ", ci.Timestamp)
+	}
+}
+
+func TestGetFirstPacketTimestamp(t *testing.T) {
+	sFilename := filepath.Join(t.TempDir(), "corpus.pcap")
+	if err := pcaptest.WriteFile(sFilename, pcaptest.Corpus()); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := GetFirstPacketTimestamp(sFilename)
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if !ts.Equal(pcaptest.StartTime) {
+		t.Error("Expected ", pcaptest.StartTime, " got ", ts)
+	}
+
+	if _, err := GetFirstPacketTimestamp(filepath.Join(t.TempDir(), "missing.pcap")); err == nil {
+		t.Error("Expected an error for a file that does not exist")
+	}
+}
+
+func TestGetEarliestPacketTimestamp(t *testing.T) {
+	sFilename := filepath.Join(t.TempDir(), "unsorted.pcap")
+	packets := []pcaptest.Packet{
+		{Name: "second", Data: pcaptest.IPv4UDP(0, []byte("two"))},
+		{Name: "first", Data: pcaptest.IPv4UDP(0, []byte("one"))},
+		{Name: "third", Data: pcaptest.IPv4UDP(0, []byte("three"))},
+	}
+	timestamps := []time.Time{pcaptest.StartTime.Add(time.Second), pcaptest.StartTime, pcaptest.StartTime.Add(2 * time.Second)}
+	if err := pcaptest.WriteFileAt(sFilename, packets, timestamps); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first packet is not the earliest one
+	ts, err := GetEarliestPacketTimestamp(sFilename)
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if !ts.Equal(pcaptest.StartTime) {
+		t.Error("Expected ", pcaptest.StartTime, " got ", ts)
+	}
+	if ts, _ := GetFirstPacketTimestamp(sFilename); !ts.Equal(timestamps[0]) {
+		t.Error("Expected the first packet at ", timestamps[0], " got ", ts)
+	}
+
+	if _, err := GetEarliestPacketTimestamp(filepath.Join(t.TempDir(), "missing.pcap")); err == nil {
+		t.Error("Expected an error for a file that does not exist")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package icmp rewrites the addresses in the packet that is quoted inside an
+// ICMP or ICMPv6 error message.  A destination unreachable or time exceeded
+// message carries the IP header and at least the first 8 bytes of the packet
+// that caused it, so the addresses in there have to change along with the ones
+// in the outer header or the error no longer lines up with its connection.
+package icmp
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/layer3"
+)
+
+var iDebug = 0
+
+// The ICMP error messages have a fixed 8 byte header in front of the packet
+// they quote
+const iHeaderLength = 8
+
+// The ICMP message types that quote the packet that caused them
+var icmpErrorTypes = map[byte]string{
+	3:  "destination unreachable",
+	4:  "source quench",
+	5:  "redirect",
+	11: "time exceeded",
+	12: "parameter problem",
+}
+
+// The ICMPv6 message types that quote the packet that caused them
+var icmpv6ErrorTypes = map[byte]string{
+	1: "destination unreachable",
+	2: "packet too big",
+	3: "time exceeded",
+	4: "parameter problem",
+}
+
+//
+// -----------------------------------------------------------------------------
+// Locate()
+// -----------------------------------------------------------------------------
+// This function will find an ICMP or ICMPv6 error message in the frame.  The
+// start and end offsets of the message in the frame data are returned, the
+// quoted packet starts 8 bytes in.  The end is the end of the IP packet or of the
+// data if the capture cut it short.  A start of -1 means the frame is not an
+// error message, or it was cut short before the end of the quoted IP header.
+func Locate(f *frame.Frame) (int, int) {
+	if f.ICMPOffset < 0 || f.NetworkOffset < 0 || len(f.Data) < f.ICMPOffset+iHeaderLength {
+		return -1, -1
+	}
+
+	iType := f.Data[f.ICMPOffset]
+	switch {
+	case f.IPVersion == 4 && f.IPProtocol == layers.IPProtocolICMPv4 && icmpErrorTypes[iType] != "":
+	case f.IPVersion == 6 && f.IPProtocol == layers.IPProtocolICMPv6 && icmpv6ErrorTypes[iType] != "":
+	default:
+		return -1, -1
+	}
+
+	// The message runs to the end of the IP packet, any ethernet padding after
+	// it is left out
+	ipHeader := f.Data[f.NetworkOffset:]
+	iEnd := len(f.Data)
+	switch f.IPVersion {
+	case 4:
+		if iIPEnd := f.NetworkOffset + (int(ipHeader[2])<<8 | int(ipHeader[3])); iIPEnd < iEnd {
+			iEnd = iIPEnd
+		}
+	case 6:
+		if iPayloadLength := int(ipHeader[4])<<8 | int(ipHeader[5]); iPayloadLength != 0 && f.NetworkOffset+40+iPayloadLength < iEnd {
+			iEnd = f.NetworkOffset + 40 + iPayloadLength
+		}
+	}
+	iQuotedLength := 20
+	if f.IPVersion == 6 {
+		iQuotedLength = 40
+	}
+	if iEnd < f.ICMPOffset+iHeaderLength+iQuotedLength || int(f.Data[f.ICMPOffset+iHeaderLength]>>4) != f.IPVersion {
+		return -1, -1
+	}
+	return f.ICMPOffset, iEnd
+} // Locate()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceQuotedIPv4Addresses()
+// -----------------------------------------------------------------------------
+// This function will change the source and destination addresses of the IPv4
+// header quoted in an ICMP error message.  The quoted header checksum, the TCP
+// or UDP checksum if it was quoted, and the ICMP checksum are all updated to
+// match.  The message starts at the ICMP header.
+func ReplaceQuotedIPv4Addresses(message []byte, userSuppliedIPv4Address, userSuppliedIPv4AddressNew []byte) error {
+	quoted, err := quotedHeader(message, 4, 20)
+	if err != nil {
+		return err
+	}
+	before := append([]byte(nil), message...)
+
+	if err := layer3.ReplaceIPv4HeaderAddresses(quoted, userSuppliedIPv4Address, userSuppliedIPv4AddressNew); err != nil {
+		return err
+	}
+
+	// Only the first fragment has the TCP or UDP header in it
+	iQuotedHeaderLength := int(quoted[0]&0x0f) * 4
+	iFragmentOffset := (uint16(quoted[6])<<8 | uint16(quoted[7])) & 0x1fff
+	if iFragmentOffset == 0 {
+		oldAddresses := before[iHeaderLength+12 : iHeaderLength+20]
+		checksum.UpdateTransport(quoted[iQuotedHeaderLength:], layers.IPProtocol(quoted[9]), 0, oldAddresses, quoted[12:20])
+	}
+	updateChecksum(message, before)
+	return nil
+} // ReplaceQuotedIPv4Addresses()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceQuotedIPv6Addresses()
+// -----------------------------------------------------------------------------
+// This function will change the source and destination addresses of the IPv6
+// header quoted in an ICMPv6 error message.  The TCP or UDP checksum is updated
+// if it was quoted right after the IPv6 header, and so is the ICMPv6 checksum.
+// The checksum for the outer addresses is left to the caller.  The message
+// starts at the ICMPv6 header.
+func ReplaceQuotedIPv6Addresses(message []byte, userSuppliedIPv6Address, userSuppliedIPv6AddressNew []byte) error {
+	quoted, err := quotedHeader(message, 6, 40)
+	if err != nil {
+		return err
+	}
+	before := append([]byte(nil), message...)
+
+	if err := layer3.ReplaceIPv6HeaderAddresses(quoted, userSuppliedIPv6Address, userSuppliedIPv6AddressNew); err != nil {
+		return err
+	}
+	oldAddresses := before[iHeaderLength+8 : iHeaderLength+40]
+	checksum.UpdateTransport(quoted[40:], layers.IPProtocol(quoted[6]), 0, oldAddresses, quoted[8:40])
+	updateChecksum(message, before)
+	return nil
+} // ReplaceQuotedIPv6Addresses()
+
+// quotedHeader finds the IP header quoted after the ICMP header and makes sure
+// it has the right version and is not cut short
+func quotedHeader(message []byte, iVersion, iMinLength int) ([]byte, error) {
+	if len(message) < iHeaderLength+iMinLength {
+		return nil, fmt.Errorf("%w: ICMP message is too short to hold the quoted IPv%d header", common.ErrMalformedPacket, iVersion)
+	}
+	quoted := message[iHeaderLength:]
+	if int(quoted[0]>>4) != iVersion {
+		return nil, fmt.Errorf("%w: ICMP message quotes a packet that is not IPv%d", common.ErrMalformedPacket, iVersion)
+	}
+	return quoted, nil
+}
+
+// updateChecksum fixes the ICMP checksum for the bytes of the quoted packet
+// that changed
+func updateChecksum(message, before []byte) {
+	iChecksum := uint16(message[2])<<8 | uint16(message[3])
+	iChecksum = checksum.Update(iChecksum, iHeaderLength, before[iHeaderLength:], message[iHeaderLength:])
+	message[2] = byte(iChecksum >> 8)
+	message[3] = byte(iChecksum)
+	if iDebug == 1 {
+		fmt.Printf("DEBUG: ICMP checksum is now 0x%04x\n", iChecksum)
+	}
+}
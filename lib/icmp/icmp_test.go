@@ -0,0 +1,134 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package icmp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"net"
+	"testing"
+)
+
+var ipv4AddressNew = net.IP{2, 2, 2, 2}
+var ipv6AddressNew = net.ParseIP("2001:db8::99")
+
+// locate finds the ICMP message in one of the test packets
+func locate(t *testing.T, data []byte) []byte {
+	f := pcaptest.Parse(t, data)
+	iStart, iEnd := Locate(f)
+	if iStart < 0 {
+		t.Fatal("Expected an ICMP error message")
+	}
+	return data[iStart:iEnd]
+}
+
+func TestLocate(t *testing.T) {
+	for _, iVersion := range []int{4, 6} {
+		data := pcaptest.ICMPUnreachable(iVersion)
+		f := pcaptest.Parse(t, data)
+		iStart, iEnd := Locate(f)
+		if iStart != f.ICMPOffset || iEnd != len(data) {
+			t.Errorf("IPv%d: expected the message from %d to %d, got %d to %d", iVersion, f.ICMPOffset, len(data), iStart, iEnd)
+		}
+
+		// Cut short in the quoted header it is left alone
+		if f, err := frame.Parse(data[:f.ICMPOffset+20], layers.LinkTypeEthernet); err != nil || f.ICMPOffset < 0 {
+			t.Errorf("IPv%d: expected the ICMP header to be found (%v)", iVersion, err)
+		} else if iStart, _ := Locate(f); iStart >= 0 {
+			t.Errorf("IPv%d: did not expect a message that was cut short", iVersion)
+		}
+	}
+
+	for _, p := range pcaptest.Corpus() {
+		f, err := frame.Parse(p.Data, layers.LinkTypeEthernet)
+		if err != nil {
+			continue
+		}
+		if iStart, _ := Locate(f); iStart >= 0 {
+			t.Errorf("%s: did not expect an ICMP error message", p.Name)
+		}
+	}
+}
+
+func TestReplaceQuotedIPv4Addresses(t *testing.T) {
+	message := locate(t, pcaptest.ICMPUnreachable(4))
+	if err := ReplaceQuotedIPv4Addresses(message, pcaptest.IPv4AddressA.To4(), ipv4AddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+
+	quoted := message[8:]
+	if !bytes.Equal(quoted[12:16], ipv4AddressNew) || !bytes.Equal(quoted[16:20], pcaptest.IPv4AddressB.To4()) {
+		t.Errorf("Wrong quoted addresses %v %v", net.IP(quoted[12:16]), net.IP(quoted[16:20]))
+	}
+	if iChecksum := checksum.IPv4Header(quoted); quoted[10] != byte(iChecksum>>8) || quoted[11] != byte(iChecksum) {
+		t.Errorf("Expected a valid quoted IPv4 header checksum, got 0x%02x%02x", quoted[10], quoted[11])
+	}
+	if sum := checksum.Transport(quoted[12:16], quoted[16:20], layers.IPProtocolUDP, quoted[20:]); sum != 0 {
+		t.Errorf("Expected a valid quoted UDP checksum, got 0x%04x", sum)
+	}
+	if sum := ^checksum.Fold(checksum.Sum(message, 0)); sum != 0 {
+		t.Errorf("Expected a valid ICMP checksum, got 0x%04x", sum)
+	}
+}
+
+func TestReplaceQuotedIPv6Addresses(t *testing.T) {
+	data := pcaptest.ICMPUnreachable(6)
+	message := locate(t, data)
+	if err := ReplaceQuotedIPv6Addresses(message, pcaptest.IPv6AddressA, ipv6AddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+
+	quoted := message[8:]
+	if !bytes.Equal(quoted[8:24], ipv6AddressNew) || !bytes.Equal(quoted[24:40], pcaptest.IPv6AddressB) {
+		t.Errorf("Wrong quoted addresses %v %v", net.IP(quoted[8:24]), net.IP(quoted[24:40]))
+	}
+	if sum := checksum.Transport(quoted[8:24], quoted[24:40], layers.IPProtocolUDP, quoted[40:]); sum != 0 {
+		t.Errorf("Expected a valid quoted UDP checksum, got 0x%04x", sum)
+	}
+	if sum := checksum.Transport(data[22:38], data[38:54], layers.IPProtocolICMPv6, message); sum != 0 {
+		t.Errorf("Expected a valid ICMPv6 checksum, got 0x%04x", sum)
+	}
+}
+
+func TestReplaceQuotedErrors(t *testing.T) {
+	message := locate(t, pcaptest.ICMPUnreachable(4))
+	err := ReplaceQuotedIPv4Addresses(message[:20], pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+	if !errors.Is(err, common.ErrMalformedPacket) {
+		t.Error("Expected a malformed packet error, got ", err)
+	}
+	err = ReplaceQuotedIPv6Addresses(message, pcaptest.IPv6AddressA, ipv6AddressNew)
+	if !errors.Is(err, common.ErrMalformedPacket) {
+		t.Error("Expected a malformed packet error, got ", err)
+	}
+
+	// A message that does not quote either address is left as it was
+	original := append([]byte(nil), message...)
+	if err := ReplaceQuotedIPv4Addresses(message, net.IP{192, 0, 2, 1}, ipv4AddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if !bytes.Equal(message, original) {
+		t.Error("Expected the message to be left alone")
+	}
+}
+
+func FuzzReplaceQuotedAddresses(f *testing.F) {
+	f.Add(pcaptest.ICMPUnreachable(4)[14+20:])
+	f.Add(pcaptest.ICMPUnreachable(6)[14+40:])
+	f.Fuzz(func(t *testing.T, message []byte) {
+		iLength := len(message)
+		ReplaceQuotedIPv4Addresses(message, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+		ReplaceQuotedIPv6Addresses(message, pcaptest.IPv6AddressA, ipv6AddressNew)
+		if len(message) != iLength {
+			t.Error("The length of the message changed")
+		}
+	})
+}
@@ -0,0 +1,223 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package impair makes a capture look like it went over a bad link.  Packets
+// are dropped, duplicated, held back so they come out after the packets that
+// follow them, have their timestamps moved by a random jitter, or have a bit
+// flipped.  The random numbers come from a seed so the same run gives the same
+// file every time.
+package impair
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var iDebug = 0
+
+// The shortest time between two packets in a PCAP file
+const minGap = time.Microsecond
+
+// Rules are the impairments and how often they happen.  Drop, Duplicate, Reorder
+// and Corrupt are the chance from 0 to 1 that a packet gets them.  A reordered
+// packet is held back for 1 to ReorderWindow packets.  The timestamp of each
+// packet is moved by up to Jitter either way with a uniform distribution, or by
+// a normal distribution with Jitter as the standard deviation.  The counters
+// say how many packets got each impairment.  The rules have to be applied to
+// the packets in order from one goroutine.
+type Rules struct {
+	Drop          float64
+	Duplicate     float64
+	Reorder       float64
+	ReorderWindow int
+	Jitter        time.Duration
+	bNormal       bool
+	Corrupt       float64
+
+	Dropped    int
+	Duplicated int
+	Reordered  int
+	Jittered   int
+	Corrupted  int
+
+	random *rand.Rand
+	held   []heldPacket
+	last   time.Time
+}
+
+// heldPacket is a reordered packet with the number of packets that still have
+// to go out in front of it
+type heldPacket struct {
+	data    []byte
+	ci      gopacket.CaptureInfo
+	iBehind int
+}
+
+//
+// -----------------------------------------------------------------------------
+// ParseRules()
+// -----------------------------------------------------------------------------
+// This function will parse the impairment options from the command line.  The
+// drop, duplicate, reorder and corrupt options are percentages from 0 to 100,
+// the reorder window is a number of packets, the jitter is a duration like 5ms
+// and the distribution is uniform or normal.  Any of the strings can be empty.
+func ParseRules(sDrop, sDuplicate, sReorder string, iReorderWindow int, sJitter, sDistribution, sCorrupt string, iSeed int64) (*Rules, error) {
+	rules := &Rules{ReorderWindow: iReorderWindow, random: rand.New(rand.NewSource(iSeed))}
+	var err error
+
+	if rules.Drop, err = parsePercent(sDrop); err != nil {
+		return nil, fmt.Errorf("invalid drop %s", err)
+	}
+	if rules.Duplicate, err = parsePercent(sDuplicate); err != nil {
+		return nil, fmt.Errorf("invalid duplicate %s", err)
+	}
+	if rules.Reorder, err = parsePercent(sReorder); err != nil {
+		return nil, fmt.Errorf("invalid reorder %s", err)
+	}
+	if rules.Corrupt, err = parsePercent(sCorrupt); err != nil {
+		return nil, fmt.Errorf("invalid corrupt %s", err)
+	}
+	if iReorderWindow < 1 {
+		return nil, fmt.Errorf("invalid reorder window %d, it should be at least 1 packet", iReorderWindow)
+	}
+
+	if sJitter != "" {
+		rules.Jitter, err = time.ParseDuration(sJitter)
+		if err != nil || rules.Jitter < 0 {
+			return nil, fmt.Errorf("invalid jitter %s, it should be a duration like 5ms", sJitter)
+		}
+	}
+	switch sDistribution {
+	case "", "uniform":
+	case "normal":
+		rules.bNormal = true
+	default:
+		return nil, fmt.Errorf("invalid jitter distribution %s, it should be uniform or normal", sDistribution)
+	}
+	return rules, nil
+} // ParseRules()
+
+//
+// -----------------------------------------------------------------------------
+// Apply()
+// -----------------------------------------------------------------------------
+// This function will impair a packet and hand what is left of it to write.  A
+// dropped packet is not written, a duplicated one is written twice and a
+// reordered one is kept until the packets it is held back for were written.
+// A jittered or reordered packet that would come out after one with a later
+// timestamp is moved just after it, so the file stays in timestamp order.  The
+// data may be changed, and it is copied if it is held on to.
+func (rules *Rules) Apply(ci gopacket.CaptureInfo, data []byte, write func(gopacket.CaptureInfo, []byte) error) error {
+	if rules.chance(rules.Drop) {
+		rules.Dropped++
+		return nil
+	}
+
+	if rules.chance(rules.Corrupt) && len(data) > 0 {
+		iBit := rules.random.Intn(len(data) * 8)
+		data[iBit/8] ^= 1 << uint(iBit%8)
+		rules.Corrupted++
+	}
+
+	var jitter time.Duration
+	if rules.Jitter > 0 {
+		if rules.bNormal {
+			jitter = time.Duration(rules.random.NormFloat64() * float64(rules.Jitter))
+		} else {
+			jitter = time.Duration(rules.random.Int63n(int64(2*rules.Jitter)+1)) - rules.Jitter
+		}
+		if jitter != 0 {
+			ci.Timestamp = ci.Timestamp.Add(jitter)
+			rules.Jittered++
+		}
+	}
+
+	if rules.chance(rules.Reorder) {
+		rules.held = append(rules.held, heldPacket{data: append([]byte(nil), data...), ci: ci, iBehind: 1 + rules.random.Intn(rules.ReorderWindow)})
+		rules.Reordered++
+		return nil
+	}
+
+	if err := rules.write(ci, data, jitter != 0, write); err != nil {
+		return err
+	}
+	if rules.chance(rules.Duplicate) {
+		if err := rules.write(ci, data, jitter != 0, write); err != nil {
+			return err
+		}
+		rules.Duplicated++
+	}
+
+	// The held packets that have waited long enough go out after this one
+	held := rules.held[:0]
+	var due []heldPacket
+	for _, p := range rules.held {
+		p.iBehind--
+		if p.iBehind <= 0 {
+			due = append(due, p)
+		} else {
+			held = append(held, p)
+		}
+	}
+	rules.held = held
+	for _, p := range due {
+		if err := rules.write(p.ci, p.data, true, write); err != nil {
+			return err
+		}
+	}
+	return nil
+} // Apply()
+
+//
+// -----------------------------------------------------------------------------
+// Flush()
+// -----------------------------------------------------------------------------
+// This function will write out the packets that are still held back at the end
+// of the file
+func (rules *Rules) Flush(write func(gopacket.CaptureInfo, []byte) error) error {
+	for _, p := range rules.held {
+		if err := rules.write(p.ci, p.data, true, write); err != nil {
+			return err
+		}
+	}
+	rules.held = nil
+	return nil
+} // Flush()
+
+// write hands a packet on, a packet that was moved is moved again to just after
+// the packet before it if it would go back in time
+func (rules *Rules) write(ci gopacket.CaptureInfo, data []byte, bMoved bool, write func(gopacket.CaptureInfo, []byte) error) error {
+	if bMoved && !rules.last.IsZero() && ci.Timestamp.Before(rules.last.Add(minGap)) {
+		if iDebug == 1 {
+			fmt.Println("DEBUG: Moved a packet from", ci.Timestamp, "to just after", rules.last)
+		}
+		ci.Timestamp = rules.last.Add(minGap)
+	}
+	rules.last = ci.Timestamp
+	return write(ci, data)
+}
+
+// chance returns true with the probability p
+func (rules *Rules) chance(p float64) bool {
+	return p > 0 && rules.random.Float64() < p
+}
+
+// parsePercent reads a percentage from 0 to 100 as a probability from 0 to 1
+func parsePercent(sValue string) (float64, error) {
+	if sValue == "" {
+		return 0, nil
+	}
+	fValue, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(sValue), "%"), 64)
+	if err != nil || math.IsNaN(fValue) || fValue < 0 || fValue > 100 {
+		return 0, fmt.Errorf("%s, it should be a percentage from 0 to 100", sValue)
+	}
+	return fValue / 100, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package impair
+
+import (
+	"github.com/google/gopacket"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"math/bits"
+	"testing"
+	"time"
+)
+
+// written is a packet as it was handed on
+type written struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// run impairs iPackets packets 10ms apart, each holding its index in the first
+// two bytes
+func run(t *testing.T, rules *Rules, iPackets int) []written {
+	var output []written
+	write := func(ci gopacket.CaptureInfo, data []byte) error {
+		output = append(output, written{ci: ci, data: append([]byte(nil), data...)})
+		return nil
+	}
+	for i := 0; i < iPackets; i++ {
+		data := make([]byte, 64)
+		data[0], data[1] = byte(i>>8), byte(i)
+		ci := gopacket.CaptureInfo{Timestamp: pcaptest.StartTime.Add(time.Duration(i) * 10 * time.Millisecond), CaptureLength: 64, Length: 64}
+		if err := rules.Apply(ci, data, write); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rules.Flush(write); err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+// parse parses the rules or fails the test
+func parse(t *testing.T, sDrop, sDuplicate, sReorder string, iReorderWindow int, sJitter, sDistribution, sCorrupt string) *Rules {
+	rules, err := ParseRules(sDrop, sDuplicate, sReorder, iReorderWindow, sJitter, sDistribution, sCorrupt, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		sDrop, sJitter, sDistribution string
+		iReorderWindow                int
+	}{
+		{"101", "", "", 3},
+		{"-1", "", "", 3},
+		{"lots", "", "", 3},
+		{"1", "-5ms", "", 3},
+		{"1", "5", "", 3},
+		{"1", "5ms", "pareto", 3},
+		{"1", "", "", 0},
+	}
+	for _, tt := range tests {
+		if _, err := ParseRules(tt.sDrop, "", "", tt.iReorderWindow, tt.sJitter, tt.sDistribution, "", 1); err == nil {
+			t.Errorf("%+v: expected an error", tt)
+		}
+	}
+
+	rules := parse(t, "1.5%", "", "", 3, "5ms", "normal", "")
+	if rules.Drop != 0.015 || rules.Jitter != 5*time.Millisecond || !rules.bNormal {
+		t.Errorf("Expected a 1.5%% drop and a normal jitter of 5ms, got %+v", rules)
+	}
+}
+
+func TestDropAndDuplicate(t *testing.T) {
+	if output := run(t, parse(t, "100", "", "", 3, "", "", ""), 100); len(output) != 0 {
+		t.Errorf("Expected every packet to be dropped, got %d", len(output))
+	}
+
+	rules := parse(t, "", "100", "", 3, "", "", "")
+	output := run(t, rules, 100)
+	if len(output) != 200 || rules.Duplicated != 100 || output[0].data[1] != output[1].data[1] {
+		t.Errorf("Expected every packet to be written twice, got %d", len(output))
+	}
+
+	// The same seed gives the same packets
+	first := run(t, parse(t, "30", "30", "", 3, "", "", ""), 1000)
+	second := run(t, parse(t, "30", "30", "", 3, "", "", ""), 1000)
+	if len(first) != len(second) || len(first) < 500 || len(first) > 1100 {
+		t.Fatalf("Expected the same number of packets from the same seed, got %d and %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i].data[0] != second[i].data[0] || first[i].data[1] != second[i].data[1] {
+			t.Fatalf("Packet %d is not the same from the same seed", i)
+		}
+	}
+}
+
+func TestReorder(t *testing.T) {
+	rules := parse(t, "", "", "30", 3, "", "", "")
+	output := run(t, rules, 1000)
+	if len(output) != 1000 || rules.Reordered < 200 || rules.Reordered > 400 {
+		t.Fatalf("Expected 1000 packets with about 300 reordered, got %d and %d", len(output), rules.Reordered)
+	}
+
+	// Every packet comes out once, in timestamp order
+	seen := make(map[int]bool)
+	iOutOfOrder := 0
+	for i, p := range output {
+		iPacket := int(p.data[0])<<8 | int(p.data[1])
+		if seen[iPacket] {
+			t.Errorf("Packet %d came out twice", iPacket)
+		}
+		seen[iPacket] = true
+		if i > 0 {
+			if iPacket < int(output[i-1].data[0])<<8|int(output[i-1].data[1]) {
+				iOutOfOrder++
+			}
+			if !p.ci.Timestamp.After(output[i-1].ci.Timestamp) {
+				t.Errorf("Packet %d is not after the packet before it", i)
+			}
+		}
+	}
+	if iOutOfOrder == 0 {
+		t.Error("Expected some of the packets to be out of order")
+	}
+}
+
+func TestJitterAndCorrupt(t *testing.T) {
+	for _, sDistribution := range []string{"uniform", "normal"} {
+		rules := parse(t, "", "", "", 3, "1ms", sDistribution, "100")
+		output := run(t, rules, 1000)
+		if len(output) != 1000 || rules.Jittered < 900 || rules.Corrupted != 1000 {
+			t.Fatalf("%s: expected every packet jittered and corrupted, got %d and %d", sDistribution, rules.Jittered, rules.Corrupted)
+		}
+
+		var total time.Duration
+		for i, p := range output {
+			jitter := p.ci.Timestamp.Sub(pcaptest.StartTime.Add(time.Duration(i) * 10 * time.Millisecond))
+			if sDistribution == "uniform" && (jitter > time.Millisecond || jitter < -time.Millisecond) {
+				t.Errorf("Packet %d: expected a jitter of up to 1ms, got %v", i, jitter)
+			}
+			total += jitter
+
+			// One bit was flipped, which can be in the index
+			iBits := 0
+			for _, b := range p.data[2:] {
+				iBits += bits.OnesCount8(b)
+			}
+			if iBits > 1 {
+				t.Errorf("Packet %d: expected at most one bit flipped, got %d", i, iBits)
+			}
+		}
+		if mean := total / 1000; mean > 200*time.Microsecond || mean < -200*time.Microsecond {
+			t.Errorf("%s: expected the jitter to average out, got %v", sDistribution, mean)
+		}
+	}
+}
@@ -10,14 +10,29 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/frame"
 	"net"
-	"os"
 	"strings"
 )
 
 var iDebug = 0
 
+//
+// -----------------------------------------------------------------------------
+// GetEthernetType()
+// -----------------------------------------------------------------------------
+// This function will find the ethernet type of the frame, stepping over any
+// 802.1Q or 802.1ad (Q-in-Q) tags.  It also returns the number of bytes the tags
+// take up so the offsets of the layer 3 and ARP data can be adjusted.
+func GetEthernetType(packet gopacket.Packet) (layers.EthernetType, int, error) {
+	if packet.LinkLayer() == nil || packet.LinkLayer().LayerType() != layers.LayerTypeEthernet {
+		return 0, 0, fmt.Errorf("%w: not an ethernet frame", common.ErrMalformedPacket)
+	}
+	return frame.ParseEthernetType(packet.Data())
+} // GetEthernetType()
+
 //
 // -----------------------------------------------------------------------------
 // ReplaceMacAddresses()
@@ -25,9 +40,26 @@ var iDebug = 0
 // Lets compare the mac address supplied with the one in the pcap file for both
 // the DST MAC and SRC MAC but only if a MAC address is supplied as an ARG
 // This change will be made regardless of packet type
-func ReplaceMacAddresses(packet gopacket.Packet, userSuppliedMacAddress, userSuppliedMacAddressNew []byte) {
-	dstMacAddressFromPacket := packet.LinkLayer().LayerContents()[0:6]
-	srcMacAddressFromPacket := packet.LinkLayer().LayerContents()[6:12]
+func ReplaceMacAddresses(packet gopacket.Packet, userSuppliedMacAddress, userSuppliedMacAddressNew []byte) error {
+	if packet.LinkLayer() == nil {
+		return fmt.Errorf("%w: no ethernet header to update", common.ErrMalformedPacket)
+	}
+	return ReplaceFrameMacAddresses(packet.LinkLayer().LayerContents(), userSuppliedMacAddress, userSuppliedMacAddressNew)
+} // ReplaceMacAddresses()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceFrameMacAddresses()
+// -----------------------------------------------------------------------------
+// This does the same thing as ReplaceMacAddresses but works directly on the
+// bytes of the ethernet frame
+func ReplaceFrameMacAddresses(data []byte, userSuppliedMacAddress, userSuppliedMacAddressNew []byte) error {
+	if len(data) < 12 {
+		return fmt.Errorf("%w: no ethernet header to update", common.ErrMalformedPacket)
+	}
+
+	dstMacAddressFromPacket := data[0:6]
+	srcMacAddressFromPacket := data[6:12]
 
 	bDstMacAddressMatch := common.AreByteSlicesEqual(dstMacAddressFromPacket, userSuppliedMacAddress)
 	if bDstMacAddressMatch {
@@ -36,7 +68,7 @@ func ReplaceMacAddresses(packet gopacket.Packet, userSuppliedMacAddress, userSup
 		}
 
 		for i := 0; i < 6; i++ {
-			packet.LinkLayer().LayerContents()[i] = userSuppliedMacAddressNew[i]
+			data[i] = userSuppliedMacAddressNew[i]
 		}
 	}
 
@@ -48,18 +80,19 @@ func ReplaceMacAddresses(packet gopacket.Packet, userSuppliedMacAddress, userSup
 
 		j := 0
 		for i := 6; i < 12; i++ {
-			packet.LinkLayer().LayerContents()[i] = userSuppliedMacAddressNew[j]
+			data[i] = userSuppliedMacAddressNew[j]
 			j++
 		}
 	}
-} // ReplaceMacAddresses()
+	return nil
+} // ReplaceFrameMacAddresses()
 
 //
 // -----------------------------------------------------------------------------
 // ParseSuppliedLayer2Address()
 // -----------------------------------------------------------------------------
 // Figure out if we need to change a layer 2 mac address
-func ParseSuppliedLayer2Address(mac string) []byte {
+func ParseSuppliedLayer2Address(mac string) ([]byte, error) {
 	userSuppliedMacAddress := make([]byte, 6, 6)
 
 	if mac != "" {
@@ -67,8 +100,12 @@ func ParseSuppliedLayer2Address(mac string) []byte {
 		userSuppliedMacAddress, err = net.ParseMAC(mac)
 
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(0)
+			return nil, err
+		}
+
+		// net.ParseMAC also accepts EUI-64 and InfiniBand addresses
+		if len(userSuppliedMacAddress) != 6 {
+			return nil, fmt.Errorf("invalid MAC address %s: only 48 bit addresses are supported", mac)
 		}
 
 		if iDebug == 1 {
@@ -77,7 +114,7 @@ func ParseSuppliedLayer2Address(mac string) []byte {
 		}
 	}
 
-	return userSuppliedMacAddress
+	return userSuppliedMacAddress, nil
 } // ParseSuppliedLayer2Address()
 
 //
@@ -0,0 +1,151 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layer2
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"net"
+	"testing"
+)
+
+var macAddressNew = net.HardwareAddr{0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+
+func TestReplaceFrameMacAddresses(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		mac    []byte
+		dst    []byte
+		src    []byte
+		bError bool
+	}{
+		{"source", pcaptest.IPv4UDP(0, nil), pcaptest.MacAddressA, pcaptest.MacAddressB, macAddressNew, false},
+		{"destination", pcaptest.IPv4TCP(0, nil), pcaptest.MacAddressA, macAddressNew, pcaptest.MacAddressB, false},
+		{"tagged", pcaptest.IPv4TCP(2, nil), pcaptest.MacAddressB, pcaptest.MacAddressA, macAddressNew, false},
+		{"no match", pcaptest.IPv4UDP(0, nil), macAddressNew, pcaptest.MacAddressB, pcaptest.MacAddressA, false},
+		{"runt", []byte{1, 2, 3, 4, 5, 6, 7, 8}, pcaptest.MacAddressA, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ReplaceFrameMacAddresses(tt.data, tt.mac, macAddressNew)
+			if tt.bError {
+				if !errors.Is(err, common.ErrMalformedPacket) {
+					t.Fatal("Expected a malformed packet error, got ", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Unexpected error ", err)
+			}
+			if !bytes.Equal(tt.data[0:6], tt.dst) {
+				t.Errorf("Expected DST MAC %s, got %s", MakePrettyMacAddress(tt.dst), MakePrettyMacAddress(tt.data[0:6]))
+			}
+			if !bytes.Equal(tt.data[6:12], tt.src) {
+				t.Errorf("Expected SRC MAC %s, got %s", MakePrettyMacAddress(tt.src), MakePrettyMacAddress(tt.data[6:12]))
+			}
+		})
+	}
+}
+
+func TestReplaceMacAddresses(t *testing.T) {
+	data := pcaptest.IPv4UDP(1, nil)
+	packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+	if err := ReplaceMacAddresses(packet, pcaptest.MacAddressA, macAddressNew); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if !bytes.Equal(data[6:12], macAddressNew) {
+		t.Error("Expected the SRC MAC to be updated, got ", MakePrettyMacAddress(data[6:12]))
+	}
+}
+
+func TestGetEthernetType(t *testing.T) {
+	tests := []struct {
+		data            []byte
+		ethType         layers.EthernetType
+		i802dot1QOffset int
+	}{
+		{pcaptest.IPv4UDP(0, nil), layers.EthernetTypeIPv4, 0},
+		{pcaptest.IPv4UDP(1, nil), layers.EthernetTypeIPv4, 4},
+		{pcaptest.IPv4UDP(2, nil), layers.EthernetTypeIPv4, 8},
+		{pcaptest.ARPRequest(1), layers.EthernetTypeARP, 4},
+		{pcaptest.IPv6UDP(2, nil), layers.EthernetTypeIPv6, 8},
+	}
+
+	for i, tt := range tests {
+		packet := gopacket.NewPacket(tt.data, layers.LinkTypeEthernet, gopacket.Default)
+		ethType, i802dot1QOffset, err := GetEthernetType(packet)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %s", i, err)
+			continue
+		}
+		if ethType != tt.ethType || i802dot1QOffset != tt.i802dot1QOffset {
+			t.Errorf("Test %d: expected %s/%d, got %s/%d", i, tt.ethType, tt.i802dot1QOffset, ethType, i802dot1QOffset)
+		}
+	}
+}
+
+func TestParseSuppliedLayer2Address(t *testing.T) {
+	tests := []struct {
+		mac    string
+		result []byte
+		bError bool
+	}{
+		{"", make([]byte, 6), false},
+		{"68:A8:6D:18:36:92", pcaptest.MacAddressA, false},
+		{"00-11-22-33-44-55", pcaptest.MacAddressB, false},
+		{"68:A8:6D:18:36", nil, true},
+		{"00:00:00:00:fe:80:00:00", nil, true},
+		{"not a mac", nil, true},
+	}
+
+	for _, tt := range tests {
+		result, err := ParseSuppliedLayer2Address(tt.mac)
+		if (err != nil) != tt.bError {
+			t.Errorf("%q: expected error %t, got %v", tt.mac, tt.bError, err)
+			continue
+		}
+		if !bytes.Equal(result, tt.result) {
+			t.Errorf("%q: expected %v, got %v", tt.mac, tt.result, result)
+		}
+	}
+}
+
+func TestMakePrettyMacAddress(t *testing.T) {
+	if s := MakePrettyMacAddress(pcaptest.MacAddressA); s != "68:A8:6D:18:36:92" {
+		t.Error("Expected 68:A8:6D:18:36:92, got ", s)
+	}
+}
+
+func FuzzReplaceFrameMacAddresses(f *testing.F) {
+	for _, p := range pcaptest.Corpus() {
+		f.Add(p.Data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		iLength := len(data)
+		ReplaceFrameMacAddresses(data, pcaptest.MacAddressA, macAddressNew)
+		if len(data) != iLength {
+			t.Error("The length of the frame changed")
+		}
+	})
+}
+
+func FuzzReplaceMacAddresses(f *testing.F) {
+	for _, p := range pcaptest.Corpus() {
+		f.Add(p.Data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+		ReplaceMacAddresses(packet, pcaptest.MacAddressA, macAddressNew)
+		GetEthernetType(packet)
+	})
+}
@@ -0,0 +1,311 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layer3
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IDMode says how the IPv4 identification is changed
+type IDMode int
+
+// The ways the IPv4 identification can be changed
+const (
+	IDKeep IDMode = iota
+	IDRandom
+	IDSequential
+)
+
+// FieldRules are the changes to make to the other fields of an IP header.  The
+// TTL (or IPv6 hop limit) is set to TTL, or raised or lowered by it when
+// TTLChange is '+' or '-', and is left alone when TTLChange is 0.  DSCP and ECN
+// are the two parts of the IPv4 type of service and the IPv6 traffic class, and
+// FlowLabel is the IPv6 flow label, -1 leaves them alone.  The rules are only
+// applied to packets to or from one of the hosts, if there are any, that match
+// the BPF filter, if there is one.  The filter has to be compiled for the link
+// type of the file before it is used.
+type FieldRules struct {
+	TTL        int
+	TTLChange  byte
+	DSCP       int
+	ECN        int
+	ID         IDMode
+	FlowLabel  int
+	Hosts      [][]byte
+	sFilter    string
+	filter     *pcap.BPF
+	filterLock sync.Mutex
+	iNextID    int
+}
+
+//
+// -----------------------------------------------------------------------------
+// ParseFieldRules()
+// -----------------------------------------------------------------------------
+// This function will parse the IP header field options from the command line.
+// The TTL is a number from 1 to 255, with a + or - in front of it to raise or
+// lower the TTL by that much.  The DSCP, ECN and flow label are numbers, the IP
+// identification mode is random or sequential, the hosts are IPv4 or IPv6
+// addresses separated by a comma and the filter is in the same syntax as
+// tcpdump.  Any of them can be empty.
+func ParseFieldRules(sTTL, sDSCP, sECN, sID, sFlowLabel, sHosts, sFilter string) (*FieldRules, error) {
+	rules := &FieldRules{DSCP: -1, ECN: -1, FlowLabel: -1, sFilter: sFilter, iNextID: -1}
+	var err error
+
+	if sTTL != "" {
+		rules.TTLChange = '='
+		if sTTL[0] == '+' || sTTL[0] == '-' {
+			rules.TTLChange = sTTL[0]
+			sTTL = sTTL[1:]
+		}
+		if rules.TTL, err = parseField(sTTL, 1, 255); err != nil {
+			return nil, fmt.Errorf("invalid TTL %s, it should be 1 to 255 with an optional + or - in front of it", sTTL)
+		}
+	}
+	if sDSCP != "" {
+		if rules.DSCP, err = parseField(sDSCP, 0, 63); err != nil {
+			return nil, fmt.Errorf("invalid DSCP %s, it should be 0 to 63", sDSCP)
+		}
+	}
+	if sECN != "" {
+		if rules.ECN, err = parseField(sECN, 0, 3); err != nil {
+			return nil, fmt.Errorf("invalid ECN %s, it should be 0 to 3", sECN)
+		}
+	}
+	if sFlowLabel != "" {
+		if rules.FlowLabel, err = parseField(sFlowLabel, 0, 0xfffff); err != nil {
+			return nil, fmt.Errorf("invalid flow label %s, it should be 0 to 1048575", sFlowLabel)
+		}
+	}
+
+	switch sID {
+	case "":
+	case "random":
+		rules.ID = IDRandom
+	case "sequential":
+		rules.ID = IDSequential
+	default:
+		return nil, fmt.Errorf("invalid IP identification mode %s, it should be random or sequential", sID)
+	}
+
+	if sHosts != "" {
+		for _, sHost := range strings.Split(sHosts, ",") {
+			ip := net.ParseIP(strings.TrimSpace(sHost))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid host %s", sHost)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			rules.Hosts = append(rules.Hosts, ip)
+		}
+	}
+	return rules, nil
+} // ParseFieldRules()
+
+//
+// -----------------------------------------------------------------------------
+// Compile()
+// -----------------------------------------------------------------------------
+// This function will compile the BPF filter for the link type of the file the
+// packets come from.  It does nothing if there is no filter.
+func (rules *FieldRules) Compile(linkType layers.LinkType) error {
+	if rules.sFilter == "" {
+		return nil
+	}
+	filter, err := pcap.NewBPF(linkType, 65535, rules.sFilter)
+	if err != nil {
+		return fmt.Errorf("invalid IP field filter %s: %v", rules.sFilter, err)
+	}
+	rules.filter = filter
+	return nil
+} // Compile()
+
+//
+// -----------------------------------------------------------------------------
+// MatchesFilter()
+// -----------------------------------------------------------------------------
+// This function will check the packet against the BPF filter, it has to be the
+// packet as it was captured.  Every packet matches if there is no filter.  It is
+// safe to call from more than one goroutine.
+func (rules *FieldRules) MatchesFilter(ci gopacket.CaptureInfo, data []byte) bool {
+	if rules.filter == nil {
+		return true
+	}
+	if len(data) == 0 {
+		return false
+	}
+	rules.filterLock.Lock()
+	defer rules.filterLock.Unlock()
+	return rules.filter.Matches(ci, data)
+} // MatchesFilter()
+
+//
+// -----------------------------------------------------------------------------
+// MatchesHosts()
+// -----------------------------------------------------------------------------
+// This function will check that the source or destination address of the IP
+// header is one of the hosts.  Every packet matches if there are no hosts.
+func (rules *FieldRules) MatchesHosts(ipHeader []byte, iVersion int) bool {
+	if len(rules.Hosts) == 0 {
+		return true
+	}
+	iStart, iLength := 12, 4
+	if iVersion == 6 {
+		iStart, iLength = 8, 16
+	}
+	if len(ipHeader) < iStart+2*iLength {
+		return false
+	}
+	for _, host := range rules.Hosts {
+		if common.AreByteSlicesEqual(ipHeader[iStart:iStart+iLength], host) || common.AreByteSlicesEqual(ipHeader[iStart+iLength:iStart+2*iLength], host) {
+			return true
+		}
+	}
+	return false
+} // MatchesHosts()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceFields()
+// -----------------------------------------------------------------------------
+// This function will change the TTL or hop limit, the DSCP and ECN bits and the
+// IPv6 flow label.  The IPv4 header checksum is updated, none of these fields are
+// covered by the TCP or UDP checksum.  It returns true if anything was changed.
+func (rules *FieldRules) ReplaceFields(ipHeader []byte, iVersion int) (bool, error) {
+	iTOS, iTTL := 1, 8
+	if iVersion == 6 {
+		if len(ipHeader) < 40 || ipHeader[0]>>4 != 6 {
+			return false, fmt.Errorf("%w: IPv6 header is too short or has a bad version", common.ErrMalformedPacket)
+		}
+		iTTL = 7
+	} else if len(ipHeader) < 20 || ipHeader[0]>>4 != 4 {
+		return false, fmt.Errorf("%w: IPv4 header is too short or has a bad version", common.ErrMalformedPacket)
+	}
+
+	var old [12]byte
+	copy(old[:], ipHeader[:12])
+
+	// The IPv6 traffic class sits across the first two bytes
+	iTrafficClass := int(ipHeader[iTOS])
+	if iVersion == 6 {
+		iTrafficClass = int(ipHeader[0]&0x0f)<<4 | int(ipHeader[1]>>4)
+	}
+	if rules.DSCP >= 0 {
+		iTrafficClass = rules.DSCP<<2 | iTrafficClass&0x03
+	}
+	if rules.ECN >= 0 {
+		iTrafficClass = iTrafficClass&0xfc | rules.ECN
+	}
+	if iVersion == 6 {
+		ipHeader[0] = 0x60 | byte(iTrafficClass>>4)
+		ipHeader[1] = byte(iTrafficClass<<4) | ipHeader[1]&0x0f
+		if rules.FlowLabel >= 0 {
+			ipHeader[1] = ipHeader[1]&0xf0 | byte(rules.FlowLabel>>16)
+			ipHeader[2], ipHeader[3] = byte(rules.FlowLabel>>8), byte(rules.FlowLabel)
+		}
+	} else {
+		ipHeader[iTOS] = byte(iTrafficClass)
+	}
+
+	// A raised or lowered TTL stays between 1 and 255
+	iNewTTL := int(ipHeader[iTTL])
+	switch rules.TTLChange {
+	case '=':
+		iNewTTL = rules.TTL
+	case '+':
+		iNewTTL += rules.TTL
+	case '-':
+		iNewTTL -= rules.TTL
+	}
+	if iNewTTL > 255 {
+		iNewTTL = 255
+	} else if iNewTTL < 1 && rules.TTLChange != 0 {
+		iNewTTL = 1
+	}
+	ipHeader[iTTL] = byte(iNewTTL)
+
+	if common.AreByteSlicesEqual(old[:], ipHeader[:12]) {
+		return false, nil
+	}
+	if iVersion == 4 {
+		updateIPv4Checksum(ipHeader, old[:])
+	}
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Changed the IP header fields from", old[:], "to", ipHeader[:12])
+	}
+	return true, nil
+} // ReplaceFields()
+
+//
+// -----------------------------------------------------------------------------
+// ChangesID()
+// -----------------------------------------------------------------------------
+// This function will check that the IPv4 identification of the header is one the
+// rules change.  Fragments are left alone so they can still be put back together.
+func (rules *FieldRules) ChangesID(ipHeader []byte, iVersion int) bool {
+	if rules.ID == IDKeep || iVersion != 4 || len(ipHeader) < 20 {
+		return false
+	}
+	bMoreFragments := ipHeader[6]&0x20 != 0
+	iFragmentOffset := int(ipHeader[6]&0x1f)<<8 | int(ipHeader[7])
+	return !bMoreFragments && iFragmentOffset == 0
+} // ChangesID()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceID()
+// -----------------------------------------------------------------------------
+// This function will give the IPv4 header a random identification or the next
+// one in the sequence, which starts at the identification of the first packet.
+// The header checksum is updated.  The sequence has to follow the order of the
+// file so this is not safe to call from more than one goroutine.
+func (rules *FieldRules) ReplaceID(ipHeader []byte) {
+	var old [12]byte
+	copy(old[:], ipHeader[:12])
+
+	if rules.ID == IDRandom {
+		if _, err := rand.Read(ipHeader[4:6]); err != nil && iDebug == 1 {
+			fmt.Println("DEBUG: Could not read random bytes:", err)
+		}
+	} else {
+		if rules.iNextID < 0 {
+			rules.iNextID = int(ipHeader[4])<<8 | int(ipHeader[5])
+		}
+		ipHeader[4], ipHeader[5] = byte(rules.iNextID>>8), byte(rules.iNextID)
+		rules.iNextID = (rules.iNextID + 1) & 0xffff
+	}
+	updateIPv4Checksum(ipHeader, old[:])
+} // ReplaceID()
+
+// updateIPv4Checksum fixes the header checksum after the first 12 bytes of the
+// header changed from old
+func updateIPv4Checksum(ipHeader, old []byte) {
+	iChecksum := uint16(ipHeader[10])<<8 | uint16(ipHeader[11])
+	iChecksum = checksum.Update(iChecksum, 0, old[:10], ipHeader[:10])
+	ipHeader[10] = byte(iChecksum >> 8)
+	ipHeader[11] = byte(iChecksum)
+}
+
+// parseField reads a number that has to be from iMin to iMax
+func parseField(sValue string, iMin, iMax int) (int, error) {
+	iValue, err := strconv.Atoi(strings.TrimSpace(sValue))
+	if err != nil || iValue < iMin || iValue > iMax {
+		return 0, fmt.Errorf("%s is not from %d to %d", sValue, iMin, iMax)
+	}
+	return iValue, nil
+}
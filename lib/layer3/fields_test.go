@@ -0,0 +1,148 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layer3
+
+import (
+	"errors"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+// fieldRules parses the rules for a test, the hosts and filter are left empty
+func fieldRules(t *testing.T, sTTL, sDSCP, sECN, sID, sFlowLabel string) *FieldRules {
+	rules, err := ParseFieldRules(sTTL, sDSCP, sECN, sID, sFlowLabel, "", "")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	return rules
+}
+
+func TestParseFieldRules(t *testing.T) {
+	rules, err := ParseFieldRules("+10", "46", "0", "sequential", "12345", "10.0.2.32, 2001:db8::32", "")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if rules.TTLChange != '+' || rules.TTL != 10 || rules.DSCP != 46 || rules.ECN != 0 || rules.ID != IDSequential || rules.FlowLabel != 12345 {
+		t.Errorf("Wrong rules %+v", rules)
+	}
+	if len(rules.Hosts) != 2 || len(rules.Hosts[0]) != 4 || len(rules.Hosts[1]) != 16 {
+		t.Errorf("Wrong hosts %v", rules.Hosts)
+	}
+
+	tests := [][]string{
+		{"0", "", "", "", "", ""},
+		{"256", "", "", "", "", ""},
+		{"+", "", "", "", "", ""},
+		{"", "64", "", "", "", ""},
+		{"", "", "4", "", "", ""},
+		{"", "", "", "counter", "", ""},
+		{"", "", "", "", "1048576", ""},
+		{"", "", "", "", "", "10.0.2"},
+	}
+	for _, test := range tests {
+		if _, err := ParseFieldRules(test[0], test[1], test[2], test[3], test[4], test[5], ""); err == nil {
+			t.Errorf("%v: expected an error", test)
+		}
+	}
+}
+
+func TestReplaceFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    *FieldRules
+		iVersion int
+		iTTL     byte
+		iTOS     int
+		iFlow    int
+		bChanged bool
+	}{
+		{"set ttl", fieldRules(t, "128", "", "", "", ""), 4, 128, 0, 0, true},
+		{"raise ttl", fieldRules(t, "+250", "", "", "", ""), 4, 255, 0, 0, true},
+		{"lower ttl", fieldRules(t, "-100", "", "", "", ""), 6, 1, 0, 0, true},
+		{"dscp and ecn", fieldRules(t, "", "46", "1", "", ""), 4, 64, 46<<2 | 1, 0, true},
+		{"ipv6 dscp and flow", fieldRules(t, "", "46", "", "", "703710"), 6, 64, 46 << 2, 703710, true},
+		{"unchanged", fieldRules(t, "64", "0", "", "", ""), 4, 64, 0, 0, false},
+	}
+	for _, tt := range tests {
+		data := pcaptest.IPv4UDP(0, nil)
+		if tt.iVersion == 6 {
+			data = pcaptest.IPv6UDP(0, nil)
+		}
+		ipHeader := data[14:]
+		bChanged, err := tt.rules.ReplaceFields(ipHeader, tt.iVersion)
+		if err != nil || bChanged != tt.bChanged {
+			t.Errorf("%s: expected changed %t, got %t (%v)", tt.name, tt.bChanged, bChanged, err)
+			continue
+		}
+
+		if tt.iVersion == 4 {
+			if ipHeader[8] != tt.iTTL || int(ipHeader[1]) != tt.iTOS {
+				t.Errorf("%s: expected TTL %d and TOS %d, got %d and %d", tt.name, tt.iTTL, tt.iTOS, ipHeader[8], ipHeader[1])
+			}
+			if iChecksum := checksum.IPv4Header(ipHeader); ipHeader[10] != byte(iChecksum>>8) || ipHeader[11] != byte(iChecksum) {
+				t.Errorf("%s: expected a valid IPv4 header checksum", tt.name)
+			}
+			continue
+		}
+		iTrafficClass := int(ipHeader[0]&0x0f)<<4 | int(ipHeader[1]>>4)
+		iFlow := int(ipHeader[1]&0x0f)<<16 | int(ipHeader[2])<<8 | int(ipHeader[3])
+		if ipHeader[0]>>4 != 6 || ipHeader[7] != tt.iTTL || iTrafficClass != tt.iTOS || iFlow != tt.iFlow {
+			t.Errorf("%s: expected hop limit %d, traffic class %d and flow label %d, got %d, %d and %d", tt.name, tt.iTTL, tt.iTOS, tt.iFlow, ipHeader[7], iTrafficClass, iFlow)
+		}
+	}
+
+	if _, err := fieldRules(t, "64", "", "", "", "").ReplaceFields(pcaptest.IPv4UDP(0, nil)[14:30], 4); !errors.Is(err, common.ErrMalformedPacket) {
+		t.Errorf("Expected a malformed packet error, got %v", err)
+	}
+}
+
+func TestReplaceID(t *testing.T) {
+	rules := fieldRules(t, "", "", "", "sequential", "")
+	for i := 0; i < 3; i++ {
+		ipHeader := pcaptest.IPv4UDP(0, nil)[14:]
+		if !rules.ChangesID(ipHeader, 4) {
+			t.Fatal("Expected the identification to change")
+		}
+		rules.ReplaceID(ipHeader)
+
+		// The sequence starts at the identification of the first packet, 1
+		if iID := int(ipHeader[4])<<8 | int(ipHeader[5]); iID != 1+i {
+			t.Errorf("Packet %d: expected identification %d, got %d", i, 1+i, iID)
+		}
+		if iChecksum := checksum.IPv4Header(ipHeader); ipHeader[10] != byte(iChecksum>>8) || ipHeader[11] != byte(iChecksum) {
+			t.Errorf("Packet %d: expected a valid IPv4 header checksum", i)
+		}
+	}
+
+	// Fragments and IPv6 keep their identification
+	fragment := pcaptest.IPv4UDP(0, nil)[14:]
+	fragment[6] |= 0x20
+	if rules.ChangesID(fragment, 4) || rules.ChangesID(pcaptest.IPv6UDP(0, nil)[14:], 6) {
+		t.Error("Did not expect the identification of a fragment or an IPv6 packet to change")
+	}
+	if fieldRules(t, "64", "", "", "", "").ChangesID(pcaptest.IPv4UDP(0, nil)[14:], 4) {
+		t.Error("Did not expect the identification to change without an identification mode")
+	}
+}
+
+func TestMatchesHosts(t *testing.T) {
+	rules, err := ParseFieldRules("64", "", "", "", "", "10.0.2.32,2001:db8::99", "")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if !rules.MatchesHosts(pcaptest.IPv4UDP(0, nil)[14:], 4) {
+		t.Error("Expected the IPv4 packet from 10.0.2.32 to match")
+	}
+	if rules.MatchesHosts(pcaptest.IPv6UDP(0, nil)[14:], 6) {
+		t.Error("Did not expect the IPv6 packet to match")
+	}
+	if !fieldRules(t, "64", "", "", "", "").MatchesHosts(pcaptest.IPv6UDP(0, nil)[14:], 6) {
+		t.Error("Expected every packet to match without any hosts")
+	}
+}
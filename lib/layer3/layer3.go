@@ -9,6 +9,7 @@ package layer3
 import (
 	"fmt"
 	"github.com/google/gopacket"
+	"github.com/jordan2175/rewritecap/lib/checksum"
 	"github.com/jordan2175/rewritecap/lib/common"
 	"net"
 )
@@ -19,62 +20,132 @@ var iDebug = 0
 // -----------------------------------------------------------------------------
 // ReplaceIPv4Addresses()
 // -----------------------------------------------------------------------------
-func ReplaceIPv4Addresses(packet gopacket.Packet, i802dot1QOffset int, userSuppliedIPv4Address, userSuppliedIPv4AddressNew []byte) {
+// Lets compare the IPv4 address supplied with the one in the IPv4 header for
+// both the SRC IP and DST IP.  The 802.1Q offset is only used to find the
+// ethernet type, the network layer already starts at the IPv4 header.
+func ReplaceIPv4Addresses(packet gopacket.Packet, i802dot1QOffset int, userSuppliedIPv4Address, userSuppliedIPv4AddressNew []byte) error {
 	iEthType1 := 12 + i802dot1QOffset
 	iEthType2 := 13 + i802dot1QOffset
 
-	// Make sure the eth.type is 0800 and the IP type and size is 0x45 for IPv4
-	if packet.LinkLayer().LayerContents()[iEthType1] == 8 && packet.LinkLayer().LayerContents()[iEthType2] == 0 && packet.NetworkLayer().LayerContents()[0] == 69 {
+	if packet.LinkLayer() == nil || len(packet.Data()) <= iEthType2 {
+		return fmt.Errorf("%w: no ethernet header to read the ethernet type from", common.ErrMalformedPacket)
+	}
 
-		// Define the byte offsets for the data we are looking for
-		iLayer3SrcIPStart := 12 + i802dot1QOffset
-		iLayer3SrcIPEnd := iLayer3SrcIPStart + 4
-		iLayer3DstIPStart := 16 + i802dot1QOffset
-		iLayer3DstIPEnd := iLayer3DstIPStart + 4
+	// Make sure the eth.type is 0800
+	if packet.Data()[iEthType1] != 8 || packet.Data()[iEthType2] != 0 {
+		return nil
+	}
 
-		srcIPv4AddressFromPacket := packet.NetworkLayer().LayerContents()[iLayer3SrcIPStart:iLayer3SrcIPEnd]
-		dstIPv4AddressFromPacket := packet.NetworkLayer().LayerContents()[iLayer3DstIPStart:iLayer3DstIPEnd]
+	// gopacket will not give us a network layer if the IPv4 header could not
+	// be decoded, most likely because the frame was truncated
+	if packet.NetworkLayer() == nil {
+		return fmt.Errorf("%w: IPv4 header could not be decoded", common.ErrMalformedPacket)
+	}
+	return ReplaceIPv4HeaderAddresses(packet.NetworkLayer().LayerContents(), userSuppliedIPv4Address, userSuppliedIPv4AddressNew)
+} // ReplaceIPv4Addresses()
 
-		// Update SRC IP address
-		bSrcIPv4AddressMatch := common.AreByteSlicesEqual(srcIPv4AddressFromPacket, userSuppliedIPv4Address)
-		if bSrcIPv4AddressMatch {
-			if iDebug == 1 {
-				fmt.Println("DEBUG: There is a match on the SRC IPv4 Address, updating", userSuppliedIPv4Address, "to", userSuppliedIPv4AddressNew)
-			}
-			j := 0
-			for i := iLayer3SrcIPStart; i < iLayer3SrcIPEnd; i++ {
-				packet.NetworkLayer().LayerContents()[i] = userSuppliedIPv4AddressNew[j]
-				j++
-			}
+//
+// -----------------------------------------------------------------------------
+// ReplaceIPv4HeaderAddresses()
+// -----------------------------------------------------------------------------
+// This does the same thing as ReplaceIPv4Addresses but works directly on the
+// bytes of the IPv4 header.  The header checksum is updated for the new
+// addresses, the TCP or UDP checksum is left to the caller.
+func ReplaceIPv4HeaderAddresses(ipHeader []byte, userSuppliedIPv4Address, userSuppliedIPv4AddressNew []byte) error {
+	// Make sure the IP version is 4 and the header is at least the minimum size
+	if len(ipHeader) < 20 || ipHeader[0]>>4 != 4 || int(ipHeader[0]&0x0f)*4 < 20 || len(ipHeader) < int(ipHeader[0]&0x0f)*4 {
+		return fmt.Errorf("%w: IPv4 header is too short or has a bad version", common.ErrMalformedPacket)
+	}
+
+	// Define the byte offsets for the data we are looking for
+	iLayer3SrcIPStart := 12
+	iLayer3SrcIPEnd := iLayer3SrcIPStart + 4
+	iLayer3DstIPStart := 16
+	iLayer3DstIPEnd := iLayer3DstIPStart + 4
+
+	srcIPv4AddressFromPacket := ipHeader[iLayer3SrcIPStart:iLayer3SrcIPEnd]
+	dstIPv4AddressFromPacket := ipHeader[iLayer3DstIPStart:iLayer3DstIPEnd]
+	var oldAddresses [8]byte
+	copy(oldAddresses[:], ipHeader[iLayer3SrcIPStart:iLayer3DstIPEnd])
+
+	// Update SRC IP address
+	bSrcIPv4AddressMatch := common.AreByteSlicesEqual(srcIPv4AddressFromPacket, userSuppliedIPv4Address)
+	if bSrcIPv4AddressMatch {
+		if iDebug == 1 {
+			fmt.Println("DEBUG: There is a match on the SRC IPv4 Address, updating", userSuppliedIPv4Address, "to", userSuppliedIPv4AddressNew)
 		}
+		j := 0
+		for i := iLayer3SrcIPStart; i < iLayer3SrcIPEnd; i++ {
+			ipHeader[i] = userSuppliedIPv4AddressNew[j]
+			j++
+		}
+	}
 
-		// Update DST IP address
-		bDstIPv4AddressMatch := common.AreByteSlicesEqual(dstIPv4AddressFromPacket, userSuppliedIPv4Address)
-		if bDstIPv4AddressMatch {
+	// Update DST IP address
+	bDstIPv4AddressMatch := common.AreByteSlicesEqual(dstIPv4AddressFromPacket, userSuppliedIPv4Address)
+	if bDstIPv4AddressMatch {
+		if iDebug == 1 {
+			fmt.Println("DEBUG: There is a match on the DST IPv4 Address, updating", userSuppliedIPv4Address, "to", userSuppliedIPv4AddressNew)
+		}
+		j := 0
+		for i := iLayer3DstIPStart; i < iLayer3DstIPEnd; i++ {
+			ipHeader[i] = userSuppliedIPv4AddressNew[j]
+			j++
+		}
+	}
+
+	// Fix the header checksum for the addresses that changed
+	if bSrcIPv4AddressMatch || bDstIPv4AddressMatch {
+		iChecksum := uint16(ipHeader[10])<<8 | uint16(ipHeader[11])
+		iChecksum = checksum.Update(iChecksum, iLayer3SrcIPStart, oldAddresses[:], ipHeader[iLayer3SrcIPStart:iLayer3DstIPEnd])
+		ipHeader[10] = byte(iChecksum >> 8)
+		ipHeader[11] = byte(iChecksum)
+	}
+	return nil
+} // ReplaceIPv4HeaderAddresses()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceIPv6HeaderAddresses()
+// -----------------------------------------------------------------------------
+// Lets compare the IPv6 address supplied with the SRC IP and DST IP in the IPv6
+// header.  There is no checksum in the IPv6 header, the TCP or UDP checksum is
+// left to the caller.
+func ReplaceIPv6HeaderAddresses(ipHeader []byte, userSuppliedIPv6Address, userSuppliedIPv6AddressNew []byte) error {
+	if len(ipHeader) < 40 || ipHeader[0]>>4 != 6 {
+		return fmt.Errorf("%w: IPv6 header is too short or has a bad version", common.ErrMalformedPacket)
+	}
+
+	iLayer3SrcIPStart := 8
+	iLayer3DstIPStart := 24
+
+	for _, iStart := range []int{iLayer3SrcIPStart, iLayer3DstIPStart} {
+		if common.AreByteSlicesEqual(ipHeader[iStart:iStart+16], userSuppliedIPv6Address) {
 			if iDebug == 1 {
-				fmt.Println("DEBUG: There is a match on the DST IPv4 Address, updating", userSuppliedIPv4Address, "to", userSuppliedIPv4AddressNew)
-			}
-			j := 0
-			for i := iLayer3DstIPStart; i < iLayer3DstIPEnd; i++ {
-				packet.NetworkLayer().LayerContents()[i] = userSuppliedIPv4AddressNew[j]
-				j++
+				fmt.Println("DEBUG: There is a match on the IPv6 Address at offset", iStart, "updating", userSuppliedIPv6Address, "to", userSuppliedIPv6AddressNew)
 			}
+			copy(ipHeader[iStart:iStart+16], userSuppliedIPv6AddressNew)
 		}
 	}
-} // ReplaceIPv4Addresses()
+	return nil
+} // ReplaceIPv6HeaderAddresses()
 
 //
 // -----------------------------------------------------------------------------
 // ParseSuppliedLayer3IPv4Address()
 // -----------------------------------------------------------------------------
 // Figure out if we need to change a layer 3 IPv4 address
-func ParseSuppliedLayer3IPv4Address(address string) []byte {
+func ParseSuppliedLayer3IPv4Address(address string) ([]byte, error) {
 	userSuppliedIPv4Address := make([]byte, 4, 4)
 
 	// Since ParseIP returns a 16 byte slice (aka 128 bit address to accomodate IPv6)
-	// just grab what we need
+	// just grab what we need.  To4 returns nil if this is not an IPv4 address.
 	if address != "" {
-		userSuppliedIPv4Address = net.ParseIP(address)[12:16]
+		ip := net.ParseIP(address).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %s", address)
+		}
+		userSuppliedIPv4Address = ip
 
 		if iDebug == 1 {
 			fmt.Println("DEBUG: Passed in IPv4 Address to Change", address)
@@ -82,5 +153,30 @@ func ParseSuppliedLayer3IPv4Address(address string) []byte {
 		}
 	}
 
-	return userSuppliedIPv4Address
+	return userSuppliedIPv4Address, nil
 } // ParseSuppliedLayer3IPv4Address()
+
+//
+// -----------------------------------------------------------------------------
+// ParseSuppliedLayer3IPv6Address()
+// -----------------------------------------------------------------------------
+// Figure out if we need to change a layer 3 IPv6 address
+func ParseSuppliedLayer3IPv6Address(address string) ([]byte, error) {
+	userSuppliedIPv6Address := make([]byte, 16, 16)
+
+	// ParseIP also accepts IPv4 addresses, those have to go in --ip4
+	if address != "" {
+		ip := net.ParseIP(address)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %s", address)
+		}
+		userSuppliedIPv6Address = ip.To16()
+
+		if iDebug == 1 {
+			fmt.Println("DEBUG: Passed in IPv6 Address to Change", address)
+			fmt.Println("DEBUG: Parsed IPv6 Address to", userSuppliedIPv6Address)
+		}
+	}
+
+	return userSuppliedIPv6Address, nil
+} // ParseSuppliedLayer3IPv6Address()
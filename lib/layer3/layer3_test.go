@@ -0,0 +1,192 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layer3
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"net"
+	"testing"
+)
+
+var ipv4AddressNew = net.IP{2, 2, 2, 2}
+var ipv6AddressNew = net.ParseIP("2001:db8::99")
+
+func TestReplaceIPv4Addresses(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            []byte
+		i802dot1QOffset int
+		src             []byte
+		dst             []byte
+		bError          bool
+	}{
+		{"source", pcaptest.IPv4UDP(0, nil), 0, ipv4AddressNew, pcaptest.IPv4AddressB, false},
+		{"destination", pcaptest.IPv4TCP(0, nil), 0, pcaptest.IPv4AddressB, ipv4AddressNew, false},
+		{"802.1Q", pcaptest.IPv4TCP(1, nil), 4, pcaptest.IPv4AddressB, ipv4AddressNew, false},
+		{"Q-in-Q", pcaptest.IPv4UDP(2, nil), 8, ipv4AddressNew, pcaptest.IPv4AddressB, false},
+		{"not IPv4", pcaptest.ARPRequest(0), 0, nil, nil, false},
+		{"truncated", pcaptest.IPv4TCP(0, nil)[:24], 0, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := gopacket.NewPacket(tt.data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+			err := ReplaceIPv4Addresses(packet, tt.i802dot1QOffset, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+			if tt.bError {
+				if !errors.Is(err, common.ErrMalformedPacket) {
+					t.Fatal("Expected a malformed packet error, got ", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Unexpected error ", err)
+			}
+			if tt.src == nil {
+				return
+			}
+
+			iOffset := 14 + tt.i802dot1QOffset
+			if !bytes.Equal(tt.data[iOffset+12:iOffset+16], tt.src) {
+				t.Errorf("Expected SRC IP %v, got %v", tt.src, tt.data[iOffset+12:iOffset+16])
+			}
+			if !bytes.Equal(tt.data[iOffset+16:iOffset+20], tt.dst) {
+				t.Errorf("Expected DST IP %v, got %v", tt.dst, tt.data[iOffset+16:iOffset+20])
+			}
+			ipHeader := tt.data[iOffset : iOffset+20]
+			if sum := checksum.IPv4Header(ipHeader); ipHeader[10] != byte(sum>>8) || ipHeader[11] != byte(sum) {
+				t.Errorf("Expected the IPv4 checksum to be 0x%04x, got 0x%02x%02x", sum, ipHeader[10], ipHeader[11])
+			}
+		})
+	}
+}
+
+func TestReplaceIPv4HeaderAddresses(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipHeader []byte
+		bError   bool
+	}{
+		{"ok", pcaptest.IPv4UDP(0, nil)[14:], false},
+		{"short", pcaptest.IPv4UDP(0, nil)[14:30], true},
+		{"IPv6", pcaptest.IPv6UDP(0, nil)[14:], true},
+		{"bad header length", append([]byte{0x4f}, pcaptest.IPv4UDP(0, nil)[15:]...), true},
+	}
+
+	for _, tt := range tests {
+		err := ReplaceIPv4HeaderAddresses(tt.ipHeader, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+		if (err != nil) != tt.bError {
+			t.Errorf("%s: expected error %t, got %v", tt.name, tt.bError, err)
+		}
+	}
+}
+
+func TestReplaceIPv6HeaderAddresses(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipHeader []byte
+		src      []byte
+		dst      []byte
+		bError   bool
+	}{
+		{"source", pcaptest.IPv6UDP(0, nil)[14:], ipv6AddressNew, pcaptest.IPv6AddressB, false},
+		{"short", pcaptest.IPv6UDP(0, nil)[14:40], nil, nil, true},
+		{"IPv4", pcaptest.IPv4UDP(0, nil)[14:], nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		err := ReplaceIPv6HeaderAddresses(tt.ipHeader, pcaptest.IPv6AddressA, ipv6AddressNew)
+		if (err != nil) != tt.bError {
+			t.Errorf("%s: expected error %t, got %v", tt.name, tt.bError, err)
+			continue
+		}
+		if tt.src == nil {
+			continue
+		}
+		if !bytes.Equal(tt.ipHeader[8:24], tt.src) || !bytes.Equal(tt.ipHeader[24:40], tt.dst) {
+			t.Errorf("%s: expected %v > %v, got %v > %v", tt.name, net.IP(tt.src), net.IP(tt.dst), net.IP(tt.ipHeader[8:24]), net.IP(tt.ipHeader[24:40]))
+		}
+	}
+}
+
+func TestParseSuppliedLayer3IPv6Address(t *testing.T) {
+	tests := []struct {
+		address string
+		result  []byte
+		bError  bool
+	}{
+		{"", make([]byte, 16), false},
+		{"2001:db8::32", pcaptest.IPv6AddressA, false},
+		{"10.0.2.32", nil, true},
+		{"2001:db8::g", nil, true},
+	}
+
+	for _, tt := range tests {
+		result, err := ParseSuppliedLayer3IPv6Address(tt.address)
+		if (err != nil) != tt.bError {
+			t.Errorf("%q: expected error %t, got %v", tt.address, tt.bError, err)
+			continue
+		}
+		if !bytes.Equal(result, tt.result) {
+			t.Errorf("%q: expected %v, got %v", tt.address, tt.result, result)
+		}
+	}
+}
+
+func TestParseSuppliedLayer3IPv4Address(t *testing.T) {
+	tests := []struct {
+		address string
+		result  []byte
+		bError  bool
+	}{
+		{"", make([]byte, 4), false},
+		{"10.0.2.32", []byte{10, 0, 2, 32}, false},
+		{"300.1.1.1", nil, true},
+		{"2001:db8::1", nil, true},
+		{"not an address", nil, true},
+	}
+
+	for _, tt := range tests {
+		result, err := ParseSuppliedLayer3IPv4Address(tt.address)
+		if (err != nil) != tt.bError {
+			t.Errorf("%q: expected error %t, got %v", tt.address, tt.bError, err)
+			continue
+		}
+		if !bytes.Equal(result, tt.result) {
+			t.Errorf("%q: expected %v, got %v", tt.address, tt.result, result)
+		}
+	}
+}
+
+func FuzzReplaceIPv4HeaderAddresses(f *testing.F) {
+	for _, p := range pcaptest.Corpus() {
+		if len(p.Data) > 14 {
+			f.Add(p.Data[14:])
+		}
+	}
+	f.Fuzz(func(t *testing.T, ipHeader []byte) {
+		ReplaceIPv4HeaderAddresses(ipHeader, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+	})
+}
+
+func FuzzReplaceIPv4Addresses(f *testing.F) {
+	for _, p := range pcaptest.Corpus() {
+		f.Add(p.Data, 0)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, i802dot1QOffset int) {
+		if i802dot1QOffset < 0 || i802dot1QOffset > 8 {
+			return
+		}
+		packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{NoCopy: true})
+		ReplaceIPv4Addresses(packet, i802dot1QOffset, pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+	})
+}
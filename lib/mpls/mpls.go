@@ -0,0 +1,139 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package mpls changes the labels of an MPLS label stack and pops the whole
+// stack off a frame.  Each label in the stack is 4 bytes, a 20 bit label, 3 bits
+// of traffic class, the bottom of stack bit and a TTL.
+package mpls
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"strconv"
+	"strings"
+)
+
+var iDebug = 0
+
+// The biggest label that fits in 20 bits
+const iMaxLabel = 0xfffff
+
+// Rules map the old labels to the new ones
+type Rules struct {
+	Labels map[uint32]uint32
+}
+
+//
+// -----------------------------------------------------------------------------
+// ParseRules()
+// -----------------------------------------------------------------------------
+// This function will parse the label map from the command line, a list of
+// old=new labels separated by a comma
+func ParseRules(sMap string) (*Rules, error) {
+	rules := &Rules{Labels: make(map[uint32]uint32)}
+	for _, sPair := range strings.Split(sMap, ",") {
+		l := strings.SplitN(strings.TrimSpace(sPair), "=", 2)
+		if len(l) != 2 {
+			return nil, fmt.Errorf("invalid MPLS label mapping %s, it should be old=new", sPair)
+		}
+		iOld, err := parseLabel(l[0])
+		if err != nil {
+			return nil, err
+		}
+		iNew, err := parseLabel(l[1])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := rules.Labels[iOld]; ok {
+			return nil, fmt.Errorf("MPLS label %d is mapped more than once", iOld)
+		}
+		rules.Labels[iOld] = iNew
+	}
+	return rules, nil
+} // ParseRules()
+
+//
+// -----------------------------------------------------------------------------
+// Stack()
+// -----------------------------------------------------------------------------
+// This function will find the MPLS label stack of the frame.  The start and end
+// offsets of the labels that were captured are returned, a start of -1 means
+// there is no stack.
+func Stack(f *frame.Frame) (int, int) {
+	if f.MPLSLabels == 0 || f.LinkType != layers.LinkTypeEthernet {
+		return -1, -1
+	}
+	iStart := 14 + f.VLANOffset
+	return iStart, iStart + 4*f.MPLSLabels
+} // Stack()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceLabels()
+// -----------------------------------------------------------------------------
+// This function will change every label in the stack that is in the map.  The
+// traffic class, bottom of stack bit and TTL are left as they are.  The number
+// of labels that were changed is returned.
+func (rules *Rules) ReplaceLabels(stack []byte) int {
+	iChanges := 0
+	for i := 0; i+4 <= len(stack); i += 4 {
+		iLabel := uint32(stack[i])<<12 | uint32(stack[i+1])<<4 | uint32(stack[i+2])>>4
+		iNew, ok := rules.Labels[iLabel]
+		if !ok || iNew == iLabel {
+			continue
+		}
+		stack[i] = byte(iNew >> 12)
+		stack[i+1] = byte(iNew >> 4)
+		stack[i+2] = byte(iNew<<4) | stack[i+2]&0x0f
+		iChanges++
+		if iDebug == 1 {
+			fmt.Println("DEBUG: Changed MPLS label", iLabel, "to", iNew)
+		}
+	}
+	return iChanges
+} // ReplaceLabels()
+
+//
+// -----------------------------------------------------------------------------
+// Pop()
+// -----------------------------------------------------------------------------
+// This function will return a new copy of the frame without its MPLS label
+// stack, or nil if it has none or the stack was cut short.  An IP packet gets
+// the ethernet header and any 802.1Q tags of the frame with the ethernet type
+// set for it.  Anything else is taken to be an ethernet pseudowire with a
+// control word (RFC 4385), and the frame it carries is returned.
+func Pop(f *frame.Frame) []byte {
+	iStart, iEnd := Stack(f)
+	if iStart < 0 || f.NetworkOffset != iEnd {
+		return nil
+	}
+
+	if f.IPVersion != 0 {
+		ethType := layers.EthernetTypeIPv4
+		if f.IPVersion == 6 {
+			ethType = layers.EthernetTypeIPv6
+		}
+		data := make([]byte, 0, len(f.Data)-(iEnd-iStart))
+		data = append(data, f.Data[:iStart-2]...)
+		data = append(data, byte(ethType>>8), byte(ethType))
+		return append(data, f.Data[iEnd:]...)
+	}
+
+	if len(f.Data) < iEnd+4+14 || f.Data[iEnd]>>4 != 0 {
+		return nil
+	}
+	return append([]byte(nil), f.Data[iEnd+4:]...)
+} // Pop()
+
+// parseLabel reads one label from the label map
+func parseLabel(sLabel string) (uint32, error) {
+	iLabel, err := strconv.ParseUint(strings.TrimSpace(sLabel), 10, 32)
+	if err != nil || iLabel > iMaxLabel {
+		return 0, fmt.Errorf("invalid MPLS label %s, it should be 0 to %d", sLabel, iMaxLabel)
+	}
+	return uint32(iLabel), nil
+}
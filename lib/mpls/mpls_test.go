@@ -0,0 +1,105 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package mpls
+
+import (
+	"bytes"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("100=200, 300=1048575")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if len(rules.Labels) != 2 || rules.Labels[100] != 200 || rules.Labels[300] != 1048575 {
+		t.Errorf("Wrong label map %v", rules.Labels)
+	}
+
+	for _, sMap := range []string{"", "100", "100=", "100=200,100=300", "100=1048576", "-1=2", "a=b"} {
+		if _, err := ParseRules(sMap); err == nil {
+			t.Errorf("%q: expected an error", sMap)
+		}
+	}
+}
+
+func TestReplaceLabels(t *testing.T) {
+	rules, err := ParseRules("100=1048575,200=200")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	data := pcaptest.MPLS(4, 100, 200)
+	data[16] |= 0x0a // a traffic class on the first label
+	iStart, iEnd := Stack(pcaptest.Parse(t, data))
+	if iStart != 14 || iEnd != 22 {
+		t.Fatalf("Expected the stack at 14 to 22, got %d to %d", iStart, iEnd)
+	}
+
+	// Only the first label changes, the traffic class, bottom of stack bit and TTL
+	// stay the same
+	if iChanges := rules.ReplaceLabels(data[iStart:iEnd]); iChanges != 1 {
+		t.Errorf("Expected 1 label to change, got %d", iChanges)
+	}
+	expected := []byte{0xff, 0xff, 0xfa, 64, 0x00, 0x0c, 0x81, 64}
+	if !bytes.Equal(data[iStart:iEnd], expected) {
+		t.Errorf("Expected the stack\n% x\ngot\n% x", expected, data[iStart:iEnd])
+	}
+
+	if iStart, _ := Stack(pcaptest.Parse(t, pcaptest.IPv4UDP(0, nil))); iStart != -1 {
+		t.Errorf("Did not expect a stack, got one at %d", iStart)
+	}
+}
+
+func TestPop(t *testing.T) {
+	ipv4 := pcaptest.IPv4UDP(0, []byte("hello world"))
+	ipv6 := pcaptest.IPv6UDP(0, []byte("hello world"))
+	if data := Pop(pcaptest.Parse(t, pcaptest.MPLS(4, 100, 200, 300))); !bytes.Equal(data, ipv4) {
+		t.Errorf("IPv4: expected the frame\n% x\ngot\n% x", ipv4, data)
+	}
+	if data := Pop(pcaptest.Parse(t, pcaptest.MPLS(6, 100))); !bytes.Equal(data, ipv6) {
+		t.Errorf("IPv6: expected the frame\n% x\ngot\n% x", ipv6, data)
+	}
+
+	// An ethernet pseudowire with a control word gives up the frame it carries
+	pseudowire := append([]byte(nil), pcaptest.MPLS(4, 100)[:18]...)
+	pseudowire = append(append(pseudowire, 0, 0, 0, 1), ipv6...)
+	if data := Pop(pcaptest.Parse(t, pseudowire)); !bytes.Equal(data, ipv6) {
+		t.Errorf("Pseudowire: expected the frame\n% x\ngot\n% x", ipv6, data)
+	}
+
+	// A stack that was cut short is left alone
+	if data := Pop(pcaptest.Parse(t, pcaptest.MPLS(4, 100, 200)[:20])); data != nil {
+		t.Errorf("Did not expect a frame for a stack that was cut short, got % x", data)
+	}
+	if data := Pop(pcaptest.Parse(t, ipv4)); data != nil {
+		t.Errorf("Did not expect a frame without a stack, got % x", data)
+	}
+}
+
+func FuzzReplaceLabels(f *testing.F) {
+	rules, err := ParseRules("100=1048575,200=16")
+	if err != nil {
+		f.Fatal(err)
+	}
+	data := pcaptest.MPLS(4, 100, 200)
+	f.Add(data[14:22])
+	f.Fuzz(func(t *testing.T, stack []byte) {
+		original := append([]byte(nil), stack...)
+		iChanges := rules.ReplaceLabels(stack)
+		if iChanges > len(stack)/4 {
+			t.Errorf("Expected at most %d labels to change, got %d", len(stack)/4, iChanges)
+		}
+		for i := range stack {
+			if i%4 == 3 || i+4-i%4 > len(stack) {
+				if stack[i] != original[i] {
+					t.Errorf("Did not expect byte %d to change", i)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,288 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package payload searches the TCP and UDP payloads of packets for strings and
+// replaces them, for example to scrub a user name or an API key out of a
+// capture.  A replacement can be a different length from what it replaces.  The
+// rules can be limited to some ports or to the packets that match a BPF filter.
+// A string is only found if it is inside a single packet.
+package payload
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var iDebug = 0
+
+// The DNS port is left to the DNS rewrite, changing bytes in a DNS message
+// without knowing how its names are encoded would break it
+const iDNSPort = 53
+
+// Replacement is a single search and replace.  The search is either a literal
+// string or a regular expression, and in the second case the new string can use
+// $1 and the like for what the groups matched.
+type Replacement struct {
+	old   []byte
+	re    *regexp.Regexp
+	new   []byte
+	sRule string
+}
+
+// Rules are the replacements to make, in order, along with the ports and BPF
+// filter that limit which packets they are made in.  The filter has to be
+// compiled for the link type of the file before it is used.
+type Rules struct {
+	Replacements []Replacement
+	Ports        []uint16
+	sFilter      string
+	filter       *pcap.BPF
+	filterLock   sync.Mutex
+}
+
+//
+// -----------------------------------------------------------------------------
+// ParseRules()
+// -----------------------------------------------------------------------------
+// This function will parse the payload rules from the command line.  Each rule
+// is written like s/old/new/ for a literal string or s/old/new/r for a regular
+// expression, see ParseReplacement.  The ports are separated by a comma and the
+// filter is in the same syntax as tcpdump, both of them can be empty.
+func ParseRules(sRules []string, sPorts, sFilter string) (*Rules, error) {
+	rules := &Rules{sFilter: sFilter}
+	for _, sRule := range sRules {
+		r, err := ParseReplacement(sRule)
+		if err != nil {
+			return nil, err
+		}
+		rules.Replacements = append(rules.Replacements, r)
+	}
+
+	if sPorts != "" {
+		for _, sPort := range strings.Split(sPorts, ",") {
+			iPort, err := strconv.ParseUint(strings.TrimSpace(sPort), 10, 16)
+			if err != nil || iPort == 0 {
+				return nil, fmt.Errorf("invalid payload port %s", sPort)
+			}
+			rules.Ports = append(rules.Ports, uint16(iPort))
+		}
+	}
+	return rules, nil
+} // ParseRules()
+
+//
+// -----------------------------------------------------------------------------
+// ParseReplacement()
+// -----------------------------------------------------------------------------
+// This function will parse a single rule.  Like sed the character after the s
+// separates the parts of the rule, so s|/api/key|/api/xxx| works as well, and it
+// can be used inside a part by putting a backslash in front of it.  A literal
+// string may use \\, \n, \r, \t and \xNN, in a regular expression they are left
+// for the regular expression to handle.  The new string always understands them.
+func ParseReplacement(sRule string) (Replacement, error) {
+	if len(sRule) < 4 || sRule[0] != 's' {
+		return Replacement{}, fmt.Errorf("invalid payload rule %s, it should be s/old/new/", sRule)
+	}
+	cDelimiter := sRule[1]
+	parts := splitRule(sRule[2:], cDelimiter)
+	if len(parts) != 3 || (parts[2] != "" && parts[2] != "r") {
+		return Replacement{}, fmt.Errorf("invalid payload rule %s, it should be s/old/new/ or s/old/new/r", sRule)
+	}
+
+	r := Replacement{sRule: sRule}
+	new, err := unescape(parts[1])
+	if err != nil {
+		return Replacement{}, fmt.Errorf("invalid payload rule %s: %v", sRule, err)
+	}
+	r.new = new
+
+	if parts[2] == "r" {
+		r.re, err = regexp.Compile(parts[0])
+		if err != nil {
+			return Replacement{}, fmt.Errorf("invalid payload rule %s: %v", sRule, err)
+		}
+		// A pattern that matches nothing at all would match between every byte
+		if r.re.MatchString("") {
+			return Replacement{}, fmt.Errorf("invalid payload rule %s, the pattern matches an empty string", sRule)
+		}
+		return r, nil
+	}
+
+	r.old, err = unescape(parts[0])
+	if err != nil {
+		return Replacement{}, fmt.Errorf("invalid payload rule %s: %v", sRule, err)
+	}
+	if len(r.old) == 0 {
+		return Replacement{}, fmt.Errorf("invalid payload rule %s, there is nothing to search for", sRule)
+	}
+	return r, nil
+} // ParseReplacement()
+
+//
+// -----------------------------------------------------------------------------
+// Compile()
+// -----------------------------------------------------------------------------
+// This function will compile the BPF filter for the link type of the file the
+// packets come from.  It does nothing if there is no filter.
+func (rules *Rules) Compile(linkType layers.LinkType) error {
+	if rules.sFilter == "" {
+		return nil
+	}
+	filter, err := pcap.NewBPF(linkType, 65535, rules.sFilter)
+	if err != nil {
+		return fmt.Errorf("invalid payload filter %s: %v", rules.sFilter, err)
+	}
+	rules.filter = filter
+	return nil
+} // Compile()
+
+//
+// -----------------------------------------------------------------------------
+// MatchesFilter()
+// -----------------------------------------------------------------------------
+// This function will check the packet against the BPF filter, it has to be the
+// packet as it was captured as the filter can name the addresses that are being
+// rewritten.  Every packet matches if there is no filter.  It is safe to call
+// from more than one goroutine.
+func (rules *Rules) MatchesFilter(ci gopacket.CaptureInfo, data []byte) bool {
+	if rules.filter == nil {
+		return true
+	}
+	if len(data) == 0 {
+		return false
+	}
+
+	// The filter keeps the packet header it hands to libpcap in itself
+	rules.filterLock.Lock()
+	defer rules.filterLock.Unlock()
+	return rules.filter.Matches(ci, data)
+} // MatchesFilter()
+
+//
+// -----------------------------------------------------------------------------
+// AppliesTo()
+// -----------------------------------------------------------------------------
+// This function will check that the frame has a TCP or UDP payload that the
+// rules can change.  If there are ports one of them has to be the source or the
+// destination port.  The DNS port is never changed.
+func (rules *Rules) AppliesTo(f *frame.Frame) bool {
+	if f.IPProtocol != layers.IPProtocolTCP && f.IPProtocol != layers.IPProtocolUDP {
+		return false
+	}
+	iSrcPort, iDstPort := f.Ports()
+	if iSrcPort == iDNSPort || iDstPort == iDNSPort {
+		return false
+	}
+	if len(rules.Ports) == 0 {
+		return true
+	}
+	for _, iPort := range rules.Ports {
+		if iSrcPort == iPort || iDstPort == iPort {
+			return true
+		}
+	}
+	return false
+} // AppliesTo()
+
+//
+// -----------------------------------------------------------------------------
+// Replace()
+// -----------------------------------------------------------------------------
+// This function will make each of the replacements in turn, every match of a
+// rule is replaced before the next rule is looked at.  The payload passed in is
+// never changed, the new payload is returned along with the number of matches
+// that were replaced.
+func (rules *Rules) Replace(payload []byte) ([]byte, int) {
+	iChanges := 0
+	for _, r := range rules.Replacements {
+		var iMatches int
+		if r.re != nil {
+			iMatches = len(r.re.FindAllIndex(payload, -1))
+			if iMatches > 0 {
+				payload = r.re.ReplaceAll(payload, r.new)
+			}
+		} else {
+			iMatches = bytes.Count(payload, r.old)
+			if iMatches > 0 {
+				payload = bytes.Replace(payload, r.old, r.new, -1)
+			}
+		}
+		if iMatches > 0 && iDebug == 1 {
+			fmt.Println("DEBUG: Payload rule", r.sRule, "matched", iMatches, "times")
+		}
+		iChanges += iMatches
+	}
+	return payload, iChanges
+} // Replace()
+
+// splitRule splits the rule on the delimiter, a delimiter with a backslash in
+// front of it is kept without the backslash
+func splitRule(sRule string, cDelimiter byte) []string {
+	var parts []string
+	var part []byte
+	for i := 0; i < len(sRule); i++ {
+		switch {
+		case sRule[i] == '\\' && i+1 < len(sRule) && sRule[i+1] == cDelimiter:
+			part = append(part, cDelimiter)
+			i++
+		case sRule[i] == '\\' && i+1 < len(sRule):
+			part = append(part, sRule[i], sRule[i+1])
+			i++
+		case sRule[i] == cDelimiter:
+			parts = append(parts, string(part))
+			part = nil
+		default:
+			part = append(part, sRule[i])
+		}
+	}
+	return append(parts, string(part))
+}
+
+// unescape turns \\, \n, \r, \t and \xNN in to the bytes they stand for
+func unescape(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return nil, fmt.Errorf("backslash at the end of %s", s)
+		}
+		i++
+		switch s[i] {
+		case '\\':
+			b = append(b, '\\')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("short \\x escape in %s", s)
+			}
+			c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid \\x escape in %s", s)
+			}
+			b = append(b, byte(c))
+			i += 2
+		default:
+			return nil, fmt.Errorf("unknown escape \\%c in %s", s[i], s)
+		}
+	}
+	return b, nil
+}
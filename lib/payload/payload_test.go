@@ -0,0 +1,169 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package payload
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+func TestParseReplacement(t *testing.T) {
+	tests := []struct {
+		sRule  string
+		old    string
+		new    string
+		bRegex bool
+		bError bool
+	}{
+		{"s/alice/bob/", "alice", "bob", false, false},
+		{"s|/api/key|/api/xxx|", "/api/key", "/api/xxx", false, false},
+		{`s/a\/b/c/`, "a/b", "c", false, false},
+		{`s/\x00\r\n/\t/`, "\x00\r\n", "\t", false, false},
+		{`s/key=[0-9a-f]+/key=$1/r`, `key=[0-9a-f]+`, "key=$1", true, false},
+		{"s/alice/bob", "", "", false, true},
+		{"s/alice/bob/g", "", "", false, true},
+		{"x/alice/bob/", "", "", false, true},
+		{"s//bob/", "", "", false, true},
+		{"s/a*/bob/r", "", "", false, true},
+		{"s/(/bob/r", "", "", false, true},
+		{`s/\q/bob/`, "", "", false, true},
+		{`s/\x4/bob/`, "", "", false, true},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseReplacement(tt.sRule)
+		if tt.bError {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.sRule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.sRule, err)
+			continue
+		}
+		if tt.bRegex {
+			if r.re == nil || r.re.String() != tt.old {
+				t.Errorf("%s: expected the regular expression %s, got %v", tt.sRule, tt.old, r.re)
+			}
+		} else if r.re != nil || string(r.old) != tt.old {
+			t.Errorf("%s: expected %q, got %q", tt.sRule, tt.old, r.old)
+		}
+		if string(r.new) != tt.new {
+			t.Errorf("%s: expected %q, got %q", tt.sRule, tt.new, r.new)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]string{"s/a/b/", "s/c/d/"}, "80, 8080", "")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if len(rules.Replacements) != 2 || len(rules.Ports) != 2 || rules.Ports[0] != 80 || rules.Ports[1] != 8080 {
+		t.Errorf("Wrong rules %+v", rules)
+	}
+
+	for _, sPorts := range []string{"http", "0", "65536", "80,"} {
+		if _, err := ParseRules([]string{"s/a/b/"}, sPorts, ""); err == nil {
+			t.Errorf("%s: expected an error", sPorts)
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		payload  string
+		expected string
+		iChanges int
+	}{
+		{"literal", []string{"s/alice/bob/"}, "user=alice&name=alice", "user=bob&name=bob", 2},
+		{"no match", []string{"s/alice/bob/"}, "user=carol", "user=carol", 0},
+		{"regex", []string{`s/key=([0-9a-f]+)/key=<$1>/r`}, "GET /?key=c0ffee HTTP/1.1", "GET /?key=<c0ffee> HTTP/1.1", 1},
+		{"in order", []string{"s/alice/bob/", "s/bob/carol/"}, "alice bob", "carol carol", 3},
+		{"binary", []string{`s/\x00\x01/\xff/`}, "a\x00\x01b", "a\xffb", 1},
+	}
+
+	for _, tt := range tests {
+		rules, err := ParseRules(tt.rules, "", "")
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		payload := []byte(tt.payload)
+		newPayload, iChanges := rules.Replace(payload)
+		if string(newPayload) != tt.expected || iChanges != tt.iChanges {
+			t.Errorf("%s: expected %q %d, got %q %d", tt.name, tt.expected, tt.iChanges, newPayload, iChanges)
+		}
+		if string(payload) != tt.payload {
+			t.Errorf("%s: the payload passed in was changed", tt.name)
+		}
+	}
+}
+
+func TestAppliesTo(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		sPorts   string
+		expected bool
+	}{
+		{"tcp", pcaptest.ServerTCP(4002, 80, false, 1, 1, []byte("x")), "", true},
+		{"port", pcaptest.ServerTCP(4002, 80, true, 1, 1, []byte("x")), "80", true},
+		{"other port", pcaptest.ServerTCP(4002, 80, false, 1, 1, []byte("x")), "443", false},
+		{"dns", pcaptest.DNSOverUDP(4, pcaptest.DNSQuery("www.example.com", 1)), "", false},
+		{"arp", pcaptest.ARPRequest(0), "", false},
+	}
+
+	for _, tt := range tests {
+		rules, err := ParseRules([]string{"s/a/b/"}, tt.sPorts, "")
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		f := pcaptest.Parse(t, tt.data)
+		if rules.AppliesTo(f) != tt.expected {
+			t.Errorf("%s: expected %t", tt.name, tt.expected)
+		}
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	// Without a filter every packet matches, even once it has been compiled
+	rules, err := ParseRules([]string{"s/a/b/"}, "", "")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if err := rules.Compile(layers.LinkTypeEthernet); err != nil || rules.filter != nil {
+		t.Fatal("Unexpected filter ", err)
+	}
+	data := pcaptest.ServerTCP(4002, 80, false, 1, 1, []byte("x"))
+	if !rules.MatchesFilter(gopacket.CaptureInfo{Length: len(data)}, data) {
+		t.Error("Expected the packet to match")
+	}
+}
+
+func FuzzReplace(f *testing.F) {
+	rules, err := ParseRules([]string{"s/alice/bob/", `s/key=([0-9a-f]+)/key=$1$1/r`}, "", "")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte("user=alice&key=c0ffee"))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		original := append([]byte(nil), payload...)
+		newPayload, iChanges := rules.Replace(payload)
+		if !bytes.Equal(payload, original) {
+			t.Error("The payload passed in was changed")
+		}
+		if iChanges == 0 && !bytes.Equal(newPayload, original) {
+			t.Error("The payload changed without a change being counted")
+		}
+	})
+}
@@ -0,0 +1,659 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package pcaptest builds the packets and PCAP files that are used by the tests
+// and benchmarks of the other packages.  Every frame is built the same way each
+// time so the files can be compared with golden copies.
+package pcaptest
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The addresses used in the test packets
+var (
+	MacAddressA  = net.HardwareAddr{0x68, 0xa8, 0x6d, 0x18, 0x36, 0x92}
+	MacAddressB  = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	IPv4AddressA = net.IP{10, 0, 2, 32}
+	IPv4AddressB = net.IP{8, 8, 8, 8}
+	IPv6AddressA = net.ParseIP("2001:db8::32")
+	IPv6AddressB = net.ParseIP("2001:db8::8")
+)
+
+// StartTime is the timestamp of the first packet in a file built by WriteFile
+var StartTime = time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+// Packet is a named test frame
+type Packet struct {
+	Name string
+	Data []byte
+}
+
+//
+// -----------------------------------------------------------------------------
+// Serialize()
+// -----------------------------------------------------------------------------
+// Build a frame from the layers with the lengths and checksums filled in.  It
+// panics if the layers can not be serialized as that is a bug in the test.
+func Serialize(l ...gopacket.SerializableLayer) []byte {
+	for _, layer := range l {
+		if ip, ok := layer.(gopacket.NetworkLayer); ok {
+			for _, other := range l {
+				if t, ok := other.(interface {
+					SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+				}); ok {
+					t.SetNetworkLayerForChecksum(ip)
+				}
+			}
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		panic(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+} // Serialize()
+
+//
+// -----------------------------------------------------------------------------
+// Parse()
+// -----------------------------------------------------------------------------
+// Find the headers of an ethernet test frame, the test fails if they can not be
+// found
+func Parse(t testing.TB, data []byte) *frame.Frame {
+	t.Helper()
+	f, err := frame.Parse(data, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+} // Parse()
+
+//
+// -----------------------------------------------------------------------------
+// Ethernet()
+// -----------------------------------------------------------------------------
+// Build the ethernet header and any 802.1Q tags.  With two tags the outer one is
+// an 802.1ad (Q-in-Q) tag.
+func Ethernet(src, dst net.HardwareAddr, iTags int, ethType layers.EthernetType) []gopacket.SerializableLayer {
+	eth := &layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: ethType}
+	l := []gopacket.SerializableLayer{eth}
+
+	switch iTags {
+	case 1:
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		l = append(l, &layers.Dot1Q{VLANIdentifier: 100, Type: ethType})
+	case 2:
+		eth.EthernetType = layers.EthernetTypeQinQ
+		l = append(l, &layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeDot1Q})
+		l = append(l, &layers.Dot1Q{VLANIdentifier: 100, Type: ethType})
+	}
+	return l
+} // Ethernet()
+
+//
+// -----------------------------------------------------------------------------
+// IPv4UDP()
+// -----------------------------------------------------------------------------
+// Build an IPv4 UDP packet from A to B
+func IPv4UDP(iTags int, payload []byte) []byte {
+	l := Ethernet(MacAddressA, MacAddressB, iTags, layers.EthernetTypeIPv4)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Id: 1, Protocol: layers.IPProtocolUDP, SrcIP: IPv4AddressA, DstIP: IPv4AddressB}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5000}
+	l = append(l, ip, udp, gopacket.Payload(payload))
+	return Serialize(l...)
+} // IPv4UDP()
+
+//
+// -----------------------------------------------------------------------------
+// IPv4TCP()
+// -----------------------------------------------------------------------------
+// Build an IPv4 TCP packet from B to A
+func IPv4TCP(iTags int, payload []byte) []byte {
+	l := Ethernet(MacAddressB, MacAddressA, iTags, layers.EthernetTypeIPv4)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Id: 2, Protocol: layers.IPProtocolTCP, SrcIP: IPv4AddressB, DstIP: IPv4AddressA}
+	tcp := &layers.TCP{SrcPort: 80, DstPort: 4000, Seq: 1000, Ack: 2000, ACK: true, PSH: true, Window: 1000}
+	l = append(l, ip, tcp, gopacket.Payload(payload))
+	return Serialize(l...)
+} // IPv4TCP()
+
+//
+// -----------------------------------------------------------------------------
+// IPv6UDP()
+// -----------------------------------------------------------------------------
+// Build an IPv6 UDP packet from A to B
+func IPv6UDP(iTags int, payload []byte) []byte {
+	l := Ethernet(MacAddressA, MacAddressB, iTags, layers.EthernetTypeIPv6)
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: IPv6AddressA, DstIP: IPv6AddressB}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5000}
+	l = append(l, ip, udp, gopacket.Payload(payload))
+	return Serialize(l...)
+} // IPv6UDP()
+
+//
+// -----------------------------------------------------------------------------
+// ARPRequest()
+// -----------------------------------------------------------------------------
+// Build an ARP request from A asking for B
+func ARPRequest(iTags int) []byte {
+	l := Ethernet(MacAddressA, layers.EthernetBroadcast, iTags, layers.EthernetTypeARP)
+	a := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   MacAddressA,
+		SourceProtAddress: IPv4AddressA.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    IPv4AddressB.To4(),
+	}
+	l = append(l, a)
+	return Serialize(l...)
+} // ARPRequest()
+
+//
+// -----------------------------------------------------------------------------
+// DNSName()
+// -----------------------------------------------------------------------------
+// Encode a dotted name in DNS wire form
+func DNSName(sName string) []byte {
+	var wire []byte
+	for _, sLabel := range strings.Split(strings.TrimSuffix(sName, "."), ".") {
+		wire = append(wire, byte(len(sLabel)))
+		wire = append(wire, sLabel...)
+	}
+	return append(wire, 0)
+} // DNSName()
+
+//
+// -----------------------------------------------------------------------------
+// DNSQuery()
+// -----------------------------------------------------------------------------
+// Build a DNS query with a single question
+func DNSQuery(sName string, iType uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, DNSName(sName)...)
+	return append(msg, byte(iType>>8), byte(iType), 0, 1)
+} // DNSQuery()
+
+//
+// -----------------------------------------------------------------------------
+// DNSResponse()
+// -----------------------------------------------------------------------------
+// Build a DNS response with a single answer.  The name of the answer is a
+// compression pointer back to the question, the way servers send them.
+func DNSResponse(sName string, iType uint16, rdata []byte) []byte {
+	msg := DNSQuery(sName, iType)
+	msg[2], msg[3], msg[7] = 0x81, 0x80, 1
+	msg = append(msg, 0xc0, 12, byte(iType>>8), byte(iType), 0, 1, 0, 0, 0x0e, 0x10)
+	msg = append(msg, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(msg, rdata...)
+} // DNSResponse()
+
+//
+// -----------------------------------------------------------------------------
+// ServerUDP()
+// -----------------------------------------------------------------------------
+// Build a UDP packet between a client on A and a server on B, over IPv4 or IPv6.
+// If bFromServer is true the packet goes from the server back to the client.
+func ServerUDP(iIPVersion int, iClientPort, iServerPort uint16, bFromServer bool, payload []byte) []byte {
+	udp := &layers.UDP{SrcPort: layers.UDPPort(iClientPort), DstPort: layers.UDPPort(iServerPort)}
+	src, dst := MacAddressA, MacAddressB
+	if bFromServer {
+		udp.SrcPort, udp.DstPort = udp.DstPort, udp.SrcPort
+		src, dst = MacAddressB, MacAddressA
+	}
+
+	var l []gopacket.SerializableLayer
+	if iIPVersion == 6 {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: IPv6AddressA, DstIP: IPv6AddressB}
+		if bFromServer {
+			ip.SrcIP, ip.DstIP = IPv6AddressB, IPv6AddressA
+		}
+		l = append(Ethernet(src, dst, 0, layers.EthernetTypeIPv6), ip)
+	} else {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Id: 3, Protocol: layers.IPProtocolUDP, SrcIP: IPv4AddressA, DstIP: IPv4AddressB}
+		if bFromServer {
+			ip.SrcIP, ip.DstIP = IPv4AddressB, IPv4AddressA
+		}
+		l = append(Ethernet(src, dst, 0, layers.EthernetTypeIPv4), ip)
+	}
+	l = append(l, udp, gopacket.Payload(payload))
+	return Serialize(l...)
+} // ServerUDP()
+
+//
+// -----------------------------------------------------------------------------
+// DNSOverUDP()
+// -----------------------------------------------------------------------------
+// Build a DNS message over UDP.  Queries go from A to the server on B and the
+// responses come back, over IPv4 or IPv6.
+func DNSOverUDP(iIPVersion int, msg []byte) []byte {
+	return ServerUDP(iIPVersion, 1234, 53, msg[2]&0x80 != 0, msg)
+} // DNSOverUDP()
+
+//
+// -----------------------------------------------------------------------------
+// DHCPAck()
+// -----------------------------------------------------------------------------
+// Build a DHCP ack from the server on B that gives address A to the client with
+// MAC address A.  The options name B and A as the DNS servers.
+func DHCPAck() []byte {
+	msg := make([]byte, 240)
+	msg[0], msg[1], msg[2] = 2, 1, 6
+	copy(msg[4:], []byte{0xde, 0xad, 0xbe, 0xef})
+	copy(msg[16:], IPv4AddressA.To4())
+	copy(msg[20:], IPv4AddressB.To4())
+	copy(msg[28:], MacAddressA)
+	copy(msg[236:], []byte{99, 130, 83, 99})
+
+	msg = append(msg, 53, 1, 5)
+	msg = append(msg, 54, 4)
+	msg = append(msg, IPv4AddressB.To4()...)
+	msg = append(msg, 6, 8)
+	msg = append(msg, IPv4AddressB.To4()...)
+	msg = append(msg, IPv4AddressA.To4()...)
+	msg = append(msg, 61, 7, 1)
+	msg = append(msg, MacAddressA...)
+	msg = append(msg, 255)
+	return ServerUDP(4, 68, 67, true, msg)
+} // DHCPAck()
+
+//
+// -----------------------------------------------------------------------------
+// DHCPv6Reply()
+// -----------------------------------------------------------------------------
+// Build a DHCPv6 reply from the server on B that gives address A to the client
+// with MAC address A.  The options name B and A as the DNS servers.
+func DHCPv6Reply() []byte {
+	option := func(msg []byte, iCode uint16, value ...[]byte) []byte {
+		iLength := 0
+		for _, v := range value {
+			iLength += len(v)
+		}
+		msg = append(msg, byte(iCode>>8), byte(iCode), byte(iLength>>8), byte(iLength))
+		for _, v := range value {
+			msg = append(msg, v...)
+		}
+		return msg
+	}
+
+	msg := []byte{7, 0x12, 0x34, 0x56}
+	msg = option(msg, 1, []byte{0, 3, 0, 1}, MacAddressA)
+	msg = option(msg, 2, []byte{0, 1, 0, 1, 0x1d, 0x2b, 0x3c, 0x4d}, MacAddressB)
+	iaAddress := option(nil, 5, IPv6AddressA, []byte{0, 0, 0x0e, 0x10, 0, 0, 0x1c, 0x20})
+	msg = option(msg, 3, []byte{0, 0, 0, 1, 0, 0, 0x07, 0x08, 0, 0, 0x0b, 0x40}, iaAddress)
+	msg = option(msg, 23, IPv6AddressB, IPv6AddressA)
+	return ServerUDP(6, 546, 547, true, msg)
+} // DHCPv6Reply()
+
+//
+// -----------------------------------------------------------------------------
+// ICMPUnreachable()
+// -----------------------------------------------------------------------------
+// Build an ICMP or ICMPv6 port unreachable from B back to A, it quotes the UDP
+// datagram that A sent to B
+func ICMPUnreachable(iIPVersion int) []byte {
+	if iIPVersion == 6 {
+		datagram := IPv6UDP(0, []byte("hello world"))
+		quoted := datagram[14 : 14+40+8+11]
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: IPv6AddressB, DstIP: IPv6AddressA}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)}
+		l := append(Ethernet(MacAddressB, MacAddressA, 0, layers.EthernetTypeIPv6), ip, icmp, gopacket.Payload(append([]byte{0, 0, 0, 0}, quoted...)))
+		return Serialize(l...)
+	}
+
+	datagram := IPv4UDP(0, []byte("hello world"))
+	quoted := datagram[14 : 14+20+8+11]
+	ip := &layers.IPv4{Version: 4, TTL: 64, Id: 6, Protocol: layers.IPProtocolICMPv4, SrcIP: IPv4AddressB, DstIP: IPv4AddressA}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)}
+	l := append(Ethernet(MacAddressB, MacAddressA, 0, layers.EthernetTypeIPv4), ip, icmp, gopacket.Payload(quoted))
+	return Serialize(l...)
+} // ICMPUnreachable()
+
+//
+// -----------------------------------------------------------------------------
+// Tunnel()
+// -----------------------------------------------------------------------------
+// Build a tunnel packet from A to B that carries the IPv4 UDP packet built by
+// IPv4UDP, as a whole ethernet frame or just its IP packet.  The kind is gre
+// (with a GRE checksum), gre-eth, vxlan, geneve, ipip, 6in4 (which carries the
+// IPv6 UDP packet instead) or gtpu.
+func Tunnel(sKind string) []byte {
+	inner := IPv4UDP(0, []byte("hello world"))
+	packet := inner[14:]
+
+	ipProtocol := layers.IPProtocolUDP
+	var iPort layers.UDPPort
+	var payload []byte
+	switch sKind {
+	case "gre":
+		ipProtocol = layers.IPProtocolGRE
+		payload = append([]byte{0x80, 0, 0x08, 0x00, 0, 0, 0, 0}, packet...)
+		iChecksum := ^checksum.Fold(checksum.Sum(payload, 0))
+		payload[4], payload[5] = byte(iChecksum>>8), byte(iChecksum)
+	case "gre-eth":
+		ipProtocol = layers.IPProtocolGRE
+		payload = append([]byte{0, 0, 0x65, 0x58}, inner...)
+	case "vxlan":
+		iPort = 4789
+		payload = append([]byte{0x08, 0, 0, 0, 0, 0, 100, 0}, inner...)
+	case "geneve":
+		iPort = 6081
+		payload = append([]byte{0x01, 0, 0x65, 0x58, 0, 0, 100, 0, 0x01, 0x02, 0x03, 0x00}, inner...)
+	case "ipip":
+		ipProtocol = layers.IPProtocolIPv4
+		payload = packet
+	case "6in4":
+		ipProtocol = layers.IPProtocolIPv6
+		payload = IPv6UDP(0, []byte("hello world"))[14:]
+	case "gtpu":
+		iPort = 2152
+		payload = append([]byte{0x30, 0xff, byte(len(packet) >> 8), byte(len(packet)), 0, 0, 0, 1}, packet...)
+	default:
+		panic("unknown tunnel " + sKind)
+	}
+
+	l := Ethernet(MacAddressA, MacAddressB, 0, layers.EthernetTypeIPv4)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Id: 7, Protocol: ipProtocol, SrcIP: IPv4AddressA, DstIP: IPv4AddressB}
+	l = append(l, ip)
+	if ipProtocol == layers.IPProtocolUDP {
+		l = append(l, &layers.UDP{SrcPort: iPort, DstPort: iPort})
+	}
+	l = append(l, gopacket.Payload(payload))
+	return Serialize(l...)
+} // Tunnel()
+
+//
+// -----------------------------------------------------------------------------
+// MPLS()
+// -----------------------------------------------------------------------------
+// Build an MPLS frame from A to B that carries the IPv4 or IPv6 UDP packet built
+// by IPv4UDP or IPv6UDP under the labels, the last one is the bottom of the
+// stack
+func MPLS(iIPVersion int, labels ...uint32) []byte {
+	inner := IPv4UDP(0, []byte("hello world"))
+	if iIPVersion == 6 {
+		inner = IPv6UDP(0, []byte("hello world"))
+	}
+
+	var stack []byte
+	for i, iLabel := range labels {
+		var iBottom byte
+		if i == len(labels)-1 {
+			iBottom = 0x01
+		}
+		stack = append(stack, byte(iLabel>>12), byte(iLabel>>4), byte(iLabel<<4)|iBottom, 64)
+	}
+	l := Ethernet(MacAddressA, MacAddressB, 0, layers.EthernetTypeMPLSUnicast)
+	l = append(l, gopacket.Payload(append(stack, inner[14:]...)))
+	return Serialize(l...)
+} // MPLS()
+
+//
+// -----------------------------------------------------------------------------
+// PPPoE()
+// -----------------------------------------------------------------------------
+// Build a PPPoE session frame from A to B that carries the IPv4 or IPv6 UDP packet
+// built by IPv4UDP or IPv6UDP in PPP
+func PPPoE(iIPVersion int, iSession uint16) []byte {
+	inner := IPv4UDP(0, []byte("hello world"))
+	var iProtocol uint16 = 0x0021
+	if iIPVersion == 6 {
+		inner = IPv6UDP(0, []byte("hello world"))
+		iProtocol = 0x0057
+	}
+	packet := inner[14:]
+
+	iLength := 2 + len(packet)
+	header := []byte{0x11, 0x00, byte(iSession >> 8), byte(iSession), byte(iLength >> 8), byte(iLength), byte(iProtocol >> 8), byte(iProtocol)}
+	l := Ethernet(MacAddressA, MacAddressB, 0, layers.EthernetTypePPPoESession)
+	l = append(l, gopacket.Payload(append(header, packet...)))
+	return Serialize(l...)
+} // PPPoE()
+
+//
+// -----------------------------------------------------------------------------
+// DNSOverTCP()
+// -----------------------------------------------------------------------------
+// Build a DNS response over TCP from the server on B to A, the message has its
+// two byte length in front of it
+func DNSOverTCP(msg []byte) []byte {
+	l := Ethernet(MacAddressB, MacAddressA, 0, layers.EthernetTypeIPv4)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Id: 4, Protocol: layers.IPProtocolTCP, SrcIP: IPv4AddressB, DstIP: IPv4AddressA}
+	tcp := &layers.TCP{SrcPort: 53, DstPort: 4001, Seq: 3000, Ack: 4000, ACK: true, PSH: true, Window: 1000}
+	payload := append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	l = append(l, ip, tcp, gopacket.Payload(payload))
+	return Serialize(l...)
+} // DNSOverTCP()
+
+//
+// -----------------------------------------------------------------------------
+// ServerTCP()
+// -----------------------------------------------------------------------------
+// Build an IPv4 TCP segment between a client on A and a server on B.  If
+// bFromServer is true the segment goes from the server back to the client.
+func ServerTCP(iClientPort, iServerPort uint16, bFromServer bool, iSeq, iAck uint32, payload []byte) []byte {
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(iClientPort), DstPort: layers.TCPPort(iServerPort), Seq: iSeq, Ack: iAck, ACK: true, PSH: true, Window: 1000}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Id: 5, Protocol: layers.IPProtocolTCP, SrcIP: IPv4AddressA, DstIP: IPv4AddressB}
+	src, dst := MacAddressA, MacAddressB
+	if bFromServer {
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		src, dst = MacAddressB, MacAddressA
+	}
+
+	l := append(Ethernet(src, dst, 0, layers.EthernetTypeIPv4), ip, tcp, gopacket.Payload(payload))
+	return Serialize(l...)
+} // ServerTCP()
+
+//
+// -----------------------------------------------------------------------------
+// TLSClientHello()
+// -----------------------------------------------------------------------------
+// Build a TLS record with a ClientHello that asks for the server name.  The
+// server name extension is followed by a supported versions extension.
+func TLSClientHello(sServerName string) []byte {
+	serverName := []byte{0, byte(len(sServerName) >> 8), byte(len(sServerName))}
+	serverName = append(serverName, sServerName...)
+	serverName = append([]byte{byte(len(serverName) >> 8), byte(len(serverName))}, serverName...)
+
+	var extensions []byte
+	extensions = append(extensions, 0, 0, byte(len(serverName)>>8), byte(len(serverName)))
+	extensions = append(extensions, serverName...)
+	extensions = append(extensions, 0, 43, 0, 3, 2, 3, 4)
+
+	hello := []byte{3, 3}
+	for i := 0; i < 32; i++ {
+		hello = append(hello, byte(i))
+	}
+	hello = append(hello, 0, 0, 2, 0x13, 0x01, 1, 0)
+	hello = append(hello, byte(len(extensions)>>8), byte(len(extensions)))
+	hello = append(hello, extensions...)
+
+	handshake := append([]byte{1, 0, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	return append([]byte{22, 3, 1, byte(len(handshake) >> 8), byte(len(handshake))}, handshake...)
+} // TLSClientHello()
+
+//
+// -----------------------------------------------------------------------------
+// Corpus()
+// -----------------------------------------------------------------------------
+// Every kind of frame the rewrite functions need to handle, including broken
+// ones that are cut short
+func Corpus() []Packet {
+	payload := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	tcp := IPv4TCP(0, payload)
+
+	// A connection where the first request changes length, the rest of the
+	// connection has to follow it
+	request := []byte("GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: test\r\n\r\n")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+
+	return []Packet{
+		{"ipv4-udp", IPv4UDP(0, []byte("hello world"))},
+		{"ipv4-tcp", tcp},
+		{"ipv4-tcp-8021q", IPv4TCP(1, payload)},
+		{"ipv4-tcp-qinq", IPv4TCP(2, payload)},
+		{"ipv6-udp", IPv6UDP(0, []byte("hello world"))},
+		{"arp", ARPRequest(0)},
+		{"arp-8021q", ARPRequest(1)},
+		{"arp-qinq", ARPRequest(2)},
+		{"truncated-ethernet", tcp[:8]},
+		{"truncated-ipv4", tcp[:24]},
+		{"truncated-arp", ARPRequest(0)[:20]},
+		{"truncated-tcp", tcp[:40]},
+		{"dns-a", DNSOverUDP(4, DNSResponse("www.example.com", 1, IPv4AddressA.To4()))},
+		{"dns-aaaa", DNSOverUDP(6, DNSResponse("www.example.com", 28, IPv6AddressA))},
+		{"dns-ptr-query", DNSOverUDP(4, DNSQuery("32.2.0.10.in-addr.arpa", 12))},
+		{"dns-ptr", DNSOverUDP(4, DNSResponse("32.2.0.10.in-addr.arpa", 12, DNSName("host.example.com")))},
+		{"dns-tcp", DNSOverTCP(DNSResponse("www.example.com", 1, IPv4AddressA.To4()))},
+		{"dhcp-ack", DHCPAck()},
+		{"dhcpv6-reply", DHCPv6Reply()},
+		{"http-request", ServerTCP(4002, 80, false, 5000, 9000, request)},
+		{"http-response", ServerTCP(4002, 80, true, 9000, 5000+uint32(len(request)), response)},
+		{"http-request-2", ServerTCP(4002, 80, false, 5000+uint32(len(request)), 9000+uint32(len(response)), []byte("GET /next HTTP/1.1\r\nHost: Example.COM:8080\r\n\r\n"))},
+		{"tls-client-hello", ServerTCP(4003, 443, false, 7000, 8000, TLSClientHello("www.example.com"))},
+	}
+} // Corpus()
+
+//
+// -----------------------------------------------------------------------------
+// WriteFile()
+// -----------------------------------------------------------------------------
+// Write the packets to a PCAP file, each one 10ms after the one before it
+func WriteFile(sFilename string, packets []Packet) error {
+	timestamps := make([]time.Time, len(packets))
+	for i := range timestamps {
+		timestamps[i] = StartTime.Add(time.Duration(i) * 10 * time.Millisecond)
+	}
+	return WriteFileAt(sFilename, packets, timestamps)
+} // WriteFile()
+
+//
+// -----------------------------------------------------------------------------
+// WriteFileAt()
+// -----------------------------------------------------------------------------
+// Write the packets to a PCAP file with the timestamps given for them, so they
+// can be out of order
+func WriteFileAt(sFilename string, packets []Packet, timestamps []time.Time) error {
+	fileHandle, err := os.Create(sFilename)
+	if err != nil {
+		return err
+	}
+	defer fileHandle.Close()
+
+	writer := pcapgo.NewWriter(fileHandle)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+
+	for i, p := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: timestamps[i], CaptureLength: len(p.Data), Length: len(p.Data)}
+		if err := writer.WritePacket(ci, p.Data); err != nil {
+			return err
+		}
+	}
+	return fileHandle.Close()
+} // WriteFileAt()
+
+//
+// -----------------------------------------------------------------------------
+// Offloaded()
+// -----------------------------------------------------------------------------
+// Build an IPv4 or IPv6 TCP packet from A to B the way it is captured on a host
+// with segmentation offload, with a big payload, an IP length of zero and no TCP
+// checksum.  The CWR, PSH and FIN flags are set.
+func Offloaded(iIPVersion int, iPayloadLength int) []byte {
+	payload := make([]byte, iPayloadLength)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	tcp := &layers.TCP{SrcPort: 4003, DstPort: 80, Seq: 1000, Ack: 2000, ACK: true, PSH: true, FIN: true, CWR: true, Window: 1000}
+
+	var l []gopacket.SerializableLayer
+	iLengthOffset := 14 + 2
+	if iIPVersion == 6 {
+		l = Ethernet(MacAddressA, MacAddressB, 0, layers.EthernetTypeIPv6)
+		l = append(l, &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: IPv6AddressA, DstIP: IPv6AddressB})
+		iLengthOffset = 14 + 4
+	} else {
+		l = Ethernet(MacAddressA, MacAddressB, 0, layers.EthernetTypeIPv4)
+		l = append(l, &layers.IPv4{Version: 4, TTL: 64, Id: 8, Protocol: layers.IPProtocolTCP, SrcIP: IPv4AddressA, DstIP: IPv4AddressB})
+	}
+	data := Serialize(append(l, tcp, gopacket.Payload(payload))...)
+
+	iTCPOffset := 14 + 20
+	if iIPVersion == 6 {
+		iTCPOffset = 14 + 40
+	}
+	data[iLengthOffset], data[iLengthOffset+1] = 0, 0
+	data[iTCPOffset+16], data[iTCPOffset+17] = 0, 0
+	return data
+} // Offloaded()
+
+//
+// -----------------------------------------------------------------------------
+// Fragments()
+// -----------------------------------------------------------------------------
+// Build an IPv4 or IPv6 UDP packet from A to B and fragment it, with iSize bytes
+// of the UDP datagram in each fragment but the last.  The size has to be a
+// multiple of 8.  IPv6 fragments carry identification 7.
+func Fragments(iIPVersion int, payload []byte, iSize int) [][]byte {
+	data := IPv4UDP(0, payload)
+	iStart := 14 + 20
+	if iIPVersion == 6 {
+		data = IPv6UDP(0, payload)
+		iStart = 14 + 40
+	}
+
+	var fragments [][]byte
+	for iOffset := 0; iOffset < len(data)-iStart; iOffset += iSize {
+		iEnd := iOffset + iSize
+		bMore := iEnd < len(data)-iStart
+		if !bMore {
+			iEnd = len(data) - iStart
+		}
+		fragment := append([]byte(nil), data[:iStart]...)
+		ipHeader := fragment[14:]
+		if iIPVersion == 6 {
+			iFragmentOffset := iOffset
+			if bMore {
+				iFragmentOffset |= 1
+			}
+			ipHeader[6] = byte(layers.IPProtocolIPv6Fragment)
+			fragment = append(fragment, byte(layers.IPProtocolUDP), 0, byte(iFragmentOffset>>8), byte(iFragmentOffset), 0, 0, 0, 7)
+			fragment = append(fragment, data[iStart+iOffset:iStart+iEnd]...)
+			ipHeader = fragment[14:]
+			ipHeader[4], ipHeader[5] = byte((len(ipHeader)-40)>>8), byte(len(ipHeader)-40)
+		} else {
+			iFlags := iOffset / 8
+			if bMore {
+				iFlags |= 0x2000
+			}
+			fragment = append(fragment, data[iStart+iOffset:iStart+iEnd]...)
+			ipHeader = fragment[14:]
+			ipHeader[2], ipHeader[3] = byte(len(ipHeader)>>8), byte(len(ipHeader))
+			ipHeader[6], ipHeader[7] = byte(iFlags>>8), byte(iFlags)
+			iChecksum := checksum.IPv4Header(ipHeader)
+			ipHeader[10], ipHeader[11] = byte(iChecksum>>8), byte(iChecksum)
+		}
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+} // Fragments()
@@ -0,0 +1,182 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pipeline
+
+import (
+	"github.com/google/gopacket"
+	"io"
+	"sync"
+)
+
+// This is how many packets each worker can have in flight before the reader has
+// to wait for the writer to catch up.  It bounds the memory that is used to put
+// the packets back in order when one of the workers falls behind.
+const iWindowPerWorker = 256
+
+// Job is a single packet moving through the pipeline.  The Index is the position
+// of the packet in the source file, starting at 0.  Workers are free to replace
+// the Data and CaptureInfo and can use Result to hand anything else to the writer.
+type Job struct {
+	Index       int
+	Data        []byte
+	CaptureInfo gopacket.CaptureInfo
+	Result      interface{}
+}
+
+// Reader returns the next packet, io.EOF is returned at the end of the file
+type Reader func() ([]byte, gopacket.CaptureInfo, error)
+
+// Worker rewrites a single packet, it may be called from many goroutines
+type Worker func(job *Job)
+
+// Writer is called from the goroutine that called Run with each packet in the
+// same order they were read.  Returning an error stops the pipeline.
+type Writer func(job *Job) error
+
+//
+// -----------------------------------------------------------------------------
+// Run()
+// -----------------------------------------------------------------------------
+// This function will read every packet with the reader, hand them out to the
+// requested number of workers, and then put the packets back in their original
+// order before passing them to the writer.  With only one worker everything is
+// done in the calling goroutine.  It returns the first error from the reader or
+// the writer, reaching the end of the file is not an error.
+func Run(iWorkers int, read Reader, work Worker, write Writer) error {
+	if iWorkers <= 1 {
+		return runSequential(read, work, write)
+	}
+
+	jobs := make(chan *Job, iWorkers*4)
+	results := make(chan *Job, iWorkers*4)
+	window := make(chan struct{}, iWorkers*iWindowPerWorker)
+	done := make(chan struct{})
+
+	//
+	// -------------------------------------------------------------------------
+	// Reader, this only reads a new packet when there is room in the window
+	// -------------------------------------------------------------------------
+	// The reader and the workers are both waited on so that nothing is still
+	// reading from the handle or running the worker once Run has returned
+	var wg sync.WaitGroup
+	var readErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for i := 0; ; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			data, ci, err := read()
+			if err != nil {
+				if !isEndOfFile(err) {
+					readErr = err
+				}
+				return
+			}
+
+			select {
+			case jobs <- &Job{Index: i, Data: data, CaptureInfo: ci}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	//
+	// -------------------------------------------------------------------------
+	// Workers
+	// -------------------------------------------------------------------------
+	for w := 0; w < iWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				work(job)
+				select {
+				case results <- job:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	//
+	// -------------------------------------------------------------------------
+	// Put the packets back in order and write them out
+	// -------------------------------------------------------------------------
+	pending := make(map[int]*Job)
+	iNext := 0
+	for job := range results {
+		pending[job.Index] = job
+		for {
+			next, ok := pending[iNext]
+			if !ok {
+				break
+			}
+			delete(pending, iNext)
+
+			if err := write(next); err != nil {
+				// Stop the reader and the workers, and wait for them to
+				// finish before handing the error back
+				close(done)
+				for range results {
+				}
+				return err
+			}
+			<-window
+			iNext++
+		}
+	}
+
+	// The results channel is only closed after the reader and the workers have
+	// finished so it is safe to look at the read error here
+	return readErr
+} // Run()
+
+//
+// -----------------------------------------------------------------------------
+// runSequential()
+// -----------------------------------------------------------------------------
+// Read, rewrite and write each packet in turn without any goroutines
+func runSequential(read Reader, work Worker, write Writer) error {
+	for i := 0; ; i++ {
+		data, ci, err := read()
+		if err != nil {
+			if isEndOfFile(err) {
+				return nil
+			}
+			return err
+		}
+
+		job := &Job{Index: i, Data: data, CaptureInfo: ci}
+		work(job)
+		if err := write(job); err != nil {
+			return err
+		}
+	}
+} // runSequential()
+
+//
+// -----------------------------------------------------------------------------
+// isEndOfFile()
+// -----------------------------------------------------------------------------
+// A file that ends part way through the last packet is treated the same as one
+// that ends cleanly, just like gopacket.PacketSource does
+func isEndOfFile(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+} // isEndOfFile()
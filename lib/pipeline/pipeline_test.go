@@ -0,0 +1,117 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pipeline
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// counterReader returns iCount one byte packets holding their own index
+func counterReader(iCount int, errEnd error) Reader {
+	i := 0
+	return func() ([]byte, gopacket.CaptureInfo, error) {
+		if i == iCount {
+			return nil, gopacket.CaptureInfo{}, errEnd
+		}
+		i++
+		return []byte{byte(i - 1)}, gopacket.CaptureInfo{}, nil
+	}
+}
+
+func TestRunKeepsOrder(t *testing.T) {
+	for _, iWorkers := range []int{1, 2, 8} {
+		iNext := 0
+		work := func(job *Job) {
+			// Make the workers finish out of order
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+			job.Result = job.Index
+		}
+		write := func(job *Job) error {
+			if job.Index != iNext || job.Result.(int) != iNext || job.Data[0] != byte(iNext) {
+				t.Fatalf("%d workers: expected packet %d, got %d", iWorkers, iNext, job.Index)
+			}
+			iNext++
+			return nil
+		}
+
+		if err := Run(iWorkers, counterReader(2000, io.EOF), work, write); err != nil {
+			t.Fatalf("%d workers: unexpected error %s", iWorkers, err)
+		}
+		if iNext != 2000 {
+			t.Errorf("%d workers: expected 2000 packets, got %d", iWorkers, iNext)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	errRead := errors.New("read failed")
+	errWrite := errors.New("write failed")
+
+	for _, iWorkers := range []int{1, 4} {
+		work := func(job *Job) {}
+		write := func(job *Job) error { return nil }
+
+		if err := Run(iWorkers, counterReader(10, io.ErrUnexpectedEOF), work, write); err != nil {
+			t.Errorf("%d workers: expected a truncated file to end cleanly, got %s", iWorkers, err)
+		}
+		if err := Run(iWorkers, counterReader(10, errRead), work, write); err != errRead {
+			t.Errorf("%d workers: expected the read error, got %v", iWorkers, err)
+		}
+
+		iWritten := 0
+		stop := func(job *Job) error {
+			iWritten++
+			if job.Index == 5 {
+				return errWrite
+			}
+			return nil
+		}
+		if err := Run(iWorkers, counterReader(5000, io.EOF), work, stop); err != errWrite {
+			t.Errorf("%d workers: expected the write error, got %v", iWorkers, err)
+		}
+		if iWritten != 6 {
+			t.Errorf("%d workers: expected 6 packets to be written, got %d", iWorkers, iWritten)
+		}
+	}
+}
+
+func TestRunWaitsAfterWriteError(t *testing.T) {
+	errWrite := errors.New("write failed")
+
+	// Once Run has returned nothing may read from the source or run a worker
+	var bReturned int32
+	read := counterReader(5000, io.EOF)
+	checked := func() ([]byte, gopacket.CaptureInfo, error) {
+		if atomic.LoadInt32(&bReturned) == 1 {
+			t.Error("Did not expect a read after Run returned")
+		}
+		return read()
+	}
+	work := func(job *Job) {
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+		if atomic.LoadInt32(&bReturned) == 1 {
+			t.Error("Did not expect a worker to run after Run returned")
+		}
+	}
+	stop := func(job *Job) error {
+		if job.Index == 5 {
+			return errWrite
+		}
+		return nil
+	}
+	if err := Run(8, checked, work, stop); err != errWrite {
+		t.Errorf("Expected the write error, got %v", err)
+	}
+	atomic.StoreInt32(&bReturned, 1)
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,104 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package pppoe finds the PPPoE header (RFC 2516) of discovery and session frames
+// and changes their session IDs.  The header is 6 bytes, the version and type,
+// the code, the session ID and the length of what follows.
+package pppoe
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"strconv"
+	"strings"
+)
+
+var iDebug = 0
+
+// Rules map the old session IDs to the new ones
+type Rules struct {
+	Sessions map[uint16]uint16
+}
+
+//
+// -----------------------------------------------------------------------------
+// ParseRules()
+// -----------------------------------------------------------------------------
+// This function will parse the session map from the command line, a list of
+// old=new session IDs separated by a comma.  The IDs can be given in decimal or
+// in hex with a 0x in front of them.
+func ParseRules(sMap string) (*Rules, error) {
+	rules := &Rules{Sessions: make(map[uint16]uint16)}
+	for _, sPair := range strings.Split(sMap, ",") {
+		l := strings.SplitN(strings.TrimSpace(sPair), "=", 2)
+		if len(l) != 2 {
+			return nil, fmt.Errorf("invalid PPPoE session mapping %s, it should be old=new", sPair)
+		}
+		iOld, err := parseSession(l[0])
+		if err != nil {
+			return nil, err
+		}
+		iNew, err := parseSession(l[1])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := rules.Sessions[iOld]; ok {
+			return nil, fmt.Errorf("PPPoE session 0x%04x is mapped more than once", iOld)
+		}
+		rules.Sessions[iOld] = iNew
+	}
+	return rules, nil
+} // ParseRules()
+
+//
+// -----------------------------------------------------------------------------
+// Header()
+// -----------------------------------------------------------------------------
+// This function will find the PPPoE header of a discovery or session frame.  The
+// offset in the frame data is returned, or -1 if the frame is not PPPoE or the
+// header was cut short.
+func Header(f *frame.Frame) int {
+	if f.LinkType != layers.LinkTypeEthernet {
+		return -1
+	}
+	if f.EthernetType != layers.EthernetTypePPPoEDiscovery && f.EthernetType != layers.EthernetTypePPPoESession {
+		return -1
+	}
+	iOffset := 14 + f.VLANOffset
+	if len(f.Data) < iOffset+6 {
+		return -1
+	}
+	return iOffset
+} // Header()
+
+//
+// -----------------------------------------------------------------------------
+// ReplaceSession()
+// -----------------------------------------------------------------------------
+// This function will change the session ID in a PPPoE header if it is in the map,
+// and return true if it was changed
+func (rules *Rules) ReplaceSession(header []byte) bool {
+	iSession := uint16(header[2])<<8 | uint16(header[3])
+	iNew, ok := rules.Sessions[iSession]
+	if !ok || iNew == iSession {
+		return false
+	}
+	header[2], header[3] = byte(iNew>>8), byte(iNew)
+	if iDebug == 1 {
+		fmt.Printf("DEBUG: Changed PPPoE session 0x%04x to 0x%04x\n", iSession, iNew)
+	}
+	return true
+} // ReplaceSession()
+
+// parseSession reads one session ID from the session map
+func parseSession(sSession string) (uint16, error) {
+	iSession, err := strconv.ParseUint(strings.TrimSpace(sSession), 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PPPoE session %s, it should be 0 to 65535 or 0x0000 to 0xffff", sSession)
+	}
+	return uint16(iSession), nil
+}
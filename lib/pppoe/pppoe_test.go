@@ -0,0 +1,82 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pppoe
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("0x1234=0x4321, 7=65535")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if len(rules.Sessions) != 2 || rules.Sessions[0x1234] != 0x4321 || rules.Sessions[7] != 0xffff {
+		t.Errorf("Wrong session map %v", rules.Sessions)
+	}
+
+	for _, sMap := range []string{"", "0x1234", "1=", "1=2,1=3", "1=65536", "0x10000=1", "a=b"} {
+		if _, err := ParseRules(sMap); err == nil {
+			t.Errorf("%q: expected an error", sMap)
+		}
+	}
+}
+
+func TestReplaceSession(t *testing.T) {
+	rules, err := ParseRules("0x1234=0x4321")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+
+	// A session frame and a PADT discovery frame for the same session
+	padt := pcaptest.Ethernet(pcaptest.MacAddressA, pcaptest.MacAddressB, 1, layers.EthernetTypePPPoEDiscovery)
+	padt = append(padt, gopacket.Payload([]byte{0x11, 0xa7, 0x12, 0x34, 0x00, 0x00}))
+	for _, data := range [][]byte{pcaptest.PPPoE(4, 0x1234), pcaptest.Serialize(padt...)} {
+		f := pcaptest.Parse(t, data)
+		iOffset := Header(f)
+		if iOffset != 14+f.VLANOffset {
+			t.Fatalf("Expected the PPPoE header at %d, got %d", 14+f.VLANOffset, iOffset)
+		}
+		if !rules.ReplaceSession(f.Data[iOffset:]) || f.Data[iOffset+2] != 0x43 || f.Data[iOffset+3] != 0x21 {
+			t.Errorf("Expected session 0x4321, got 0x%02x%02x", f.Data[iOffset+2], f.Data[iOffset+3])
+		}
+
+		// It is not changed a second time
+		if rules.ReplaceSession(f.Data[iOffset:]) {
+			t.Error("Did not expect session 0x4321 to change")
+		}
+	}
+
+	if iOffset := Header(pcaptest.Parse(t, pcaptest.IPv4UDP(0, nil))); iOffset != -1 {
+		t.Errorf("Did not expect a PPPoE header, got one at %d", iOffset)
+	}
+	if iOffset := Header(pcaptest.Parse(t, pcaptest.PPPoE(4, 1)[:18])); iOffset != -1 {
+		t.Errorf("Did not expect a PPPoE header that was cut short, got one at %d", iOffset)
+	}
+}
+
+func FuzzReplaceSession(f *testing.F) {
+	rules, err := ParseRules("0x1234=0x4321")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(pcaptest.PPPoE(4, 0x1234))
+	f.Add(pcaptest.PPPoE(6, 0x4321))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pppoe, err := frame.Parse(data, layers.LinkTypeEthernet)
+		if err != nil {
+			return
+		}
+		if iOffset := Header(pppoe); iOffset >= 0 {
+			rules.ReplaceSession(pppoe.Data[iOffset:])
+		}
+	})
+}
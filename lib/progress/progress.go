@@ -0,0 +1,205 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package progress shows how far through the source file a run is.  On a
+// terminal a single status line is kept up to date, anything else gets a log
+// line every so often.
+package progress
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The size of the PCAP file header and of the header in front of each packet,
+// these are used to work out how far through the file we are
+const (
+	iFileHeaderLength   = 24
+	iPacketHeaderLength = 16
+)
+
+// How often the status line is redrawn on a terminal and how often a log line
+// is written when the output is not a terminal
+const (
+	terminalInterval = 250 * time.Millisecond
+	logInterval      = 10 * time.Second
+)
+
+// Only look at the clock every so many packets, it is cheap but not free
+const iCheckEvery = 64
+
+// Reporter keeps track of how many packets and bytes have been done.  The packets
+// are counted as they are read while the status line is cleared by the writer,
+// so the lock is held while either of them is running.
+type Reporter struct {
+	lock        sync.Mutex
+	out         io.Writer
+	bTerminal   bool
+	iTotalBytes int64
+	iBytes      int64
+	iPackets    int
+	start       time.Time
+	lastReport  time.Time
+	iLineLength int
+}
+
+//
+// -----------------------------------------------------------------------------
+// New()
+// -----------------------------------------------------------------------------
+// Create a reporter for a source file that is iTotalBytes long.  If bTerminal is
+// true the status line is redrawn in place, otherwise log lines are written.
+func New(out io.Writer, iTotalBytes int64, bTerminal bool) *Reporter {
+	now := time.Now()
+	return &Reporter{
+		out:         out,
+		bTerminal:   bTerminal,
+		iTotalBytes: iTotalBytes,
+		iBytes:      iFileHeaderLength,
+		start:       now,
+		lastReport:  now,
+	}
+} // New()
+
+//
+// -----------------------------------------------------------------------------
+// IsTerminal()
+// -----------------------------------------------------------------------------
+// Report if the file is a terminal rather than a pipe or a regular file
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+} // IsTerminal()
+
+//
+// -----------------------------------------------------------------------------
+// Add()
+// -----------------------------------------------------------------------------
+// Count a packet that was read from the source file, iLength is the captured
+// length of the packet
+func (r *Reporter) Add(iLength int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.iPackets++
+	r.iBytes += int64(iLength + iPacketHeaderLength)
+
+	if r.iPackets%iCheckEvery != 0 {
+		return
+	}
+
+	interval := logInterval
+	if r.bTerminal {
+		interval = terminalInterval
+	}
+	now := time.Now()
+	if now.Sub(r.lastReport) < interval {
+		return
+	}
+	r.lastReport = now
+	r.report(now)
+} // Add()
+
+//
+// -----------------------------------------------------------------------------
+// Reader()
+// -----------------------------------------------------------------------------
+// Wrap a packet reader so that the progress follows the source file, every
+// packet is counted as soon as it is read rather than when it is written out.
+func (r *Reporter) Reader(read func() ([]byte, gopacket.CaptureInfo, error)) func() ([]byte, gopacket.CaptureInfo, error) {
+	return func() ([]byte, gopacket.CaptureInfo, error) {
+		data, ci, err := read()
+		if err == nil {
+			r.Add(len(data))
+		}
+		return data, ci, err
+	}
+} // Reader()
+
+//
+// -----------------------------------------------------------------------------
+// Clear()
+// -----------------------------------------------------------------------------
+// Remove the status line from a terminal so something else can be printed, it
+// is drawn again with the next update
+func (r *Reporter) Clear() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.bTerminal && r.iLineLength > 0 {
+		fmt.Fprint(r.out, "\r"+strings.Repeat(" ", r.iLineLength)+"\r")
+		r.iLineLength = 0
+	}
+} // Clear()
+
+//
+// -----------------------------------------------------------------------------
+// Finish()
+// -----------------------------------------------------------------------------
+// Remove the status line at the end of the run
+func (r *Reporter) Finish() {
+	r.Clear()
+} // Finish()
+
+//
+// -----------------------------------------------------------------------------
+// Status()
+// -----------------------------------------------------------------------------
+// Build the status text with the percentage done, the packet and byte rates and
+// the estimated time left
+func (r *Reporter) Status(now time.Time) string {
+	elapsed := now.Sub(r.start).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1e-9
+	}
+	fPacketRate := float64(r.iPackets) / elapsed
+	fByteRate := float64(r.iBytes) / elapsed
+
+	fPercent := 0.0
+	sETA := "unknown"
+	if r.iTotalBytes > 0 {
+		fPercent = 100 * float64(r.iBytes) / float64(r.iTotalBytes)
+		if fPercent > 100 {
+			fPercent = 100
+		}
+		if fByteRate > 0 && r.iBytes < r.iTotalBytes {
+			eta := time.Duration(float64(r.iTotalBytes-r.iBytes) / fByteRate * float64(time.Second))
+			sETA = eta.Round(time.Second).String()
+		} else if r.iBytes >= r.iTotalBytes {
+			sETA = "0s"
+		}
+	}
+
+	return fmt.Sprintf("%5.1f%%  %d packets  %.0f pkts/s  %.1f MB/s  ETA %s",
+		fPercent, r.iPackets, fPacketRate, fByteRate/(1<<20), sETA)
+} // Status()
+
+//
+// -----------------------------------------------------------------------------
+// report()
+// -----------------------------------------------------------------------------
+// Redraw the status line on a terminal or write a log line
+func (r *Reporter) report(now time.Time) {
+	sStatus := r.Status(now)
+	if !r.bTerminal {
+		fmt.Fprintln(r.out, now.Format("2006-01-02 15:04:05"), "progress:", sStatus)
+		return
+	}
+
+	// Pad the line so that nothing is left over from a longer line before it
+	sLine := sStatus
+	if len(sLine) < r.iLineLength {
+		sLine += strings.Repeat(" ", r.iLineLength-len(sLine))
+	}
+	fmt.Fprint(r.out, "\r"+sLine)
+	r.iLineLength = len(sStatus)
+} // report()
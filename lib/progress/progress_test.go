@@ -0,0 +1,90 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package progress
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	var buf bytes.Buffer
+	r := New(&buf, iFileHeaderLength+4*(iPacketHeaderLength+1008), false)
+
+	// Just over half of the file (the file header is counted too) in two seconds
+	// leaves about two seconds to go
+	r.Add(1008)
+	r.Add(1008)
+	sStatus := r.Status(r.start.Add(2 * time.Second))
+	expected := " 50.3%  2 packets  1 pkts/s  0.0 MB/s  ETA 2s"
+	if sStatus != expected {
+		t.Errorf("Expected %q, got %q", expected, sStatus)
+	}
+
+	// Nothing is written until enough packets and time have gone by
+	if buf.Len() != 0 {
+		t.Error("Expected no output, got ", buf.String())
+	}
+
+	r.Add(1008)
+	r.Add(1008)
+	if sStatus := r.Status(r.start.Add(4 * time.Second)); !strings.HasPrefix(sStatus, "100.0%") || !strings.HasSuffix(sStatus, "ETA 0s") {
+		t.Error("Expected the run to be done, got ", sStatus)
+	}
+
+	// Without a file size there is no way to tell how long is left
+	if sStatus := New(&buf, 0, false).Status(time.Now()); !strings.HasSuffix(sStatus, "ETA unknown") {
+		t.Error("Expected an unknown ETA, got ", sStatus)
+	}
+}
+
+func TestReport(t *testing.T) {
+	var buf bytes.Buffer
+	r := New(&buf, 1000, false)
+	r.report(r.start.Add(time.Second))
+	if !strings.Contains(buf.String(), "progress:") || !strings.HasSuffix(buf.String(), "\n") {
+		t.Error("Expected a log line, got ", buf.String())
+	}
+
+	// On a terminal the line is redrawn in place and cleared at the end
+	buf.Reset()
+	r = New(&buf, 1000, true)
+	r.report(r.start.Add(time.Second))
+	r.Finish()
+	sOutput := buf.String()
+	if !strings.HasPrefix(sOutput, "\r") || !strings.HasSuffix(sOutput, "\r") || strings.Contains(sOutput, "\n") {
+		t.Errorf("Expected the status line to be redrawn and cleared, got %q", sOutput)
+	}
+}
+
+func TestReader(t *testing.T) {
+	var buf bytes.Buffer
+	r := New(&buf, iFileHeaderLength+4*(iPacketHeaderLength+1008), false)
+
+	// Every packet in the file is counted, even the ones that are left out
+	// further along
+	iPackets := 0
+	read := r.Reader(func() ([]byte, gopacket.CaptureInfo, error) {
+		if iPackets == 4 {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		iPackets++
+		return make([]byte, 1008), gopacket.CaptureInfo{}, nil
+	})
+	for {
+		if _, _, err := read(); err != nil {
+			break
+		}
+	}
+	if sStatus := r.Status(r.start.Add(time.Second)); !strings.HasPrefix(sStatus, "100.0%  4 packets") {
+		t.Error("Expected every packet to be counted, got ", sStatus)
+	}
+}
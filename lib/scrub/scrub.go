@@ -0,0 +1,204 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package scrub removes the application data from TCP and UDP payloads so that
+// a capture can be shared with only its headers in it.  The payload can be
+// filled with zeros, filled with random bytes, or cut off after the transport
+// header.  Some protocols, like DNS, can be kept as they are.
+package scrub
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var iDebug = 0
+
+// Mode is what is done to a payload
+type Mode int
+
+// The ways a payload can be scrubbed
+const (
+	ModeZero Mode = iota + 1
+	ModeRandom
+	ModeTruncate
+)
+
+// Rules say how payloads are scrubbed and which ports are kept.  When a payload
+// is truncated and AdjustLengths is false the IP and UDP lengths still say how
+// long the packet was, the same as a capture made with a short snap length.
+type Rules struct {
+	Mode          Mode
+	KeepPorts     map[uint16]bool
+	AdjustLengths bool
+}
+
+// The protocols that can be kept by name and the ports they use
+var protocolPorts = map[string][]uint16{
+	"dhcp":    {67, 68, 546, 547},
+	"dns":     {53, 5353},
+	"ftp":     {20, 21},
+	"http":    {80, 8080},
+	"https":   {443},
+	"imap":    {143},
+	"ldap":    {389},
+	"mdns":    {5353},
+	"netbios": {137, 138, 139},
+	"ntp":     {123},
+	"pop3":    {110},
+	"radius":  {1812, 1813},
+	"sip":     {5060},
+	"smb":     {445},
+	"smtp":    {25, 587},
+	"snmp":    {161, 162},
+	"ssh":     {22},
+	"syslog":  {514},
+	"telnet":  {23},
+	"tftp":    {69},
+	"tls":     {443},
+}
+
+//
+// -----------------------------------------------------------------------------
+// ParseRules()
+// -----------------------------------------------------------------------------
+// This function will parse the scrub options from the command line.  The mode is
+// zero, random or truncate, the protocols to keep are names like dns or port
+// numbers separated by a comma, and the lengths are either keep or adjust.
+func ParseRules(sMode, sKeep, sLengths string) (*Rules, error) {
+	rules := &Rules{KeepPorts: make(map[uint16]bool)}
+	switch sMode {
+	case "zero":
+		rules.Mode = ModeZero
+	case "random":
+		rules.Mode = ModeRandom
+	case "truncate":
+		rules.Mode = ModeTruncate
+	default:
+		return nil, fmt.Errorf("invalid scrub mode %s, it should be zero, random or truncate", sMode)
+	}
+
+	switch sLengths {
+	case "", "keep":
+	case "adjust":
+		rules.AdjustLengths = true
+	default:
+		return nil, fmt.Errorf("invalid scrub lengths %s, it should be keep or adjust", sLengths)
+	}
+
+	if sKeep == "" {
+		return rules, nil
+	}
+	for _, sProtocol := range strings.Split(sKeep, ",") {
+		sProtocol = strings.ToLower(strings.TrimSpace(sProtocol))
+		if ports, ok := protocolPorts[sProtocol]; ok {
+			for _, iPort := range ports {
+				rules.KeepPorts[iPort] = true
+			}
+			continue
+		}
+		iPort, err := strconv.ParseUint(sProtocol, 10, 16)
+		if err != nil || iPort == 0 {
+			return nil, fmt.Errorf("invalid protocol to keep %s, it should be a port or one of %s", sProtocol, strings.Join(Protocols(), ", "))
+		}
+		rules.KeepPorts[uint16(iPort)] = true
+	}
+	return rules, nil
+} // ParseRules()
+
+//
+// -----------------------------------------------------------------------------
+// Protocols()
+// -----------------------------------------------------------------------------
+// This function will return the names of the protocols that can be kept, in
+// order
+func Protocols() []string {
+	var l []string
+	for sName := range protocolPorts {
+		l = append(l, sName)
+	}
+	sort.Strings(l)
+	return l
+} // Protocols()
+
+//
+// -----------------------------------------------------------------------------
+// Locate()
+// -----------------------------------------------------------------------------
+// This function will find the TCP or UDP payload the rules scrub.  Unlike
+// frame.Payload a payload that was cut short by the capture is still found, it
+// runs to the end of the data and false is returned for complete.  A start of -1
+// means there is nothing to scrub, because there is no payload, it is not TCP or
+// UDP, or one of the ports is kept.
+func (rules *Rules) Locate(f *frame.Frame) (int, int, bool) {
+	if f.NetworkOffset < 0 || f.TransportOffset < 0 {
+		return -1, -1, false
+	}
+	if f.IPProtocol != layers.IPProtocolTCP && f.IPProtocol != layers.IPProtocolUDP {
+		return -1, -1, false
+	}
+	iSrcPort, iDstPort := f.Ports()
+	if rules.KeepPorts[iSrcPort] || rules.KeepPorts[iDstPort] {
+		return -1, -1, false
+	}
+
+	if iStart, iEnd := f.Payload(); iStart >= 0 {
+		if iStart == iEnd {
+			return -1, -1, false
+		}
+		return iStart, iEnd, true
+	}
+
+	// The payload was cut short, it is whatever is left after the header
+	iStart := f.TransportOffset + 8
+	if f.IPProtocol == layers.IPProtocolTCP {
+		if len(f.Data) < f.TransportOffset+13 {
+			return -1, -1, false
+		}
+		iStart = f.TransportOffset + int(f.Data[f.TransportOffset+12]>>4)*4
+	}
+	if iStart >= len(f.Data) {
+		return -1, -1, false
+	}
+	return iStart, len(f.Data), false
+} // Locate()
+
+//
+// -----------------------------------------------------------------------------
+// Scrub()
+// -----------------------------------------------------------------------------
+// This function will return what the payload is replaced with, a slice of zeros
+// or random bytes the same length as the payload, or an empty slice when it is
+// truncated.  The payload passed in is never changed.
+func (rules *Rules) Scrub(payload []byte) []byte {
+	switch rules.Mode {
+	case ModeZero:
+		return make([]byte, len(payload))
+	case ModeRandom:
+		b := make([]byte, len(payload))
+		if _, err := rand.Read(b); err != nil && iDebug == 1 {
+			fmt.Println("DEBUG: Random bytes could not be read, using zeros:", err)
+		}
+		return b
+	}
+	return []byte{}
+} // Scrub()
+
+//
+// -----------------------------------------------------------------------------
+// ChangesLength()
+// -----------------------------------------------------------------------------
+// This function will check if a scrubbed packet can end up with different IP and
+// TCP lengths, which means the TCP sequence numbers of the rest of the
+// connection have to move with it
+func (rules *Rules) ChangesLength() bool {
+	return rules.Mode == ModeTruncate && rules.AdjustLengths
+} // ChangesLength()
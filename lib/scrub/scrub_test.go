@@ -0,0 +1,114 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package scrub
+
+import (
+	"bytes"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("truncate", "dns, 8080", "adjust")
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if rules.Mode != ModeTruncate || !rules.AdjustLengths || !rules.ChangesLength() {
+		t.Errorf("Wrong rules %+v", rules)
+	}
+	for _, iPort := range []uint16{53, 5353, 8080} {
+		if !rules.KeepPorts[iPort] {
+			t.Errorf("Expected port %d to be kept", iPort)
+		}
+	}
+
+	rules, err = ParseRules("zero", "", "")
+	if err != nil || rules.Mode != ModeZero || rules.AdjustLengths || rules.ChangesLength() {
+		t.Errorf("Wrong rules %+v (%v)", rules, err)
+	}
+
+	tests := [][]string{
+		{"blank", "", ""},
+		{"zero", "gopher", ""},
+		{"zero", "0", ""},
+		{"zero", "70000", ""},
+		{"truncate", "", "shrink"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseRules(tt[0], tt[1], tt[2]); err == nil {
+			t.Errorf("%v: expected an error", tt)
+		}
+	}
+}
+
+func TestLocate(t *testing.T) {
+	dhcpAck := pcaptest.DHCPAck()
+	tcp := pcaptest.ServerTCP(4002, 80, false, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+
+	tests := []struct {
+		name      string
+		data      []byte
+		sKeep     string
+		iStart    int
+		iEnd      int
+		bComplete bool
+	}{
+		{"udp", pcaptest.IPv4UDP(0, []byte("hello world")), "", 42, 53, true},
+		{"tcp", tcp, "", 54, len(tcp), true},
+		{"cut short", tcp[:60], "", 54, 60, false},
+		{"kept", tcp, "http", -1, -1, false},
+		{"kept by port", tcp, "4002", -1, -1, false},
+		{"dhcp", dhcpAck, "dns,dhcp", -1, -1, false},
+		{"no payload", pcaptest.ServerTCP(4002, 80, false, 1, 1, nil), "", -1, -1, false},
+		{"arp", pcaptest.ARPRequest(0), "", -1, -1, false},
+	}
+
+	for _, tt := range tests {
+		rules, err := ParseRules("zero", tt.sKeep, "")
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		f := pcaptest.Parse(t, tt.data)
+		iStart, iEnd, bComplete := rules.Locate(f)
+		if iStart != tt.iStart || iEnd != tt.iEnd || bComplete != tt.bComplete {
+			t.Errorf("%s: expected %d %d %t, got %d %d %t", tt.name, tt.iStart, tt.iEnd, tt.bComplete, iStart, iEnd, bComplete)
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	payload := []byte("user=alice&key=c0ffee")
+	original := append([]byte(nil), payload...)
+
+	for _, tt := range []struct {
+		sMode    string
+		iLength  int
+		bNonZero bool
+	}{
+		{"zero", len(payload), false},
+		{"random", len(payload), true},
+		{"truncate", 0, false},
+	} {
+		rules, err := ParseRules(tt.sMode, "", "")
+		if err != nil {
+			t.Fatal(tt.sMode, err)
+		}
+		scrubbed := rules.Scrub(payload)
+		if len(scrubbed) != tt.iLength {
+			t.Errorf("%s: expected %d bytes, got %d", tt.sMode, tt.iLength, len(scrubbed))
+		}
+		if !tt.bNonZero && bytes.Count(scrubbed, []byte{0}) != len(scrubbed) {
+			t.Errorf("%s: expected only zeros, got %x", tt.sMode, scrubbed)
+		}
+		if bytes.Equal(scrubbed, original) {
+			t.Errorf("%s: the payload was not scrubbed", tt.sMode)
+		}
+		if !bytes.Equal(payload, original) {
+			t.Errorf("%s: the payload passed in was changed", tt.sMode)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package segment splits the super-packets that TCP segmentation offload (TSO)
+// and generic segmentation offload (GSO) leave in a capture back in to packets
+// that fit the MTU.  TCP packets are cut in to segments the way the network card
+// would have done it, anything else carried in IPv4 is fragmented (RFC 791).
+// Offloaded packets can have an IPv4 total length or IPv6 payload length of
+// zero, the length of the captured data is used instead.
+package segment
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/fragment"
+	"github.com/jordan2175/rewritecap/lib/frame"
+)
+
+var iDebug = 0
+
+// The smallest and biggest MTU a packet can be split for, every IPv4 host has to
+// take 68 byte packets (RFC 791)
+const (
+	MinMTU = 68
+	MaxMTU = 65535
+)
+
+// The TCP flags that only belong on the first or the last segment
+const (
+	iTCPFlagFIN = 0x01
+	iTCPFlagPSH = 0x08
+	iTCPFlagCWR = 0x80
+)
+
+// The flags and fragment offset of an IPv4 header
+const (
+	iIPv4FlagDF         = 0x4000
+	iIPv4FlagMF         = 0x2000
+	iIPv4FragmentOffset = 0x1fff
+)
+
+//
+// -----------------------------------------------------------------------------
+// FixLength()
+// -----------------------------------------------------------------------------
+// This function will set an IPv4 total length or the IPv6 payload length of a TCP
+// packet that was left at zero by segmentation offload to the length of the
+// captured data, and fix the IPv4 header checksum.  A packet that is too big
+// for the length field keeps its zero.  It returns true if the length was set.
+func FixLength(f *frame.Frame) bool {
+	if f.NetworkOffset < 0 || f.TransportOffset < 0 || f.IPProtocol != layers.IPProtocolTCP {
+		return false
+	}
+	iIPEnd, bZeroLength := fragment.IPEnd(f)
+	if !bZeroLength || iIPEnd < 0 || iIPEnd-f.NetworkOffset > MaxMTU {
+		return false
+	}
+	fragment.FixLengths(f, f.Data[:iIPEnd])
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Set the IP length of an offloaded packet to", iIPEnd-f.NetworkOffset)
+	}
+	return true
+} // FixLength()
+
+//
+// -----------------------------------------------------------------------------
+// Split()
+// -----------------------------------------------------------------------------
+// This function will split a packet that is bigger than the MTU.  A TCP packet is
+// cut in to segments of the biggest size that fits, with the sequence numbers,
+// IPv4 identifications, lengths and checksums they would have had on the wire.
+// Only the first segment keeps the CWR flag and only the last one keeps the FIN
+// and PSH flags.  Anything else carried in IPv4 is fragmented, unless the don't
+// fragment bit is set.  Whatever comes before the IP header is copied to every
+// new packet and any ethernet padding is left off.  nil is returned when the
+// packet fits the MTU or can not be split, which includes a packet that was cut
+// short by the snap length and anything other than TCP in IPv6.
+func Split(f *frame.Frame, iMTU int) [][]byte {
+	if f.NetworkOffset < 0 || f.IPVersion == 0 {
+		return nil
+	}
+	iIPEnd, _ := fragment.IPEnd(f)
+	if iIPEnd < 0 || iIPEnd-f.NetworkOffset <= iMTU {
+		return nil
+	}
+
+	bFragment := false
+	if f.IPVersion == 4 {
+		iFlags := int(f.Data[f.NetworkOffset+6])<<8 | int(f.Data[f.NetworkOffset+7])
+		bFragment = iFlags&(iIPv4FlagMF|iIPv4FragmentOffset) != 0
+	}
+
+	var packets [][]byte
+	if f.IPProtocol == layers.IPProtocolTCP && f.TransportOffset >= 0 && !bFragment {
+		packets = splitTCP(f, iIPEnd, iMTU)
+	} else if f.IPVersion == 4 && f.Data[f.NetworkOffset+6]&(iIPv4FlagDF>>8) == 0 {
+		packets = fragment.Split(f, fragment.MTUPieces(f, iMTU), 0)
+	}
+	if iDebug == 1 && packets != nil {
+		fmt.Println("DEBUG: Split a packet of", iIPEnd-f.NetworkOffset, "bytes in to", len(packets))
+	}
+	return packets
+} // Split()
+
+//
+// -----------------------------------------------------------------------------
+// splitTCP()
+// -----------------------------------------------------------------------------
+// Cut the TCP payload in to segments that fit the MTU with the IP and TCP headers
+// in front of them.  The IPv4 identification goes up by one for each segment.
+func splitTCP(f *frame.Frame, iIPEnd, iMTU int) [][]byte {
+	iHeaderEnd := f.TransportOffset + int(f.Data[f.TransportOffset+12]>>4)*4
+	iMSS := iMTU - (iHeaderEnd - f.NetworkOffset)
+	if iMSS < 1 || iHeaderEnd > iIPEnd {
+		return nil
+	}
+
+	payload := f.Data[iHeaderEnd:iIPEnd]
+	tcp := f.Data[f.TransportOffset:]
+	iSeq := readUint32(tcp[4:8])
+	iID := int(f.Data[f.NetworkOffset+4])<<8 | int(f.Data[f.NetworkOffset+5])
+
+	var packets [][]byte
+	for iStart := 0; iStart < len(payload); iStart += iMSS {
+		iEnd := iStart + iMSS
+		if iEnd > len(payload) {
+			iEnd = len(payload)
+		}
+		packet := make([]byte, 0, iHeaderEnd+iEnd-iStart)
+		packet = append(packet, f.Data[:iHeaderEnd]...)
+		packet = append(packet, payload[iStart:iEnd]...)
+
+		segment := packet[f.TransportOffset:]
+		writeUint32(segment[4:8], iSeq+uint32(iStart))
+		if iStart > 0 {
+			segment[13] &^= iTCPFlagCWR
+		}
+		if iEnd < len(payload) {
+			segment[13] &^= iTCPFlagFIN | iTCPFlagPSH
+		}
+		if f.IPVersion == 4 {
+			iNewID := iID + len(packets)
+			packet[f.NetworkOffset+4], packet[f.NetworkOffset+5] = byte(iNewID>>8), byte(iNewID)
+		}
+		fragment.FixLengths(f, packet)
+
+		src, dst := addresses(f, packet)
+		segment[16], segment[17] = 0, 0
+		iChecksum := checksum.Transport(src, dst, layers.IPProtocolTCP, segment)
+		segment[16], segment[17] = byte(iChecksum>>8), byte(iChecksum)
+		packets = append(packets, packet)
+	}
+	return packets
+} // splitTCP()
+
+// addresses finds the source and destination addresses of the IP header for
+// the TCP pseudo header
+func addresses(f *frame.Frame, packet []byte) ([]byte, []byte) {
+	ipHeader := packet[f.NetworkOffset:]
+	if f.IPVersion == 4 {
+		return ipHeader[12:16], ipHeader[16:20]
+	}
+	return ipHeader[8:24], ipHeader[24:40]
+}
+
+// readUint32 reads a big endian 32 bit number
+func readUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// writeUint32 writes a big endian 32 bit number
+func writeUint32(b []byte, i uint32) {
+	b[0], b[1], b[2], b[3] = byte(i>>24), byte(i>>16), byte(i>>8), byte(i)
+}
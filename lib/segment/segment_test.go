@@ -0,0 +1,147 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package segment
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+func TestFixLength(t *testing.T) {
+	for _, iVersion := range []int{4, 6} {
+		f := pcaptest.Parse(t, pcaptest.Offloaded(iVersion, 100))
+		if !FixLength(f) {
+			t.Fatalf("IPv%d: expected the length to be set", iVersion)
+		}
+		if iVersion == 4 {
+			if iLength := int(f.Data[16])<<8 | int(f.Data[17]); iLength != 140 {
+				t.Errorf("Expected an IPv4 total length of 140, got %d", iLength)
+			}
+			if iChecksum := checksum.IPv4Header(f.Data[14:]); f.Data[24] != byte(iChecksum>>8) || f.Data[25] != byte(iChecksum) {
+				t.Error("Expected a valid IPv4 header checksum")
+			}
+		} else if iLength := int(f.Data[18])<<8 | int(f.Data[19]); iLength != 120 {
+			t.Errorf("Expected an IPv6 payload length of 120, got %d", iLength)
+		}
+
+		// It is only set once
+		if FixLength(f) {
+			t.Errorf("IPv%d: did not expect the length to be set a second time", iVersion)
+		}
+	}
+}
+
+func TestSplitTCP(t *testing.T) {
+	for _, iVersion := range []int{4, 6} {
+		f := pcaptest.Parse(t, pcaptest.Offloaded(iVersion, 3000))
+		iHeaders := 40
+		if iVersion == 6 {
+			iHeaders = 60
+		}
+
+		// Each segment carries the MTU less the headers, the last one the rest
+		packets := Split(f, 1500)
+		iMSS := 1500 - iHeaders
+		if len(packets) != 3 {
+			t.Fatalf("IPv%d: expected 3 segments, got %d", iVersion, len(packets))
+		}
+		iPayload := 0
+		for i, packet := range packets {
+			segmentFrame := pcaptest.Parse(t, packet)
+			tcp := packet[segmentFrame.TransportOffset:]
+			iStart, iEnd := segmentFrame.Payload()
+			if iStart < 0 || len(packet)-14 > 1500 {
+				t.Fatalf("IPv%d segment %d: expected a payload and at most 1500 bytes, got %d", iVersion, i, len(packet)-14)
+			}
+			if iSeq := readUint32(tcp[4:8]); iSeq != 1000+uint32(iPayload) {
+				t.Errorf("IPv%d segment %d: expected sequence %d, got %d", iVersion, i, 1000+iPayload, iSeq)
+			}
+			if packet[iStart] != byte(iPayload) {
+				t.Errorf("IPv%d segment %d: expected the payload to start with 0x%02x, got 0x%02x", iVersion, i, byte(iPayload), packet[iStart])
+			}
+			if i < 2 && iEnd-iStart != iMSS {
+				t.Errorf("IPv%d segment %d: expected %d bytes of payload, got %d", iVersion, i, iMSS, iEnd-iStart)
+			}
+			iPayload += iEnd - iStart
+
+			// CWR stays on the first segment, PSH and FIN on the last
+			iExpectedFlags := byte(0x10)
+			if i == 0 {
+				iExpectedFlags |= iTCPFlagCWR
+			}
+			if i == 2 {
+				iExpectedFlags |= iTCPFlagFIN | iTCPFlagPSH
+			}
+			if tcp[13] != iExpectedFlags {
+				t.Errorf("IPv%d segment %d: expected flags 0x%02x, got 0x%02x", iVersion, i, iExpectedFlags, tcp[13])
+			}
+
+			src, dst := addresses(segmentFrame, packet)
+			if checksum.Transport(src, dst, layers.IPProtocolTCP, tcp) != 0 {
+				t.Errorf("IPv%d segment %d: expected a valid TCP checksum", iVersion, i)
+			}
+			if iVersion == 4 {
+				if iID := int(packet[18])<<8 | int(packet[19]); iID != 8+i {
+					t.Errorf("Segment %d: expected IP identification %d, got %d", i, 8+i, iID)
+				}
+				if iChecksum := checksum.IPv4Header(packet[14:]); packet[24] != byte(iChecksum>>8) || packet[25] != byte(iChecksum) {
+					t.Errorf("Segment %d: expected a valid IPv4 header checksum", i)
+				}
+			}
+		}
+		if iPayload != 3000 {
+			t.Errorf("IPv%d: expected 3000 bytes of payload in all, got %d", iVersion, iPayload)
+		}
+
+		// A packet that fits is left alone
+		if packets := Split(f, 9000); packets != nil {
+			t.Errorf("IPv%d: did not expect a packet that fits to be split, got %d", iVersion, len(packets))
+		}
+	}
+}
+
+func TestFragmentIPv4(t *testing.T) {
+	data := pcaptest.IPv4UDP(0, make([]byte, 3000))
+	packets := Split(pcaptest.Parse(t, data), 1500)
+	if len(packets) != 3 {
+		t.Fatalf("Expected 3 fragments, got %d", len(packets))
+	}
+
+	// The fragments put back together are the original IP payload
+	var reassembled []byte
+	for i, packet := range packets {
+		ipHeader := packet[14:]
+		iFlags := int(ipHeader[6])<<8 | int(ipHeader[7])
+		if iFlags&iIPv4FragmentOffset*8 != len(reassembled) {
+			t.Errorf("Fragment %d: expected offset %d, got %d", i, len(reassembled), iFlags&iIPv4FragmentOffset*8)
+		}
+		if bMore := iFlags&iIPv4FlagMF != 0; bMore != (i < 2) {
+			t.Errorf("Fragment %d: expected more fragments %t", i, i < 2)
+		}
+		if iLength := int(ipHeader[2])<<8 | int(ipHeader[3]); iLength != len(ipHeader) || iLength > 1500 {
+			t.Errorf("Fragment %d: expected a total length of %d up to 1500, got %d", i, len(ipHeader), iLength)
+		}
+		if ipHeader[4] != 0 || ipHeader[5] != 1 {
+			t.Errorf("Fragment %d: expected every fragment to keep identification 1", i)
+		}
+		reassembled = append(reassembled, ipHeader[20:]...)
+	}
+	if string(reassembled) != string(data[34:]) {
+		t.Error("Expected the fragments to put back together in to the original payload")
+	}
+
+	// Don't fragment is honoured, and IPv6 is only split for TCP
+	data[20] |= 0x40
+	if packets := Split(pcaptest.Parse(t, data), 1500); packets != nil {
+		t.Errorf("Did not expect a packet with don't fragment set to be split, got %d", len(packets))
+	}
+	if packets := Split(pcaptest.Parse(t, pcaptest.IPv6UDP(0, make([]byte, 3000))), 1500); packets != nil {
+		t.Errorf("Did not expect an IPv6 UDP packet to be split, got %d", len(packets))
+	}
+}
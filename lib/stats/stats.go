@@ -0,0 +1,180 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package stats collects a machine readable summary of a rewrite run so that the
+// results can be saved as JSON and compared between runs.
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// TimeRange is the earliest and the latest packet timestamp, a file that is not
+// in timestamp order can have them anywhere in the file
+type TimeRange struct {
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// Summary is everything that is saved to the JSON file at the end of a run
+type Summary struct {
+	InputFile        string         `json:"input_file"`
+	OutputFile       string         `json:"output_file"`
+	DryRun           bool           `json:"dry_run"`
+	LinkType         string         `json:"link_type"`
+	PacketsRead      int            `json:"packets_read"`
+	PacketsWritten   int            `json:"packets_written"`
+	BytesRead        int64          `json:"bytes_read"`
+	BytesWritten     int64          `json:"bytes_written"`
+	Malformed        int            `json:"malformed"`
+	Dropped          int            `json:"dropped"`
+	Duplicates       int            `json:"duplicates"`
+	ARP              int            `json:"arp"`
+	Dot1Q            int            `json:"802.1q"`
+	Dot1QinQ         int            `json:"802.1qinq"`
+	EthernetTypes    map[string]int `json:"ethernet_types"`
+	IPProtocols      map[string]int `json:"ip_protocols"`
+	Rewrites         map[string]int `json:"rewrites"`
+	TimestampsBefore *TimeRange     `json:"timestamps_before"`
+	TimestampsAfter  *TimeRange     `json:"timestamps_after"`
+	ElapsedSeconds   float64        `json:"elapsed_seconds"`
+	PacketsPerSecond float64        `json:"packets_per_second"`
+	BytesPerSecond   float64        `json:"bytes_per_second"`
+}
+
+//
+// -----------------------------------------------------------------------------
+// New()
+// -----------------------------------------------------------------------------
+// Create an empty summary for a run from one file to another
+func New(sInputFile, sOutputFile string) *Summary {
+	return &Summary{
+		InputFile:     sInputFile,
+		OutputFile:    sOutputFile,
+		EthernetTypes: make(map[string]int),
+		IPProtocols:   make(map[string]int),
+		Rewrites:      make(map[string]int),
+	}
+} // New()
+
+//
+// -----------------------------------------------------------------------------
+// AddRead()
+// -----------------------------------------------------------------------------
+// Count a packet that was read from the source file along with its timestamp
+// before it was changed
+func (s *Summary) AddRead(ts time.Time, iLength int) {
+	s.PacketsRead++
+	s.BytesRead += int64(iLength)
+	s.TimestampsBefore = addTimestamp(s.TimestampsBefore, ts)
+} // AddRead()
+
+//
+// -----------------------------------------------------------------------------
+// Reader()
+// -----------------------------------------------------------------------------
+// Wrap a packet reader so that the packets are counted with their original
+// timestamps as they are read from the source file.  Nothing else calls AddRead
+// while the reader is in use.
+func (s *Summary) Reader(read func() ([]byte, gopacket.CaptureInfo, error)) func() ([]byte, gopacket.CaptureInfo, error) {
+	return func() ([]byte, gopacket.CaptureInfo, error) {
+		data, ci, err := read()
+		if err == nil {
+			s.AddRead(ci.Timestamp, len(data))
+		}
+		return data, ci, err
+	}
+} // Reader()
+
+//
+// -----------------------------------------------------------------------------
+// AddWritten()
+// -----------------------------------------------------------------------------
+// Count a packet that was written to the new file along with its timestamp
+// after it was changed
+func (s *Summary) AddWritten(ts time.Time, iLength int) {
+	s.PacketsWritten++
+	s.BytesWritten += int64(iLength)
+	s.TimestampsAfter = addTimestamp(s.TimestampsAfter, ts)
+} // AddWritten()
+
+//
+// -----------------------------------------------------------------------------
+// AddEthernetType()
+// -----------------------------------------------------------------------------
+// Count a packet by its ethernet type, types that gopacket does not know are
+// shown in hex
+func (s *Summary) AddEthernetType(ethType layers.EthernetType) {
+	sName := ethType.String()
+	if sName == "" || strings.HasPrefix(sName, "Unknown") {
+		sName = fmt.Sprintf("0x%04x", uint16(ethType))
+	}
+	s.EthernetTypes[sName]++
+} // AddEthernetType()
+
+//
+// -----------------------------------------------------------------------------
+// AddIPProtocol()
+// -----------------------------------------------------------------------------
+// Count a packet by its IP protocol, protocols that gopacket does not know are
+// shown as a number
+func (s *Summary) AddIPProtocol(ipProtocol layers.IPProtocol) {
+	sName := ipProtocol.String()
+	if sName == "" || strings.HasPrefix(sName, "Unknown") {
+		sName = fmt.Sprintf("%d", uint8(ipProtocol))
+	}
+	s.IPProtocols[sName]++
+} // AddIPProtocol()
+
+//
+// -----------------------------------------------------------------------------
+// Finish()
+// -----------------------------------------------------------------------------
+// Record how long the run took and work out the throughput
+func (s *Summary) Finish(elapsed time.Duration) {
+	s.ElapsedSeconds = elapsed.Seconds()
+	if s.ElapsedSeconds > 0 {
+		s.PacketsPerSecond = float64(s.PacketsRead) / s.ElapsedSeconds
+		s.BytesPerSecond = float64(s.BytesRead) / s.ElapsedSeconds
+	}
+} // Finish()
+
+//
+// -----------------------------------------------------------------------------
+// WriteFile()
+// -----------------------------------------------------------------------------
+// Save the summary as indented JSON
+func (s *Summary) WriteFile(sFilename string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sFilename, append(data, '\n'), 0644)
+} // WriteFile()
+
+//
+// -----------------------------------------------------------------------------
+// addTimestamp()
+// -----------------------------------------------------------------------------
+// Widen the range to take in the timestamp
+func addTimestamp(r *TimeRange, ts time.Time) *TimeRange {
+	if r == nil {
+		return &TimeRange{First: ts, Last: ts}
+	}
+	if ts.Before(r.First) {
+		r.First = ts
+	}
+	if ts.After(r.Last) {
+		r.Last = ts
+	}
+	return r
+} // addTimestamp()
@@ -0,0 +1,90 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package stats
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	s := New("in.pcap", "out.pcap")
+	start := time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		s.AddRead(ts, 100)
+		s.AddWritten(ts.Add(time.Hour), 100)
+	}
+	s.AddEthernetType(layers.EthernetTypeIPv4)
+	s.AddEthernetType(layers.EthernetType(0x88b5))
+	s.AddIPProtocol(layers.IPProtocolTCP)
+	s.AddIPProtocol(layers.IPProtocol(253))
+	s.Finish(2 * time.Second)
+
+	if s.PacketsRead != 3 || s.BytesRead != 300 || s.PacketsWritten != 3 || s.BytesWritten != 300 {
+		t.Errorf("Wrong counts: %+v", s)
+	}
+	if !s.TimestampsBefore.First.Equal(start) || !s.TimestampsBefore.Last.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Wrong timestamps before: %+v", s.TimestampsBefore)
+	}
+	if !s.TimestampsAfter.First.Equal(start.Add(time.Hour)) {
+		t.Errorf("Wrong timestamps after: %+v", s.TimestampsAfter)
+	}
+	if s.EthernetTypes["IPv4"] != 1 || s.EthernetTypes["0x88b5"] != 1 {
+		t.Errorf("Wrong ethernet types: %v", s.EthernetTypes)
+	}
+	if s.IPProtocols["TCP"] != 1 || s.IPProtocols["253"] != 1 {
+		t.Errorf("Wrong IP protocols: %v", s.IPProtocols)
+	}
+	if s.PacketsPerSecond != 1.5 || s.BytesPerSecond != 150 {
+		t.Errorf("Wrong throughput: %v %v", s.PacketsPerSecond, s.BytesPerSecond)
+	}
+}
+
+func TestTimestampsOutOfOrder(t *testing.T) {
+	s := New("in.pcap", "out.pcap")
+	start := time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	// The earliest packet is in the middle of the file and the latest one is
+	// first
+	for _, offset := range []time.Duration{time.Minute, -time.Hour, time.Second} {
+		s.AddRead(start.Add(offset), 100)
+	}
+	if !s.TimestampsBefore.First.Equal(start.Add(-time.Hour)) || !s.TimestampsBefore.Last.Equal(start.Add(time.Minute)) {
+		t.Errorf("Expected the earliest and latest timestamps, got %+v", s.TimestampsBefore)
+	}
+}
+
+func TestReader(t *testing.T) {
+	s := New("in.pcap", "out.pcap")
+	start := time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	// The packets are counted with the timestamps they had in the file
+	iPackets := 0
+	read := s.Reader(func() ([]byte, gopacket.CaptureInfo, error) {
+		if iPackets == 3 {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		iPackets++
+		return make([]byte, 60), gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(-iPackets) * time.Second)}, nil
+	})
+	for {
+		if _, _, err := read(); err != nil {
+			break
+		}
+	}
+	if s.PacketsRead != 3 || s.BytesRead != 180 {
+		t.Errorf("Wrong counts: %+v", s)
+	}
+	if !s.TimestampsBefore.First.Equal(start.Add(-3*time.Second)) || !s.TimestampsBefore.Last.Equal(start.Add(-time.Second)) {
+		t.Errorf("Wrong timestamps before: %+v", s.TimestampsBefore)
+	}
+}
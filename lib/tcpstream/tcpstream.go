@@ -0,0 +1,237 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package tcpstream keeps the sequence and acknowledgement numbers of a TCP
+// connection lined up after a rewrite made the payload of some of its segments
+// longer or shorter.  Every later segment in the same direction has its sequence
+// number moved, and every segment going the other way has its acknowledgement
+// number and any SACK blocks moved to match.
+package tcpstream
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/frame"
+)
+
+var iDebug = 0
+
+// The TCP option that carries SACK blocks
+const iOptionSACK = 5
+
+// Tracker remembers where the payloads changed length in each direction of each
+// connection.  The segments have to be handed to Fix in the order they were
+// captured.  Only connections that had a payload change length are kept.
+type Tracker struct {
+	flows map[flowKey]*flow
+}
+
+// flowKey is one direction of a connection
+type flowKey struct {
+	src      [16]byte
+	dst      [16]byte
+	iSrcPort uint16
+	iDstPort uint16
+}
+
+// change is a segment that changed length.  iEnd is the sequence number just
+// past the original payload, everything from there on moves by iDelta.
+type change struct {
+	iEnd   uint32
+	iDelta int
+}
+
+// flow is one direction of a connection.  The changes are sorted by where they
+// are in the sequence space and iTotal is the sum of all of their deltas.
+type flow struct {
+	changes []change
+	iTotal  int
+}
+
+//
+// -----------------------------------------------------------------------------
+// New()
+// -----------------------------------------------------------------------------
+// This function will create a tracker with no connections in it
+func New() *Tracker {
+	return &Tracker{flows: make(map[flowKey]*flow)}
+} // New()
+
+//
+// -----------------------------------------------------------------------------
+// Fix()
+// -----------------------------------------------------------------------------
+// This function will move the sequence and acknowledgement numbers of a TCP
+// segment by however much the payloads before them changed length, and then
+// record that the payload of this segment grew by iDelta bytes, which may be 0
+// or negative.  The TCP checksum is updated to match.  True is returned if the
+// segment was changed.  Anything that is not a complete TCP header is left
+// alone.
+func (t *Tracker) Fix(f *frame.Frame, iDelta int) bool {
+	if f.TransportOffset < 0 || f.NetworkOffset < 0 || f.IPProtocol != layers.IPProtocolTCP {
+		return false
+	}
+	key, ok := newFlowKey(f)
+	if !ok {
+		return false
+	}
+	reverse := flowKey{src: key.dst, dst: key.src, iSrcPort: key.iDstPort, iDstPort: key.iSrcPort}
+
+	segment := f.Data[f.TransportOffset:]
+	iHeaderLength := int(segment[12]>>4) * 4
+	iSeq := readUint32(segment[4:8])
+	bSYN := segment[13]&0x02 != 0
+	bACK := segment[13]&0x10 != 0
+
+	// ---------------------------------------------------------------------
+	// Record where this payload changed length, before any later segment
+	// in the same direction is moved.  A SYN takes up one sequence number
+	// in front of the payload.
+	// ---------------------------------------------------------------------
+	if iDelta != 0 {
+		iStart, iEnd := f.Payload()
+		if iStart >= 0 {
+			iDataSeq := iSeq
+			if bSYN {
+				iDataSeq++
+			}
+			fl := t.flows[key]
+			if fl == nil {
+				fl = &flow{}
+				t.flows[key] = fl
+			}
+			fl.add(iDataSeq+uint32(iEnd-iStart-iDelta), iDelta)
+		}
+	}
+
+	forward, backward := t.flows[key], t.flows[reverse]
+	if forward == nil && backward == nil {
+		return false
+	}
+
+	// ---------------------------------------------------------------------
+	// Move the numbers, the header is kept so the checksum can be updated
+	// ---------------------------------------------------------------------
+	var before [60]byte
+	copy(before[:], segment[:iHeaderLength])
+
+	if forward != nil {
+		writeUint32(segment[4:8], iSeq+uint32(forward.shift(iSeq)))
+	}
+	if backward != nil {
+		if bACK {
+			iAck := readUint32(segment[8:12])
+			writeUint32(segment[8:12], iAck+uint32(backward.shift(iAck)))
+		}
+		fixSACK(segment[20:iHeaderLength], backward)
+	}
+
+	if bytes.Equal(before[:iHeaderLength], segment[:iHeaderLength]) {
+		return false
+	}
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Moved the TCP sequence numbers from", readUint32(before[4:8]), readUint32(before[8:12]), "to", readUint32(segment[4:8]), readUint32(segment[8:12]))
+	}
+	checksum.UpdateTransport(segment, layers.IPProtocolTCP, 0, before[:iHeaderLength], segment[:iHeaderLength])
+	return true
+} // Fix()
+
+//
+// -----------------------------------------------------------------------------
+// add()
+// -----------------------------------------------------------------------------
+// Record a change in the flow.  A retransmission of a segment that was already
+// changed ends at the same place so it replaces the change it repeats.
+func (fl *flow) add(iEnd uint32, iDelta int) {
+	i := len(fl.changes)
+	for i > 0 && int32(fl.changes[i-1].iEnd-iEnd) >= 0 {
+		i--
+	}
+
+	if i < len(fl.changes) && fl.changes[i].iEnd == iEnd {
+		fl.iTotal += iDelta - fl.changes[i].iDelta
+		fl.changes[i].iDelta = iDelta
+		return
+	}
+	fl.changes = append(fl.changes, change{})
+	copy(fl.changes[i+1:], fl.changes[i:])
+	fl.changes[i] = change{iEnd: iEnd, iDelta: iDelta}
+	fl.iTotal += iDelta
+} // add()
+
+//
+// -----------------------------------------------------------------------------
+// shift()
+// -----------------------------------------------------------------------------
+// Work out how far a sequence number moves, the deltas of every change that
+// ends at or before it.  Most segments come after all of the changes so the
+// changes are looked at from the last one back.
+func (fl *flow) shift(iSeq uint32) int {
+	iShift := fl.iTotal
+	for i := len(fl.changes) - 1; i >= 0 && int32(iSeq-fl.changes[i].iEnd) < 0; i-- {
+		iShift -= fl.changes[i].iDelta
+	}
+	return iShift
+} // shift()
+
+//
+// -----------------------------------------------------------------------------
+// fixSACK()
+// -----------------------------------------------------------------------------
+// Move the edges of the SACK blocks in the TCP options, they are sequence
+// numbers of the other direction the same as the acknowledgement number
+func fixSACK(options []byte, backward *flow) {
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case 0:
+			return
+		case 1:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return
+		}
+		iLength := int(options[i+1])
+		if options[i] == iOptionSACK {
+			for j := i + 2; j+4 <= i+iLength; j += 4 {
+				iEdge := readUint32(options[j : j+4])
+				writeUint32(options[j:j+4], iEdge+uint32(backward.shift(iEdge)))
+			}
+		}
+		i += iLength
+	}
+} // fixSACK()
+
+// newFlowKey builds the key for the direction the segment is going in
+func newFlowKey(f *frame.Frame) (flowKey, bool) {
+	var key flowKey
+	ipHeader := f.Data[f.NetworkOffset:]
+	switch f.IPVersion {
+	case 4:
+		copy(key.src[:], ipHeader[12:16])
+		copy(key.dst[:], ipHeader[16:20])
+	case 6:
+		copy(key.src[:], ipHeader[8:24])
+		copy(key.dst[:], ipHeader[24:40])
+	default:
+		return key, false
+	}
+	key.iSrcPort, key.iDstPort = f.Ports()
+	return key, true
+}
+
+// readUint32 reads a big endian 32 bit number
+func readUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// writeUint32 writes a big endian 32 bit number
+func writeUint32(b []byte, i uint32) {
+	b[0], b[1], b[2], b[3] = byte(i>>24), byte(i>>16), byte(i>>8), byte(i)
+}
@@ -0,0 +1,110 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpstream
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+// segment builds a parsed TCP segment between the client and the server
+func segment(t *testing.T, bFromServer bool, iSeq, iAck uint32, payload string) *frame.Frame {
+	f := pcaptest.Parse(t, pcaptest.ServerTCP(4002, 80, bFromServer, iSeq, iAck, []byte(payload)))
+	return f
+}
+
+func TestFix(t *testing.T) {
+	tracker := New()
+	tests := []struct {
+		name        string
+		f           *frame.Frame
+		iDelta      int
+		iExpectSeq  uint32
+		iExpectAck  uint32
+		bExpectDiff bool
+	}{
+		{"first request grows from 7 to 10", segment(t, false, 1000, 5000, "0123456789"), 3, 1000, 5000, false},
+		{"response", segment(t, true, 5000, 1007, "abcde"), 0, 5000, 1010, true},
+		{"second request shrinks from 12 to 10", segment(t, false, 1007, 5005, "0123456789"), -2, 1010, 5005, true},
+		{"retransmission of the first", segment(t, false, 1000, 5000, "0123456789"), 3, 1000, 5000, false},
+		{"ack in the middle", segment(t, true, 5005, 1010, ""), 0, 5005, 1013, true},
+		{"ack of both", segment(t, true, 5005, 1019, ""), 0, 5005, 1020, true},
+		{"third request", segment(t, false, 1019, 5005, "x"), 0, 1020, 5005, true},
+	}
+
+	for _, tt := range tests {
+		bChanged := tracker.Fix(tt.f, tt.iDelta)
+		tcpHeader := tt.f.Data[tt.f.TransportOffset:]
+		if iSeq, iAck := readUint32(tcpHeader[4:8]), readUint32(tcpHeader[8:12]); iSeq != tt.iExpectSeq || iAck != tt.iExpectAck {
+			t.Errorf("%s: expected seq %d ack %d, got %d %d", tt.name, tt.iExpectSeq, tt.iExpectAck, iSeq, iAck)
+		}
+		if bChanged != tt.bExpectDiff {
+			t.Errorf("%s: expected changed %t, got %t", tt.name, tt.bExpectDiff, bChanged)
+		}
+
+		// The segments are built with the payload that was already rewritten,
+		// so the checksum has to stay right
+		if !isChecksumValid(tt.f) {
+			t.Errorf("%s: TCP checksum is wrong", tt.name)
+		}
+	}
+
+	// Other connections are left alone
+	f := pcaptest.Parse(t, pcaptest.ServerTCP(4003, 80, false, 1020, 5005, nil))
+	if tracker.Fix(f, 0) {
+		t.Error("Expected a different connection to be left alone")
+	}
+}
+
+func TestFixSACK(t *testing.T) {
+	tracker := New()
+	tracker.Fix(segment(t, false, 1000, 5000, "0123456789"), 4)
+
+	// A SACK block from the server for data after the change
+	data := pcaptest.ServerTCP(4002, 80, true, 5000, 1000, nil)[:54]
+	options := []byte{1, 1, 5, 10, 0, 0, 0x03, 0xf2, 0, 0, 0x03, 0xfc}
+	f := pcaptest.Parse(t, withOptions(data, options))
+	if !tracker.Fix(f, 0) {
+		t.Fatal("Expected the SACK block to change")
+	}
+	tcpHeader := f.Data[f.TransportOffset:]
+	if iLeft, iRight := readUint32(tcpHeader[24:28]), readUint32(tcpHeader[28:32]); iLeft != 1014 || iRight != 1024 {
+		t.Errorf("Expected SACK block 1014-1024, got %d-%d", iLeft, iRight)
+	}
+	if !isChecksumValid(f) {
+		t.Error("TCP checksum is wrong")
+	}
+}
+
+// isChecksumValid checks the TCP checksum of a segment, leaving out any ethernet
+// padding
+func isChecksumValid(f *frame.Frame) bool {
+	ipHeader := f.Data[f.NetworkOffset:]
+	iEnd := int(ipHeader[2])<<8 | int(ipHeader[3])
+	return checksum.Transport(ipHeader[12:16], ipHeader[16:20], layers.IPProtocolTCP, ipHeader[20:iEnd]) == 0
+}
+
+// withOptions adds TCP options to a segment with no payload and fixes the
+// lengths and checksums
+func withOptions(data, options []byte) []byte {
+	data = append(data, options...)
+	ipHeader := data[14:]
+	iLength := len(ipHeader)
+	ipHeader[2], ipHeader[3] = byte(iLength>>8), byte(iLength)
+	iChecksum := checksum.IPv4Header(ipHeader)
+	ipHeader[10], ipHeader[11] = byte(iChecksum>>8), byte(iChecksum)
+
+	tcpHeader := ipHeader[20:]
+	tcpHeader[12] = byte((20+len(options))/4) << 4
+	tcpHeader[16], tcpHeader[17] = 0, 0
+	iChecksum = checksum.Transport(ipHeader[12:16], ipHeader[16:20], layers.IPProtocolTCP, tcpHeader)
+	tcpHeader[16], tcpHeader[17] = byte(iChecksum>>8), byte(iChecksum)
+	return data
+}
@@ -0,0 +1,296 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package timesort puts the packets of a capture in timestamp order.  Captures
+// that were merged by other tools or taken on a NIC with more than one queue can
+// have them mixed up.  The packets are sorted in memory in runs, a run that does
+// not fit is written to a temporary file, and the runs are merged as the
+// packets are read back so a capture that is bigger than memory can be sorted.
+// Packets with the same timestamp keep the order they had in the file.
+package timesort
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var iDebug = 0
+
+// The bytes a packet takes in memory on top of its data, used to work out when a
+// run is full
+const iPacketOverhead = 64
+
+// The size of the record header in a run file: the timestamp in nanoseconds, the
+// length of the data, the capture length and the length on the wire
+const iRecordHeader = 20
+
+// Sorter reads all of the packets and hands them back in timestamp order.  The
+// counter says how many packets were earlier than a packet that came before them
+// in the file.
+type Sorter struct {
+	OutOfOrder int
+
+	iMemory   int64
+	sTempDir  string
+	buffered  []packet
+	iBuffered int64
+	latest    time.Time
+	runs      []*run
+	merge     runHeap
+	bSorted   bool
+	endErr    error
+}
+
+// packet is a packet with its capture info
+type packet struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+// run is a sorted run of packets, in memory or in a temporary file, with the next
+// packet to hand back
+type run struct {
+	iRun    int
+	packets []packet
+	file    *os.File
+	reader  *bufio.Reader
+	current packet
+}
+
+//
+// -----------------------------------------------------------------------------
+// New()
+// -----------------------------------------------------------------------------
+// This function will make a sorter that keeps up to about iMemory bytes of
+// packets in memory before it writes them to a temporary file.  The files go in
+// the temporary directory of the system and are removed by Close.
+func New(iMemory int64) *Sorter {
+	return &Sorter{iMemory: iMemory}
+} // New()
+
+//
+// -----------------------------------------------------------------------------
+// Reader()
+// -----------------------------------------------------------------------------
+// This function will wrap a packet reader so the packets come back in timestamp
+// order.  The first call reads every packet, they are copied so the reader can
+// reuse its buffer.  The error that ended the file is returned after the last
+// packet.  The reader has to be called from one goroutine.
+func (s *Sorter) Reader(read func() ([]byte, gopacket.CaptureInfo, error)) func() ([]byte, gopacket.CaptureInfo, error) {
+	return func() ([]byte, gopacket.CaptureInfo, error) {
+		if !s.bSorted {
+			if err := s.readAll(read); err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+			s.bSorted = true
+		}
+		return s.next()
+	}
+} // Reader()
+
+//
+// -----------------------------------------------------------------------------
+// Close()
+// -----------------------------------------------------------------------------
+// This function will close and remove the temporary files
+func (s *Sorter) Close() error {
+	for _, r := range s.runs {
+		if r.file != nil {
+			r.file.Close()
+		}
+	}
+	s.runs = nil
+	if s.sTempDir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.sTempDir)
+} // Close()
+
+//
+// -----------------------------------------------------------------------------
+// readAll()
+// -----------------------------------------------------------------------------
+// Read every packet in to sorted runs and get the runs ready to be merged
+func (s *Sorter) readAll(read func() ([]byte, gopacket.CaptureInfo, error)) error {
+	for {
+		data, ci, err := read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.endErr = err
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if ci.Timestamp.Before(s.latest) {
+			s.OutOfOrder++
+		} else {
+			s.latest = ci.Timestamp
+		}
+		s.buffered = append(s.buffered, packet{data: append([]byte(nil), data...), ci: ci})
+		s.iBuffered += int64(len(data)) + iPacketOverhead
+		if s.iBuffered > s.iMemory {
+			if err := s.spill(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The last run stays in memory
+	sortPackets(s.buffered)
+	s.runs = append(s.runs, &run{iRun: len(s.runs), packets: s.buffered})
+	s.buffered = nil
+	for _, r := range s.runs {
+		bMore, err := r.advance()
+		if err != nil {
+			return err
+		}
+		if bMore {
+			s.merge = append(s.merge, r)
+		}
+	}
+	heap.Init(&s.merge)
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Merging", len(s.runs), "sorted runs,", s.OutOfOrder, "packets were out of order")
+	}
+	return nil
+} // readAll()
+
+//
+// -----------------------------------------------------------------------------
+// spill()
+// -----------------------------------------------------------------------------
+// Sort the packets in memory and write them to a temporary file as a run
+func (s *Sorter) spill() error {
+	if s.sTempDir == "" {
+		sTempDir, err := ioutil.TempDir("", "rewritecap-sort")
+		if err != nil {
+			return err
+		}
+		s.sTempDir = sTempDir
+	}
+	file, err := os.Create(filepath.Join(s.sTempDir, fmt.Sprintf("run-%d", len(s.runs))))
+	if err != nil {
+		return err
+	}
+	r := &run{iRun: len(s.runs), file: file}
+	s.runs = append(s.runs, r)
+
+	sortPackets(s.buffered)
+	writer := bufio.NewWriterSize(file, 1<<20)
+	var recordHeader [iRecordHeader]byte
+	for _, p := range s.buffered {
+		binary.LittleEndian.PutUint64(recordHeader[0:8], uint64(p.ci.Timestamp.UnixNano()))
+		binary.LittleEndian.PutUint32(recordHeader[8:12], uint32(len(p.data)))
+		binary.LittleEndian.PutUint32(recordHeader[12:16], uint32(p.ci.CaptureLength))
+		binary.LittleEndian.PutUint32(recordHeader[16:20], uint32(p.ci.Length))
+		if _, err := writer.Write(recordHeader[:]); err != nil {
+			return err
+		}
+		if _, err := writer.Write(p.data); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r.reader = bufio.NewReaderSize(file, 1<<16)
+
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Wrote a run of", len(s.buffered), "packets to", file.Name())
+	}
+	s.buffered, s.iBuffered = nil, 0
+	return nil
+} // spill()
+
+// next hands back the earliest packet of all of the runs
+func (s *Sorter) next() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.merge) == 0 {
+		return nil, gopacket.CaptureInfo{}, s.endErr
+	}
+	r := s.merge[0]
+	p := r.current
+	bMore, err := r.advance()
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	if bMore {
+		heap.Fix(&s.merge, 0)
+	} else {
+		heap.Pop(&s.merge)
+	}
+	return p.data, p.ci, nil
+}
+
+// advance moves a run on to its next packet, it returns false at the end
+func (r *run) advance() (bool, error) {
+	if r.reader == nil {
+		if len(r.packets) == 0 {
+			return false, nil
+		}
+		r.current, r.packets = r.packets[0], r.packets[1:]
+		return true, nil
+	}
+
+	var recordHeader [iRecordHeader]byte
+	if _, err := io.ReadFull(r.reader, recordHeader[:]); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(recordHeader[8:12]))
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return false, err
+	}
+	r.current = packet{
+		data: data,
+		ci: gopacket.CaptureInfo{
+			Timestamp:     time.Unix(0, int64(binary.LittleEndian.Uint64(recordHeader[0:8]))),
+			CaptureLength: int(binary.LittleEndian.Uint32(recordHeader[12:16])),
+			Length:        int(binary.LittleEndian.Uint32(recordHeader[16:20])),
+		},
+	}
+	return true, nil
+}
+
+// sortPackets sorts packets by timestamp, keeping the order of equal ones
+func sortPackets(packets []packet) {
+	sort.SliceStable(packets, func(i, j int) bool {
+		return packets[i].ci.Timestamp.Before(packets[j].ci.Timestamp)
+	})
+}
+
+// runHeap orders the runs by their next packet, a run from earlier in the file
+// goes first when the timestamps are the same
+type runHeap []*run
+
+func (h runHeap) Len() int      { return len(h) }
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h runHeap) Less(i, j int) bool {
+	if h[i].current.ci.Timestamp.Equal(h[j].current.ci.Timestamp) {
+		return h[i].iRun < h[j].iRun
+	}
+	return h[i].current.ci.Timestamp.Before(h[j].current.ci.Timestamp)
+}
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*run)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
@@ -0,0 +1,94 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package timesort
+
+import (
+	"github.com/google/gopacket"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// sortAll sorts packets that are one byte long, holding their index in the file,
+// and returns the indexes in the order they came back
+func sortAll(t *testing.T, s *Sorter, offsets []int, endErr error) []int {
+	i := 0
+	read := s.Reader(func() ([]byte, gopacket.CaptureInfo, error) {
+		if i == len(offsets) {
+			return nil, gopacket.CaptureInfo{}, endErr
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     pcaptest.StartTime.Add(time.Duration(offsets[i]) * time.Millisecond),
+			CaptureLength: 1,
+			Length:        60,
+		}
+		i++
+		return []byte{byte(i - 1)}, ci, nil
+	})
+
+	var order []int
+	last := time.Time{}
+	for {
+		data, ci, err := read()
+		if err != nil {
+			if err != endErr {
+				t.Errorf("Expected the file to end with %v, got %v", endErr, err)
+			}
+			return order
+		}
+		if ci.Timestamp.Before(last) || ci.CaptureLength != 1 || ci.Length != 60 {
+			t.Errorf("Packet %d is out of order or lost its capture info: %+v", data[0], ci)
+		}
+		last = ci.Timestamp
+		order = append(order, int(data[0]))
+	}
+}
+
+func TestSort(t *testing.T) {
+	offsets := []int{30, 10, 20, 10, 40, 0, 20}
+	expected := []int{5, 1, 3, 2, 6, 0, 4}
+
+	// All in memory, in runs of 4 and 3 packets, and a file for each packet
+	for _, iMemory := range []int64{1 << 20, 3 * (1 + iPacketOverhead), 1} {
+		s := New(iMemory)
+		order := sortAll(t, s, offsets, io.EOF)
+		if len(order) != len(expected) {
+			t.Fatalf("Memory %d: expected %d packets, got %d", iMemory, len(expected), len(order))
+		}
+		for i := range order {
+			if order[i] != expected[i] {
+				t.Errorf("Memory %d: expected the packets in the order %v, got %v", iMemory, expected, order)
+				break
+			}
+		}
+		if s.OutOfOrder != 5 {
+			t.Errorf("Memory %d: expected 5 packets out of order, got %d", iMemory, s.OutOfOrder)
+		}
+
+		// The temporary files are removed
+		sTempDir := s.sTempDir
+		if (iMemory < 1<<20) != (sTempDir != "") {
+			t.Errorf("Memory %d: did not expect temporary directory %q", iMemory, sTempDir)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(sTempDir); sTempDir != "" && !os.IsNotExist(err) {
+			t.Errorf("Memory %d: expected %s to be removed", iMemory, sTempDir)
+		}
+	}
+}
+
+func TestSortTruncatedFile(t *testing.T) {
+	s := New(1)
+	defer s.Close()
+	if order := sortAll(t, s, []int{20, 10}, io.ErrUnexpectedEOF); len(order) != 2 || order[0] != 1 {
+		t.Errorf("Expected both packets sorted before the end of the file, got %v", order)
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package tunnel finds the packet that is carried inside a GRE (including
+// ERSPAN), VXLAN, Geneve, IP-in-IP (including 6in4) or GTP-U tunnel, so the rules
+// can be applied to its headers as well as the outer ones.  The inner packet is a frame of its own
+// that shares its data with the outer one.  The outer headers of a tunnel, or
+// an MPLS label stack, can also be stripped off.
+package tunnel
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/mpls"
+)
+
+var iDebug = 0
+
+// Layers says which headers of a tunnelled packet the rules change.  The zero
+// value changes both the outer and the inner headers.
+type Layers int
+
+// The headers of a tunnelled packet that can be changed
+const (
+	LayersBoth Layers = iota
+	LayersInner
+	LayersOuter
+)
+
+// The UDP ports the tunnels are found on
+const (
+	iPortVXLAN      = 4789
+	iPortVXLANLinux = 8472
+	iPortGeneve     = 6081
+	iPortGTPU       = 2152
+)
+
+// The protocol types used by GRE and Geneve for what they carry
+const (
+	iProtocolEthernet = 0x6558
+	iProtocolIPv4     = 0x0800
+	iProtocolIPv6     = 0x86dd
+	iProtocolERSPAN   = 0x88be
+)
+
+// The GRE flags that add fields to its header
+const (
+	iGREChecksum = 0x8000
+	iGREKey      = 0x2000
+	iGRESequence = 0x1000
+)
+
+// The GTP-U message type for a packet from a user
+const iGTPUMessageGPDU = 0xff
+
+//
+// -----------------------------------------------------------------------------
+// ParseLayers()
+// -----------------------------------------------------------------------------
+// This function will parse which headers of a tunnelled packet to change, both,
+// inner or outer
+func ParseLayers(sLayers string) (Layers, error) {
+	switch sLayers {
+	case "", "both":
+		return LayersBoth, nil
+	case "inner":
+		return LayersInner, nil
+	case "outer":
+		return LayersOuter, nil
+	}
+	return LayersBoth, fmt.Errorf("invalid tunnel layers %s, it should be both, inner or outer", sLayers)
+} // ParseLayers()
+
+//
+// -----------------------------------------------------------------------------
+// Inner()
+// -----------------------------------------------------------------------------
+// This function will find the packet carried by a tunnel.  The offset where it
+// starts in the outer frame data is returned along with a frame for it, which
+// is an ethernet frame for VXLAN, Geneve and GRE bridging and an IP packet
+// otherwise.  The frame is nil if the packet is not a tunnel that is understood
+// or the inner packet was cut short before the end of its first header.
+func Inner(f *frame.Frame) (int, *frame.Frame) {
+	iStart, linkType := locate(f)
+	if iStart < 0 {
+		return -1, nil
+	}
+	inner := parseInner(f.Data, iStart, linkType)
+	if inner == nil {
+		return -1, nil
+	}
+	if iDebug == 1 {
+		fmt.Println("DEBUG: Found a tunnel, the inner packet starts at", iStart)
+	}
+	return iStart, inner
+} // Inner()
+
+//
+// -----------------------------------------------------------------------------
+// Decapsulate()
+// -----------------------------------------------------------------------------
+// This function will strip the outer headers off a tunnel or an MPLS label stack
+// and return a new copy of the packet it carries, or nil if there is nothing to
+// strip.  Only one level is stripped.  The packet keeps the link type of the
+// frame: an IP packet taken out of an ethernet frame gets the outer ethernet
+// header and any 802.1Q tags, and an ethernet frame taken out of a packet that
+// starts with its IP header loses its own ethernet header.  A packet that can
+// not be made to fit the link type is left alone.
+func Decapsulate(f *frame.Frame) []byte {
+	if data := mpls.Pop(f); data != nil {
+		return data
+	}
+	_, inner := Inner(f)
+	if inner == nil {
+		return nil
+	}
+
+	switch {
+	case f.LinkType == layers.LinkTypeEthernet && inner.LinkType == layers.LinkTypeEthernet:
+		return append([]byte(nil), inner.Data...)
+	case f.LinkType == layers.LinkTypeEthernet:
+		iTypeOffset := 12 + f.VLANOffset
+		ethType := layers.EthernetTypeIPv4
+		if inner.IPVersion == 6 {
+			ethType = layers.EthernetTypeIPv6
+		}
+		data := make([]byte, 0, iTypeOffset+2+len(inner.Data))
+		data = append(data, f.Data[:iTypeOffset]...)
+		data = append(data, byte(ethType>>8), byte(ethType))
+		return append(data, inner.Data...)
+	case !fitsLinkType(f.LinkType, inner.IPVersion) || inner.NetworkOffset < 0:
+		return nil
+	}
+	return append([]byte(nil), inner.Data[inner.NetworkOffset:]...)
+} // Decapsulate()
+
+//
+// -----------------------------------------------------------------------------
+// ChecksumOffset()
+// -----------------------------------------------------------------------------
+// This function will find the outer checksum that covers the inner packet, the
+// UDP checksum of VXLAN, Geneve and GTP-U or the GRE checksum if there is one.
+// The offset in the frame data is returned, or -1 if nothing covers the inner
+// packet.
+func ChecksumOffset(f *frame.Frame) int {
+	if iStart, _ := locate(f); iStart < 0 {
+		return -1
+	}
+	switch f.IPProtocol {
+	case layers.IPProtocolUDP:
+		return f.TransportOffset + 6
+	case layers.IPProtocolGRE:
+		iFlags := int(f.Data[f.IPPayloadOffset])<<8 | int(f.Data[f.IPPayloadOffset+1])
+		if iFlags&iGREChecksum != 0 {
+			return f.IPPayloadOffset + 4
+		}
+	}
+	return -1
+} // ChecksumOffset()
+
+//
+// -----------------------------------------------------------------------------
+// UpdateChecksum()
+// -----------------------------------------------------------------------------
+// This function will fix the outer UDP or GRE checksum after the inner packet
+// that starts at iStart was changed from the old bytes to the new ones.  A UDP
+// checksum of 0 means there is none and is left alone.
+func UpdateChecksum(f *frame.Frame, iStart int, old, new []byte) {
+	iOffset := ChecksumOffset(f)
+	if iOffset < 0 || iOffset+2 > len(f.Data) {
+		return
+	}
+	if f.IPProtocol == layers.IPProtocolUDP {
+		checksum.UpdateTransport(f.Data[f.TransportOffset:], f.IPProtocol, iStart-f.TransportOffset, old, new)
+		return
+	}
+
+	// The GRE checksum covers the GRE header and what it carries, without a
+	// pseudo header
+	iChecksum := uint16(f.Data[iOffset])<<8 | uint16(f.Data[iOffset+1])
+	iChecksum = checksum.Update(iChecksum, iStart-f.IPPayloadOffset, old, new)
+	f.Data[iOffset] = byte(iChecksum >> 8)
+	f.Data[iOffset+1] = byte(iChecksum)
+} // UpdateChecksum()
+
+//
+// -----------------------------------------------------------------------------
+// locate()
+// -----------------------------------------------------------------------------
+// Find where the inner packet starts and what kind of packet it is.  A start of
+// -1 means there is no tunnel.
+func locate(f *frame.Frame) (int, layers.LinkType) {
+	if f.NetworkOffset < 0 || f.IPPayloadOffset < 0 {
+		return -1, 0
+	}
+
+	switch f.IPProtocol {
+	case layers.IPProtocolIPv4, layers.IPProtocolIPv6:
+		return f.IPPayloadOffset, layers.LinkTypeRaw
+	case layers.IPProtocolGRE:
+		return locateGRE(f.Data, f.IPPayloadOffset)
+	case layers.IPProtocolUDP:
+		if f.TransportOffset < 0 {
+			return -1, 0
+		}
+		iStart := f.TransportOffset + 8
+		iSrcPort, iDstPort := f.Ports()
+		switch {
+		case iDstPort == iPortVXLAN || iDstPort == iPortVXLANLinux:
+			return locateVXLAN(f.Data, iStart)
+		case iDstPort == iPortGeneve:
+			return locateGeneve(f.Data, iStart)
+		case iSrcPort == iPortGTPU && iDstPort == iPortGTPU:
+			return locateGTPU(f.Data, iStart)
+		}
+	}
+	return -1, 0
+} // locate()
+
+// locateGRE steps over a GRE header (RFC 2784 and RFC 2890), only version 0 is
+// understood.  ERSPAN type II has its own 8 byte header before the ethernet
+// frame.
+func locateGRE(data []byte, iStart int) (int, layers.LinkType) {
+	if len(data) < iStart+4 {
+		return -1, 0
+	}
+	iFlags := int(data[iStart])<<8 | int(data[iStart+1])
+	if iFlags&0x0007 != 0 {
+		return -1, 0
+	}
+
+	iLength := 4
+	for _, iFlag := range []int{iGREChecksum, iGREKey, iGRESequence} {
+		if iFlags&iFlag != 0 {
+			iLength += 4
+		}
+	}
+	iProtocol := int(data[iStart+2])<<8 | int(data[iStart+3])
+	if iProtocol == iProtocolERSPAN {
+		if len(data) < iStart+iLength+8 || data[iStart+iLength]>>4 != 1 {
+			return -1, 0
+		}
+		return iStart + iLength + 8, layers.LinkTypeEthernet
+	}
+	return carried(iStart+iLength, iProtocol)
+}
+
+// locateVXLAN steps over a VXLAN header (RFC 7348), the I flag says the VNI is
+// valid and it always carries an ethernet frame
+func locateVXLAN(data []byte, iStart int) (int, layers.LinkType) {
+	if len(data) < iStart+8 || data[iStart]&0x08 == 0 {
+		return -1, 0
+	}
+	return iStart + 8, layers.LinkTypeEthernet
+}
+
+// locateGeneve steps over a Geneve header (RFC 8926) and its options
+func locateGeneve(data []byte, iStart int) (int, layers.LinkType) {
+	if len(data) < iStart+8 || data[iStart]>>6 != 0 {
+		return -1, 0
+	}
+	iLength := 8 + int(data[iStart]&0x3f)*4
+	return carried(iStart+iLength, int(data[iStart+2])<<8|int(data[iStart+3]))
+}
+
+// locateGTPU steps over a GTP-U header (3GPP TS 29.281) and any extension
+// headers, only a G-PDU carries a packet from a user
+func locateGTPU(data []byte, iStart int) (int, layers.LinkType) {
+	if len(data) < iStart+8 || data[iStart]>>5 != 1 || data[iStart]&0x10 == 0 || data[iStart+1] != iGTPUMessageGPDU {
+		return -1, 0
+	}
+
+	// The sequence number, N-PDU number and next extension type are there if
+	// any of the E, S or PN flags are set
+	iOffset := iStart + 8
+	if data[iStart]&0x07 == 0 {
+		return iOffset, layers.LinkTypeRaw
+	}
+	if len(data) < iOffset+4 {
+		return -1, 0
+	}
+	iNextType := data[iOffset+3]
+	iOffset += 4
+	if data[iStart]&0x04 == 0 {
+		return iOffset, layers.LinkTypeRaw
+	}
+
+	// Each extension header gives its length in units of 4 bytes and ends with
+	// the type of the next one
+	for iNextType != 0 {
+		if len(data) < iOffset+1 || data[iOffset] == 0 {
+			return -1, 0
+		}
+		iOffset += int(data[iOffset]) * 4
+		if len(data) < iOffset {
+			return -1, 0
+		}
+		iNextType = data[iOffset-1]
+	}
+	return iOffset, layers.LinkTypeRaw
+}
+
+// parseInner finds the headers of the inner packet, it has to hold at least the
+// header the rules change
+func parseInner(data []byte, iStart int, linkType layers.LinkType) *frame.Frame {
+	iMinLength := 20
+	if linkType == layers.LinkTypeEthernet {
+		iMinLength = 14
+	}
+	if len(data) < iStart+iMinLength {
+		return nil
+	}
+
+	inner, err := frame.Parse(data[iStart:], linkType)
+	if err != nil || (linkType != layers.LinkTypeEthernet && inner.NetworkOffset < 0) {
+		return nil
+	}
+	return inner
+}
+
+// fitsLinkType checks that an IP packet can be written out with a link type that
+// starts with the IP header
+func fitsLinkType(linkType layers.LinkType, iIPVersion int) bool {
+	switch linkType {
+	case layers.LinkTypeRaw:
+		return iIPVersion == 4 || iIPVersion == 6
+	case layers.LinkTypeIPv4:
+		return iIPVersion == 4
+	case layers.LinkTypeIPv6:
+		return iIPVersion == 6
+	}
+	return false
+}
+
+// carried works out the link type of the inner packet from a GRE or Geneve
+// protocol type
+func carried(iStart, iProtocol int) (int, layers.LinkType) {
+	switch iProtocol {
+	case iProtocolEthernet:
+		return iStart, layers.LinkTypeEthernet
+	case iProtocolIPv4, iProtocolIPv6:
+		return iStart, layers.LinkTypeRaw
+	}
+	return -1, 0
+}
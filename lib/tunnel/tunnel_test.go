@@ -0,0 +1,206 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tunnel
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"testing"
+)
+
+func TestParseLayers(t *testing.T) {
+	tests := []struct {
+		sLayers string
+		layers  Layers
+	}{
+		{"", LayersBoth},
+		{"both", LayersBoth},
+		{"inner", LayersInner},
+		{"outer", LayersOuter},
+	}
+	for _, test := range tests {
+		if l, err := ParseLayers(test.sLayers); err != nil || l != test.layers {
+			t.Errorf("%q: expected %d, got %d (%v)", test.sLayers, test.layers, l, err)
+		}
+	}
+	if _, err := ParseLayers("middle"); err == nil {
+		t.Error("Expected an error for middle")
+	}
+}
+
+func TestInner(t *testing.T) {
+	tests := []struct {
+		sKind      string
+		iStart     int
+		linkType   layers.LinkType
+		iIPVersion int
+	}{
+		{"gre", 14 + 20 + 8, layers.LinkTypeRaw, 4},
+		{"gre-eth", 14 + 20 + 4, layers.LinkTypeEthernet, 4},
+		{"vxlan", 14 + 20 + 8 + 8, layers.LinkTypeEthernet, 4},
+		{"geneve", 14 + 20 + 8 + 12, layers.LinkTypeEthernet, 4},
+		{"ipip", 14 + 20, layers.LinkTypeRaw, 4},
+		{"6in4", 14 + 20, layers.LinkTypeRaw, 6},
+		{"gtpu", 14 + 20 + 8 + 8, layers.LinkTypeRaw, 4},
+	}
+	for _, test := range tests {
+		data := pcaptest.Tunnel(test.sKind)
+		iStart, inner := Inner(pcaptest.Parse(t, data))
+		if inner == nil {
+			t.Errorf("%s: expected an inner packet", test.sKind)
+			continue
+		}
+		if iStart != test.iStart || inner.LinkType != test.linkType || inner.IPVersion != test.iIPVersion {
+			t.Errorf("%s: expected IPv%d at %d (%s), got IPv%d at %d (%s)", test.sKind, test.iIPVersion, test.iStart, test.linkType, inner.IPVersion, iStart, inner.LinkType)
+		}
+		if inner.IPProtocol != layers.IPProtocolUDP || inner.TransportOffset < 0 {
+			t.Errorf("%s: expected the inner UDP header to be found", test.sKind)
+		}
+
+		// Cut short in the inner header it is left alone
+		if _, inner := Inner(pcaptest.Parse(t, data[:iStart+10])); inner != nil {
+			t.Errorf("%s: did not expect an inner packet that was cut short", test.sKind)
+		}
+	}
+
+	for _, p := range pcaptest.Corpus() {
+		f, err := frame.Parse(p.Data, layers.LinkTypeEthernet)
+		if err != nil {
+			continue
+		}
+		if _, inner := Inner(f); inner != nil {
+			t.Errorf("%s: did not expect a tunnel", p.Name)
+		}
+	}
+}
+
+func TestInnerGTPUExtension(t *testing.T) {
+	// A G-PDU with a sequence number and one PDU session container extension
+	packet := pcaptest.IPv4UDP(0, []byte("hello world"))[14:]
+	header := []byte{0x36, 0xff, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0x85, 1, 0x10, 0x01, 0}
+	l := pcaptest.Ethernet(pcaptest.MacAddressA, pcaptest.MacAddressB, 0, layers.EthernetTypeIPv4)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: pcaptest.IPv4AddressA, DstIP: pcaptest.IPv4AddressB}
+	l = append(l, ip, &layers.UDP{SrcPort: 2152, DstPort: 2152}, gopacket.Payload(append(header, packet...)))
+	data := pcaptest.Serialize(l...)
+
+	iStart, inner := Inner(pcaptest.Parse(t, data))
+	if inner == nil || iStart != 14+20+8+16 || inner.IPVersion != 4 {
+		t.Errorf("Expected the inner IPv4 packet at %d, got %d", 14+20+8+16, iStart)
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	for _, sKind := range []string{"gre", "vxlan", "geneve", "gtpu"} {
+		data := pcaptest.Tunnel(sKind)
+		f := pcaptest.Parse(t, data)
+		iStart, inner := Inner(f)
+		iOffset := ChecksumOffset(f)
+		if inner == nil || iOffset < 0 {
+			t.Fatalf("%s: expected a tunnel with a checksum", sKind)
+		}
+
+		// Change the inner source address and check the outer checksum still
+		// adds up
+		address := inner.Data[inner.NetworkOffset+12 : inner.NetworkOffset+16]
+		before := append([]byte(nil), inner.Data...)
+		copy(address, []byte{2, 2, 2, 2})
+		UpdateChecksum(f, iStart, before, inner.Data)
+
+		var iChecksum uint16
+		if sKind == "gre" {
+			iChecksum = ^checksum.Fold(checksum.Sum(data[f.IPPayloadOffset:], 0))
+		} else {
+			udp := data[f.TransportOffset:]
+			iChecksum = ^checksum.Fold(checksum.PseudoHeader(data[f.NetworkOffset+12:f.NetworkOffset+16], data[f.NetworkOffset+16:f.NetworkOffset+20], layers.IPProtocolUDP, len(udp)) + checksum.Sum(udp, 0))
+		}
+		if iChecksum != 0 {
+			t.Errorf("%s: expected the outer checksum to add up, got 0x%04x left over", sKind, iChecksum)
+		}
+	}
+
+	// IP-in-IP has no checksum over the inner packet
+	if iOffset := ChecksumOffset(pcaptest.Parse(t, pcaptest.Tunnel("ipip"))); iOffset >= 0 {
+		t.Errorf("Did not expect a checksum for IP-in-IP, got %d", iOffset)
+	}
+}
+
+func TestDecapsulate(t *testing.T) {
+	ipv4 := pcaptest.IPv4UDP(0, []byte("hello world"))
+	ipv6 := pcaptest.IPv6UDP(0, []byte("hello world"))
+
+	// The outer ethernet header of the tunnels is the same as the inner one, so
+	// an IP packet that is taken out ends up with the same frame
+	for _, sKind := range []string{"gre", "gre-eth", "vxlan", "geneve", "ipip", "6in4", "gtpu"} {
+		expected := ipv4
+		if sKind == "6in4" {
+			expected = ipv6
+		}
+		if data := Decapsulate(pcaptest.Parse(t, pcaptest.Tunnel(sKind))); !bytes.Equal(data, expected) {
+			t.Errorf("%s: expected the inner frame\n% x\ngot\n% x", sKind, expected, data)
+		}
+	}
+
+	// An MPLS label stack with two labels
+	labels := []byte{0, 0x01, 0x00, 64, 0, 0x02, 0x01, 64}
+	l := pcaptest.Ethernet(pcaptest.MacAddressA, pcaptest.MacAddressB, 0, layers.EthernetTypeMPLSUnicast)
+	mpls := pcaptest.Serialize(append(l, gopacket.Payload(append(labels, ipv4[14:]...)))...)
+	if data := Decapsulate(pcaptest.Parse(t, mpls)); !bytes.Equal(data, ipv4) {
+		t.Errorf("MPLS: expected the inner frame\n% x\ngot\n% x", ipv4, data)
+	}
+
+	// A packet that starts with its IP header keeps only the inner IP packet
+	vxlan := pcaptest.Tunnel("vxlan")
+	f, err := frame.Parse(vxlan[14:], layers.LinkTypeRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := Decapsulate(f); !bytes.Equal(data, ipv4[14:]) {
+		t.Errorf("Raw: expected the inner IP packet\n% x\ngot\n% x", ipv4[14:], data)
+	}
+
+	// Anything that is not a tunnel is left alone
+	for _, p := range pcaptest.Corpus() {
+		f, err := frame.Parse(p.Data, layers.LinkTypeEthernet)
+		if err != nil {
+			continue
+		}
+		if data := Decapsulate(f); data != nil {
+			t.Errorf("%s: did not expect a tunnel to strip", p.Name)
+		}
+	}
+}
+
+func FuzzInner(f *testing.F) {
+	for _, sKind := range []string{"gre", "gre-eth", "vxlan", "geneve", "ipip", "6in4", "gtpu"} {
+		f.Add(pcaptest.Tunnel(sKind))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		outer, err := frame.Parse(data, layers.LinkTypeEthernet)
+		if err != nil {
+			return
+		}
+		iStart, inner := Inner(outer)
+		if inner == nil {
+			return
+		}
+		if iStart+len(inner.Data) != len(data) {
+			t.Errorf("Expected the inner packet to run from %d to the end of the frame, got %d bytes", iStart, len(inner.Data))
+		}
+
+		// Change the inner packet the way a rewrite would and fix the outer
+		// checksum for it
+		if len(inner.Data) > 0 {
+			old := append([]byte(nil), inner.Data...)
+			inner.Data[len(inner.Data)-1]++
+			UpdateChecksum(outer, iStart, old, inner.Data)
+		}
+	})
+}
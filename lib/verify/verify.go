@@ -0,0 +1,609 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package verify checks that a rewritten packet only differs from the original
+// in the fields the rewrite rules were supposed to change.
+package verify
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/dhcp"
+	"github.com/jordan2175/rewritecap/lib/dns"
+	"github.com/jordan2175/rewritecap/lib/domain"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/icmp"
+	"github.com/jordan2175/rewritecap/lib/layer2"
+	"github.com/jordan2175/rewritecap/lib/layer3"
+	"github.com/jordan2175/rewritecap/lib/mpls"
+	"github.com/jordan2175/rewritecap/lib/payload"
+	"github.com/jordan2175/rewritecap/lib/pppoe"
+	"github.com/jordan2175/rewritecap/lib/scrub"
+	"github.com/jordan2175/rewritecap/lib/tunnel"
+	"net"
+)
+
+// Rules are the changes that were asked for, a nil address means that address
+// was not rewritten.  DNS is nil if DNS messages were not rewritten, Domains is
+// nil if the names in HTTP requests and TLS ClientHellos were not rewritten,
+// Payload is nil if there were no strings to replace in the payloads, and Scrub
+// is nil if the payloads were not scrubbed.  Tunnels says which headers of a
+// tunnelled packet the MAC and IP addresses were changed in.  MPLS is nil if the
+// MPLS labels were not changed, PPPoE is nil if the PPPoE session IDs were not
+// changed, and Fields is nil if the TTL, DSCP, ECN, IP identification and flow
+// label were not changed.
+type Rules struct {
+	MacAddress     []byte
+	MacAddressNew  []byte
+	IPv4Address    []byte
+	IPv4AddressNew []byte
+	IPv6Address    []byte
+	IPv6AddressNew []byte
+	DNS            *dns.Rules
+	Domains        *domain.Rules
+	Payload        *payload.Rules
+	Scrub          *scrub.Rules
+	Tunnels        tunnel.Layers
+	MPLS           *mpls.Rules
+	PPPoE          *pppoe.Rules
+	Fields         *layer3.FieldRules
+	Timestamps     bool
+}
+
+// Difference is something about a rewritten packet that was not expected.  The
+// Offset is from the start of the packet, it is -1 if the difference is not in
+// the packet bytes.
+type Difference struct {
+	Packet  int
+	Offset  int
+	Message string
+}
+
+// String formats the difference for the verify output
+func (d Difference) String() string {
+	if d.Offset < 0 {
+		return fmt.Sprintf("packet %d: %s", d.Packet, d.Message)
+	}
+	return fmt.Sprintf("packet %d offset %d: %s", d.Packet, d.Offset, d.Message)
+}
+
+// field is an address in the packet that a rule is allowed to change
+type field struct {
+	sName   string
+	iOffset int
+	old     []byte
+	new     []byte
+}
+
+//
+// -----------------------------------------------------------------------------
+// ComparePackets()
+// -----------------------------------------------------------------------------
+// This function will compare a rewritten packet with the original one and
+// return every difference that the rules do not explain.  Addresses may only
+// change from the old address to the new one, checksums may change when an IP
+// address is rewritten, and the timestamp may change when a date or time rule
+// was used.  DNS messages are compared by what they say rather than byte for
+// byte, and may change the length of the packet, as may the host name in an
+// HTTP request or a TLS ClientHello and the strings the payload rules replace.
+// When a payload can change length the TCP sequence numbers can move as well.
+// DHCP messages have to match the original with the rules applied to it, and so
+// do an MPLS label stack, a PPPoE session ID and the TTL, DSCP, ECN and flow
+// label of the IP header.  The IP identification may change to anything when it
+// was asked for.  A scrubbed payload has to be all zeros, or gone if it was
+// truncated, whatever the other rules did to it.  The packet carried by a
+// tunnel is checked the same way as the outer one.  Every other byte has to be
+// the same.  The frame is the original packet.
+func ComparePackets(iPacket int, original *frame.Frame, rewritten []byte, originalCaptureInfo, rewrittenCaptureInfo gopacket.CaptureInfo, rules *Rules) []Difference {
+	var differences []Difference
+	add := func(iOffset int, format string, a ...interface{}) {
+		differences = append(differences, Difference{Packet: iPacket, Offset: iOffset, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if !rules.Timestamps && !originalCaptureInfo.Timestamp.Equal(rewrittenCaptureInfo.Timestamp) {
+		add(-1, "timestamp changed from %s to %s", originalCaptureInfo.Timestamp.UTC(), rewrittenCaptureInfo.Timestamp.UTC())
+	}
+
+	data := original.Data
+	iStart, iEnd, bTCP := -1, -1, false
+	var expected []byte
+	if rules.DNS != nil {
+		iStart, iEnd, bTCP = dns.Locate(original)
+	}
+	if iStart < 0 {
+		if iPayloadStart, iPayloadEnd := original.Payload(); iPayloadStart >= 0 && iPayloadStart < iPayloadEnd {
+			var bChanged bool
+			expected, bChanged = expectedPayload(original, data[iPayloadStart:iPayloadEnd], originalCaptureInfo, rules)
+			if bChanged {
+				iStart, iEnd = iPayloadStart, iPayloadEnd
+			}
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// A scrubbed payload takes the place of whatever the other rules did to
+	// it.  When it was cut off without fixing the lengths the rest of the
+	// original packet is put back so the headers can be compared, they can
+	// only have changed if another rule changed the payload first.
+	// ---------------------------------------------------------------------
+	bScrubbed, bCut := false, false
+	bPayloadRules := rules.DNS != nil || rules.Domains != nil || rules.Payload != nil
+	if rules.Scrub != nil {
+		if iScrubStart, iScrubEnd, bComplete := rules.Scrub.Locate(original); iScrubStart >= 0 {
+			iStart, iEnd, expected, bScrubbed = iScrubStart, iScrubEnd, nil, true
+			if rules.Scrub.Mode == scrub.ModeTruncate && (!bComplete || !rules.Scrub.AdjustLengths) {
+				if len(rewritten) != iStart {
+					add(-1, "captured length is %d, expected the payload to be cut off at %d", len(rewritten), iStart)
+					return differences
+				}
+				rewritten = append(append([]byte(nil), rewritten...), data[iStart:]...)
+				iStart, iEnd, bScrubbed, bCut = -1, -1, false, true
+			}
+		}
+	}
+
+	// Only a DNS message or a TCP or UDP payload that the domain, payload or
+	// scrub rules changed can change the length of the packet
+	iDelta := len(rewritten) - len(data)
+	bResized := iDelta != 0 && iStart >= 0 && iEnd+iDelta >= iStart
+	if bResized {
+		if originalCaptureInfo.Length+iDelta != rewrittenCaptureInfo.Length {
+			add(-1, "length changed from %d to %d", originalCaptureInfo.Length, rewrittenCaptureInfo.Length)
+		}
+	} else {
+		if originalCaptureInfo.Length != rewrittenCaptureInfo.Length && !(bCut && bPayloadRules) {
+			add(-1, "length changed from %d to %d", originalCaptureInfo.Length, rewrittenCaptureInfo.Length)
+		}
+		if iDelta != 0 {
+			add(-1, "captured length changed from %d to %d", len(data), len(rewritten))
+			return differences
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Compare the DNS messages or the payloads, then line up the bytes that
+	// come after them so the rest of the packet can be compared as if
+	// nothing moved
+	// ---------------------------------------------------------------------
+	if iStart >= 0 {
+		if bScrubbed {
+			if sMessage := compareScrubbed(rewritten[iStart:iEnd+iDelta], rules.Scrub); sMessage != "" {
+				add(iStart, "%s", sMessage)
+			}
+		} else if expected != nil {
+			if !bytes.Equal(expected, rewritten[iStart:iEnd+iDelta]) {
+				add(iStart, "payload is not the original with the domain and payload rules applied to it")
+			}
+		} else {
+			for _, sMessage := range compareDNS(data[iStart:iEnd], rewritten[iStart:iEnd+iDelta], bTCP, rules.DNS) {
+				add(iStart, "%s", sMessage)
+			}
+		}
+
+		// The payload is replaced with the original one so it is not compared
+		// again below
+		lined := make([]byte, 0, len(data))
+		lined = append(lined, rewritten[:iStart]...)
+		lined = append(lined, data[iStart:iEnd]...)
+		rewritten = append(lined, rewritten[iEnd+iDelta:]...)
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Check each address a rule could have changed, and mark those bytes so
+	// they are not reported again below
+	// ---------------------------------------------------------------------
+	allowed := make([]bool, len(data))
+	for _, f := range fields(original, rules) {
+		oldValue := data[f.iOffset : f.iOffset+len(f.old)]
+		newValue := rewritten[f.iOffset : f.iOffset+len(f.old)]
+		for i := range oldValue {
+			allowed[f.iOffset+i] = true
+		}
+
+		bChanged := !bytes.Equal(oldValue, newValue)
+		bMatches := bytes.Equal(oldValue, f.old)
+		if bChanged && (!bMatches || !bytes.Equal(newValue, f.new)) {
+			add(f.iOffset, "%s changed from %s to %s", f.sName, formatAddress(oldValue), formatAddress(newValue))
+		} else if !bChanged && bMatches && !bytes.Equal(f.old, f.new) {
+			add(f.iOffset, "%s %s was not rewritten", f.sName, formatAddress(oldValue))
+		}
+	}
+
+	for _, iOffset := range checksums(original, rules, iStart >= 0 || (bCut && bPayloadRules)) {
+		if iOffset+2 > len(data) {
+			continue
+		}
+		allowed[iOffset] = true
+		allowed[iOffset+1] = true
+	}
+
+	// When a DNS message or any other payload changed length the sequence
+	// and acknowledgement numbers and the SACK blocks of the rest of the
+	// connection move with it, along with the TCP checksum
+	bLengthRules := rules.DNS != nil || rules.Payload != nil || (rules.Scrub != nil && rules.Scrub.ChangesLength())
+	if bLengthRules && original.IPProtocol == layers.IPProtocolTCP && original.TransportOffset >= 0 {
+		iHeaderEnd := original.TransportOffset + int(data[original.TransportOffset+12]>>4)*4
+		for i := original.TransportOffset + 4; i < iHeaderEnd && i < len(data); i++ {
+			if i < original.TransportOffset+12 || i >= original.TransportOffset+20 || i == original.TransportOffset+16 || i == original.TransportOffset+17 {
+				allowed[i] = true
+			}
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// A DHCP message has to be exactly what the rules turn the original in
+	// to, the UDP checksum changes along with it
+	// ---------------------------------------------------------------------
+	if iDhcpStart, iDhcpEnd, iVersion := dhcp.Locate(original); iDhcpStart >= 0 {
+		expected := expectedDHCP(data[iDhcpStart:iDhcpEnd], iVersion, rules)
+		for i := range expected {
+			iOffset := iDhcpStart + i
+			if expected[i] != rewritten[iOffset] {
+				add(iOffset, "DHCP byte changed from 0x%02x to 0x%02x, expected 0x%02x", data[iOffset], rewritten[iOffset], expected[i])
+			}
+			allowed[iOffset] = true
+		}
+		allowed[original.TransportOffset+6] = true
+		allowed[original.TransportOffset+7] = true
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// The MPLS label stack has to be the original one with the label map
+	// applied to it
+	// ---------------------------------------------------------------------
+	if iMPLSStart, iMPLSEnd := mpls.Stack(original); iMPLSStart >= 0 && rules.MPLS != nil {
+		expected := append([]byte(nil), data[iMPLSStart:iMPLSEnd]...)
+		rules.MPLS.ReplaceLabels(expected)
+		for i := range expected {
+			iOffset := iMPLSStart + i
+			if expected[i] != rewritten[iOffset] {
+				add(iOffset, "MPLS label stack byte changed from 0x%02x to 0x%02x, expected 0x%02x", data[iOffset], rewritten[iOffset], expected[i])
+			}
+			allowed[iOffset] = true
+		}
+	}
+
+	// The PPPoE session ID may only change to the one it is mapped to
+	if iPPPoE := pppoe.Header(original); iPPPoE >= 0 && rules.PPPoE != nil {
+		expected := append([]byte(nil), data[iPPPoE:iPPPoE+6]...)
+		rules.PPPoE.ReplaceSession(expected)
+		if expected[2] != rewritten[iPPPoE+2] || expected[3] != rewritten[iPPPoE+3] {
+			add(iPPPoE+2, "PPPoE session changed from 0x%02x%02x to 0x%02x%02x, expected 0x%02x%02x", data[iPPPoE+2], data[iPPPoE+3], rewritten[iPPPoE+2], rewritten[iPPPoE+3], expected[2], expected[3])
+		}
+		allowed[iPPPoE+2] = true
+		allowed[iPPPoE+3] = true
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// The TTL, DSCP, ECN and flow label have to be the original ones with
+	// the field rules applied to them, the IPv4 header checksum changes
+	// along with them
+	// ---------------------------------------------------------------------
+	if rules.Fields != nil && original.IPVersion != 0 && original.NetworkOffset >= 0 && rules.Fields.MatchesFilter(originalCaptureInfo, data) {
+		ipHeader := data[original.NetworkOffset:]
+		expected := append([]byte(nil), ipHeader...)
+		if _, err := rules.Fields.ReplaceFields(expected, original.IPVersion); err == nil && rules.Fields.MatchesHosts(ipHeader, original.IPVersion) {
+			l := []int{0, 1, 2, 3, 7}
+			if original.IPVersion == 4 {
+				l = []int{1, 8, 10, 11}
+				if rules.Fields.ChangesID(ipHeader, original.IPVersion) {
+					l = []int{1, 8}
+					allowed[original.NetworkOffset+4] = true
+					allowed[original.NetworkOffset+5] = true
+					allowed[original.NetworkOffset+10] = true
+					allowed[original.NetworkOffset+11] = true
+				}
+			}
+			for _, i := range l {
+				iOffset := original.NetworkOffset + i
+				if expected[i] != rewritten[iOffset] && !allowed[iOffset] {
+					add(iOffset, "IP header byte changed from 0x%02x to 0x%02x, expected 0x%02x", data[iOffset], rewritten[iOffset], expected[i])
+				}
+				allowed[iOffset] = true
+			}
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Anything else that is different was not asked for
+	// ---------------------------------------------------------------------
+	for i := range data {
+		if data[i] != rewritten[i] && !allowed[i] {
+			add(i, "byte changed from 0x%02x to 0x%02x", data[i], rewritten[i])
+		}
+	}
+	return differences
+} // ComparePackets()
+
+//
+// -----------------------------------------------------------------------------
+// fields()
+// -----------------------------------------------------------------------------
+// Find the addresses in the packet that the rules are allowed to change.  The
+// addresses of the packet carried by a tunnel are named with an inner prefix.
+func fields(f *frame.Frame, rules *Rules) []field {
+	iInner, inner := tunnel.Inner(f)
+	var l []field
+	if inner == nil || rules.Tunnels != tunnel.LayersInner {
+		l = headerFields(f, rules)
+	}
+	if inner != nil && rules.Tunnels != tunnel.LayersOuter {
+		for _, innerField := range fields(inner, rules) {
+			innerField.sName = "inner." + innerField.sName
+			innerField.iOffset += iInner
+			l = append(l, innerField)
+		}
+	}
+	return l
+} // fields()
+
+// headerFields finds the addresses in the headers of one packet, without looking
+// inside a tunnel
+func headerFields(f *frame.Frame, rules *Rules) []field {
+	var l []field
+	add := func(sName string, iOffset int, old, new []byte) {
+		if old != nil && new != nil && iOffset >= 0 && len(f.Data) >= iOffset+len(old) {
+			l = append(l, field{sName: sName, iOffset: iOffset, old: old, new: new})
+		}
+	}
+
+	if f.LinkType == layers.LinkTypeEthernet {
+		add("eth.dst", 0, rules.MacAddress, rules.MacAddressNew)
+		add("eth.src", 6, rules.MacAddress, rules.MacAddressNew)
+	}
+	if f.NetworkOffset < 0 {
+		return l
+	}
+
+	if f.IPVersion == 4 && len(f.Data) >= f.NetworkOffset+20 {
+		add("ip.src", f.NetworkOffset+12, rules.IPv4Address, rules.IPv4AddressNew)
+		add("ip.dst", f.NetworkOffset+16, rules.IPv4Address, rules.IPv4AddressNew)
+	}
+	if f.IPVersion == 6 && len(f.Data) >= f.NetworkOffset+40 {
+		add("ip6.src", f.NetworkOffset+8, rules.IPv6Address, rules.IPv6AddressNew)
+		add("ip6.dst", f.NetworkOffset+24, rules.IPv6Address, rules.IPv6AddressNew)
+	}
+
+	// The header quoted in an ICMP error message changes with the outer one
+	if iStart, _ := icmp.Locate(f); iStart >= 0 {
+		iQuoted := iStart + 8
+		if f.IPVersion == 4 {
+			add("icmp.ip.src", iQuoted+12, rules.IPv4Address, rules.IPv4AddressNew)
+			add("icmp.ip.dst", iQuoted+16, rules.IPv4Address, rules.IPv4AddressNew)
+		} else {
+			add("icmp.ip6.src", iQuoted+8, rules.IPv6Address, rules.IPv6AddressNew)
+			add("icmp.ip6.dst", iQuoted+24, rules.IPv6Address, rules.IPv6AddressNew)
+		}
+	}
+
+	// Only ethernet and IPv4 ARP packets are rewritten
+	if f.EthernetType == layers.EthernetTypeARP && len(f.Data) >= f.NetworkOffset+28 {
+		arpHeader := f.Data[f.NetworkOffset:]
+		if arpHeader[0] == 0 && arpHeader[1] == 1 && arpHeader[2] == 0x08 && arpHeader[3] == 0x00 {
+			add("arp.src.mac", f.NetworkOffset+8, rules.MacAddress, rules.MacAddressNew)
+			add("arp.src.ip", f.NetworkOffset+14, rules.IPv4Address, rules.IPv4AddressNew)
+			add("arp.dst.mac", f.NetworkOffset+18, rules.MacAddress, rules.MacAddressNew)
+			add("arp.dst.ip", f.NetworkOffset+24, rules.IPv4Address, rules.IPv4AddressNew)
+		}
+	}
+	return l
+}
+
+//
+// -----------------------------------------------------------------------------
+// checksums()
+// -----------------------------------------------------------------------------
+// Find the offsets of the checksums and lengths that change along with an IP
+// address or a payload, the IPv4 header checksum and the TCP or UDP checksum
+// that covers the addresses.  When a payload changed length the PPPoE, IP and
+// UDP lengths change with it.  An ICMP error message has its own checksum and
+// the ones of the packet it quotes.  A tunnel adds the checksums of the packet
+// it carries and the outer UDP or GRE checksum that covers it.
+func checksums(f *frame.Frame, rules *Rules, bPayload bool) []int {
+	l := headerChecksums(f, rules, bPayload)
+	if iPPPoE := pppoe.Header(f); iPPPoE >= 0 && bPayload && f.EthernetType == layers.EthernetTypePPPoESession {
+		l = append(l, iPPPoE+4)
+	}
+	bAddressRule := rules.MacAddress != nil || rules.IPv4Address != nil || rules.IPv6Address != nil
+	if iInner, inner := tunnel.Inner(f); inner != nil && bAddressRule && rules.Tunnels != tunnel.LayersOuter {
+		for _, iOffset := range checksums(inner, rules, false) {
+			l = append(l, iOffset+iInner)
+		}
+		if iOffset := tunnel.ChecksumOffset(f); iOffset >= 0 {
+			l = append(l, iOffset)
+		}
+	}
+	return l
+} // checksums()
+
+// headerChecksums finds the checksums that cover the addresses or the payload of
+// one packet, without looking inside a tunnel
+func headerChecksums(f *frame.Frame, rules *Rules, bPayload bool) []int {
+	bIPRule := (f.IPVersion == 4 && rules.IPv4Address != nil) || (f.IPVersion == 6 && rules.IPv6Address != nil)
+	if f.NetworkOffset < 0 || (!bIPRule && !bPayload) {
+		return nil
+	}
+
+	var l []int
+	switch f.IPVersion {
+	case 4:
+		if len(f.Data) < f.NetworkOffset+20 {
+			return nil
+		}
+		l = append(l, f.NetworkOffset+10)
+		if bPayload {
+			l = append(l, f.NetworkOffset+2)
+		}
+	case 6:
+		if bPayload {
+			l = append(l, f.NetworkOffset+4)
+		}
+	default:
+		return nil
+	}
+
+	if f.TransportOffset >= 0 {
+		switch f.IPProtocol {
+		case layers.IPProtocolTCP:
+			l = append(l, f.TransportOffset+16)
+		case layers.IPProtocolUDP:
+			l = append(l, f.TransportOffset+6)
+			if bPayload {
+				l = append(l, f.TransportOffset+4)
+			}
+		}
+	}
+	if bIPRule && f.ICMPOffset >= 0 {
+		l = append(l, f.ICMPOffset+2)
+		l = append(l, quotedChecksums(f)...)
+	}
+	return l
+}
+
+// quotedChecksums finds the checksums of the packet quoted in an ICMP error
+// message, the IPv4 header checksum and the TCP, UDP or ICMPv6 checksum
+func quotedChecksums(f *frame.Frame) []int {
+	iStart, iEnd := icmp.Locate(f)
+	if iStart < 0 {
+		return nil
+	}
+	iQuoted := iStart + 8
+	quoted := f.Data[iQuoted:iEnd]
+
+	var l []int
+	var iSegment int
+	var ipProtocol layers.IPProtocol
+	if f.IPVersion == 4 {
+		l = append(l, iQuoted+10)
+		iSegment = iQuoted + int(quoted[0]&0x0f)*4
+		ipProtocol = layers.IPProtocol(quoted[9])
+	} else {
+		iSegment = iQuoted + 40
+		ipProtocol = layers.IPProtocol(quoted[6])
+	}
+	switch ipProtocol {
+	case layers.IPProtocolTCP:
+		l = append(l, iSegment+16)
+	case layers.IPProtocolUDP:
+		l = append(l, iSegment+6)
+	case layers.IPProtocolICMPv6:
+		l = append(l, iSegment+2)
+	}
+	return l
+}
+
+//
+// -----------------------------------------------------------------------------
+// expectedDHCP()
+// -----------------------------------------------------------------------------
+// Apply the rules to a copy of a DHCP or DHCPv6 message.  A message that can not
+// be parsed keeps whatever was changed before the problem was found, the same as
+// the rewrite does.
+func expectedDHCP(original []byte, iVersion int, rules *Rules) []byte {
+	expected := append([]byte(nil), original...)
+	if rules.MacAddress != nil {
+		var err error
+		if iVersion == 4 {
+			err = dhcp.ReplaceDhcpHeaderMacAddresses(expected, rules.MacAddress, rules.MacAddressNew)
+		} else {
+			err = dhcp.ReplaceDhcpv6HeaderMacAddresses(expected, rules.MacAddress, rules.MacAddressNew)
+		}
+		if err != nil {
+			return expected
+		}
+	}
+	if iVersion == 4 && rules.IPv4Address != nil {
+		dhcp.ReplaceDhcpHeaderIPv4Addresses(expected, rules.IPv4Address, rules.IPv4AddressNew)
+	}
+	if iVersion == 6 && rules.IPv6Address != nil {
+		dhcp.ReplaceDhcpv6HeaderIPv6Addresses(expected, rules.IPv6Address, rules.IPv6AddressNew)
+	}
+	return expected
+} // expectedDHCP()
+
+//
+// -----------------------------------------------------------------------------
+// compareDNS()
+// -----------------------------------------------------------------------------
+// Compare the DNS payloads of the two packets.  If the original payload is not a
+// DNS message it should not have been touched at all.
+func compareDNS(original, rewritten []byte, bTCP bool, rules *dns.Rules) []string {
+	var l []string
+	var err error
+	if bTCP {
+		l, err = dns.CompareTCPPayloads(original, rewritten, rules)
+	} else {
+		l, err = dns.CompareMessages(original, rewritten, rules)
+	}
+	if err != nil && !bytes.Equal(original, rewritten) {
+		return []string{"payload on the DNS port changed but it is not a DNS message"}
+	}
+	return l
+} // compareDNS()
+
+//
+// -----------------------------------------------------------------------------
+// expectedPayload()
+// -----------------------------------------------------------------------------
+// Apply the domain rules and then the payload rules to a copy of a TCP or UDP
+// payload that is not a DNS message, the same way the rewrite does.  False is
+// returned if none of the rules change it.
+func expectedPayload(f *frame.Frame, original []byte, ci gopacket.CaptureInfo, rules *Rules) ([]byte, bool) {
+	expected := original
+	iChanges := 0
+	if rules.Domains != nil && f.IPProtocol == layers.IPProtocolTCP {
+		if iSrcPort, iDstPort := f.Ports(); iSrcPort != dns.Port && iDstPort != dns.Port {
+			var iDomainChanges int
+			expected, iDomainChanges = domain.RewriteTCPPayload(expected, rules.Domains)
+			iChanges += iDomainChanges
+		}
+	}
+	if rules.Payload != nil && rules.Payload.AppliesTo(f) && rules.Payload.MatchesFilter(ci, f.Data) {
+		var iPayloadChanges int
+		expected, iPayloadChanges = rules.Payload.Replace(expected)
+		iChanges += iPayloadChanges
+	}
+	return expected, iChanges > 0
+} // expectedPayload()
+
+//
+// -----------------------------------------------------------------------------
+// compareScrubbed()
+// -----------------------------------------------------------------------------
+// Check a payload that was scrubbed, zeros have to be zero and a payload that
+// was truncated has to be gone.  Random bytes can be anything.
+func compareScrubbed(rewritten []byte, rules *scrub.Rules) string {
+	switch rules.Mode {
+	case scrub.ModeZero:
+		for _, b := range rewritten {
+			if b != 0 {
+				return "scrubbed payload is not all zeros"
+			}
+		}
+	case scrub.ModeTruncate:
+		if len(rewritten) != 0 {
+			return fmt.Sprintf("scrubbed payload is %d bytes, expected it to be truncated", len(rewritten))
+		}
+	}
+	return ""
+} // compareScrubbed()
+
+// formatAddress shows a MAC address or an IP address
+func formatAddress(address []byte) string {
+	if len(address) == 6 {
+		return layer2.MakePrettyMacAddress(address)
+	}
+	return net.IP(address).String()
+}
@@ -0,0 +1,206 @@
+// Copyright 2014-2017 Bret Jordan, All rights reserved.
+//
+// Use of this source code is governed by an Apache 2.0 license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package verify
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jordan2175/rewritecap/lib/frame"
+	"github.com/jordan2175/rewritecap/lib/layer2"
+	"github.com/jordan2175/rewritecap/lib/layer3"
+	"github.com/jordan2175/rewritecap/lib/mpls"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"github.com/jordan2175/rewritecap/lib/pppoe"
+	"net"
+	"testing"
+	"time"
+)
+
+var macAddressNew = []byte{0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+var ipv4AddressNew = []byte{2, 2, 2, 2}
+
+func TestComparePackets(t *testing.T) {
+	rules := &Rules{
+		MacAddress:     pcaptest.MacAddressA,
+		MacAddressNew:  macAddressNew,
+		IPv4Address:    pcaptest.IPv4AddressA.To4(),
+		IPv4AddressNew: ipv4AddressNew,
+	}
+	ci := gopacket.CaptureInfo{Timestamp: pcaptest.StartTime}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		change    func(data []byte)
+		ci        gopacket.CaptureInfo
+		iExpected int
+	}{
+		{"unchanged mac and ip", pcaptest.IPv4TCP(1, nil), func(data []byte) {}, ci, 2},
+		{"rewritten", pcaptest.IPv4TCP(1, nil), func(data []byte) {
+			layer2.ReplaceFrameMacAddresses(data, pcaptest.MacAddressA, macAddressNew)
+			layer3.ReplaceIPv4HeaderAddresses(data[18:], pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+			data[28], data[29] = 0xab, 0xcd // ip checksum
+			data[54], data[55] = 0xab, 0xcd // tcp checksum
+		}, ci, 0},
+		{"wrong address", pcaptest.IPv4UDP(0, nil), func(data []byte) {
+			layer2.ReplaceFrameMacAddresses(data, pcaptest.MacAddressA, macAddressNew)
+			copy(data[26:], []byte{3, 3, 3, 3})
+		}, ci, 1},
+		{"payload", pcaptest.IPv4UDP(0, []byte("hello")), func(data []byte) {
+			layer2.ReplaceFrameMacAddresses(data, pcaptest.MacAddressA, macAddressNew)
+			layer3.ReplaceIPv4HeaderAddresses(data[14:], pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+			data[len(data)-1] = 'O'
+		}, ci, 1},
+		{"timestamp", pcaptest.IPv6UDP(0, nil), func(data []byte) {
+			copy(data[6:], macAddressNew)
+		}, gopacket.CaptureInfo{Timestamp: pcaptest.StartTime.Add(time.Hour)}, 1},
+		{"arp", pcaptest.ARPRequest(2), func(data []byte) {
+			copy(data[6:], macAddressNew)
+			copy(data[30:], macAddressNew)
+			copy(data[36:], ipv4AddressNew)
+		}, ci, 0},
+	}
+
+	for _, tt := range tests {
+		f := pcaptest.Parse(t, tt.data)
+		rewritten := append([]byte(nil), tt.data...)
+		tt.change(rewritten)
+
+		differences := ComparePackets(1, f, rewritten, ci, tt.ci, rules)
+		if len(differences) != tt.iExpected {
+			t.Errorf("%s: expected %d differences, got %v", tt.name, tt.iExpected, differences)
+		}
+	}
+}
+
+func TestComparePacketsLength(t *testing.T) {
+	data := pcaptest.IPv4UDP(0, nil)
+	f := pcaptest.Parse(t, data)
+	ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+	differences := ComparePackets(1, f, data[:len(data)-1], ci, ci, &Rules{})
+	if len(differences) != 1 || differences[0].Offset != -1 {
+		t.Errorf("Expected a length difference, got %v", differences)
+	}
+}
+
+func TestComparePacketsIPv6(t *testing.T) {
+	ipv6AddressNew := net.ParseIP("2001:db8::99")
+	rules := &Rules{IPv6Address: pcaptest.IPv6AddressA, IPv6AddressNew: ipv6AddressNew}
+	ci := gopacket.CaptureInfo{Timestamp: pcaptest.StartTime}
+
+	data := pcaptest.IPv6UDP(0, nil)
+	f := pcaptest.Parse(t, data)
+
+	rewritten := append([]byte(nil), data...)
+	layer3.ReplaceIPv6HeaderAddresses(rewritten[14:], pcaptest.IPv6AddressA, ipv6AddressNew)
+	rewritten[60], rewritten[61] = 0xab, 0xcd // udp checksum
+	if differences := ComparePackets(1, f, rewritten, ci, ci, rules); len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v", differences)
+	}
+
+	// The IPv4 rules do not cover IPv6 addresses
+	if differences := ComparePackets(1, f, rewritten, ci, ci, &Rules{IPv4Address: pcaptest.IPv4AddressA.To4(), IPv4AddressNew: ipv4AddressNew}); len(differences) == 0 {
+		t.Error("Expected differences, got none")
+	}
+}
+
+func TestComparePacketsMPLS(t *testing.T) {
+	mplsRules, err := mpls.ParseRules("100=300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := gopacket.CaptureInfo{Timestamp: pcaptest.StartTime}
+
+	data := pcaptest.MPLS(4, 100, 200)
+	f := pcaptest.Parse(t, data)
+
+	rewritten := append([]byte(nil), data...)
+	mplsRules.ReplaceLabels(rewritten[14:22])
+	if differences := ComparePackets(1, f, rewritten, ci, ci, &Rules{MPLS: mplsRules}); len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v", differences)
+	}
+
+	// A label that was not in the map can not change, and a label that was has
+	// to change
+	rewritten[19] ^= 0x10
+	if differences := ComparePackets(1, f, rewritten, ci, ci, &Rules{MPLS: mplsRules}); len(differences) != 1 {
+		t.Errorf("Expected 1 difference, got %v", differences)
+	}
+	if differences := ComparePackets(1, f, data, ci, ci, &Rules{MPLS: mplsRules}); len(differences) != 2 {
+		t.Errorf("Expected 2 differences, got %v", differences)
+	}
+}
+
+func TestComparePacketsPPPoE(t *testing.T) {
+	pppoeRules, err := pppoe.ParseRules("0x1234=0x4321")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &Rules{IPv4Address: pcaptest.IPv4AddressA.To4(), IPv4AddressNew: ipv4AddressNew, PPPoE: pppoeRules}
+	ci := gopacket.CaptureInfo{Timestamp: pcaptest.StartTime}
+
+	data := pcaptest.PPPoE(4, 0x1234)
+	f := pcaptest.Parse(t, data)
+
+	// The IP packet after the PPPoE and PPP headers is checked like any other
+	rewritten := append([]byte(nil), data...)
+	pppoeRules.ReplaceSession(rewritten[14:])
+	layer3.ReplaceIPv4HeaderAddresses(rewritten[22:], pcaptest.IPv4AddressA.To4(), ipv4AddressNew)
+	rewritten[32], rewritten[33] = 0xab, 0xcd // ip checksum
+	rewritten[48], rewritten[49] = 0xab, 0xcd // udp checksum
+	if differences := ComparePackets(1, f, rewritten, ci, ci, rules); len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v", differences)
+	}
+
+	// Without the session rule both bytes of the session ID are differences
+	if differences := ComparePackets(1, f, rewritten, ci, ci, &Rules{IPv4Address: rules.IPv4Address, IPv4AddressNew: ipv4AddressNew}); len(differences) != 2 {
+		t.Errorf("Expected 2 differences, got %v", differences)
+	}
+}
+
+func TestComparePacketsFields(t *testing.T) {
+	fieldRules, err := layer3.ParseFieldRules("128", "46", "", "sequential", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := gopacket.CaptureInfo{Timestamp: pcaptest.StartTime}
+
+	data := pcaptest.IPv4UDP(0, nil)
+	f := pcaptest.Parse(t, data)
+
+	// The identification may change to anything, the TTL and DSCP have to be
+	// the ones that were asked for
+	rewritten := append([]byte(nil), data...)
+	fieldRules.ReplaceFields(rewritten[14:], 4)
+	rewritten[18], rewritten[19] = 0xab, 0xcd
+	rewritten[24], rewritten[25] = 0xab, 0xcd // ip checksum
+	if differences := ComparePackets(1, f, rewritten, ci, ci, &Rules{Fields: fieldRules}); len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v", differences)
+	}
+	rewritten[22] = 100
+	if differences := ComparePackets(1, f, rewritten, ci, ci, &Rules{Fields: fieldRules}); len(differences) != 1 {
+		t.Errorf("Expected 1 difference, got %v", differences)
+	}
+
+	// An IPv6 packet from a host that is not in the list keeps its flow label
+	hostRules, err := layer3.ParseFieldRules("", "", "", "", "12345", "10.0.2.32", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = pcaptest.IPv6UDP(0, nil)
+	if f, err = frame.Parse(data, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	if differences := ComparePackets(1, f, data, ci, ci, &Rules{Fields: hostRules}); len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v", differences)
+	}
+	rewritten = append([]byte(nil), data...)
+	hostRules.ReplaceFields(rewritten[14:], 6)
+	if differences := ComparePackets(1, f, rewritten, ci, ci, &Rules{Fields: hostRules}); len(differences) != 2 {
+		t.Errorf("Expected 2 differences, got %v", differences)
+	}
+}
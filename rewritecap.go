@@ -7,17 +7,50 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
 	"github.com/jordan2175/rewritecap/lib/arp"
+	"github.com/jordan2175/rewritecap/lib/checksum"
+	"github.com/jordan2175/rewritecap/lib/common"
+	"github.com/jordan2175/rewritecap/lib/dedup"
+	"github.com/jordan2175/rewritecap/lib/dhcp"
+	"github.com/jordan2175/rewritecap/lib/diff"
+	"github.com/jordan2175/rewritecap/lib/dns"
+	"github.com/jordan2175/rewritecap/lib/domain"
+	"github.com/jordan2175/rewritecap/lib/encap"
+	"github.com/jordan2175/rewritecap/lib/fragment"
+	"github.com/jordan2175/rewritecap/lib/frame"
 	"github.com/jordan2175/rewritecap/lib/header"
+	"github.com/jordan2175/rewritecap/lib/icmp"
+	"github.com/jordan2175/rewritecap/lib/impair"
 	"github.com/jordan2175/rewritecap/lib/layer2"
 	"github.com/jordan2175/rewritecap/lib/layer3"
+	"github.com/jordan2175/rewritecap/lib/mpls"
+	"github.com/jordan2175/rewritecap/lib/payload"
+	"github.com/jordan2175/rewritecap/lib/pipeline"
+	"github.com/jordan2175/rewritecap/lib/pppoe"
+	"github.com/jordan2175/rewritecap/lib/progress"
+	"github.com/jordan2175/rewritecap/lib/scrub"
+	"github.com/jordan2175/rewritecap/lib/segment"
+	"github.com/jordan2175/rewritecap/lib/stats"
+	"github.com/jordan2175/rewritecap/lib/tcpstream"
+	"github.com/jordan2175/rewritecap/lib/timesort"
+	"github.com/jordan2175/rewritecap/lib/tunnel"
+	"github.com/jordan2175/rewritecap/lib/verify"
 	"github.com/pborman/getopt"
+	"io"
+	"io/ioutil"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var sOptPcapSrcFilename = getopt.StringLong("file", 'f', "", "Filename of the source PCAP file", "string")
@@ -26,20 +59,252 @@ var sOptMacAddress = getopt.StringLong("mac", 0, "", "The MAC Address to change
 var sOptMacAddressNew = getopt.StringLong("mac-new", 0, "", "The replacement MAC Address, required if mac is used", "string")
 var sOptIPv4Address = getopt.StringLong("ip4", 0, "", "The IPv4 Address to change", "string")
 var sOptIPv4AddressNew = getopt.StringLong("ip4-new", 0, "", "The replacement IPv4 Address, required if ip4 is used", "string")
+var sOptIPv6Address = getopt.StringLong("ip6", 0, "", "The IPv6 Address to change", "string")
+var sOptIPv6AddressNew = getopt.StringLong("ip6-new", 0, "", "The replacement IPv6 Address, required if ip6 is used", "string")
+var sOptTTL = getopt.StringLong("ttl", 0, "", "Set the IPv4 TTL and IPv6 hop limit, or raise or lower it with a + or - in front", "[+|-]1-255")
+var sOptDSCP = getopt.StringLong("dscp", 0, "", "Set the DSCP bits of the IPv4 type of service and IPv6 traffic class", "0-63")
+var sOptECN = getopt.StringLong("ecn", 0, "", "Set the ECN bits of the IPv4 type of service and IPv6 traffic class", "0-3")
+var sOptIPID = getopt.StringLong("ip-id", 0, "", "Give every IPv4 packet that is not a fragment a new identification", "random|sequential")
+var sOptFlowLabel = getopt.StringLong("flow-label", 0, "", "Set the IPv6 flow label", "0-1048575")
+var sOptIPFieldsHosts = getopt.StringLong("ip-fields-hosts", 0, "", "Only change the TTL, DSCP, ECN, IP ID and flow label of packets to or from these addresses, separated by a comma", "string")
+var sOptIPFieldsFilter = getopt.StringLong("ip-fields-filter", 0, "", "Only change the TTL, DSCP, ECN, IP ID and flow label of packets that match this BPF filter", "string")
+var sOptTunnel = getopt.StringLong("tunnel", 0, "both", "Which headers of GRE, VXLAN, Geneve, IP-in-IP and GTP-U packets the MAC and IP rules change", "both|inner|outer")
+var bOptDecap = getopt.BoolLong("decap", 0, "Strip the outer headers off GRE, VXLAN, Geneve, IP-in-IP, GTP-U and MPLS packets and keep the packet they carry")
+var sOptEncap = getopt.StringLong("encap", 0, "", "Wrap every packet in a VXLAN, GRE or ERSPAN tunnel", "vxlan|gre|erspan")
+var sOptEncapSrcMac = getopt.StringLong("encap-src-mac", 0, "", "The outer source MAC Address of the tunnel", "string")
+var sOptEncapDstMac = getopt.StringLong("encap-dst-mac", 0, "", "The outer destination MAC Address of the tunnel", "string")
+var sOptEncapSrcIP = getopt.StringLong("encap-src-ip", 0, "", "The outer source IPv4 or IPv6 Address of the tunnel, required if encap is used", "string")
+var sOptEncapDstIP = getopt.StringLong("encap-dst-ip", 0, "", "The outer destination IPv4 or IPv6 Address of the tunnel, required if encap is used", "string")
+var iOptEncapVNI = getopt.IntLong("encap-vni", 0, 0, "The VXLAN network identifier, GRE key or ERSPAN session ID of the tunnel", "int")
+var sOptMPLSLabelMap = getopt.StringLong("mpls-label-map", 0, "", "MPLS labels to change, as old=new separated by a comma", "string")
+var bOptMPLSPop = getopt.BoolLong("mpls-pop", 0, "Pop the whole MPLS label stack and keep the IP packet or ethernet frame under it")
+var sOptPPPoESessionMap = getopt.StringLong("pppoe-session-map", 0, "", "PPPoE session IDs to change, as old=new separated by a comma", "string")
+var iOptResegment = getopt.IntLong("resegment", 0, 0, "Split TCP packets that are bigger than this MTU in to segments and fragment other IPv4 packets", "mtu")
+var bOptReassemble = getopt.BoolLong("reassemble", 0, "Put fragmented IPv4 and IPv6 datagrams back together before they are rewritten")
+var sOptReassembleTimeout = getopt.StringLong("reassemble-timeout", 0, "30s", "How long to wait for the rest of the fragments of a datagram, by the capture timestamps", "duration")
+var sOptRefragment = getopt.StringLong("refragment", 0, "", "Fragment the datagrams that were put back together again, where they were fragmented before or to fit an MTU", "original|mtu")
+var sOptDomainMap = getopt.StringLong("domain-map", 0, "", "Domains to change in DNS, HTTP Host headers and TLS SNI, as old=new separated by a comma", "string")
+
+var payloadRuleSpecs ruleList
+var _ = getopt.VarLong(&payloadRuleSpecs, "payload-replace", 0, "Replace a string in TCP and UDP payloads, s/old/new/ or s/old/new/r for a regular expression, can be used more than once", "s/old/new/")
+var sOptPayloadPorts = getopt.StringLong("payload-ports", 0, "", "Only replace payloads of packets to or from these ports, separated by a comma", "string")
+var sOptPayloadFilter = getopt.StringLong("payload-filter", 0, "", "Only replace payloads of packets that match this BPF filter", "string")
+var sOptScrub = getopt.StringLong("scrub", 0, "", "Remove the TCP and UDP payloads: fill them with zeros or random bytes, or truncate them after the header", "zero|random|truncate")
+var sOptScrubKeep = getopt.StringLong("scrub-keep", 0, "", "Protocols to leave alone when scrubbing, by name like dns or by port, separated by a comma", "string")
+var sOptScrubLengths = getopt.StringLong("scrub-lengths", 0, "keep", "Keep the original lengths in the IP and UDP headers of truncated packets or adjust them to the new length", "keep|adjust")
 
 var iOptNewYear = getopt.IntLong("year", 'y', 0, "Rebase to Year (yyyy)", "int")
 var iOptNewMonth = getopt.IntLong("month", 'm', 0, "Rebase to Month (mm)", "int")
 var iOptNewDay = getopt.IntLong("day", 'd', 0, "Rebase to Day (dd)", "int")
 var sOptTimeShift = getopt.StringLong("time-shift", 0, "", "Rebase Time of Day (+/-00h00m00s) supports multiple values separated by a comma", "string")
 
+var bOptSort = getopt.BoolLong("sort", 0, "Put the packets in timestamp order before they are rewritten, big captures are sorted with temporary files")
+var iOptSortMemory = getopt.IntLong("sort-memory", 0, 512, "Megabytes of packets to sort in memory before they are written to a temporary file", "int")
+var bOptDedup = getopt.BoolLong("dedup", 0, "Remove the copies of packets that were captured on more than one SPAN port")
+var sOptDedupWindow = getopt.StringLong("dedup-window", 0, "50ms", "How close together the copies of a packet have to be, by the capture timestamps", "duration")
+
+var sOptImpairDrop = getopt.StringLong("impair-drop", 0, "", "Drop this percentage of the packets", "0-100")
+var sOptImpairDuplicate = getopt.StringLong("impair-duplicate", 0, "", "Write this percentage of the packets twice", "0-100")
+var sOptImpairReorder = getopt.StringLong("impair-reorder", 0, "", "Hold this percentage of the packets back so they come out after the ones that follow them", "0-100")
+var iOptImpairReorderWindow = getopt.IntLong("impair-reorder-window", 0, 3, "Most packets a reordered packet is held back for", "int")
+var sOptImpairJitter = getopt.StringLong("impair-jitter", 0, "", "Move the timestamp of every packet by up to this much either way", "duration")
+var sOptImpairJitterDistribution = getopt.StringLong("impair-jitter-distribution", 0, "uniform", "Spread the jitter evenly or on a normal distribution with the jitter as the standard deviation", "uniform|normal")
+var sOptImpairCorrupt = getopt.StringLong("impair-corrupt", 0, "", "Flip a random bit in this percentage of the packets", "0-100")
+var iOptImpairSeed = getopt.Int64Long("impair-seed", 0, 1, "Seed for the random impairments, the same seed gives the same file", "int")
+
+var iOptWorkers = getopt.IntLong("workers", 0, runtime.NumCPU(), "Number of packets to rewrite at the same time, the output order is always kept", "int")
+var bOptFast = getopt.BoolLong("fast", 0, "Find the headers with a lightweight parser instead of fully decoding each packet")
+var sOptOnMalformed = getopt.StringLong("on-malformed", 0, "pass", "What to do with malformed packets: pass them through, drop them, or abort the run", "pass|drop|abort")
+var bOptDryRun = getopt.BoolLong("dry-run", 0, "Show what would change without writing a new PCAP file")
+var iOptDryRunCount = getopt.IntLong("dry-run-count", 0, 10, "Number of changed packets to show in a dry run", "int")
+var sOptStatsJSON = getopt.StringLong("stats-json", 0, "", "Filename to save a JSON summary of the run to", "string")
+var bOptQuiet = getopt.BoolLong("quiet", 'q', "Do not show the progress of the run")
+var bOptVerify = getopt.BoolLong("verify", 0, "Check that the new PCAP file only differs from the source file where the rules say it should")
+
 var bOptHelp = getopt.BoolLong("help", 0, "Help")
 var bOptVer = getopt.BoolLong("version", 0, "Version")
 
 var iDebug = 0
 var sVersion = "1.41"
 
-//
-//
+// rewriteRules holds the parsed command line options that are applied to every
+// packet
+type rewriteRules struct {
+	linkType                   layers.LinkType
+	iDiffYear                  int
+	iDiffMonth                 int
+	iDiffDay                   int
+	timeShifts                 []time.Duration
+	userSuppliedMacAddress     []byte
+	userSuppliedMacAddressNew  []byte
+	userSuppliedIPv4Address    []byte
+	userSuppliedIPv4AddressNew []byte
+	userSuppliedIPv6Address    []byte
+	userSuppliedIPv6AddressNew []byte
+	domainRules                *domain.Rules
+	dnsRules                   *dns.Rules
+	payloadRules               *payload.Rules
+	scrubRules                 *scrub.Rules
+	tunnelLayers               tunnel.Layers
+	bDecap                     bool
+	encapRules                 *encap.Rules
+	mplsRules                  *mpls.Rules
+	bMPLSPop                   bool
+	pppoeRules                 *pppoe.Rules
+	fieldRules                 *layer3.FieldRules
+	iResegmentMTU              int
+	bReassemble                bool
+	reassembleTimeout          time.Duration
+	bRefragmentOriginal        bool
+	iRefragmentMTU             int
+	dedupWindow                time.Duration
+	bSort                      bool
+	iSortMemory                int64
+	impairRules                *impair.Rules
+}
+
+// ruleList is an option that can be given more than once.  Unlike a getopt list
+// the values are not split on commas, a rule can have one in it.
+type ruleList []string
+
+// Set adds a value, the first time the option is seen the default is cleared
+func (l *ruleList) Set(sValue string, opt getopt.Option) error {
+	if opt.Count() <= 1 {
+		*l = nil
+	}
+	if sValue != "" {
+		*l = append(*l, sValue)
+	}
+	return nil
+}
+
+// String shows the values the same way they would be given
+func (l *ruleList) String() string {
+	return strings.Join(*l, " ")
+}
+
+// packetCounters holds the counters that are reported at the end of the run
+type packetCounters struct {
+	iTotalPacketCounter   int
+	iArpCounter           int
+	i802dot1QCounter      int
+	i802dot1QinQCounter   int
+	iMalformedCounter     int
+	iDroppedCounter       int
+	iDuplicateCounter     int
+	iSortCounter          int
+	iImpairDropCounter    int
+	iImpairDupCounter     int
+	iImpairOrderCounter   int
+	iImpairJitterCounter  int
+	iImpairCorruptCounter int
+	iChangedCounter       int
+
+	// How many packets each kind of rewrite actually changed
+	iMacRewriteCounter       int
+	iIPv4RewriteCounter      int
+	iIPv6RewriteCounter      int
+	iArpMacRewriteCounter    int
+	iArpIPv4RewriteCounter   int
+	iDhcpMacRewriteCounter   int
+	iDhcpIPRewriteCounter    int
+	iIcmpIPRewriteCounter    int
+	iTunnelCounter           int
+	iDecapCounter            int
+	iEncapCounter            int
+	iMPLSLabelRewriteCounter int
+	iMPLSPopCounter          int
+	iPPPoESessionCounter     int
+	iIPFieldRewriteCounter   int
+	iIPIDRewriteCounter      int
+	iResegmentCounter        int
+	iSegmentCounter          int
+	iReassembleCounter       int
+	iOverlapCounter          int
+	iBadLengthCounter        int
+	iIncompleteCounter       int
+	iRefragmentCounter       int
+	iFragmentCounter         int
+	iDNSRewriteCounter       int
+	iDomainRewriteCounter    int
+	iPayloadRewriteCounter   int
+	iScrubCounter            int
+	iTCPSeqRewriteCounter    int
+	iTimestampRewriteCounter int
+}
+
+// add will add the counters from a single packet to the running totals
+func (c *packetCounters) add(o packetCounters) {
+	c.iTotalPacketCounter += o.iTotalPacketCounter
+	c.iArpCounter += o.iArpCounter
+	c.i802dot1QCounter += o.i802dot1QCounter
+	c.i802dot1QinQCounter += o.i802dot1QinQCounter
+	c.iMalformedCounter += o.iMalformedCounter
+	c.iDroppedCounter += o.iDroppedCounter
+	c.iDuplicateCounter += o.iDuplicateCounter
+	c.iSortCounter += o.iSortCounter
+	c.iImpairDropCounter += o.iImpairDropCounter
+	c.iImpairDupCounter += o.iImpairDupCounter
+	c.iImpairOrderCounter += o.iImpairOrderCounter
+	c.iImpairJitterCounter += o.iImpairJitterCounter
+	c.iImpairCorruptCounter += o.iImpairCorruptCounter
+	c.iChangedCounter += o.iChangedCounter
+	c.iMacRewriteCounter += o.iMacRewriteCounter
+	c.iIPv4RewriteCounter += o.iIPv4RewriteCounter
+	c.iIPv6RewriteCounter += o.iIPv6RewriteCounter
+	c.iArpMacRewriteCounter += o.iArpMacRewriteCounter
+	c.iArpIPv4RewriteCounter += o.iArpIPv4RewriteCounter
+	c.iDhcpMacRewriteCounter += o.iDhcpMacRewriteCounter
+	c.iDhcpIPRewriteCounter += o.iDhcpIPRewriteCounter
+	c.iIcmpIPRewriteCounter += o.iIcmpIPRewriteCounter
+	c.iTunnelCounter += o.iTunnelCounter
+	c.iDecapCounter += o.iDecapCounter
+	c.iEncapCounter += o.iEncapCounter
+	c.iMPLSLabelRewriteCounter += o.iMPLSLabelRewriteCounter
+	c.iMPLSPopCounter += o.iMPLSPopCounter
+	c.iPPPoESessionCounter += o.iPPPoESessionCounter
+	c.iIPFieldRewriteCounter += o.iIPFieldRewriteCounter
+	c.iIPIDRewriteCounter += o.iIPIDRewriteCounter
+	c.iResegmentCounter += o.iResegmentCounter
+	c.iSegmentCounter += o.iSegmentCounter
+	c.iReassembleCounter += o.iReassembleCounter
+	c.iOverlapCounter += o.iOverlapCounter
+	c.iBadLengthCounter += o.iBadLengthCounter
+	c.iIncompleteCounter += o.iIncompleteCounter
+	c.iRefragmentCounter += o.iRefragmentCounter
+	c.iFragmentCounter += o.iFragmentCounter
+	c.iDNSRewriteCounter += o.iDNSRewriteCounter
+	c.iDomainRewriteCounter += o.iDomainRewriteCounter
+	c.iPayloadRewriteCounter += o.iPayloadRewriteCounter
+	c.iScrubCounter += o.iScrubCounter
+	c.iTCPSeqRewriteCounter += o.iTCPSeqRewriteCounter
+	c.iTimestampRewriteCounter += o.iTimestampRewriteCounter
+}
+
+// packetResult is what a worker hands back to the writer for each packet.  In a
+// dry run the original packet is kept so it can be compared once the sequence
+// numbers have been fixed.
+type packetResult struct {
+	counters            packetCounters
+	err                 error
+	frame               *frame.Frame
+	iPayloadDelta       int
+	original            []byte
+	originalCaptureInfo gopacket.CaptureInfo
+	originalTimestamp   time.Time
+}
+
+// Exit codes, these follow the values in sysexits.h so that scripts can tell
+// the different classes of failure apart
+const (
+	iExitVerifyFailed     = 1
+	iExitBadArguments     = 64
+	iExitMalformedPacket  = 65
+	iExitUnreadableInput  = 66
+	iExitSoftwareFailure  = 70
+	iExitUnwritableOutput = 73
+)
+
 //
 // --------------------------------------------------------------------------------
 // Function Main
@@ -50,205 +315,1736 @@ func main() {
 	getopt.Parse()
 	checkCommandLineOptions()
 
+	rules, iExitCode, err := newRewriteRules()
+	if err != nil {
+		exitWithError(err, iExitCode)
+	}
+
+	if *bOptVerify {
+		iPackets, iDifferent, iExitCode, err := verifyFiles(*sOptPcapSrcFilename, *sOptPcapNewFilename, rules)
+		if err != nil {
+			exitWithError(err, iExitCode)
+		}
+		fmt.Println("Total number of packets compared:", iPackets)
+		fmt.Println("Total number of packets with unexpected differences:", iDifferent)
+		if iDifferent > 0 {
+			os.Exit(iExitVerifyFailed)
+		}
+		return
+	}
+
+	if *bOptDryRun {
+		fmt.Println("Dry run, no new PCAP file will be written.")
+	}
+
+	summary := stats.New(*sOptPcapSrcFilename, *sOptPcapNewFilename)
+	counters, iExitCode, err := rewriteFile(*sOptPcapSrcFilename, *sOptPcapNewFilename, rules, summary)
+	if err != nil {
+		exitWithError(err, iExitCode)
+	}
+
+	if *sOptStatsJSON != "" {
+		if err := summary.WriteFile(*sOptStatsJSON); err != nil {
+			exitWithError(err, iExitUnwritableOutput)
+		}
+	}
+
+	fmt.Println("Total number of packets processed:", counters.iTotalPacketCounter)
+	fmt.Println("Total number of ARP packets processed:", counters.iArpCounter)
+	fmt.Println("Total number of 802.1Q packets processed:", counters.i802dot1QCounter)
+	fmt.Println("Total number of 802.1QinQ packets processed:", counters.i802dot1QinQCounter)
+	fmt.Println("Total number of malformed packets:", counters.iMalformedCounter)
+	if counters.iDroppedCounter > 0 {
+		fmt.Println("Total number of malformed packets dropped:", counters.iDroppedCounter)
+	}
+	if *bOptDedup {
+		fmt.Println("Total number of duplicate packets removed:", counters.iDuplicateCounter)
+	}
+	if *bOptSort {
+		fmt.Println("Total number of packets out of timestamp order:", counters.iSortCounter)
+	}
+	if rules.impairRules != nil && !*bOptDryRun {
+		fmt.Println("Total number of packets dropped, duplicated, reordered, jittered and corrupted:", counters.iImpairDropCounter, counters.iImpairDupCounter, counters.iImpairOrderCounter, counters.iImpairJitterCounter, counters.iImpairCorruptCounter)
+	}
+	if *bOptDryRun {
+		fmt.Println("Total number of packets that would be changed:", counters.iChangedCounter)
+	}
+
+} // main()
+
+//
+// --------------------------------------------------------------------------------
+// newRewriteRules()
+// --------------------------------------------------------------------------------
+// Parse the command line options that are applied to every packet.  If one of
+// them is bad the exit code for that class of failure is returned with the error.
+func newRewriteRules() (*rewriteRules, int, error) {
 	// Figure out if there is a change needed for the date of each packet.  We will
-	// compute the difference between what is in the first packet and what was passed
-	// in via the command line arguments.
-	pcapStartTimestamp := header.GetFirstPacketTimestamp(*sOptPcapSrcFilename)
+	// compute the difference between the earliest packet and what was passed in via
+	// the command line arguments.  The earliest packet is not always the first one
+	// and finding it reads the whole file, so that is only done for a new date.
+	getStartTimestamp := header.GetFirstPacketTimestamp
+	if *iOptNewYear != 0 || *iOptNewMonth != 0 || *iOptNewDay != 0 {
+		getStartTimestamp = header.GetEarliestPacketTimestamp
+	}
+	pcapStartTimestamp, err := getStartTimestamp(*sOptPcapSrcFilename)
+	if err != nil {
+		return nil, iExitUnreadableInput, err
+	}
 	iDiffYear, iDiffMonth, iDiffDay := header.ComputeNeededPacketDateChange(*iOptNewYear, *iOptNewMonth, *iOptNewDay, pcapStartTimestamp)
 
-	// Allow for multiple time shifts to be passed in at once
-	timeShifts := strings.Split(*sOptTimeShift, ",")
+	// Allow for multiple time shifts to be passed in at once, make sure they are
+	// all valid before we start processing packets
+	var timeShifts []time.Duration
+	if *sOptTimeShift != "" {
+		for _, ts := range strings.Split(*sOptTimeShift, ",") {
+			amountOfTimeChange, err := header.ParseTimeShift(ts)
+			if err != nil {
+				return nil, iExitBadArguments, err
+			}
+			timeShifts = append(timeShifts, amountOfTimeChange)
+		}
+	}
 
 	// Parse layer 2 addresses
-	userSuppliedMacAddress := layer2.ParseSuppliedLayer2Address(*sOptMacAddress)
-	userSuppliedMacAddressNew := layer2.ParseSuppliedLayer2Address(*sOptMacAddressNew)
+	userSuppliedMacAddress, err := layer2.ParseSuppliedLayer2Address(*sOptMacAddress)
+	if err != nil {
+		return nil, iExitBadArguments, err
+	}
+	userSuppliedMacAddressNew, err := layer2.ParseSuppliedLayer2Address(*sOptMacAddressNew)
+	if err != nil {
+		return nil, iExitBadArguments, err
+	}
 
 	// Parse layer 3 IPv4 address
-	userSuppliedIPv4Address := layer3.ParseSuppliedLayer3IPv4Address(*sOptIPv4Address)
-	userSuppliedIPv4AddressNew := layer3.ParseSuppliedLayer3IPv4Address(*sOptIPv4AddressNew)
+	userSuppliedIPv4Address, err := layer3.ParseSuppliedLayer3IPv4Address(*sOptIPv4Address)
+	if err != nil {
+		return nil, iExitBadArguments, err
+	}
+	userSuppliedIPv4AddressNew, err := layer3.ParseSuppliedLayer3IPv4Address(*sOptIPv4AddressNew)
+	if err != nil {
+		return nil, iExitBadArguments, err
+	}
+
+	// Parse layer 3 IPv6 address
+	userSuppliedIPv6Address, err := layer3.ParseSuppliedLayer3IPv6Address(*sOptIPv6Address)
+	if err != nil {
+		return nil, iExitBadArguments, err
+	}
+	userSuppliedIPv6AddressNew, err := layer3.ParseSuppliedLayer3IPv6Address(*sOptIPv6AddressNew)
+	if err != nil {
+		return nil, iExitBadArguments, err
+	}
+
+	// Parse the other IP header fields to change
+	var fieldRules *layer3.FieldRules
+	if *sOptTTL != "" || *sOptDSCP != "" || *sOptECN != "" || *sOptIPID != "" || *sOptFlowLabel != "" {
+		fieldRules, err = layer3.ParseFieldRules(*sOptTTL, *sOptDSCP, *sOptECN, *sOptIPID, *sOptFlowLabel, *sOptIPFieldsHosts, *sOptIPFieldsFilter)
+		if err != nil {
+			return nil, iExitBadArguments, err
+		}
+	}
+
+	// Parse which headers of a tunnelled packet to change
+	tunnelLayers, err := tunnel.ParseLayers(*sOptTunnel)
+	if err != nil {
+		return nil, iExitBadArguments, err
+	}
+
+	// Parse the outer headers to wrap the packets in
+	var encapRules *encap.Rules
+	if *sOptEncap != "" {
+		encapRules, err = encap.ParseRules(*sOptEncap, *sOptEncapSrcMac, *sOptEncapDstMac, *sOptEncapSrcIP, *sOptEncapDstIP, *iOptEncapVNI)
+		if err != nil {
+			return nil, iExitBadArguments, err
+		}
+	}
+
+	// Parse the MPLS labels to change
+	var mplsRules *mpls.Rules
+	if *sOptMPLSLabelMap != "" {
+		mplsRules, err = mpls.ParseRules(*sOptMPLSLabelMap)
+		if err != nil {
+			return nil, iExitBadArguments, err
+		}
+	}
+
+	// Parse the PPPoE sessions to change
+	var pppoeRules *pppoe.Rules
+	if *sOptPPPoESessionMap != "" {
+		pppoeRules, err = pppoe.ParseRules(*sOptPPPoESessionMap)
+		if err != nil {
+			return nil, iExitBadArguments, err
+		}
+	}
+
+	// The MTU to split packets for
+	if *iOptResegment != 0 && (*iOptResegment < segment.MinMTU || *iOptResegment > segment.MaxMTU) {
+		return nil, iExitBadArguments, fmt.Errorf("invalid MTU %d for resegment, it should be %d to %d", *iOptResegment, segment.MinMTU, segment.MaxMTU)
+	}
+
+	// How long to wait for fragments and how the datagrams are fragmented again
+	var reassembleTimeout time.Duration
+	if *bOptReassemble {
+		reassembleTimeout, err = time.ParseDuration(*sOptReassembleTimeout)
+		if err != nil || reassembleTimeout <= 0 {
+			return nil, iExitBadArguments, fmt.Errorf("invalid reassemble timeout %q, it should be a duration like 30s", *sOptReassembleTimeout)
+		}
+	}
+	// Parse the impairments of a bad link
+	var impairRules *impair.Rules
+	if *sOptImpairDrop != "" || *sOptImpairDuplicate != "" || *sOptImpairReorder != "" || *sOptImpairJitter != "" || *sOptImpairCorrupt != "" {
+		impairRules, err = impair.ParseRules(*sOptImpairDrop, *sOptImpairDuplicate, *sOptImpairReorder, *iOptImpairReorderWindow, *sOptImpairJitter, *sOptImpairJitterDistribution, *sOptImpairCorrupt, *iOptImpairSeed)
+		if err != nil {
+			return nil, iExitBadArguments, err
+		}
+	}
+
+	// How much of the capture is sorted in memory
+	if *bOptSort && *iOptSortMemory < 1 {
+		return nil, iExitBadArguments, fmt.Errorf("invalid sort memory %d, it should be at least 1 megabyte", *iOptSortMemory)
+	}
+
+	// How close together the copies of a packet have to be
+	var dedupWindow time.Duration
+	if *bOptDedup {
+		dedupWindow, err = time.ParseDuration(*sOptDedupWindow)
+		if err != nil || dedupWindow <= 0 {
+			return nil, iExitBadArguments, fmt.Errorf("invalid dedup window %q, it should be a duration like 50ms", *sOptDedupWindow)
+		}
+	}
+
+	iRefragmentMTU := 0
+	if *sOptRefragment != "" && *sOptRefragment != "original" {
+		iRefragmentMTU, err = strconv.Atoi(*sOptRefragment)
+		if err != nil || iRefragmentMTU < segment.MinMTU || iRefragmentMTU > segment.MaxMTU {
+			return nil, iExitBadArguments, fmt.Errorf("invalid refragment %q, it should be original or an MTU of %d to %d", *sOptRefragment, segment.MinMTU, segment.MaxMTU)
+		}
+	}
+
+	// Parse the domains to change
+	var domainRules *domain.Rules
+	if *sOptDomainMap != "" {
+		domainRules, err = domain.ParseRules(*sOptDomainMap)
+		if err != nil {
+			return nil, iExitBadArguments, err
+		}
+	}
+
+	// Parse the strings to replace in the payloads
+	var payloadRules *payload.Rules
+	if len(payloadRuleSpecs) > 0 {
+		payloadRules, err = payload.ParseRules(payloadRuleSpecs, *sOptPayloadPorts, *sOptPayloadFilter)
+		if err != nil {
+			return nil, iExitBadArguments, err
+		}
+	}
+
+	// Parse how the payloads are scrubbed
+	var scrubRules *scrub.Rules
+	if *sOptScrub != "" {
+		scrubRules, err = scrub.ParseRules(*sOptScrub, *sOptScrubKeep, *sOptScrubLengths)
+		if err != nil {
+			return nil, iExitBadArguments, err
+		}
+	}
+
+	rules := &rewriteRules{
+		iDiffYear:                  iDiffYear,
+		iDiffMonth:                 iDiffMonth,
+		iDiffDay:                   iDiffDay,
+		timeShifts:                 timeShifts,
+		userSuppliedMacAddress:     userSuppliedMacAddress,
+		userSuppliedMacAddressNew:  userSuppliedMacAddressNew,
+		userSuppliedIPv4Address:    userSuppliedIPv4Address,
+		userSuppliedIPv4AddressNew: userSuppliedIPv4AddressNew,
+		userSuppliedIPv6Address:    userSuppliedIPv6Address,
+		userSuppliedIPv6AddressNew: userSuppliedIPv6AddressNew,
+		domainRules:                domainRules,
+		payloadRules:               payloadRules,
+		scrubRules:                 scrubRules,
+		tunnelLayers:               tunnelLayers,
+		bDecap:                     *bOptDecap,
+		encapRules:                 encapRules,
+		mplsRules:                  mplsRules,
+		bMPLSPop:                   *bOptMPLSPop,
+		pppoeRules:                 pppoeRules,
+		fieldRules:                 fieldRules,
+		iResegmentMTU:              *iOptResegment,
+		bReassemble:                *bOptReassemble,
+		reassembleTimeout:          reassembleTimeout,
+		bRefragmentOriginal:        *sOptRefragment == "original",
+		iRefragmentMTU:             iRefragmentMTU,
+		dedupWindow:                dedupWindow,
+		bSort:                      *bOptSort,
+		iSortMemory:                int64(*iOptSortMemory) << 20,
+		impairRules:                impairRules,
+	}
+
+	// DNS answers and reverse lookups are changed along with the IP addresses,
+	// and the names along with the domains
+	var mappings []dns.Mapping
+	if *sOptIPv4Address != "" && *sOptIPv4AddressNew != "" {
+		mappings = append(mappings, dns.Mapping{Old: userSuppliedIPv4Address, New: userSuppliedIPv4AddressNew})
+	}
+	if *sOptIPv6Address != "" && *sOptIPv6AddressNew != "" {
+		mappings = append(mappings, dns.Mapping{Old: userSuppliedIPv6Address, New: userSuppliedIPv6AddressNew})
+	}
+	if len(mappings) > 0 || domainRules != nil {
+		rules.dnsRules = &dns.Rules{Addresses: mappings, Domains: domainRules}
+	}
+	return rules, 0, nil
+} // newRewriteRules()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteFile()
+// --------------------------------------------------------------------------------
+// Loop through every packet in the source file and update them as needed, writing
+// the changes out to the new file.  The summary is filled in as the packets are
+// written.  If something goes wrong the exit code for that class of failure is
+// returned with the error.
+func rewriteFile(sSrcFilename, sNewFilename string, rules *rewriteRules, summary *stats.Summary) (packetCounters, int, error) {
+	var counters packetCounters
+	startTime := time.Now()
 
 	//
 	// Get a handle to the PCAP source file so we can loop through each packet and make
 	// changes as needed.
-	handle, err1 := pcap.OpenOffline(*sOptPcapSrcFilename)
-	if err1 != nil {
-		fmt.Println(err1)
-		os.Exit(0)
+	handle, err := pcap.OpenOffline(sSrcFilename)
+	if err != nil {
+		return counters, iExitUnreadableInput, err
 	}
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	defer handle.Close()
+	rules.linkType = handle.LinkType()
 
-	// Create file handle to write to
-	fileHandle, err2 := os.Create(*sOptPcapNewFilename)
-	if err2 != nil {
-		fmt.Println(err2)
-		os.Exit(0)
+	// The payload and IP field filters can only be compiled once the link type
+	// is known
+	if rules.payloadRules != nil {
+		if err := rules.payloadRules.Compile(rules.linkType); err != nil {
+			return counters, iExitBadArguments, err
+		}
+	}
+	if rules.fieldRules != nil {
+		if err := rules.fieldRules.Compile(rules.linkType); err != nil {
+			return counters, iExitBadArguments, err
+		}
 	}
-	writer := pcapgo.NewWriter(fileHandle)
-	writer.WriteFileHeader(65535, handle.LinkType())
 
-	fmt.Println("Each '.' represents 1000 packets converted.")
+	// The packets are written out as ethernet frames once they are wrapped in
+	// a tunnel
+	outputLinkType := rules.linkType
+	if rules.encapRules != nil {
+		if err := rules.encapRules.CheckLinkType(rules.linkType); err != nil {
+			return counters, iExitBadArguments, err
+		}
+		outputLinkType = layers.LinkTypeEthernet
+	}
 
-	// -------------------------------------------------------------------------
-	// Define counters for status
-	// -------------------------------------------------------------------------
-	iTotalPacketCounter := 0
-	iArpCounter := 0
-	i802dot1QCounter := 0
-	i802dot1QinQCounter := 0
+	// The progress is worked out from how much of the source file has been read,
+	// it goes to stderr so it does not get mixed up with the totals
+	var reporter *progress.Reporter
+	if !*bOptQuiet {
+		var iFileSize int64
+		if fi, err := os.Stat(sSrcFilename); err == nil {
+			iFileSize = fi.Size()
+		}
+		reporter = progress.New(os.Stderr, iFileSize, progress.IsTerminal(os.Stderr))
+		defer reporter.Finish()
+	}
+
+	// Create file handle to write to, the writes are buffered as pcapgo does two
+	// small writes for every packet.  A dry run does not write anything so the
+	// packets are just thrown away.
+	var fileHandle *os.File
+	var bufferedWriter *bufio.Writer
+	if *bOptDryRun {
+		bufferedWriter = bufio.NewWriter(ioutil.Discard)
+	} else {
+		fileHandle, err = os.Create(sNewFilename)
+		if err != nil {
+			return counters, iExitUnwritableOutput, err
+		}
+		defer fileHandle.Close()
+		bufferedWriter = bufio.NewWriterSize(fileHandle, 1<<20)
+	}
 
+	writer := pcapgo.NewWriter(bufferedWriter)
+	if err := writer.WriteFileHeader(65535, outputLinkType); err != nil {
+		return counters, iExitUnwritableOutput, err
+	}
+
+	//
 	// -------------------------------------------------------------------------
-	// Loop through every packet and update them as needed writing the changes
-	// out to a new file
+	// Each packet is decoded and rewritten by one of the workers, this may happen
+	// on many goroutines at the same time
 	// -------------------------------------------------------------------------
-	for packet := range packetSource.Packets() {
+	rewrite := func(job *pipeline.Job) {
 		if iDebug == 1 {
 			fmt.Println("DEBUG: ", "----------------------------------------")
 		}
 
-		// ---------------------------------------------------------------------
-		// Change timestamps in the PCAP header as needed
-		// ---------------------------------------------------------------------
-		if iDiffYear != 0 || iDiffMonth != 0 || iDiffDay != 0 {
-			header.ChangeTimestampDate(packet, iDiffYear, iDiffMonth, iDiffDay)
+		result := &packetResult{
+			originalTimestamp: job.CaptureInfo.Timestamp,
 		}
 
-		if *sOptTimeShift != "" {
-			// Allow for multiple time shifts to be passed at once
-			for _, ts := range timeShifts {
-				header.ChangeTimestampTimeOfDay(packet, ts)
-			}
+		// A dry run needs a copy of the packet so it can be compared after the
+		// rewrite is done
+		if *bOptDryRun {
+			result.original = append([]byte(nil), job.Data...)
+			result.originalCaptureInfo = job.CaptureInfo
+		}
 
+		result.frame, result.iPayloadDelta, result.err = rewritePacket(job.Data, &job.CaptureInfo, rules, &result.counters)
+
+		// Stripping a tunnel, the DNS, domain and payload rewrites and the scrub
+		// can make the packet longer or shorter
+		if result.frame != nil {
+			job.Data = result.frame.Data
 		}
+		job.Result = result
+	}
 
-		// ---------------------------------------------------------------------
-		// Change layer 2 MAC addresses as needed
-		// ---------------------------------------------------------------------
-		if *sOptMacAddress != "" && *sOptMacAddressNew != "" {
-			layer2.ReplaceMacAddresses(packet, userSuppliedMacAddress, userSuppliedMacAddressNew)
+	//
+	// -------------------------------------------------------------------------
+	// When a payload can change length the TCP sequence numbers of the rest of
+	// the connection have to move with it.  This needs the packets in order so
+	// it is done by the writer.
+	// -------------------------------------------------------------------------
+	var tracker *tcpstream.Tracker
+	if rules.dnsRules != nil || rules.payloadRules != nil || (rules.scrubRules != nil && rules.scrubRules.ChangesLength()) {
+		tracker = tcpstream.New()
+	}
+
+	// Fragmented datagrams are put back together as the packets are read
+	var reassembler *fragment.Reassembler
+	if rules.bReassemble {
+		reassembler = fragment.New(rules.linkType, rules.reassembleTimeout)
+	}
+
+	// The fragments of a datagram that is split again where it was before are
+	// held back until the packets that were read in between them are written
+	var held fragment.Holder
+
+	//
+	// -------------------------------------------------------------------------
+	// The packets come back in their original order so we can write the changes
+	// out to a new file
+	// -------------------------------------------------------------------------
+	// writePacket writes a packet out to the new file and counts it
+	writePacket := func(ci gopacket.CaptureInfo, data []byte) error {
+		summary.AddWritten(ci.Timestamp, len(data))
+		return writer.WritePacket(ci, data)
+	}
+
+	// sendPacket sends a packet through the impairments on its way to the new
+	// file, they come last so they follow the order of the file
+	sendPacket := func(ci gopacket.CaptureInfo, data []byte) error {
+		if rules.impairRules != nil {
+			return rules.impairRules.Apply(ci, data, writePacket)
 		}
+		return writePacket(ci, data)
+	}
 
-		i802dot1QOffset := 0
-		// ---------------------------------------------------------------------
-		// Look for an 802.1Q frames
-		// ---------------------------------------------------------------------
-		if packet.LinkLayer().LayerContents()[12] == 81 && packet.LinkLayer().LayerContents()[13] == 0 {
-			if iDebug == 1 {
-				fmt.Println("DEBUG: Found an 802.1Q packet")
+	iExitCode := iExitUnreadableInput
+	iShownCounter := 0
+	write := func(job *pipeline.Job) error {
+		result := job.Result.(*packetResult)
+		counters.add(result.counters)
+		counters.iTotalPacketCounter++
+
+		if result.frame != nil {
+			if result.frame.LinkType == layers.LinkTypeEthernet {
+				summary.AddEthernetType(result.frame.EthernetType)
+			}
+			if result.frame.IPVersion != 0 && result.frame.IPProtocol != 0 {
+				summary.AddIPProtocol(result.frame.IPProtocol)
 			}
-			i802dot1QOffset = 4
-			i802dot1QCounter++
 		}
 
+		//
 		// ---------------------------------------------------------------------
-		// Look for an 802.1QinQ frame
+		// Malformed packets are either passed through with whatever changes
+		// could be made, dropped, or stop the run depending on the policy
 		// ---------------------------------------------------------------------
-		if packet.LinkLayer().LayerContents()[12] == 88 && packet.LinkLayer().LayerContents()[13] == 168 {
+		if result.err != nil {
+			if !errors.Is(result.err, common.ErrMalformedPacket) {
+				iExitCode = iExitSoftwareFailure
+				return fmt.Errorf("packet %d could not be rewritten: %w", counters.iTotalPacketCounter, result.err)
+			}
 			if iDebug == 1 {
-				fmt.Println("DEBUG: Found an 802.1QinQ packet")
+				fmt.Println("DEBUG: Packet", counters.iTotalPacketCounter, result.err)
+			}
+
+			counters.iMalformedCounter++
+			if *sOptOnMalformed == "abort" {
+				iExitCode = iExitMalformedPacket
+				return fmt.Errorf("packet %d could not be rewritten: %w", counters.iTotalPacketCounter, result.err)
+			}
+			if *sOptOnMalformed == "drop" {
+				counters.iDroppedCounter++
+				if *bOptDryRun && iShownCounter < *iOptDryRunCount {
+					iShownCounter++
+					if reporter != nil {
+						reporter.Clear()
+					}
+					fmt.Println("Packet", counters.iTotalPacketCounter, "would be dropped:", result.err)
+				}
+				return nil
 			}
-			i802dot1QOffset = 8
-			i802dot1QinQCounter++
+		}
+		if tracker != nil && result.frame != nil && tracker.Fix(result.frame, result.iPayloadDelta) {
+			counters.iTCPSeqRewriteCounter++
 		}
 
-		// ---------------------------------------------------------------------
-		// Look for an ARP frame.  If it is an ARP packet, we may need update the
-		// internal MAC and IP addresses.
-		// ---------------------------------------------------------------------
-		iEthType1 := 12 + i802dot1QOffset
-		iEthType2 := 13 + i802dot1QOffset
-		if packet.LinkLayer().LayerContents()[iEthType1] == 8 && packet.LinkLayer().LayerContents()[iEthType2] == 6 {
-			if iDebug == 1 {
-				fmt.Println("DEBUG: Found an ARP packet")
+		// A datagram that was put back together is fragmented again once its
+		// sequence numbers are fixed.  It gets its new IP identification first
+		// so all of the fragments carry it, and fragments at the original
+		// boundaries keep their own timestamps moved the same as the datagram.
+		packets := [][]byte{job.Data}
+		var captureInfos []gopacket.CaptureInfo
+		bIDGiven := false
+		var datagram *fragment.Datagram
+		if reassembler != nil {
+			datagram = reassembler.Datagram(job.Index)
+		}
+		if datagram != nil && (rules.bRefragmentOriginal || rules.iRefragmentMTU > 0) && result.frame != nil && result.err == nil {
+			ipHeader := job.Data[result.frame.NetworkOffset:]
+			if rules.fieldRules != nil && result.counters.iIPIDRewriteCounter > 0 && rules.fieldRules.ChangesID(ipHeader, result.frame.IPVersion) {
+				rules.fieldRules.ReplaceID(ipHeader)
+			}
+			bIDGiven = true
+
+			pieces := datagram.Pieces
+			if rules.iRefragmentMTU > 0 {
+				pieces = fragment.MTUPieces(result.frame, rules.iRefragmentMTU)
+			}
+			shift := job.CaptureInfo.Timestamp.Sub(result.originalTimestamp)
+			var fragments [][]byte
+			for i, data := range fragment.Split(result.frame, pieces, datagram.ID) {
+				if data == nil {
+					continue
+				}
+				ci := job.CaptureInfo
+				if rules.bRefragmentOriginal {
+					ci.Timestamp = pieces[i].CaptureInfo.Timestamp.Add(shift)
+				}
+				fragments = append(fragments, data)
+				captureInfos = append(captureInfos, ci)
+			}
+			if len(fragments) > 0 {
+				packets = fragments
+				counters.iRefragmentCounter++
+				counters.iFragmentCounter += len(fragments)
+			} else {
+				captureInfos = nil
+			}
+		} else if rules.iResegmentMTU > 0 && result.frame != nil && result.err == nil && job.CaptureInfo.CaptureLength == job.CaptureInfo.Length {
+			// A packet bigger than the MTU is split once its sequence numbers
+			// are fixed, unless it was cut short by the snap length
+			if segments := segment.Split(result.frame, rules.iResegmentMTU); segments != nil {
+				packets = segments
+				counters.iResegmentCounter++
+				counters.iSegmentCounter += len(segments)
+			}
+		}
+
+		// The fragments held back from the datagrams before this packet go out
+		// first once they are due
+		if err := held.Release(job.CaptureInfo.Timestamp, sendPacket); err != nil {
+			iExitCode = iExitUnwritableOutput
+			return err
+		}
+
+		for i, data := range packets {
+			ci := job.CaptureInfo
+			if captureInfos != nil {
+				ci = captureInfos[i]
+			}
+			if len(packets) > 1 {
+				ci.CaptureLength, ci.Length = len(data), len(data)
 			}
 
-			// Fix the MAC addresses in the ARP payload if we are fixing MAC addresses at layer 2
-			if *sOptMacAddress != "" && *sOptMacAddressNew != "" {
-				arp.ReplaceArpPayloadMacAddresses(packet, i802dot1QOffset, userSuppliedMacAddress, userSuppliedMacAddressNew)
+			// The worker counted the packets that get a new IP identification,
+			// it is given here so a sequence follows the order of the file.  The
+			// fragments of a packet that was split keep the same one.
+			if rules.fieldRules != nil && result.counters.iIPIDRewriteCounter > 0 && !bIDGiven {
+				ipHeader := data[result.frame.NetworkOffset:]
+				if rules.fieldRules.ChangesID(ipHeader, result.frame.IPVersion) {
+					rules.fieldRules.ReplaceID(ipHeader)
+				}
 			}
 
-			// Fix the IP addresses in the ARP payload if we are changing layer 3 information
-			if *sOptIPv4Address != "" && *sOptIPv4AddressNew != "" {
-				arp.ReplaceArpPayloadIPv4Addresses(packet, i802dot1QOffset, userSuppliedIPv4Address, userSuppliedIPv4AddressNew)
+			// The packet is wrapped in a tunnel last, once its sequence numbers
+			// are fixed.  This is done here as the IP identification and the
+			// ERSPAN sequence numbers have to follow the order of the file.
+			if rules.encapRules != nil {
+				encapsulated, err := rules.encapRules.Encapsulate(data, rules.linkType)
+				if err != nil {
+					iExitCode = iExitMalformedPacket
+					return fmt.Errorf("packet %d could not be encapsulated: %w", counters.iTotalPacketCounter, err)
+				}
+				ci.Length += len(encapsulated) - len(data)
+				ci.CaptureLength = len(encapsulated)
+				data = encapsulated
+				counters.iEncapCounter++
+			}
+			// In a dry run show what changed for the first few packets, a
+			// packet that was split is compared with its first part.  The
+			// packets are not impaired.
+			if *bOptDryRun {
+				summary.AddWritten(ci.Timestamp, len(data))
+				if i > 0 {
+					continue
+				}
+				changes := comparePackets(result.original, data, result.originalCaptureInfo, ci, rules.linkType, outputLinkType)
+				if len(packets) > 1 {
+					changes = append(changes, diff.Change{Field: "packets", Old: "1", New: fmt.Sprint(len(packets))})
+				}
+				if len(changes) == 0 {
+					continue
+				}
+				counters.iChangedCounter++
+				if iShownCounter < *iOptDryRunCount {
+					iShownCounter++
+					if reporter != nil {
+						reporter.Clear()
+					}
+					fmt.Println("Packet", counters.iTotalPacketCounter)
+					for _, change := range changes {
+						fmt.Println("    " + change.String())
+					}
+				}
+				continue
 			}
 
-			iArpCounter++
-		} // End ARP Packets
+			// The rest of the fragments of a datagram that is split where it
+			// was before wait for the packets that were read in between them
+			if i > 0 && captureInfos != nil && rules.bRefragmentOriginal {
+				held.Hold(ci, data)
+				continue
+			}
 
-		// ---------------------------------------------------------------------
-		// Change Layer 3 information
-		// ---------------------------------------------------------------------
-		if *sOptIPv4Address != "" && *sOptIPv4AddressNew != "" {
-			layer3.ReplaceIPv4Addresses(packet, i802dot1QOffset, userSuppliedIPv4Address, userSuppliedIPv4AddressNew)
+			//
+			// Write the packet out to the new file, going through the
+			// impairments last so they follow the order of the file
+			if err := sendPacket(ci, data); err != nil {
+				iExitCode = iExitUnwritableOutput
+				return err
+			}
 		}
+		return nil
+	}
 
-		//
-		// Write the packet out to the new file
-		writer.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+	//
+	// -------------------------------------------------------------------------
+	// In fast mode with a single worker each packet is written out before the
+	// next one is read, so we can let pcap reuse the same buffer for every packet
+	// -------------------------------------------------------------------------
+	read := handle.ReadPacketData
+	if *bOptFast && *iOptWorkers == 1 {
+		read = handle.ZeroCopyReadPacketData
+	}
+
+	// The summary and the progress count the packets as they come out of the
+	// file, before any of them are sorted, left out or held back
+	read = summary.Reader(read)
+	if reporter != nil {
+		read = reporter.Reader(read)
+	}
+
+	// The packets are put in timestamp order first, the sorter keeps its own
+	// copy of them
+	var sorter *timesort.Sorter
+	if rules.bSort {
+		sorter = timesort.New(rules.iSortMemory)
+		defer sorter.Close()
+		read = sorter.Reader(read)
+	}
+
+	// The copies of a packet from other SPAN ports are left out before they
+	// are rewritten
+	var filter *dedup.Filter
+	if rules.dedupWindow > 0 {
+		filter = dedup.New(rules.linkType, rules.dedupWindow)
+		read = filter.Reader(read)
+	}
+
+	// The fragments of a datagram are held back until it can be put back
+	// together, the reassembler keeps its own copy of them
+	if reassembler != nil {
+		read = reassembler.Reader(read)
+	}
+
+	err = pipeline.Run(*iOptWorkers, read, rewrite, write)
+	if sorter != nil {
+		counters.iSortCounter = sorter.OutOfOrder
+	}
+	if filter != nil {
+		counters.iDuplicateCounter = filter.Duplicates
+	}
+	if reassembler != nil {
+		counters.iReassembleCounter = reassembler.Reassembled
+		counters.iOverlapCounter = reassembler.Overlaps
+		counters.iBadLengthCounter = reassembler.BadLengths
+		counters.iIncompleteCounter = reassembler.Incomplete
+	}
+	if err != nil {
+		bufferedWriter.Flush()
+		return counters, iExitCode, err
+	}
+
+	// The fragments that are still held back go out at the end
+	if err := held.Flush(sendPacket); err != nil {
+		return counters, iExitUnwritableOutput, err
+	}
 
-		// Write some output to the screen so users know we are doing something
-		iTotalPacketCounter++
-		if iTotalPacketCounter%1000 == 0 {
-			fmt.Print(".")
-			if iTotalPacketCounter%80000 == 0 {
-				fmt.Print("\n")
+	// The packets that are still held back to be reordered go out last
+	if rules.impairRules != nil {
+		if !*bOptDryRun {
+			if err := rules.impairRules.Flush(writePacket); err != nil {
+				return counters, iExitUnwritableOutput, err
 			}
-		} // screen feedback
+		}
+		counters.iImpairDropCounter = rules.impairRules.Dropped
+		counters.iImpairDupCounter = rules.impairRules.Duplicated
+		counters.iImpairOrderCounter = rules.impairRules.Reordered
+		counters.iImpairJitterCounter = rules.impairRules.Jittered
+		counters.iImpairCorruptCounter = rules.impairRules.Corrupted
+	}
+
+	if err := bufferedWriter.Flush(); err != nil {
+		return counters, iExitUnwritableOutput, err
+	}
+	if fileHandle != nil {
+		if err := fileHandle.Close(); err != nil {
+			return counters, iExitUnwritableOutput, err
+		}
+	}
 
-	} // End loop through every packet
+	fillSummary(summary, counters, handle.LinkType())
+	summary.Finish(time.Since(startTime))
+	return counters, 0, nil
+} // rewriteFile()
 
-	fileHandle.Close()
-	fmt.Println("\nTotal number of packets processed:", iTotalPacketCounter)
-	fmt.Println("Total number of ARP packets processed:", iArpCounter)
-	fmt.Println("Total number of 802.1Q packets processed:", i802dot1QCounter)
-	fmt.Println("Total number of 802.1QinQ packets processed:", i802dot1QinQCounter)
+//
+// --------------------------------------------------------------------------------
+// fillSummary()
+// --------------------------------------------------------------------------------
+// Copy the counters that are kept during the run in to the summary
+func fillSummary(summary *stats.Summary, counters packetCounters, linkType layers.LinkType) {
+	summary.DryRun = *bOptDryRun
+	summary.LinkType = linkType.String()
+	summary.Malformed = counters.iMalformedCounter
+	summary.Dropped = counters.iDroppedCounter
+	summary.Duplicates = counters.iDuplicateCounter
+	summary.ARP = counters.iArpCounter
+	summary.Dot1Q = counters.i802dot1QCounter
+	summary.Dot1QinQ = counters.i802dot1QinQCounter
 
-} // main()
+	summary.Rewrites["mac"] = counters.iMacRewriteCounter
+	summary.Rewrites["ipv4"] = counters.iIPv4RewriteCounter
+	summary.Rewrites["ipv6"] = counters.iIPv6RewriteCounter
+	summary.Rewrites["arp_mac"] = counters.iArpMacRewriteCounter
+	summary.Rewrites["arp_ipv4"] = counters.iArpIPv4RewriteCounter
+	summary.Rewrites["dhcp_mac"] = counters.iDhcpMacRewriteCounter
+	summary.Rewrites["dhcp_ip"] = counters.iDhcpIPRewriteCounter
+	summary.Rewrites["icmp_ip"] = counters.iIcmpIPRewriteCounter
+	summary.Rewrites["tunnel"] = counters.iTunnelCounter
+	summary.Rewrites["decap"] = counters.iDecapCounter
+	summary.Rewrites["encap"] = counters.iEncapCounter
+	summary.Rewrites["mpls_label"] = counters.iMPLSLabelRewriteCounter
+	summary.Rewrites["mpls_pop"] = counters.iMPLSPopCounter
+	summary.Rewrites["pppoe_session"] = counters.iPPPoESessionCounter
+	summary.Rewrites["ip_fields"] = counters.iIPFieldRewriteCounter
+	summary.Rewrites["ip_id"] = counters.iIPIDRewriteCounter
+	summary.Rewrites["resegment"] = counters.iResegmentCounter
+	summary.Rewrites["resegment_packets"] = counters.iSegmentCounter
+	summary.Rewrites["reassembled"] = counters.iReassembleCounter
+	summary.Rewrites["fragment_overlap"] = counters.iOverlapCounter
+	summary.Rewrites["fragment_bad_length"] = counters.iBadLengthCounter
+	summary.Rewrites["fragment_incomplete"] = counters.iIncompleteCounter
+	summary.Rewrites["refragment"] = counters.iRefragmentCounter
+	summary.Rewrites["refragment_packets"] = counters.iFragmentCounter
+	summary.Rewrites["dns"] = counters.iDNSRewriteCounter
+	summary.Rewrites["domain"] = counters.iDomainRewriteCounter
+	summary.Rewrites["payload"] = counters.iPayloadRewriteCounter
+	summary.Rewrites["scrub"] = counters.iScrubCounter
+	summary.Rewrites["tcp_seq"] = counters.iTCPSeqRewriteCounter
+	summary.Rewrites["timestamp"] = counters.iTimestampRewriteCounter
+	summary.Rewrites["sort"] = counters.iSortCounter
+	summary.Rewrites["impair_drop"] = counters.iImpairDropCounter
+	summary.Rewrites["impair_duplicate"] = counters.iImpairDupCounter
+	summary.Rewrites["impair_reorder"] = counters.iImpairOrderCounter
+	summary.Rewrites["impair_jitter"] = counters.iImpairJitterCounter
+	summary.Rewrites["impair_corrupt"] = counters.iImpairCorruptCounter
+} // fillSummary()
 
 //
 // --------------------------------------------------------------------------------
-// checkCommandLineOptions()
+// verifyFiles()
 // --------------------------------------------------------------------------------
-// Verify that all of the command line options meet the required dependencies
-func checkCommandLineOptions() {
-	if *bOptVer {
-		fmt.Println("rewritecap, copyright Bret Jordan, 2015")
-		fmt.Println("Version:", sVersion)
-		fmt.Println("")
-		os.Exit(0)
-	}
+// Read the source file and the new file side by side and make sure each packet
+// only differs where the rules say it should.  Each unexpected difference is
+// printed, up to iMaxShownDifferences of them.  The number of packets compared
+// and the number of packets with unexpected differences are returned.
+func verifyFiles(sSrcFilename, sNewFilename string, rules *rewriteRules) (int, int, int, error) {
+	const iMaxShownDifferences = 100
 
-	if *bOptHelp || (*sOptPcapSrcFilename == "" || *sOptPcapNewFilename == "") {
-		fmt.Println("rewritecap, copyright Bret Jordan, 2015")
-		fmt.Println("Version:", sVersion)
-		fmt.Println("")
-		getopt.Usage()
-		os.Exit(0)
+	srcHandle, err := pcap.OpenOffline(sSrcFilename)
+	if err != nil {
+		return 0, 0, iExitUnreadableInput, err
 	}
+	defer srcHandle.Close()
 
-	if *sOptPcapSrcFilename == *sOptPcapNewFilename {
-		fmt.Println("rewritecap, copyright Bret Jordan, 2015")
-		fmt.Println("Version:", sVersion)
-		fmt.Println("")
-		fmt.Println("Filenames are the same.")
-		os.Exit(0)
+	newHandle, err := pcap.OpenOffline(sNewFilename)
+	if err != nil {
+		return 0, 0, iExitUnreadableInput, err
+	}
+	defer newHandle.Close()
 
+	if srcHandle.LinkType() != newHandle.LinkType() {
+		return 0, 0, iExitVerifyFailed, fmt.Errorf("link type changed from %s to %s", srcHandle.LinkType(), newHandle.LinkType())
 	}
 
-	// Make sure if the user supplies a Layer2 address, that they also supply the other
-	if (*sOptMacAddress != "" && *sOptMacAddressNew == "") || (*sOptMacAddressNew != "" && *sOptMacAddress == "") {
-		fmt.Println("rewritecap, copyright Bret Jordan, 2015")
-		fmt.Println("Version:", sVersion)
-		fmt.Println("")
-		getopt.Usage()
-		os.Exit(0)
+	verifyRules := &verify.Rules{
+		Timestamps: rules.iDiffYear != 0 || rules.iDiffMonth != 0 || rules.iDiffDay != 0 || len(rules.timeShifts) > 0,
+	}
+	if *sOptMacAddress != "" && *sOptMacAddressNew != "" {
+		verifyRules.MacAddress = rules.userSuppliedMacAddress
+		verifyRules.MacAddressNew = rules.userSuppliedMacAddressNew
+	}
+	if *sOptIPv4Address != "" && *sOptIPv4AddressNew != "" {
+		verifyRules.IPv4Address = rules.userSuppliedIPv4Address
+		verifyRules.IPv4AddressNew = rules.userSuppliedIPv4AddressNew
+	}
+	if *sOptIPv6Address != "" && *sOptIPv6AddressNew != "" {
+		verifyRules.IPv6Address = rules.userSuppliedIPv6Address
+		verifyRules.IPv6AddressNew = rules.userSuppliedIPv6AddressNew
+	}
+	verifyRules.DNS = rules.dnsRules
+	verifyRules.Domains = rules.domainRules
+	if rules.payloadRules != nil {
+		if err := rules.payloadRules.Compile(srcHandle.LinkType()); err != nil {
+			return 0, 0, iExitBadArguments, err
+		}
+		verifyRules.Payload = rules.payloadRules
+	}
+	verifyRules.Scrub = rules.scrubRules
+	verifyRules.Tunnels = rules.tunnelLayers
+	verifyRules.MPLS = rules.mplsRules
+	verifyRules.PPPoE = rules.pppoeRules
+	if rules.fieldRules != nil {
+		if err := rules.fieldRules.Compile(srcHandle.LinkType()); err != nil {
+			return 0, 0, iExitBadArguments, err
+		}
+		verifyRules.Fields = rules.fieldRules
 	}
 
-	// Make sure if the user supplies a Layer3 address, that they also supply the other
-	if (*sOptIPv4Address != "" && *sOptIPv4AddressNew == "") || (*sOptIPv4AddressNew != "" && *sOptIPv4Address == "") {
-		fmt.Println("rewritecap, copyright Bret Jordan, 2015")
-		fmt.Println("Version:", sVersion)
-		fmt.Println("")
-		getopt.Usage()
-		os.Exit(0)
+	iPackets := 0
+	iDifferent := 0
+	iShown := 0
+	for {
+		srcData, srcCaptureInfo, srcErr := srcHandle.ReadPacketData()
+		newData, newCaptureInfo, newErr := newHandle.ReadPacketData()
+		if srcErr != nil || newErr != nil {
+			bSrcDone := srcErr == io.EOF || srcErr == io.ErrUnexpectedEOF
+			bNewDone := newErr == io.EOF || newErr == io.ErrUnexpectedEOF
+			switch {
+			case srcErr != nil && !bSrcDone:
+				return iPackets, iDifferent, iExitUnreadableInput, srcErr
+			case newErr != nil && !bNewDone:
+				return iPackets, iDifferent, iExitUnreadableInput, newErr
+			case srcErr == nil:
+				fmt.Println("The new file ends after", iPackets, "packets but the source file has more")
+				iDifferent++
+			case newErr == nil:
+				fmt.Println("The source file ends after", iPackets, "packets but the new file has more")
+				iDifferent++
+			}
+			return iPackets, iDifferent, 0, nil
+		}
+		iPackets++
+
+		// A packet that can not be decoded has no headers the rules could have
+		// changed, so it is compared byte for byte
+		f, err := decodeFrame(srcData, srcHandle.LinkType())
+		if err != nil {
+			f = &frame.Frame{Data: srcData, NetworkOffset: -1, TransportOffset: -1, ICMPOffset: -1, IPPayloadOffset: -1}
+		}
+
+		differences := verify.ComparePackets(iPackets, f, newData, srcCaptureInfo, newCaptureInfo, verifyRules)
+		if len(differences) > 0 {
+			iDifferent++
+		}
+		for _, difference := range differences {
+			if iShown < iMaxShownDifferences {
+				fmt.Println(difference)
+			}
+			iShown++
+		}
 	}
-} //checkCommandLineOptions()
+} // verifyFiles()
+
+//
+// --------------------------------------------------------------------------------
+// comparePackets()
+// --------------------------------------------------------------------------------
+// Find the fields that are different between the original packet and the
+// rewritten one, which has a different link type once it is wrapped in a
+// tunnel.  Only the timestamp is compared if the headers can not be found.
+func comparePackets(original, data []byte, originalCaptureInfo, ci gopacket.CaptureInfo, linkType, newLinkType layers.LinkType) []diff.Change {
+	changes := diff.CompareCaptureInfo(originalCaptureInfo, ci)
+
+	oldFrame, err := decodeFrame(original, linkType)
+	if err != nil {
+		return changes
+	}
+	newFrame, err := decodeFrame(data, newLinkType)
+	if err != nil {
+		return changes
+	}
+	return append(diff.CompareFrames(oldFrame, newFrame), changes...)
+} // comparePackets()
+
+//
+// --------------------------------------------------------------------------------
+// rewritePacket()
+// --------------------------------------------------------------------------------
+// Apply all of the requested changes to a single packet.  If the packet turns
+// out to be malformed an error wrapping common.ErrMalformedPacket is returned
+// and any changes that were made before the problem was found are left in
+// place.  The headers that were found are returned so they can be counted, this
+// is nil if the packet could not be decoded at all.  The data of the frame that
+// is returned is a new slice if a tunnel was stripped off or a DNS, domain or
+// payload rewrite or the scrub changed the length of the packet, in which case
+// the number of bytes a TCP payload grew by is returned as well.
+func rewritePacket(data []byte, ci *gopacket.CaptureInfo, rules *rewriteRules, counters *packetCounters) (*frame.Frame, int, error) {
+	// The payload and IP field filters have to see the packet before anything
+	// is changed
+	bPayloadFilter := rules.payloadRules != nil && rules.payloadRules.MatchesFilter(*ci, data)
+	bFieldFilter := rules.fieldRules != nil && rules.fieldRules.MatchesFilter(*ci, data)
+
+	//
+	// ---------------------------------------------------------------------
+	// Change timestamps in the PCAP header as needed
+	// ---------------------------------------------------------------------
+	originalTimestamp := ci.Timestamp
+	if rules.iDiffYear != 0 || rules.iDiffMonth != 0 || rules.iDiffDay != 0 {
+		header.ChangeCaptureInfoDate(ci, rules.iDiffYear, rules.iDiffMonth, rules.iDiffDay)
+	}
+
+	// Allow for multiple time shifts to be passed at once
+	for _, amountOfTimeChange := range rules.timeShifts {
+		header.ChangeCaptureInfoTimeOfDay(ci, amountOfTimeChange)
+	}
+	if !ci.Timestamp.Equal(originalTimestamp) {
+		counters.iTimestampRewriteCounter++
+	}
+
+	f, err := decodeFrame(data, rules.linkType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Strip the outer headers off a tunnel first, so the rest of the rules
+	// are applied to the packet it carries
+	// ---------------------------------------------------------------------
+	if rules.bDecap {
+		if decapsulated := tunnel.Decapsulate(f); decapsulated != nil {
+			inner, err := decodeFrame(decapsulated, rules.linkType)
+			if err != nil {
+				return f, 0, err
+			}
+			counters.iDecapCounter++
+			ci.Length -= len(f.Data) - len(decapsulated)
+			ci.CaptureLength = len(decapsulated)
+			f = inner
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Pop the MPLS label stack, or change its labels
+	// ---------------------------------------------------------------------
+	if rules.bMPLSPop {
+		if popped := mpls.Pop(f); popped != nil {
+			inner, err := decodeFrame(popped, rules.linkType)
+			if err != nil {
+				return f, 0, err
+			}
+			counters.iMPLSPopCounter++
+			ci.Length -= len(f.Data) - len(popped)
+			ci.CaptureLength = len(popped)
+			f = inner
+		}
+	}
+	if rules.mplsRules != nil {
+		if iStart, iEnd := mpls.Stack(f); iStart >= 0 && rules.mplsRules.ReplaceLabels(f.Data[iStart:iEnd]) > 0 {
+			counters.iMPLSLabelRewriteCounter++
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Change the PPPoE session ID
+	// ---------------------------------------------------------------------
+	if rules.pppoeRules != nil {
+		if iOffset := pppoe.Header(f); iOffset >= 0 && rules.pppoeRules.ReplaceSession(f.Data[iOffset:]) {
+			counters.iPPPoESessionCounter++
+		}
+	}
+
+	// Segmentation offload can leave the IP length at zero, it is set first
+	// so the payload can be found
+	if rules.iResegmentMTU > 0 {
+		segment.FixLength(f)
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Change the TTL, DSCP, ECN and flow label of the IP header.  The hosts
+	// are matched before the addresses are rewritten, and the IP
+	// identification is changed later on by the writer.
+	// ---------------------------------------------------------------------
+	if bFieldFilter && f.IPVersion != 0 && f.NetworkOffset >= 0 {
+		ipHeader := f.Data[f.NetworkOffset:]
+		if rules.fieldRules.MatchesHosts(ipHeader, f.IPVersion) {
+			bChanged, err := rules.fieldRules.ReplaceFields(ipHeader, f.IPVersion)
+			if err != nil {
+				return f, 0, err
+			}
+			if bChanged {
+				counters.iIPFieldRewriteCounter++
+			}
+			if rules.fieldRules.ChangesID(ipHeader, f.IPVersion) {
+				counters.iIPIDRewriteCounter++
+			}
+		}
+	}
+
+	if f.LinkType == layers.LinkTypeEthernet {
+		countEthernetFrame(f, counters)
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Change the MAC and IP addresses of the packet and the addresses inside
+	// DHCP and DHCPv6 messages.  For a tunnel the outer headers are left
+	// alone if only the inner ones should change.
+	// ---------------------------------------------------------------------
+	iInner, inner := tunnel.Inner(f)
+	if inner == nil || rules.tunnelLayers != tunnel.LayersInner {
+		if err := rewriteHeaders(f, rules, counters); err != nil {
+			return f, 0, err
+		}
+		if err := rewriteDHCP(f, rules, counters); err != nil {
+			return f, 0, err
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Change the addresses of the packet carried by a tunnel
+	// ---------------------------------------------------------------------
+	if inner != nil && rules.tunnelLayers != tunnel.LayersOuter {
+		if err := rewriteTunnel(f, iInner, inner, rules, counters); err != nil {
+			return f, 0, err
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Change the addresses and names inside DNS messages, and the names in
+	// HTTP requests and TLS ClientHellos
+	// ---------------------------------------------------------------------
+	iPayloadDelta := 0
+	if rules.dnsRules != nil {
+		iPayloadDelta += rewriteDNS(f, ci, rules.dnsRules, counters)
+	}
+	if rules.domainRules != nil {
+		iPayloadDelta += rewriteDomains(f, ci, rules.domainRules, counters)
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Replace the strings the user asked for in the payload
+	// ---------------------------------------------------------------------
+	if bPayloadFilter {
+		iPayloadDelta += replaceStrings(f, ci, rules.payloadRules, counters)
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Scrub the payload last, it replaces whatever the rules above did
+	// ---------------------------------------------------------------------
+	if rules.scrubRules != nil {
+		iPayloadDelta += scrubPayload(f, ci, rules.scrubRules, counters)
+	}
+	return f, iPayloadDelta, nil
+} // rewritePacket()
+
+//
+// --------------------------------------------------------------------------------
+// countEthernetFrame()
+// --------------------------------------------------------------------------------
+// Count the 802.1Q, 802.1QinQ and ARP frames
+func countEthernetFrame(f *frame.Frame, counters *packetCounters) {
+	if f.VLANOffset == 4 {
+		if iDebug == 1 {
+			fmt.Println("DEBUG: Found an 802.1Q packet")
+		}
+		counters.i802dot1QCounter++
+	}
+
+	if f.VLANOffset == 8 {
+		if iDebug == 1 {
+			fmt.Println("DEBUG: Found an 802.1QinQ packet")
+		}
+		counters.i802dot1QinQCounter++
+	}
+
+	if f.EthernetType == layers.EthernetTypeARP {
+		if iDebug == 1 {
+			fmt.Println("DEBUG: Found an ARP packet")
+		}
+		counters.iArpCounter++
+	}
+} // countEthernetFrame()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteHeaders()
+// --------------------------------------------------------------------------------
+// Change the MAC addresses, the IP addresses and the addresses the IP header
+// quoted in an ICMP error message.  This is done for the outer packet and for
+// the packet carried by a tunnel.
+func rewriteHeaders(f *frame.Frame, rules *rewriteRules, counters *packetCounters) error {
+	//
+	// ---------------------------------------------------------------------
+	// Everything at layer 2 only applies to ethernet frames
+	// ---------------------------------------------------------------------
+	if f.LinkType == layers.LinkTypeEthernet {
+		if err := rewriteEthernetFrame(f, rules, counters); err != nil {
+			return err
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Change Layer 3 information
+	// ---------------------------------------------------------------------
+	if *sOptIPv4Address != "" && *sOptIPv4AddressNew != "" && f.IPVersion == 4 {
+		if f.NetworkOffset < 0 {
+			return fmt.Errorf("%w: IPv4 header could not be found", common.ErrMalformedPacket)
+		}
+		err := rewriteIPAddresses(f, 12, 4, &counters.iIPv4RewriteCounter, func(ipHeader []byte) error {
+			return layer3.ReplaceIPv4HeaderAddresses(ipHeader, rules.userSuppliedIPv4Address, rules.userSuppliedIPv4AddressNew)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if *sOptIPv6Address != "" && *sOptIPv6AddressNew != "" && f.IPVersion == 6 {
+		if f.NetworkOffset < 0 {
+			return fmt.Errorf("%w: IPv6 header could not be found", common.ErrMalformedPacket)
+		}
+		err := rewriteIPAddresses(f, 8, 16, &counters.iIPv6RewriteCounter, func(ipHeader []byte) error {
+			return layer3.ReplaceIPv6HeaderAddresses(ipHeader, rules.userSuppliedIPv6Address, rules.userSuppliedIPv6AddressNew)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Change the addresses of the packet quoted in an ICMP error message
+	// ---------------------------------------------------------------------
+	return rewriteICMP(f, rules, counters)
+} // rewriteHeaders()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteEthernetFrame()
+// --------------------------------------------------------------------------------
+// Change the MAC addresses and fix up ARP packets
+func rewriteEthernetFrame(f *frame.Frame, rules *rewriteRules, counters *packetCounters) error {
+	// ---------------------------------------------------------------------
+	// Change layer 2 MAC addresses as needed
+	// ---------------------------------------------------------------------
+	if *sOptMacAddress != "" && *sOptMacAddressNew != "" {
+		err := countRewrite(f.Data, 12, &counters.iMacRewriteCounter, func() error {
+			return layer2.ReplaceFrameMacAddresses(f.Data, rules.userSuppliedMacAddress, rules.userSuppliedMacAddressNew)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Look for an ARP frame.  If it is an ARP packet, we may need update the
+	// internal MAC and IP addresses.
+	// ---------------------------------------------------------------------
+	if f.EthernetType == layers.EthernetTypeARP {
+		arpHeader := f.Data[f.NetworkOffset:]
+
+		// Fix the MAC addresses in the ARP payload if we are fixing MAC addresses at layer 2
+		if *sOptMacAddress != "" && *sOptMacAddressNew != "" {
+			err := countRewrite(arpHeader, 28, &counters.iArpMacRewriteCounter, func() error {
+				return arp.ReplaceArpHeaderMacAddresses(arpHeader, rules.userSuppliedMacAddress, rules.userSuppliedMacAddressNew)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Fix the IP addresses in the ARP payload if we are changing layer 3 information
+		if *sOptIPv4Address != "" && *sOptIPv4AddressNew != "" {
+			err := countRewrite(arpHeader, 28, &counters.iArpIPv4RewriteCounter, func() error {
+				return arp.ReplaceArpHeaderIPv4Addresses(arpHeader, rules.userSuppliedIPv4Address, rules.userSuppliedIPv4AddressNew)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	} // End ARP Packets
+	return nil
+} // rewriteEthernetFrame()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteTunnel()
+// --------------------------------------------------------------------------------
+// Change the MAC and IP addresses of the packet carried by a tunnel, which starts
+// iInner bytes in to the outer frame.  A tunnel inside a tunnel is followed all
+// the way down, and only the innermost packet is changed if the rules are just
+// for the inner headers.  The outer UDP or GRE checksum is fixed to match.  The
+// rewrites of the inner packet are counted once as a tunnel rewrite rather than
+// by what they changed.
+func rewriteTunnel(f *frame.Frame, iInner int, inner *frame.Frame, rules *rewriteRules, counters *packetCounters) error {
+	before := append([]byte(nil), inner.Data...)
+	var innerCounters packetCounters
+
+	var err error
+	iNested, nested := tunnel.Inner(inner)
+	if nested == nil || rules.tunnelLayers == tunnel.LayersBoth {
+		err = rewriteHeaders(inner, rules, &innerCounters)
+	}
+	if err == nil && nested != nil {
+		err = rewriteTunnel(inner, iNested, nested, rules, &innerCounters)
+	}
+
+	if !bytes.Equal(before, inner.Data) {
+		counters.iTunnelCounter++
+		tunnel.UpdateChecksum(f, iInner, before, inner.Data)
+	}
+	return err
+} // rewriteTunnel()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteIPAddresses()
+// --------------------------------------------------------------------------------
+// Run one of the IP address rewrites and add one to the counter if it changed the
+// source or destination address.  The TCP, UDP or ICMPv6 checksum covers the
+// addresses so it is updated to match.  The addresses start iAddressOffset bytes
+// in to the IP header and are iAddressLength bytes long.
+func rewriteIPAddresses(f *frame.Frame, iAddressOffset, iAddressLength int, counter *int, rewrite func([]byte) error) error {
+	ipHeader := f.Data[f.NetworkOffset:]
+	iEnd := iAddressOffset + 2*iAddressLength
+
+	var before [32]byte
+	iCopied := 0
+	if len(ipHeader) >= iEnd {
+		iCopied = copy(before[:], ipHeader[iAddressOffset:iEnd])
+	}
+
+	if err := rewrite(ipHeader); err != nil {
+		return err
+	}
+	if iCopied == 0 || bytes.Equal(before[:iCopied], ipHeader[iAddressOffset:iEnd]) {
+		return nil
+	}
+	*counter++
+
+	if f.TransportOffset >= 0 {
+		checksum.UpdateTransport(f.Data[f.TransportOffset:], f.IPProtocol, 0, before[:iCopied], ipHeader[iAddressOffset:iEnd])
+	}
+	if f.ICMPOffset >= 0 && f.IPProtocol == layers.IPProtocolICMPv6 {
+		checksum.UpdateTransport(f.Data[f.ICMPOffset:], f.IPProtocol, 0, before[:iCopied], ipHeader[iAddressOffset:iEnd])
+	}
+	return nil
+} // rewriteIPAddresses()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteDHCP()
+// --------------------------------------------------------------------------------
+// Change the MAC and IP addresses inside a DHCP or DHCPv6 message, the same way
+// the ARP payloads are fixed.  Messages that were cut short are left alone.
+func rewriteDHCP(f *frame.Frame, rules *rewriteRules, counters *packetCounters) error {
+	iStart, iEnd, iVersion := dhcp.Locate(f)
+	if iStart < 0 {
+		return nil
+	}
+
+	if *sOptMacAddress != "" && *sOptMacAddressNew != "" {
+		err := rewritePayload(f, iStart, iEnd, &counters.iDhcpMacRewriteCounter, func(dhcpHeader []byte) error {
+			if iVersion == 4 {
+				return dhcp.ReplaceDhcpHeaderMacAddresses(dhcpHeader, rules.userSuppliedMacAddress, rules.userSuppliedMacAddressNew)
+			}
+			return dhcp.ReplaceDhcpv6HeaderMacAddresses(dhcpHeader, rules.userSuppliedMacAddress, rules.userSuppliedMacAddressNew)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if iVersion == 4 && *sOptIPv4Address != "" && *sOptIPv4AddressNew != "" {
+		return rewritePayload(f, iStart, iEnd, &counters.iDhcpIPRewriteCounter, func(dhcpHeader []byte) error {
+			return dhcp.ReplaceDhcpHeaderIPv4Addresses(dhcpHeader, rules.userSuppliedIPv4Address, rules.userSuppliedIPv4AddressNew)
+		})
+	}
+	if iVersion == 6 && *sOptIPv6Address != "" && *sOptIPv6AddressNew != "" {
+		return rewritePayload(f, iStart, iEnd, &counters.iDhcpIPRewriteCounter, func(dhcpHeader []byte) error {
+			return dhcp.ReplaceDhcpv6HeaderIPv6Addresses(dhcpHeader, rules.userSuppliedIPv6Address, rules.userSuppliedIPv6AddressNew)
+		})
+	}
+	return nil
+} // rewriteDHCP()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteICMP()
+// --------------------------------------------------------------------------------
+// Change the IP addresses in the header quoted by an ICMP or ICMPv6 error
+// message, so the error still matches the connection it belongs to.  The
+// checksums inside the quoted packet and the ICMP checksum are fixed as well.
+func rewriteICMP(f *frame.Frame, rules *rewriteRules, counters *packetCounters) error {
+	iStart, iEnd := icmp.Locate(f)
+	if iStart < 0 {
+		return nil
+	}
+
+	message := f.Data[iStart:iEnd]
+	before := append([]byte(nil), message...)
+	var err error
+	if f.IPVersion == 4 && *sOptIPv4Address != "" && *sOptIPv4AddressNew != "" {
+		err = icmp.ReplaceQuotedIPv4Addresses(message, rules.userSuppliedIPv4Address, rules.userSuppliedIPv4AddressNew)
+	}
+	if f.IPVersion == 6 && *sOptIPv6Address != "" && *sOptIPv6AddressNew != "" {
+		err = icmp.ReplaceQuotedIPv6Addresses(message, rules.userSuppliedIPv6Address, rules.userSuppliedIPv6AddressNew)
+	}
+	if !bytes.Equal(before, message) {
+		counters.iIcmpIPRewriteCounter++
+	}
+	return err
+} // rewriteICMP()
+
+//
+// --------------------------------------------------------------------------------
+// rewritePayload()
+// --------------------------------------------------------------------------------
+// Run one of the payload rewrites on the bytes from iStart to iEnd and add one to
+// the counter if it changed any of them.  The TCP or UDP checksum is updated to
+// match, even if the rewrite stopped part way with an error.
+func rewritePayload(f *frame.Frame, iStart, iEnd int, counter *int, rewrite func([]byte) error) error {
+	payload := f.Data[iStart:iEnd]
+	before := append([]byte(nil), payload...)
+
+	err := rewrite(payload)
+	if !bytes.Equal(before, payload) {
+		*counter++
+		checksum.UpdateTransport(f.Data[f.TransportOffset:], f.IPProtocol, iStart-f.TransportOffset, before, payload)
+	}
+	return err
+} // rewritePayload()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteDNS()
+// --------------------------------------------------------------------------------
+// Change the addresses and names in a DNS message over UDP or TCP.  A message may
+// change length, see replacePayload.  Payloads on port 53 that are not DNS are
+// left alone.  The number of bytes a TCP payload grew by is returned.
+func rewriteDNS(f *frame.Frame, ci *gopacket.CaptureInfo, rules *dns.Rules, counters *packetCounters) int {
+	iStart, iEnd, bTCP := dns.Locate(f)
+	if iStart < 0 {
+		return 0
+	}
+	original := append([]byte(nil), f.Data[iStart:iEnd]...)
+
+	var iChanges int
+	var err error
+	var payload []byte
+	if bTCP {
+		payload, iChanges, err = dns.RewriteTCPPayload(f.Data[iStart:iEnd], rules)
+	} else {
+		payload, iChanges, err = dns.RewriteMessage(f.Data[iStart:iEnd], rules, true)
+	}
+	if err != nil && iDebug == 1 {
+		fmt.Println("DEBUG: Payload on the DNS port was not rewritten:", err)
+	}
+	if iChanges == 0 {
+		return 0
+	}
+	counters.iDNSRewriteCounter++
+	return replacePayload(f, ci, iStart, iEnd, original, payload)
+} // rewriteDNS()
+
+//
+// --------------------------------------------------------------------------------
+// rewriteDomains()
+// --------------------------------------------------------------------------------
+// Change the host name in an HTTP request or a TLS ClientHello at the start of a
+// TCP payload.  DNS over TCP is left to rewriteDNS.  The number of bytes the
+// payload grew by is returned.
+func rewriteDomains(f *frame.Frame, ci *gopacket.CaptureInfo, rules *domain.Rules, counters *packetCounters) int {
+	if f.IPProtocol != layers.IPProtocolTCP {
+		return 0
+	}
+	if iSrcPort, iDstPort := f.Ports(); iSrcPort == dns.Port || iDstPort == dns.Port {
+		return 0
+	}
+	iStart, iEnd := f.Payload()
+	if iStart < 0 || iStart == iEnd {
+		return 0
+	}
+
+	payload, iChanges := domain.RewriteTCPPayload(f.Data[iStart:iEnd], rules)
+	if iChanges == 0 {
+		return 0
+	}
+	counters.iDomainRewriteCounter++
+	return replacePayload(f, ci, iStart, iEnd, append([]byte(nil), f.Data[iStart:iEnd]...), payload)
+} // rewriteDomains()
+
+//
+// --------------------------------------------------------------------------------
+// replaceStrings()
+// --------------------------------------------------------------------------------
+// Replace the strings from the payload rules in a TCP or UDP payload.  The number
+// of bytes a TCP payload grew by is returned.
+func replaceStrings(f *frame.Frame, ci *gopacket.CaptureInfo, rules *payload.Rules, counters *packetCounters) int {
+	if !rules.AppliesTo(f) {
+		return 0
+	}
+	iStart, iEnd := f.Payload()
+	if iStart < 0 || iStart == iEnd {
+		return 0
+	}
+
+	newPayload, iChanges := rules.Replace(f.Data[iStart:iEnd])
+	if iChanges == 0 {
+		return 0
+	}
+	counters.iPayloadRewriteCounter++
+	return replacePayload(f, ci, iStart, iEnd, append([]byte(nil), f.Data[iStart:iEnd]...), newPayload)
+} // replaceStrings()
+
+//
+// --------------------------------------------------------------------------------
+// scrubPayload()
+// --------------------------------------------------------------------------------
+// Fill a TCP or UDP payload with zeros or random bytes, or cut it off after the
+// header.  A truncated packet keeps the lengths in its IP and UDP headers unless
+// the rules say to adjust them, in which case it is handled by replacePayload.
+// A payload that was already cut short by the capture is always cut without
+// changing the lengths as the checksum can not be worked out.  The number of
+// bytes a TCP payload grew by is returned.
+func scrubPayload(f *frame.Frame, ci *gopacket.CaptureInfo, rules *scrub.Rules, counters *packetCounters) int {
+	iStart, iEnd, bComplete := rules.Locate(f)
+	if iStart < 0 {
+		return 0
+	}
+	counters.iScrubCounter++
+
+	original := append([]byte(nil), f.Data[iStart:iEnd]...)
+	newPayload := rules.Scrub(original)
+	if len(newPayload) == len(original) {
+		copy(f.Data[iStart:iEnd], newPayload)
+		checksum.UpdateTransport(f.Data[f.TransportOffset:], f.IPProtocol, iStart-f.TransportOffset, original, newPayload)
+		return 0
+	}
+	if bComplete && rules.AdjustLengths {
+		return replacePayload(f, ci, iStart, iEnd, original, newPayload)
+	}
+
+	// Like a capture with a short snap length the packet still says how long it
+	// was on the wire
+	f.Data = f.Data[:iStart]
+	ci.CaptureLength = iStart
+	return 0
+} // scrubPayload()
+
+//
+// --------------------------------------------------------------------------------
+// replacePayload()
+// --------------------------------------------------------------------------------
+// Put a new TCP or UDP payload in place of the one from iStart to iEnd, original
+// is a copy of the old payload as the new one may have been written over it.  If
+// it kept its length the checksum is updated in place.  Otherwise a new slice is
+// used for the frame data and the lengths in the PPPoE, IP and UDP headers and
+// the capture info are fixed.  The IPv4 header checksum is worked out again, and so
+// is the TCP or UDP checksum if it was right to start with.  The number of bytes
+// the payload grew by is returned, a payload that would not fit in an IP packet
+// is not changed.
+func replacePayload(f *frame.Frame, ci *gopacket.CaptureInfo, iStart, iEnd int, original, payload []byte) int {
+	segment := f.Data[f.TransportOffset:]
+	if len(payload) == len(original) {
+		copy(f.Data[iStart:iEnd], payload)
+		checksum.UpdateTransport(segment, f.IPProtocol, iStart-f.TransportOffset, original, payload)
+		return 0
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Make sure the new lengths fit, an IPv6 jumbogram has no length to fix
+	// ---------------------------------------------------------------------
+	iDelta := len(payload) - len(original)
+	ipHeader := f.Data[f.NetworkOffset:]
+	iLengthOffset := 2
+	if f.IPVersion == 6 {
+		iLengthOffset = 4
+	}
+	iIPLength := int(ipHeader[iLengthOffset])<<8 | int(ipHeader[iLengthOffset+1])
+	if iIPLength == 0 || iIPLength+iDelta > 0xffff {
+		copy(f.Data[iStart:iEnd], original)
+		if iDebug == 1 {
+			fmt.Println("DEBUG: New payload does not fit in the IP packet, leaving it as it was")
+		}
+		return 0
+	}
+
+	//
+	// ---------------------------------------------------------------------
+	// Build the new packet around the longer or shorter payload
+	// ---------------------------------------------------------------------
+	data := make([]byte, 0, len(f.Data)+iDelta)
+	data = append(data, f.Data[:iStart]...)
+	data = append(data, payload...)
+	data = append(data, f.Data[iEnd:]...)
+
+	ipHeader = data[f.NetworkOffset:]
+	segment = data[f.TransportOffset : iEnd+iDelta]
+	addToLength(ipHeader, iLengthOffset, iDelta)
+	if iPPPoE := pppoe.Header(f); iPPPoE >= 0 && f.EthernetType == layers.EthernetTypePPPoESession {
+		addToLength(data[iPPPoE:], 4, iDelta)
+	}
+	if f.IPVersion == 4 {
+		iChecksum := checksum.IPv4Header(ipHeader)
+		ipHeader[10] = byte(iChecksum >> 8)
+		ipHeader[11] = byte(iChecksum)
+	}
+
+	iChecksumOffset := 16
+	if f.IPProtocol == layers.IPProtocolUDP {
+		addToLength(segment, 4, iDelta)
+		iChecksumOffset = 6
+	}
+
+	// The checksum is only worked out again if it was right to start with, a
+	// UDP checksum of 0 means the sender did not use one
+	iOldChecksum := uint16(segment[iChecksumOffset])<<8 | uint16(segment[iChecksumOffset+1])
+	if iOldChecksum != 0 || f.IPProtocol == layers.IPProtocolTCP {
+		src, dst := ipAddresses(f.Data[f.NetworkOffset:], f.IPVersion)
+		oldSegment := append(append([]byte(nil), f.Data[f.TransportOffset:iStart]...), original...)
+		if checksum.Transport(src, dst, f.IPProtocol, oldSegment) == 0 {
+			segment[iChecksumOffset], segment[iChecksumOffset+1] = 0, 0
+			iChecksum := checksum.Transport(src, dst, f.IPProtocol, segment)
+			if iChecksum == 0 && f.IPProtocol == layers.IPProtocolUDP {
+				iChecksum = 0xffff
+			}
+			segment[iChecksumOffset] = byte(iChecksum >> 8)
+			segment[iChecksumOffset+1] = byte(iChecksum)
+		}
+	}
+
+	ci.CaptureLength += iDelta
+	ci.Length += iDelta
+	f.Data = data
+	if f.IPProtocol != layers.IPProtocolTCP {
+		return 0
+	}
+	return iDelta
+} // replacePayload()
+
+// addToLength adds iDelta to the 16 bit length at iOffset in a header
+func addToLength(header []byte, iOffset, iDelta int) {
+	iLength := int(header[iOffset])<<8 | int(header[iOffset+1]) + iDelta
+	header[iOffset] = byte(iLength >> 8)
+	header[iOffset+1] = byte(iLength)
+}
+
+// ipAddresses finds the source and destination addresses in an IP header
+func ipAddresses(ipHeader []byte, iIPVersion int) ([]byte, []byte) {
+	if iIPVersion == 4 {
+		return ipHeader[12:16], ipHeader[16:20]
+	}
+	return ipHeader[8:24], ipHeader[24:40]
+}
+
+//
+// --------------------------------------------------------------------------------
+// countRewrite()
+// --------------------------------------------------------------------------------
+// Run one of the rewrites and add one to the counter if it changed any of the
+// first iLength bytes of the header, iLength can be at most 28
+func countRewrite(header []byte, iLength int, counter *int, rewrite func() error) error {
+	var before [28]byte
+	iCopied := copy(before[:iLength], header)
+
+	if err := rewrite(); err != nil {
+		return err
+	}
+	if !bytes.Equal(before[:iCopied], header[:iCopied]) {
+		*counter++
+	}
+	return nil
+} // countRewrite()
+
+//
+// --------------------------------------------------------------------------------
+// decodeFrame()
+// --------------------------------------------------------------------------------
+// Find the headers in the packet.  In fast mode this is done with the lightweight
+// parser and gopacket is only used for link types the parser does not support.
+func decodeFrame(data []byte, linkType layers.LinkType) (*frame.Frame, error) {
+	if *bOptFast {
+		f, err := frame.Parse(data, linkType)
+		if err != frame.ErrNotSupported {
+			return f, err
+		}
+	}
+
+	// The packet data already belongs to this packet so there is no need for
+	// gopacket to make another copy of it
+	packet := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{NoCopy: true})
+	return frame.FromPacket(packet, linkType)
+} // decodeFrame()
+
+//
+// --------------------------------------------------------------------------------
+// checkCommandLineOptions()
+// --------------------------------------------------------------------------------
+// Verify that all of the command line options meet the required dependencies
+func checkCommandLineOptions() {
+	if *bOptVer {
+		fmt.Println("rewritecap, copyright Bret Jordan, 2015")
+		fmt.Println("Version:", sVersion)
+		fmt.Println("")
+		os.Exit(0)
+	}
+
+	if *bOptHelp {
+		fmt.Println("rewritecap, copyright Bret Jordan, 2015")
+		fmt.Println("Version:", sVersion)
+		fmt.Println("")
+		getopt.Usage()
+		os.Exit(0)
+	}
+
+	if *sOptPcapSrcFilename == "" || (*sOptPcapNewFilename == "" && !*bOptDryRun) {
+		usageError("")
+	}
+
+	if *sOptPcapSrcFilename == *sOptPcapNewFilename && !*bOptDryRun {
+		usageError("Filenames are the same.")
+	}
+
+	if *iOptWorkers < 1 {
+		usageError("The number of workers must be at least 1.")
+	}
+
+	if *bOptVerify && *bOptDryRun {
+		usageError("The verify and dry-run options can not be used together.")
+	}
+
+	if *sOptOnMalformed != "pass" && *sOptOnMalformed != "drop" && *sOptOnMalformed != "abort" {
+		usageError("The on-malformed option must be one of pass, drop or abort.")
+	}
+
+	if (*sOptScrubKeep != "" || *sOptScrubLengths != "keep") && *sOptScrub == "" {
+		usageError("The scrub-keep and scrub-lengths options need the scrub option.")
+	}
+
+	if (*sOptEncapSrcMac != "" || *sOptEncapDstMac != "" || *sOptEncapSrcIP != "" || *sOptEncapDstIP != "" || *iOptEncapVNI != 0) && *sOptEncap == "" {
+		usageError("The encap-src-mac, encap-dst-mac, encap-src-ip, encap-dst-ip and encap-vni options need the encap option.")
+	}
+
+	bImpair := *sOptImpairDrop != "" || *sOptImpairDuplicate != "" || *sOptImpairReorder != "" || *sOptImpairJitter != "" || *sOptImpairCorrupt != ""
+	if *bOptVerify && (*bOptDecap || *sOptEncap != "" || *bOptMPLSPop || *iOptResegment != 0 || *bOptReassemble || *bOptDedup || *bOptSort || bImpair) {
+		usageError("The verify option can not be used with the decap, encap, mpls-pop, resegment, reassemble, dedup, sort or impair options.")
+	}
+
+	if (*iOptImpairReorderWindow != 3 || *sOptImpairJitterDistribution != "uniform" || *iOptImpairSeed != 1) && !bImpair {
+		usageError("The impair-reorder-window, impair-jitter-distribution and impair-seed options need at least one of the impair-drop, impair-duplicate, impair-reorder, impair-jitter or impair-corrupt options.")
+	}
+
+	if *iOptSortMemory != 512 && !*bOptSort {
+		usageError("The sort-memory option needs the sort option.")
+	}
+
+	if *sOptDedupWindow != "50ms" && !*bOptDedup {
+		usageError("The dedup-window option needs the dedup option.")
+	}
+
+	if (*sOptRefragment != "" || *sOptReassembleTimeout != "30s") && !*bOptReassemble {
+		usageError("The refragment and reassemble-timeout options need the reassemble option.")
+	}
+
+	if (*sOptPayloadPorts != "" || *sOptPayloadFilter != "") && len(payloadRuleSpecs) == 0 {
+		usageError("The payload-ports and payload-filter options need at least one payload-replace rule.")
+	}
+
+	if (*sOptIPFieldsHosts != "" || *sOptIPFieldsFilter != "") && *sOptTTL == "" && *sOptDSCP == "" && *sOptECN == "" && *sOptIPID == "" && *sOptFlowLabel == "" {
+		usageError("The ip-fields-hosts and ip-fields-filter options need at least one of the ttl, dscp, ecn, ip-id or flow-label options.")
+	}
+
+	// Make sure if the user supplies a Layer2 address, that they also supply the other
+	if (*sOptMacAddress != "" && *sOptMacAddressNew == "") || (*sOptMacAddressNew != "" && *sOptMacAddress == "") {
+		usageError("")
+	}
+
+	// Make sure if the user supplies a Layer3 address, that they also supply the other
+	if (*sOptIPv4Address != "" && *sOptIPv4AddressNew == "") || (*sOptIPv4AddressNew != "" && *sOptIPv4Address == "") {
+		usageError("")
+	}
+
+	if (*sOptIPv6Address != "" && *sOptIPv6AddressNew == "") || (*sOptIPv6AddressNew != "" && *sOptIPv6Address == "") {
+		usageError("")
+	}
+} //checkCommandLineOptions()
+
+//
+// --------------------------------------------------------------------------------
+// usageError()
+// --------------------------------------------------------------------------------
+// Print the banner and what is wrong with the command line options, or the usage
+// when there is no message, and exit
+func usageError(sMessage string) {
+	fmt.Println("rewritecap, copyright Bret Jordan, 2015")
+	fmt.Println("Version:", sVersion)
+	fmt.Println("")
+	if sMessage == "" {
+		getopt.Usage()
+	} else {
+		fmt.Println(sMessage)
+	}
+	os.Exit(iExitBadArguments)
+} // usageError()
+
+//
+// --------------------------------------------------------------------------------
+// exitWithError()
+// --------------------------------------------------------------------------------
+// Print the error and exit with the exit code for that class of failure
+func exitWithError(err error, iExitCode int) {
+	fmt.Println(err)
+	os.Exit(iExitCode)
+} // exitWithError()
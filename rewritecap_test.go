@@ -1,27 +1,987 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/jordan2175/rewritecap/lib/pcaptest"
+	"github.com/jordan2175/rewritecap/lib/stats"
+	"github.com/pborman/getopt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-func TestAreByteSlicesEqual(t *testing.T) {
-	b1 := []byte{10, 20, 30, 40, 50, 60}
-	b2 := []byte{10, 20, 30, 40, 50, 60}
-	b3 := []byte{10, 20, 35, 40, 50, 60}
-	b4 := []byte{10, 20, 30, 40, 50, 60, 70}
+var bUpdate = flag.Bool("update", false, "Update the corpus and golden files in testdata")
 
-	test1a := areByteSlicesEqual(b1, b2)
-	if test1a != true {
-		t.Error("Test 1a: Expected true, got ", test1a)
+var sCorpusFilename = filepath.Join("testdata", "corpus.pcap")
+
+// The rewrites that are compared with the golden files in testdata/golden
+var goldenTests = []struct {
+	name string
+	args []string
+}{
+	{"mac", []string{"--mac", "68:A8:6D:18:36:92", "--mac-new", "22:33:44:55:66:77"}},
+	{"ip4", []string{"--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2"}},
+	{"ip6", []string{"--ip6", "2001:db8::32", "--ip6-new", "2001:db8::99"}},
+	{"date", []string{"-y", "2017", "-m", "3", "-d", "10", "--time-shift=2h,-3m"}},
+	{"domain", []string{"--domain-map", "example.com=customer.test"}},
+	{"all-drop", []string{"--mac", "68:A8:6D:18:36:92", "--mac-new", "22:33:44:55:66:77", "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "-y", "2017", "--on-malformed=drop"}},
+}
+
+// Every rewrite has to give the same result no matter how the packets are parsed
+// or how many workers there are
+var goldenModes = [][]string{
+	{"--workers=1"},
+	{"--fast", "--workers=1"},
+	{"--fast", "--workers=4"},
+	{"--workers=4"},
+}
+
+//
+// --------------------------------------------------------------------------------
+// setOptions()
+// --------------------------------------------------------------------------------
+// Reset every command line option to its default and then parse the arguments
+// the same way main() does
+func setOptions(t testing.TB, sSrcFilename, sNewFilename string, args ...string) {
+	getopt.Reset()
+	getopt.CommandLine.Parse(append([]string{"rewritecap", "-f", sSrcFilename, "-n", sNewFilename}, args...))
+}
+
+//
+// --------------------------------------------------------------------------------
+// runRewrite()
+// --------------------------------------------------------------------------------
+// Rewrite a file the same way main() does and return the counters
+func runRewrite(t testing.TB, sSrcFilename, sNewFilename string, args ...string) packetCounters {
+	setOptions(t, sSrcFilename, sNewFilename, args...)
+
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	counters, _, err := rewriteFile(sSrcFilename, sNewFilename, rules, stats.New(sSrcFilename, sNewFilename))
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	return counters
+}
+
+func TestCorpus(t *testing.T) {
+	if *bUpdate {
+		if err := pcaptest.WriteFile(sCorpusFilename, pcaptest.Corpus()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Make sure the corpus in testdata is the one the tests expect
+	sFilename := filepath.Join(t.TempDir(), "corpus.pcap")
+	if err := pcaptest.WriteFile(sFilename, pcaptest.Corpus()); err != nil {
+		t.Fatal(err)
+	}
+	compareFiles(t, sCorpusFilename, sFilename)
+}
+
+func TestGoldenFiles(t *testing.T) {
+	for _, tt := range goldenTests {
+		sGoldenFilename := filepath.Join("testdata", "golden", tt.name+".pcap")
+
+		for _, mode := range goldenModes {
+			sNewFilename := filepath.Join(t.TempDir(), tt.name+".pcap")
+			runRewrite(t, sCorpusFilename, sNewFilename, append(mode, tt.args...)...)
+
+			if *bUpdate {
+				data, err := ioutil.ReadFile(sNewFilename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(sGoldenFilename, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			compareFiles(t, sGoldenFilename, sNewFilename)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	sNewFilename := filepath.Join(t.TempDir(), "counters.pcap")
+	counters := runRewrite(t, sCorpusFilename, sNewFilename, "--mac", "68:A8:6D:18:36:92", "--mac-new", "22:33:44:55:66:77", "--on-malformed=drop")
+
+	expected := packetCounters{
+		iTotalPacketCounter: 23,
+		iArpCounter:         4,
+		i802dot1QCounter:    2,
+		i802dot1QinQCounter: 2,
+		iMalformedCounter:   2,
+		iDroppedCounter:     2,
+
+		iMacRewriteCounter:     22,
+		iArpMacRewriteCounter:  3,
+		iDhcpMacRewriteCounter: 2,
+	}
+	if counters != expected {
+		t.Errorf("Expected counters %+v, got %+v", expected, counters)
+	}
+}
+
+func TestMalformedAbort(t *testing.T) {
+	sNewFilename := filepath.Join(t.TempDir(), "abort.pcap")
+	setOptions(t, sCorpusFilename, sNewFilename, "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "--on-malformed=abort")
+
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	_, iExitCode, err := rewriteFile(sCorpusFilename, sNewFilename, rules, stats.New(sCorpusFilename, sNewFilename))
+	if err == nil || iExitCode != iExitMalformedPacket {
+		t.Errorf("Expected exit code %d, got %d (%v)", iExitMalformedPacket, iExitCode, err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	sNewFilename := filepath.Join(t.TempDir(), "dry-run.pcap")
+	counters := runRewrite(t, sCorpusFilename, sNewFilename, "--dry-run", "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2")
+
+	// Every IPv4 packet and every ARP packet that is long enough to hold the
+	// address is changed
+	if counters.iChangedCounter != 17 {
+		t.Errorf("Expected 17 changed packets, got %d", counters.iChangedCounter)
+	}
+	if _, err := os.Stat(sNewFilename); !os.IsNotExist(err) {
+		t.Error("A dry run should not write a new file")
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	sNewFilename := filepath.Join(t.TempDir(), "stats.pcap")
+	sStatsFilename := filepath.Join(t.TempDir(), "stats.json")
+	setOptions(t, sCorpusFilename, sNewFilename, "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "-y", "2017", "--on-malformed=drop")
+
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	summary := stats.New(sCorpusFilename, sNewFilename)
+	if _, _, err := rewriteFile(sCorpusFilename, sNewFilename, rules, summary); err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if err := summary.WriteFile(sStatsFilename); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(sStatsFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s stats.Summary
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.PacketsRead != 23 || s.PacketsWritten != 20 || s.Dropped != 3 || s.LinkType != "Ethernet" {
+		t.Errorf("Wrong packet counts: %+v", s)
+	}
+	if s.EthernetTypes["IPv4"] != 15 || s.EthernetTypes["ARP"] != 4 || s.EthernetTypes["IPv6"] != 3 {
+		t.Errorf("Wrong ethernet types: %v", s.EthernetTypes)
+	}
+	if s.IPProtocols["TCP"] != 9 || s.IPProtocols["UDP"] != 8 {
+		t.Errorf("Wrong IP protocols: %v", s.IPProtocols)
+	}
+	if s.Rewrites["ipv4"] != 14 || s.Rewrites["arp_ipv4"] != 3 || s.Rewrites["dhcp_ip"] != 1 || s.Rewrites["dns"] != 4 || s.Rewrites["timestamp"] != 23 || s.Rewrites["mac"] != 0 {
+		t.Errorf("Wrong rewrite counts: %v", s.Rewrites)
+	}
+	if !s.TimestampsBefore.First.Equal(pcaptest.StartTime) || s.TimestampsAfter.First.Year() != 2017 {
+		t.Errorf("Wrong timestamps: %+v %+v", s.TimestampsBefore, s.TimestampsAfter)
+	}
+}
+
+func TestDNS(t *testing.T) {
+	sNewFilename := filepath.Join(t.TempDir(), "dns.pcap")
+	counters := runRewrite(t, sCorpusFilename, sNewFilename, "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "--ip6", "2001:db8::32", "--ip6-new", "2001:db8::99")
+
+	// The A, AAAA and TCP answers and both reverse lookups are changed
+	if counters.iDNSRewriteCounter != 5 || counters.iIPv6RewriteCounter != 3 {
+		t.Errorf("Expected 5 DNS and 3 IPv6 rewrites, got %d and %d", counters.iDNSRewriteCounter, counters.iIPv6RewriteCounter)
 	}
 
-	test1b := areByteSlicesEqual(b1, b3)
-	if test1b != false {
-		t.Error("Test 1b: Expected false, got ", test1b)
+	// The reverse lookup name is shorter so the response was rebuilt, the new
+	// file still has to verify against the rules
+	setOptions(t, sCorpusFilename, sNewFilename, "--verify", "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "--ip6", "2001:db8::32", "--ip6-new", "2001:db8::99")
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+		t.Errorf("Expected no differences, got %d (%v)", iDifferent, err)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	sNewFilename := filepath.Join(t.TempDir(), "domain.pcap")
+	counters := runRewrite(t, sCorpusFilename, sNewFilename, "--domain-map", "example.com=customer.test")
+
+	// The three HTTP requests on their own, both requests of the connection and
+	// the TLS ClientHello are changed.  The first request of the connection gets
+	// longer so the response and the second request have their numbers moved.
+	if counters.iDomainRewriteCounter != 6 || counters.iTCPSeqRewriteCounter != 2 {
+		t.Errorf("Expected 6 domain and 2 TCP sequence rewrites, got %d and %d", counters.iDomainRewriteCounter, counters.iTCPSeqRewriteCounter)
+	}
+
+	// The new file still has to verify against the rules
+	setOptions(t, sCorpusFilename, sNewFilename, "--verify", "--domain-map", "example.com=customer.test")
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+		t.Errorf("Expected no differences, got %d (%v)", iDifferent, err)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	sNewFilename := filepath.Join(t.TempDir(), "payload.pcap")
+	args := []string{"--payload-replace", "s/hello/goodbye/", "--payload-replace", "s|User-Agent: [a-z]+|User-Agent: scrubbed-agent|r"}
+	counters := runRewrite(t, sCorpusFilename, sNewFilename, args...)
+
+	// Both UDP packets and the first request of the connection are changed, the
+	// request gets longer so the response and the second request follow it
+	if counters.iPayloadRewriteCounter != 3 || counters.iTCPSeqRewriteCounter != 2 {
+		t.Errorf("Expected 3 payload and 2 TCP sequence rewrites, got %d and %d", counters.iPayloadRewriteCounter, counters.iTCPSeqRewriteCounter)
+	}
+
+	setOptions(t, sCorpusFilename, sNewFilename, append([]string{"--verify"}, args...)...)
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+		t.Errorf("Expected no differences, got %d (%v)", iDifferent, err)
+	}
+
+	// Limited to port 80 only the request is changed
+	counters = runRewrite(t, sCorpusFilename, sNewFilename, append([]string{"--payload-ports", "80"}, args...)...)
+	if counters.iPayloadRewriteCounter != 1 {
+		t.Errorf("Expected 1 payload rewrite, got %d", counters.iPayloadRewriteCounter)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"zero", []string{"--scrub", "zero", "--scrub-keep", "dns,dhcp"}},
+		{"random", []string{"--scrub", "random", "--scrub-keep", "dns,dhcp"}},
+		{"truncate", []string{"--scrub", "truncate", "--scrub-keep", "dns,dhcp"}},
+		{"truncate-adjust", []string{"--scrub", "truncate", "--scrub-keep", "dns,dhcp", "--scrub-lengths", "adjust"}},
+	}
+
+	for _, tt := range tests {
+		sNewFilename := filepath.Join(t.TempDir(), tt.name+".pcap")
+		counters := runRewrite(t, sCorpusFilename, sNewFilename, tt.args...)
+
+		// The three plain TCP packets, the two UDP ones, the connection and the
+		// TLS ClientHello, everything else is DNS, DHCP or has no payload
+		if counters.iScrubCounter != 9 {
+			t.Errorf("%s: expected 9 scrubbed packets, got %d", tt.name, counters.iScrubCounter)
+		}
+
+		setOptions(t, sCorpusFilename, sNewFilename, append([]string{"--verify"}, tt.args...)...)
+		rules, _, err := newRewriteRules()
+		if err != nil {
+			t.Fatal("Unexpected error ", err)
+		}
+		if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+			t.Errorf("%s: expected no differences, got %d (%v)", tt.name, iDifferent, err)
+		}
+	}
+
+	// A file that was not scrubbed does not verify
+	setOptions(t, sCorpusFilename, sCorpusFilename, "--verify", "--scrub", "zero")
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sCorpusFilename, rules); err != nil || iDifferent == 0 {
+		t.Errorf("Expected differences, got none (%v)", err)
+	}
+}
+
+func TestICMP(t *testing.T) {
+	sSrcFilename := filepath.Join(t.TempDir(), "icmp.pcap")
+	packets := []pcaptest.Packet{{Name: "icmp", Data: pcaptest.ICMPUnreachable(4)}, {Name: "icmpv6", Data: pcaptest.ICMPUnreachable(6)}}
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+	sNewFilename := filepath.Join(t.TempDir(), "icmp-new.pcap")
+	args := []string{"--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "--ip6", "2001:db8::32", "--ip6-new", "2001:db8::99"}
+	counters := runRewrite(t, sSrcFilename, sNewFilename, args...)
+
+	// The outer and the quoted headers both have the address in them
+	if counters.iIPv4RewriteCounter != 1 || counters.iIPv6RewriteCounter != 1 || counters.iIcmpIPRewriteCounter != 2 {
+		t.Errorf("Expected 1 IPv4, 1 IPv6 and 2 ICMP rewrites, got %d, %d and %d", counters.iIPv4RewriteCounter, counters.iIPv6RewriteCounter, counters.iIcmpIPRewriteCounter)
+	}
+
+	setOptions(t, sSrcFilename, sNewFilename, append([]string{"--verify"}, args...)...)
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, iDifferent, _, err := verifyFiles(sSrcFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+		t.Errorf("Expected no differences, got %d (%v)", iDifferent, err)
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	sSrcFilename := filepath.Join(t.TempDir(), "tunnel.pcap")
+	var packets []pcaptest.Packet
+	for _, sKind := range []string{"gre", "gre-eth", "vxlan", "geneve", "ipip", "6in4", "gtpu"} {
+		packets = append(packets, pcaptest.Packet{Name: sKind, Data: pcaptest.Tunnel(sKind)})
+	}
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every outer header is IPv4 from A, and every inner packet has A in it
+	tests := []struct {
+		sLayers  string
+		iOuter   int
+		iTunnels int
+	}{
+		{"both", 7, 7},
+		{"inner", 0, 7},
+		{"outer", 7, 0},
+	}
+	for _, tt := range tests {
+		for _, sFast := range []string{"--fast=false", "--fast"} {
+			sNewFilename := filepath.Join(t.TempDir(), "tunnel-new.pcap")
+			args := []string{"--mac", "68:A8:6D:18:36:92", "--mac-new", "22:33:44:55:66:77", "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "--ip6", "2001:db8::32", "--ip6-new", "2001:db8::99", "--tunnel", tt.sLayers, sFast}
+			counters := runRewrite(t, sSrcFilename, sNewFilename, args...)
+			if counters.iMacRewriteCounter != tt.iOuter || counters.iIPv4RewriteCounter != tt.iOuter || counters.iTunnelCounter != tt.iTunnels {
+				t.Errorf("%s %s: expected %d MAC, %d IPv4 and %d tunnel rewrites, got %d, %d and %d", tt.sLayers, sFast, tt.iOuter, tt.iOuter, tt.iTunnels, counters.iMacRewriteCounter, counters.iIPv4RewriteCounter, counters.iTunnelCounter)
+			}
+
+			setOptions(t, sSrcFilename, sNewFilename, append([]string{"--verify"}, args...)...)
+			rules, _, err := newRewriteRules()
+			if err != nil {
+				t.Fatal("Unexpected error ", err)
+			}
+			if _, iDifferent, _, err := verifyFiles(sSrcFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+				t.Errorf("%s %s: expected no differences, got %d (%v)", tt.sLayers, sFast, iDifferent, err)
+			}
+		}
+	}
+}
+
+func TestDecapEncap(t *testing.T) {
+	sSrcFilename := filepath.Join(t.TempDir(), "tunnel.pcap")
+	var packets, expected []pcaptest.Packet
+	for _, sKind := range []string{"gre", "gre-eth", "vxlan", "geneve", "ipip", "6in4", "gtpu"} {
+		packets = append(packets, pcaptest.Packet{Name: sKind, Data: pcaptest.Tunnel(sKind)})
+		if sKind == "6in4" {
+			expected = append(expected, pcaptest.Packet{Name: sKind, Data: pcaptest.IPv6UDP(0, []byte("hello world"))})
+		} else {
+			expected = append(expected, pcaptest.Packet{Name: sKind, Data: pcaptest.IPv4UDP(0, []byte("hello world"))})
+		}
+	}
+	sExpectedFilename := filepath.Join(t.TempDir(), "expected.pcap")
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+	if err := pcaptest.WriteFile(sExpectedFilename, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// The outer headers of every tunnel are stripped off
+	sDecapFilename := filepath.Join(t.TempDir(), "decap.pcap")
+	counters := runRewrite(t, sSrcFilename, sDecapFilename, "--decap")
+	if counters.iDecapCounter != 7 {
+		t.Errorf("Expected 7 packets to be decapsulated, got %d", counters.iDecapCounter)
+	}
+	compareFiles(t, sExpectedFilename, sDecapFilename)
+
+	// Wrapping the packets again and stripping that off gives back the same
+	// packets
+	tests := [][]string{
+		{"--encap", "vxlan", "--encap-src-ip", "192.0.2.1", "--encap-dst-ip", "192.0.2.2", "--encap-vni", "100"},
+		{"--encap", "vxlan", "--encap-src-ip", "2001:db8::1", "--encap-dst-ip", "2001:db8::2"},
+		{"--encap", "gre", "--encap-src-ip", "192.0.2.1", "--encap-dst-ip", "192.0.2.2", "--encap-src-mac", "22:33:44:55:66:77"},
+		{"--encap", "erspan", "--encap-src-ip", "192.0.2.1", "--encap-dst-ip", "192.0.2.2", "--encap-vni", "7"},
+	}
+	for _, args := range tests {
+		sEncapFilename := filepath.Join(t.TempDir(), "encap.pcap")
+		counters := runRewrite(t, sExpectedFilename, sEncapFilename, args...)
+		if counters.iEncapCounter != 7 {
+			t.Errorf("%v: expected 7 packets to be encapsulated, got %d", args, counters.iEncapCounter)
+		}
+		sRoundTripFilename := filepath.Join(t.TempDir(), "round-trip.pcap")
+		runRewrite(t, sEncapFilename, sRoundTripFilename, "--decap", "--fast")
+		compareFiles(t, sExpectedFilename, sRoundTripFilename)
 	}
+}
+
+func TestMPLS(t *testing.T) {
+	sSrcFilename := filepath.Join(t.TempDir(), "mpls.pcap")
+	packets := []pcaptest.Packet{
+		{Name: "mpls-ipv4", Data: pcaptest.MPLS(4, 100, 200)},
+		{Name: "mpls-ipv6", Data: pcaptest.MPLS(6, 300)},
+	}
+	expected := []pcaptest.Packet{
+		{Name: "ipv4", Data: pcaptest.IPv4UDP(0, []byte("hello world"))},
+		{Name: "ipv6", Data: pcaptest.IPv6UDP(0, []byte("hello world"))},
+	}
+	sExpectedFilename := filepath.Join(t.TempDir(), "expected.pcap")
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+	if err := pcaptest.WriteFile(sExpectedFilename, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// The IP packets under the label stacks are found and rewritten along with
+	// the labels
+	for _, sFast := range []string{"--fast=false", "--fast"} {
+		sNewFilename := filepath.Join(t.TempDir(), "mpls-new.pcap")
+		args := []string{"--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "--ip6", "2001:db8::32", "--ip6-new", "2001:db8::99", "--mpls-label-map", "100=101,300=301", sFast}
+		counters := runRewrite(t, sSrcFilename, sNewFilename, args...)
+		if counters.iIPv4RewriteCounter != 1 || counters.iIPv6RewriteCounter != 1 || counters.iMPLSLabelRewriteCounter != 2 {
+			t.Errorf("%s: expected 1 IPv4, 1 IPv6 and 2 MPLS label rewrites, got %d, %d and %d", sFast, counters.iIPv4RewriteCounter, counters.iIPv6RewriteCounter, counters.iMPLSLabelRewriteCounter)
+		}
+
+		setOptions(t, sSrcFilename, sNewFilename, append([]string{"--verify"}, args...)...)
+		rules, _, err := newRewriteRules()
+		if err != nil {
+			t.Fatal("Unexpected error ", err)
+		}
+		if _, iDifferent, _, err := verifyFiles(sSrcFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+			t.Errorf("%s: expected no differences, got %d (%v)", sFast, iDifferent, err)
+		}
+	}
+
+	// Popping the label stacks leaves the plain IP packets
+	sPopFilename := filepath.Join(t.TempDir(), "pop.pcap")
+	counters := runRewrite(t, sSrcFilename, sPopFilename, "--mpls-pop")
+	if counters.iMPLSPopCounter != 2 {
+		t.Errorf("Expected 2 label stacks to be popped, got %d", counters.iMPLSPopCounter)
+	}
+	compareFiles(t, sExpectedFilename, sPopFilename)
+}
+
+func TestPPPoE(t *testing.T) {
+	sSrcFilename := filepath.Join(t.TempDir(), "pppoe.pcap")
+	packets := []pcaptest.Packet{
+		{Name: "pppoe-ipv4", Data: pcaptest.PPPoE(4, 0x1234)},
+		{Name: "pppoe-ipv6", Data: pcaptest.PPPoE(6, 0x1234)},
+	}
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	// The IP packets after the PPPoE and PPP headers are rewritten along with the
+	// session IDs, and a longer payload makes the PPPoE length longer too
+	for _, sFast := range []string{"--fast=false", "--fast"} {
+		sNewFilename := filepath.Join(t.TempDir(), "pppoe-new.pcap")
+		args := []string{"--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2", "--ip6", "2001:db8::32", "--ip6-new", "2001:db8::99", "--pppoe-session-map", "0x1234=0x4321", "--payload-replace", "s/hello/goodbye/", sFast}
+		counters := runRewrite(t, sSrcFilename, sNewFilename, args...)
+		if counters.iIPv4RewriteCounter != 1 || counters.iIPv6RewriteCounter != 1 || counters.iPPPoESessionCounter != 2 || counters.iPayloadRewriteCounter != 2 {
+			t.Errorf("%s: expected 1 IPv4, 1 IPv6, 2 PPPoE session and 2 payload rewrites, got %d, %d, %d and %d", sFast, counters.iIPv4RewriteCounter, counters.iIPv6RewriteCounter, counters.iPPPoESessionCounter, counters.iPayloadRewriteCounter)
+		}
+
+		handle, err := pcap.OpenOffline(sNewFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(packets); i++ {
+			data, _, err := handle.ReadPacketData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if iLength := int(data[18])<<8 | int(data[19]); iLength != len(data)-20 {
+				t.Errorf("%s: packet %d expected a PPPoE length of %d, got %d", sFast, i, len(data)-20, iLength)
+			}
+		}
+		handle.Close()
+
+		setOptions(t, sSrcFilename, sNewFilename, append([]string{"--verify"}, args...)...)
+		rules, _, err := newRewriteRules()
+		if err != nil {
+			t.Fatal("Unexpected error ", err)
+		}
+		if _, iDifferent, _, err := verifyFiles(sSrcFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+			t.Errorf("%s: expected no differences, got %d (%v)", sFast, iDifferent, err)
+		}
+	}
+}
+
+func TestIPFields(t *testing.T) {
+	// The sequence of IP identifications follows the order of the file however
+	// the packets are parsed and however many workers there are
+	args := []string{"--ttl", "-10", "--dscp", "46", "--ecn", "1", "--flow-label", "12345", "--ip-id", "sequential"}
+	sFirstFilename := ""
+	var first packetCounters
+	for _, mode := range goldenModes {
+		sNewFilename := filepath.Join(t.TempDir(), "ip-fields.pcap")
+		counters := runRewrite(t, sCorpusFilename, sNewFilename, append(args, mode...)...)
+		if sFirstFilename == "" {
+			sFirstFilename, first = sNewFilename, counters
+			if counters.iIPFieldRewriteCounter == 0 || counters.iIPIDRewriteCounter == 0 {
+				t.Errorf("%v: expected IP field and identification rewrites, got %d and %d", mode, counters.iIPFieldRewriteCounter, counters.iIPIDRewriteCounter)
+			}
+		} else {
+			compareFiles(t, sFirstFilename, sNewFilename)
+			if counters.iIPFieldRewriteCounter != first.iIPFieldRewriteCounter || counters.iIPIDRewriteCounter != first.iIPIDRewriteCounter {
+				t.Errorf("%v: expected %d IP field and %d identification rewrites, got %d and %d", mode, first.iIPFieldRewriteCounter, first.iIPIDRewriteCounter, counters.iIPFieldRewriteCounter, counters.iIPIDRewriteCounter)
+			}
+		}
+
+		setOptions(t, sCorpusFilename, sNewFilename, append([]string{"--verify"}, args...)...)
+		rules, _, err := newRewriteRules()
+		if err != nil {
+			t.Fatal("Unexpected error ", err)
+		}
+		if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+			t.Errorf("%v: expected no differences, got %d (%v)", mode, iDifferent, err)
+		}
+	}
+
+	// Only the packets to or from the hosts are changed
+	sNewFilename := filepath.Join(t.TempDir(), "ip-fields-hosts.pcap")
+	hostArgs := append([]string{"--ip-fields-hosts", "2001:db8::32"}, args...)
+	counters := runRewrite(t, sCorpusFilename, sNewFilename, hostArgs...)
+	if counters.iIPIDRewriteCounter != 0 || counters.iIPFieldRewriteCounter == 0 || counters.iIPFieldRewriteCounter >= first.iIPFieldRewriteCounter {
+		t.Errorf("Expected only IPv6 packets to change, got %d IP field and %d identification rewrites", counters.iIPFieldRewriteCounter, counters.iIPIDRewriteCounter)
+	}
+	setOptions(t, sCorpusFilename, sNewFilename, append([]string{"--verify"}, hostArgs...)...)
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sNewFilename, rules); err != nil || iDifferent != 0 {
+		t.Errorf("Expected no differences, got %d (%v)", iDifferent, err)
+	}
+}
+
+func TestResegment(t *testing.T) {
+	sSrcFilename := filepath.Join(t.TempDir(), "offloaded.pcap")
+	packets := []pcaptest.Packet{
+		{Name: "tso-ipv4", Data: pcaptest.Offloaded(4, 5000)},
+		{Name: "tso-ipv6", Data: pcaptest.Offloaded(6, 3000)},
+		{Name: "big-udp", Data: pcaptest.IPv4UDP(0, make([]byte, 3000))},
+		{Name: "small-udp", Data: pcaptest.IPv4UDP(0, []byte("hello world"))},
+	}
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	// The TCP packets are cut in to 4 and 3 segments, the UDP packet in to 3
+	// fragments and the small packet is left alone
+	for _, mode := range goldenModes {
+		sNewFilename := filepath.Join(t.TempDir(), "resegmented.pcap")
+		counters := runRewrite(t, sSrcFilename, sNewFilename, append([]string{"--resegment", "1500"}, mode...)...)
+		if counters.iResegmentCounter != 3 || counters.iSegmentCounter != 10 {
+			t.Errorf("%v: expected 3 packets split in to 10, got %d and %d", mode, counters.iResegmentCounter, counters.iSegmentCounter)
+		}
+
+		handle, err := pcap.OpenOffline(sNewFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iPackets := 0
+		for {
+			data, _, err := handle.ReadPacketData()
+			if err != nil {
+				break
+			}
+			iPackets++
+			if len(data)-14 > 1500 {
+				t.Errorf("%v: packet %d is %d bytes, more than the MTU", mode, iPackets, len(data)-14)
+			}
+		}
+		handle.Close()
+		if iPackets != 11 {
+			t.Errorf("%v: expected 11 packets, got %d", mode, iPackets)
+		}
+	}
+}
+
+// readPackets reads all of the packets of a file with their capture info
+func readPackets(t *testing.T, sFilename string) ([][]byte, []gopacket.CaptureInfo) {
+	handle, err := pcap.OpenOffline(sFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+
+	var packets [][]byte
+	var captureInfos []gopacket.CaptureInfo
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			return packets, captureInfos
+		}
+		packets = append(packets, data)
+		captureInfos = append(captureInfos, ci)
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	// The string to replace straddles the end of the first fragment
+	original := make([]byte, 3000)
+	copy(original[1472:], "hello")
+	changed := make([]byte, 3000)
+	copy(changed[1472:], "howdy")
+
+	sSrcFilename := filepath.Join(t.TempDir(), "fragments.pcap")
+	other := pcaptest.IPv4TCP(0, []byte("not a fragment"))
+	var packets []pcaptest.Packet
+	var expected [][]byte
+	// The other packet was captured in between the IPv4 fragments
+	for i, fragment := range pcaptest.Fragments(4, original, 1480) {
+		packets = append(packets, pcaptest.Packet{Name: "ipv4-fragment", Data: fragment})
+		if i == 0 {
+			packets = append(packets, pcaptest.Packet{Name: "other", Data: other})
+		}
+	}
+	for _, fragment := range pcaptest.Fragments(6, original, 1448) {
+		packets = append(packets, pcaptest.Packet{Name: "ipv6-fragment", Data: fragment})
+	}
+	for i, fragment := range pcaptest.Fragments(4, changed, 1480) {
+		expected = append(expected, fragment)
+		if i == 0 {
+			expected = append(expected, other)
+		}
+	}
+	expected = append(expected, pcaptest.Fragments(6, changed, 1448)...)
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	// The datagrams are written out whole after they are put back together
+	sNewFilename := filepath.Join(t.TempDir(), "reassembled.pcap")
+	counters := runRewrite(t, sSrcFilename, sNewFilename, "--reassemble", "--payload-replace", "s/hello/howdy/")
+	if counters.iReassembleCounter != 2 || counters.iPayloadRewriteCounter != 2 || counters.iOverlapCounter != 0 || counters.iBadLengthCounter != 0 || counters.iIncompleteCounter != 0 {
+		t.Errorf("Expected 2 datagrams put back together and rewritten, got %d and %d", counters.iReassembleCounter, counters.iPayloadRewriteCounter)
+	}
+	output, _ := readPackets(t, sNewFilename)
+	if len(output) != 3 || !bytes.Equal(output[0], pcaptest.IPv4UDP(0, changed)) || !bytes.Equal(output[2], pcaptest.IPv6UDP(0, changed)) {
+		t.Errorf("Expected the 2 rewritten datagrams around the other packet, got %d packets", len(output))
+	}
+
+	// Fragmented again where they were before, each fragment keeps its time
+	for _, mode := range goldenModes {
+		sNewFilename := filepath.Join(t.TempDir(), "refragmented.pcap")
+		counters := runRewrite(t, sSrcFilename, sNewFilename, append([]string{"--reassemble", "--refragment", "original", "--payload-replace", "s/hello/howdy/"}, mode...)...)
+		if counters.iRefragmentCounter != 2 || counters.iFragmentCounter != 6 {
+			t.Errorf("%v: expected 2 datagrams fragmented in to 6, got %d and %d", mode, counters.iRefragmentCounter, counters.iFragmentCounter)
+		}
+		output, captureInfos := readPackets(t, sNewFilename)
+		if len(output) != len(expected) {
+			t.Fatalf("%v: expected %d packets, got %d", mode, len(expected), len(output))
+		}
+		for i := range output {
+			if !bytes.Equal(output[i], expected[i]) {
+				t.Errorf("%v: packet %d is not the rewritten fragment", mode, i)
+			}
+			if ts := pcaptest.StartTime.Add(time.Duration(i) * 10 * time.Millisecond); !captureInfos[i].Timestamp.Equal(ts) {
+				t.Errorf("%v: expected packet %d at %v, got %v", mode, i, ts, captureInfos[i].Timestamp)
+			}
+		}
+	}
+
+	// Fragmented again to fit a smaller MTU
+	counters = runRewrite(t, sSrcFilename, sNewFilename, "--reassemble", "--refragment", "1000")
+	if counters.iRefragmentCounter != 2 || counters.iFragmentCounter != 8 {
+		t.Errorf("Expected 2 datagrams fragmented in to 8, got %d and %d", counters.iRefragmentCounter, counters.iFragmentCounter)
+	}
+	output, _ = readPackets(t, sNewFilename)
+	if len(output) != 9 {
+		t.Errorf("Expected 9 packets, got %d", len(output))
+	}
+	for i, data := range output {
+		if len(data)-14 > 1000 {
+			t.Errorf("Packet %d is %d bytes, more than the MTU", i, len(data)-14)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	// Each packet is followed by the copy from a second SPAN port, 10ms later
+	// with an 802.1Q tag and one hop less
+	sSrcFilename := filepath.Join(t.TempDir(), "span.pcap")
+	var packets []pcaptest.Packet
+	for _, sPayload := range []string{"one", "two", "three"} {
+		copied := pcaptest.IPv4UDP(1, []byte(sPayload))
+		copied[18+8]--
+		packets = append(packets, pcaptest.Packet{Name: sPayload, Data: pcaptest.IPv4UDP(0, []byte(sPayload))})
+		packets = append(packets, pcaptest.Packet{Name: sPayload + "-copy", Data: copied})
+	}
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range goldenModes {
+		sNewFilename := filepath.Join(t.TempDir(), "dedup.pcap")
+		counters := runRewrite(t, sSrcFilename, sNewFilename, append([]string{"--dedup"}, mode...)...)
+		if counters.iDuplicateCounter != 3 || counters.iTotalPacketCounter != 3 {
+			t.Errorf("%v: expected 3 duplicates removed and 3 packets left, got %d and %d", mode, counters.iDuplicateCounter, counters.iTotalPacketCounter)
+		}
+		output, _ := readPackets(t, sNewFilename)
+		if len(output) != 3 {
+			t.Fatalf("%v: expected 3 packets, got %d", mode, len(output))
+		}
+		for i, data := range output {
+			if !bytes.Equal(data, packets[i*2].Data) {
+				t.Errorf("%v: expected packet %d to be the first copy", mode, i)
+			}
+		}
+	}
+
+	// The copies are too far apart for a smaller window
+	sNewFilename := filepath.Join(t.TempDir(), "dedup.pcap")
+	counters := runRewrite(t, sSrcFilename, sNewFilename, "--dedup", "--dedup-window", "5ms")
+	if counters.iDuplicateCounter != 0 || counters.iTotalPacketCounter != 6 {
+		t.Errorf("Expected no duplicates within 5ms, got %d", counters.iDuplicateCounter)
+	}
+}
+
+func TestSort(t *testing.T) {
+	// Merged from two capture queues, and the second packet is a day earlier
+	// than the first
+	sSrcFilename := filepath.Join(t.TempDir(), "unsorted.pcap")
+	var packets []pcaptest.Packet
+	for _, sPayload := range []string{"one", "two", "three", "four", "five"} {
+		packets = append(packets, pcaptest.Packet{Name: sPayload, Data: pcaptest.IPv4UDP(0, []byte(sPayload))})
+	}
+	start := pcaptest.StartTime
+	timestamps := []time.Time{start, start.Add(-24 * time.Hour), start.Add(20 * time.Millisecond), start.Add(10 * time.Millisecond), start.Add(30 * time.Millisecond)}
+	if err := pcaptest.WriteFileAt(sSrcFilename, packets, timestamps); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{1, 0, 3, 2, 4}
+	for _, mode := range goldenModes {
+		sNewFilename := filepath.Join(t.TempDir(), "sorted.pcap")
+		counters := runRewrite(t, sSrcFilename, sNewFilename, append([]string{"--sort"}, mode...)...)
+		if counters.iSortCounter != 2 {
+			t.Errorf("%v: expected 2 packets out of order, got %d", mode, counters.iSortCounter)
+		}
+		output, captureInfos := readPackets(t, sNewFilename)
+		if len(output) != len(expected) {
+			t.Fatalf("%v: expected %d packets, got %d", mode, len(expected), len(output))
+		}
+		for i, iPacket := range expected {
+			if !bytes.Equal(output[i], packets[iPacket].Data) || !captureInfos[i].Timestamp.Equal(timestamps[iPacket]) {
+				t.Errorf("%v: expected packet %d to be %s", mode, i, packets[iPacket].Name)
+			}
+		}
+	}
+
+	// The new date is worked out from the earliest packet, not the first one
+	sNewFilename := filepath.Join(t.TempDir(), "rebased.pcap")
+	runRewrite(t, sSrcFilename, sNewFilename, "--day", "10")
+	_, captureInfos := readPackets(t, sNewFilename)
+	if ts := captureInfos[1].Timestamp.UTC(); ts.Month() != time.May || ts.Day() != 10 {
+		t.Errorf("Expected the earliest packet to move to May 10, got %v", ts)
+	}
+}
+
+func TestImpair(t *testing.T) {
+	sSrcFilename := filepath.Join(t.TempDir(), "link.pcap")
+	var packets []pcaptest.Packet
+	for i := 0; i < 200; i++ {
+		packets = append(packets, pcaptest.Packet{Name: "udp", Data: pcaptest.IPv4UDP(0, []byte{byte(i >> 8), byte(i)})})
+	}
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same seed gives the same file however the packets are rewritten
+	args := []string{"--impair-drop", "10", "--impair-duplicate", "10", "--impair-reorder", "10", "--impair-jitter", "1ms", "--impair-corrupt", "5", "--impair-seed", "7"}
+	var first [][]byte
+	for _, mode := range goldenModes {
+		sNewFilename := filepath.Join(t.TempDir(), "impaired.pcap")
+		counters := runRewrite(t, sSrcFilename, sNewFilename, append(args, mode...)...)
+		if counters.iImpairDropCounter == 0 || counters.iImpairDupCounter == 0 || counters.iImpairOrderCounter == 0 || counters.iImpairJitterCounter == 0 || counters.iImpairCorruptCounter == 0 {
+			t.Errorf("%v: expected every impairment to happen, got %+v", mode, counters)
+		}
+		output, _ := readPackets(t, sNewFilename)
+		if len(output) != 200-counters.iImpairDropCounter+counters.iImpairDupCounter {
+			t.Errorf("%v: expected %d packets, got %d", mode, 200-counters.iImpairDropCounter+counters.iImpairDupCounter, len(output))
+		}
+		if first == nil {
+			first = output
+			continue
+		}
+		if len(output) != len(first) {
+			t.Fatalf("%v: expected the same packets as the first run", mode)
+		}
+		for i := range output {
+			if !bytes.Equal(output[i], first[i]) {
+				t.Errorf("%v: packet %d is not the same as in the first run", mode, i)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	// Each golden file only differs from the corpus where its rules say it should
+	for _, tt := range goldenTests {
+		if tt.name == "all-drop" {
+			continue
+		}
+		sGoldenFilename := filepath.Join("testdata", "golden", tt.name+".pcap")
+		setOptions(t, sCorpusFilename, sGoldenFilename, append([]string{"--verify"}, tt.args...)...)
+		rules, _, err := newRewriteRules()
+		if err != nil {
+			t.Fatal("Unexpected error ", err)
+		}
+
+		iPackets, iDifferent, _, err := verifyFiles(sCorpusFilename, sGoldenFilename, rules)
+		if err != nil || iPackets != 23 || iDifferent != 0 {
+			t.Errorf("%s: expected 23 packets and no differences, got %d and %d (%v)", tt.name, iPackets, iDifferent, err)
+		}
+	}
+
+	// Without the rules every rewritten packet is a difference
+	sGoldenFilename := filepath.Join("testdata", "golden", "ip4.pcap")
+	setOptions(t, sCorpusFilename, sGoldenFilename, "--verify")
+	rules, _, err := newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sGoldenFilename, rules); err != nil || iDifferent != 17 {
+		t.Errorf("Expected 17 packets with differences, got %d (%v)", iDifferent, err)
+	}
+
+	// A file with packets missing does not line up
+	sGoldenFilename = filepath.Join("testdata", "golden", "all-drop.pcap")
+	setOptions(t, sCorpusFilename, sGoldenFilename, "--verify")
+	rules, _, err = newRewriteRules()
+	if err != nil {
+		t.Fatal("Unexpected error ", err)
+	}
+	if _, iDifferent, _, err := verifyFiles(sCorpusFilename, sGoldenFilename, rules); err != nil || iDifferent == 0 {
+		t.Errorf("Expected differences, got none (%v)", err)
+	}
+}
+
+func TestBadArguments(t *testing.T) {
+	tests := [][]string{
+		{"--mac", "68:A8:6D:18:36", "--mac-new", "22:33:44:55:66:77"},
+		{"--ip4", "300.1.1.1", "--ip4-new", "2.2.2.2"},
+		{"--ip6", "10.0.2.32", "--ip6-new", "2001:db8::99"},
+		{"--time-shift=2 hours"},
+		{"--domain-map", "example.com"},
+		{"--payload-replace", "s/alice/bob"},
+		{"--payload-replace", "s/alice/bob/", "--payload-ports", "http"},
+		{"--scrub", "blank"},
+		{"--scrub", "zero", "--scrub-keep", "gopher"},
+		{"--tunnel", "middle"},
+		{"--encap", "ipip", "--encap-src-ip", "192.0.2.1", "--encap-dst-ip", "192.0.2.2"},
+		{"--encap", "vxlan", "--encap-src-ip", "192.0.2.1"},
+		{"--encap", "erspan", "--encap-src-ip", "192.0.2.1", "--encap-dst-ip", "192.0.2.2", "--encap-vni", "2000"},
+		{"--mpls-label-map", "100"},
+		{"--mpls-label-map", "100=2000000"},
+		{"--pppoe-session-map", "0x1234=0x10000"},
+		{"--ttl", "0"},
+		{"--ttl", "+300"},
+		{"--dscp", "64"},
+		{"--ip-id", "counter"},
+		{"--resegment", "20"},
+		{"--reassemble", "--reassemble-timeout", "0s"},
+		{"--reassemble", "--reassemble-timeout", "soon"},
+		{"--reassemble", "--refragment", "60"},
+		{"--reassemble", "--refragment", "smaller"},
+		{"--dedup", "--dedup-window", "-1s"},
+		{"--dedup", "--dedup-window", "often"},
+		{"--sort", "--sort-memory", "0"},
+		{"--impair-drop", "150"},
+		{"--impair-jitter", "5ms", "--impair-jitter-distribution", "pareto"},
+		{"--flow-label", "46", "--ip-fields-hosts", "10.0.2"},
+	}
+
+	for _, args := range tests {
+		setOptions(t, sCorpusFilename, filepath.Join(t.TempDir(), "bad.pcap"), args...)
+		if _, iExitCode, err := newRewriteRules(); err == nil || iExitCode != iExitBadArguments {
+			t.Errorf("%v: expected exit code %d, got %d (%v)", args, iExitBadArguments, iExitCode, err)
+		}
+	}
+}
+
+//
+// --------------------------------------------------------------------------------
+// compareFiles()
+// --------------------------------------------------------------------------------
+// Make sure two files are byte for byte the same
+func compareFiles(t testing.TB, sExpectedFilename, sFilename string) {
+	expected, err := ioutil.ReadFile(sExpectedFilename)
+	if err != nil {
+		t.Fatal(err, " (run go test -update to create it)")
+	}
+	data, err := ioutil.ReadFile(sFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, data) {
+		t.Errorf("%s does not match %s", sFilename, sExpectedFilename)
+	}
+}
+
+// BenchmarkRewriteFile runs the whole main loop over a file, compare the default
+// path with the fast path to see the packets per second of each
+func BenchmarkRewriteFile(b *testing.B) {
+	var packets []pcaptest.Packet
+	for i := 0; i < 1000; i++ {
+		packets = append(packets, pcaptest.Corpus()...)
+	}
+	sSrcFilename := filepath.Join(b.TempDir(), "bench.pcap")
+	if err := pcaptest.WriteFile(sSrcFilename, packets); err != nil {
+		b.Fatal(err)
+	}
+	sNewFilename := filepath.Join(b.TempDir(), "bench-new.pcap")
+
+	for _, mode := range []string{"--fast=false", "--fast"} {
+		b.Run(mode, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				runRewrite(b, sSrcFilename, sNewFilename, mode, "--workers=1", "--mac", "68:A8:6D:18:36:92", "--mac-new", "22:33:44:55:66:77", "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2")
+			}
+			b.ReportMetric(float64(b.N*len(packets))/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
+
+// BenchmarkRewritePacket rewrites a single packet without any file handling
+func BenchmarkRewritePacket(b *testing.B) {
+	original := pcaptest.IPv4TCP(1, []byte("GET / HTTP/1.1\r\n\r\n"))
+	data := make([]byte, len(original))
+
+	for _, mode := range []string{"--fast=false", "--fast"} {
+		b.Run(mode, func(b *testing.B) {
+			setOptions(b, sCorpusFilename, "unused.pcap", mode, "--mac", "68:A8:6D:18:36:92", "--mac-new", "22:33:44:55:66:77", "--ip4", "10.0.2.32", "--ip4-new", "2.2.2.2")
+			rules, _, err := newRewriteRules()
+			if err != nil {
+				b.Fatal(err)
+			}
+			rules.linkType = layers.LinkTypeEthernet
 
-	test1c := areByteSlicesEqual(b1, b4)
-	if test1c != false {
-		t.Error("Test 1c: Expected false, got ", test1c)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var counters packetCounters
+				var ci gopacket.CaptureInfo
+				copy(data, original)
+				if _, _, err := rewritePacket(data, &ci, rules, &counters); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+		})
 	}
 }